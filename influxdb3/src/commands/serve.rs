@@ -11,7 +11,11 @@ use influxdb3_process::{
     build_malloc_conf, setup_metric_registry, INFLUXDB3_GIT_HASH, INFLUXDB3_VERSION, PROCESS_UUID,
 };
 use influxdb3_server::{
-    auth::AllOrNothingAuthorizer, builder::ServerBuilder, query_executor::QueryExecutorImpl, serve,
+    auth::{AllOrNothingAuthorizer, DatabaseGrantsAuthorizer},
+    builder::ServerBuilder,
+    query_executor::QueryExecutorImpl,
+    serve,
+    tls::load_server_config,
     CommonServerState,
 };
 use influxdb3_write::persister::PersisterImpl;
@@ -30,6 +34,7 @@ use std::{
     num::NonZeroUsize,
     path::{Path, PathBuf},
     sync::Arc,
+    time::Duration,
 };
 use thiserror::Error;
 use tokio_util::sync::CancellationToken;
@@ -65,6 +70,19 @@ pub enum Error {
 
     #[error("invalid token: {0}")]
     InvalidToken(#[from] hex::FromHexError),
+
+    #[error("failed to read token grants file {path:?}: {source}")]
+    ReadTokenGrants {
+        path: PathBuf,
+        #[source]
+        source: std::io::Error,
+    },
+
+    #[error("invalid token grants: {0}")]
+    InvalidTokenGrants(#[from] influxdb3_server::auth::TokenGrantsError),
+
+    #[error("invalid TLS configuration: {0}")]
+    Tls(#[from] influxdb3_server::tls::TlsError),
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -96,6 +114,61 @@ pub struct Config {
     )]
     pub max_http_request_size: usize,
 
+    /// Maximum number of writes that are handled at once. Writes made while at the limit are
+    /// rejected with a 429 status, and should be retried. Imports and streaming writes each
+    /// count as one write for as long as they run. If not specified, there is no limit.
+    #[clap(
+        long = "max-concurrent-writes",
+        env = "INFLUXDB3_MAX_CONCURRENT_WRITES",
+        value_parser = parse_concurrency_limit,
+        action
+    )]
+    pub max_concurrent_writes: Option<usize>,
+
+    /// Maximum number of queries that run at once. Queries made while at the limit wait for
+    /// a running query to finish, up to the limit given by `--max-queued-queries`, beyond which
+    /// they are rejected with a 429 status, and should be retried. If not specified, there is
+    /// no limit.
+    #[clap(
+        long = "max-concurrent-queries",
+        env = "INFLUXDB3_MAX_CONCURRENT_QUERIES",
+        value_parser = parse_concurrency_limit,
+        action
+    )]
+    pub max_concurrent_queries: Option<usize>,
+
+    /// Maximum number of queries that wait to run while at the limit on concurrent queries.
+    /// Only applies if `--max-concurrent-queries` is given.
+    #[clap(
+        long = "max-queued-queries",
+        env = "INFLUXDB3_MAX_QUEUED_QUERIES",
+        default_value = "0",
+        action
+    )]
+    pub max_queued_queries: usize,
+
+    /// Maximum number of rows that a query made to the `/api/v3/query_sql`,
+    /// `/api/v3/query_influxql`, or v1 `/query` APIs returns. The results of queries that return
+    /// more are truncated to the limit, and marked with an `X-Influxdb-Partial: true` header, or,
+    /// for each query in a bulk v1 query, with `"partial": true`. If not specified, there is no
+    /// limit.
+    #[clap(
+        long = "max-query-rows",
+        env = "INFLUXDB3_MAX_QUERY_ROWS",
+        value_parser = parse_max_query_rows,
+        action
+    )]
+    pub max_query_rows: Option<NonZeroUsize>,
+
+    /// Fail queries that return more than `--max-query-rows` rows, rather than truncating their
+    /// results.
+    #[clap(
+        long = "error-on-max-query-rows",
+        env = "INFLUXDB3_ERROR_ON_MAX_QUERY_ROWS",
+        action
+    )]
+    pub error_on_max_query_rows: bool,
+
     /// The directory to store the write ahead log
     ///
     /// If not specified, defaults to INFLUXDB3_DB_DIR/wal
@@ -147,6 +220,38 @@ pub struct Config {
     #[clap(long = "bearer-token", env = "INFLUXDB3_BEARER_TOKEN", action)]
     pub bearer_token: Option<String>,
 
+    /// Path to a JSON file that scopes each token to the databases it can read from or write
+    /// to, keyed on the hashed token, e.g., `{"<hashed token>": {"foo": "read_write"}}`.
+    /// Access to a database can be `read`, `write`, or `read_write`. Access to `*` applies to
+    /// every database, and `read_write` access to it is needed for the compact and debug
+    /// endpoints.
+    #[clap(
+        long = "token-grants-file",
+        env = "INFLUXDB3_TOKEN_GRANTS_FILE",
+        conflicts_with = "bearer_token",
+        action
+    )]
+    pub token_grants_file: Option<PathBuf>,
+
+    /// Path to a PEM encoded certificate chain to serve the HTTP and gRPC APIs over TLS with.
+    /// HTTP/2 is negotiated with clients that support it. Requires `--tls-key`.
+    #[clap(
+        long = "tls-cert",
+        env = "INFLUXDB3_TLS_CERT",
+        requires = "tls_key",
+        action
+    )]
+    pub tls_cert: Option<PathBuf>,
+
+    /// Path to the PEM encoded private key for the certificate given by `--tls-cert`.
+    #[clap(
+        long = "tls-key",
+        env = "INFLUXDB3_TLS_KEY",
+        requires = "tls_cert",
+        action
+    )]
+    pub tls_key: Option<PathBuf>,
+
     /// Duration of wal segments that are persisted to object storage. Valid values: 1m, 5m, 10m,
     /// 15m, 30m, 1h, 2h, 4h.
     #[clap(
@@ -167,6 +272,49 @@ pub struct Config {
         action
     )]
     pub query_log_size: usize,
+
+    /// Log queries that take at least this long to run, e.g., `1s`, along with the number of
+    /// rows that they returned. Set to `0s` to log every query. If not specified, slow queries
+    /// are not logged.
+    #[clap(
+        long = "slow-query-threshold",
+        env = "INFLUXDB3_SLOW_QUERY_THRESHOLD",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub slow_query_threshold: Option<Duration>,
+
+    /// How often data that is older than the retention period of its database is removed.
+    #[clap(
+        long = "retention-check-interval",
+        env = "INFLUXDB3_RETENTION_CHECK_INTERVAL",
+        default_value = "30m",
+        value_parser = parse_retention_check_interval,
+        action
+    )]
+    pub retention_check_interval: Duration,
+
+    /// How long the responses to queries are cached for, so that repeated queries do not need
+    /// to be run again. Writes to a database invalidate the cached responses for it, and
+    /// clients can bypass the cache with the `no_cache=true` query parameter. If not
+    /// specified, query responses are not cached.
+    #[clap(
+        long = "query-cache-ttl",
+        env = "INFLUXDB3_QUERY_CACHE_TTL",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub query_cache_ttl: Option<Duration>,
+
+    /// The maximum number of query responses held in the query cache, with the least recently
+    /// used responses evicted to make room for new ones.
+    #[clap(
+        long = "query-cache-size",
+        env = "INFLUXDB3_QUERY_CACHE_SIZE",
+        default_value = "1000",
+        action
+    )]
+    pub query_cache_size: usize,
 }
 
 /// If `p` does not exist, try to create it as a directory.
@@ -279,6 +427,7 @@ pub async fn command(config: Config) -> Result<()> {
         )
         .await?,
     );
+    write_buffer.spawn_retention_enforcement(config.retention_check_interval);
     let query_executor = Arc::new(QueryExecutorImpl::new(
         write_buffer.catalog(),
         Arc::clone(&write_buffer),
@@ -287,19 +436,43 @@ pub async fn command(config: Config) -> Result<()> {
         Arc::new(config.datafusion_config),
         10,
         config.query_log_size,
+        config.slow_query_threshold,
     ));
 
-    let builder = ServerBuilder::new(common_state)
+    let mut builder = ServerBuilder::new(common_state)
         .max_request_size(config.max_http_request_size)
         .write_buffer(write_buffer)
         .query_executor(query_executor)
         .time_provider(time_provider)
         .persister(persister);
+    if let Some(max_concurrent_writes) = config.max_concurrent_writes {
+        builder = builder.max_concurrent_writes(max_concurrent_writes);
+    }
+    if let Some(max_concurrent_queries) = config.max_concurrent_queries {
+        builder = builder.max_concurrent_queries(max_concurrent_queries, config.max_queued_queries);
+    }
+    if let Some(max_query_rows) = config.max_query_rows {
+        builder = builder.max_query_rows(max_query_rows, config.error_on_max_query_rows);
+    }
+    if let Some(query_cache_ttl) = config.query_cache_ttl {
+        builder = builder.query_cache(query_cache_ttl, config.query_cache_size);
+    }
+    if let (Some(cert), Some(key)) = (&config.tls_cert, &config.tls_key) {
+        builder = builder.tls_config(load_server_config(cert, key)?);
+    }
 
     let server = if let Some(token) = config.bearer_token.map(hex::decode).transpose()? {
         builder
             .authorizer(Arc::new(AllOrNothingAuthorizer::new(token)))
             .build()
+    } else if let Some(path) = config.token_grants_file {
+        let json = std::fs::read(&path).map_err(|source| Error::ReadTokenGrants {
+            path: path.clone(),
+            source,
+        })?;
+        builder
+            .authorizer(Arc::new(DatabaseGrantsAuthorizer::from_json(&json)?))
+            .build()
     } else {
         builder.build()
     };
@@ -308,6 +481,43 @@ pub async fn command(config: Config) -> Result<()> {
     Ok(())
 }
 
+fn parse_retention_check_interval(
+    s: &str,
+) -> Result<Duration, Box<dyn std::error::Error + Send + Sync + 'static>> {
+    let interval = humantime::parse_duration(s)?;
+    if interval.is_zero() {
+        return Err("retention check interval must be greater than 0".into());
+    }
+    Ok(interval)
+}
+
+/// Parse a limit on the number of requests handled at once, which is enforced with a semaphore,
+/// so must be at least one, and at most the number of permits that a semaphore can have
+fn parse_concurrency_limit(
+    s: &str,
+) -> Result<usize, Box<dyn std::error::Error + Send + Sync + 'static>> {
+    let limit = s.parse::<usize>()?;
+    if limit == 0 {
+        return Err("limit must be greater than 0".into());
+    }
+    if limit > tokio::sync::Semaphore::MAX_PERMITS {
+        return Err(format!(
+            "limit must be at most {max}",
+            max = tokio::sync::Semaphore::MAX_PERMITS
+        )
+        .into());
+    }
+    Ok(limit)
+}
+
+/// Parse a limit on the number of rows that a query returns, which must be at least one, as a
+/// query truncated to no rows would never return any results
+fn parse_max_query_rows(
+    s: &str,
+) -> Result<NonZeroUsize, Box<dyn std::error::Error + Send + Sync + 'static>> {
+    NonZeroUsize::new(s.parse::<usize>()?).ok_or_else(|| "limit must be greater than 0".into())
+}
+
 fn parse_datafusion_config(
     s: &str,
 ) -> Result<HashMap<String, String>, Box<dyn std::error::Error + Send + Sync + 'static>> {
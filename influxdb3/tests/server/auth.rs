@@ -323,3 +323,282 @@ async fn v1_password_parameter() {
         StatusCode::OK,
     );
 }
+
+#[tokio::test]
+async fn auth_schemes() {
+    const HASHED_TOKEN: &str = "5315f0c4714537843face80cca8c18e27ce88e31e9be7a5232dc4dc8444f27c0227a9bd64831d3ab58f652bd0262dd8558dd08870ac9e5c650972ce9e4259439";
+    const TOKEN: &str = "apiv3_mp75KQAhbqv0GeQXk8MPuZ3ztaLEaR5JzS8iifk1FwuroSVyXXyrJK1c4gEr1kHkmbgzDV-j3MvQpaIMVJBAiA";
+
+    let server = TestServer::configure()
+        .auth_token(HASHED_TOKEN, TOKEN)
+        .spawn()
+        .await;
+    let client = influxdb3_client::Client::new(server.client_addr()).unwrap();
+
+    // each of the supported schemes is authorized with a valid token:
+    for client in [
+        client.clone().with_auth_token(TOKEN),
+        client.clone().with_token_auth(TOKEN),
+        client.clone().with_basic_auth("user", TOKEN),
+    ] {
+        client
+            .api_v3_write_lp("foo")
+            .body("cpu,host=a val=1i 123")
+            .send()
+            .await
+            .unwrap();
+        client
+            .api_v3_query_sql("foo", "SELECT * FROM cpu")
+            .send()
+            .await
+            .unwrap();
+    }
+
+    // and are not authorized with an invalid token, or without a token:
+    for client in [
+        client.clone().with_auth_token("invalid-token"),
+        client.clone().with_token_auth("invalid-token"),
+        client.clone().with_basic_auth("user", "invalid-token"),
+        client,
+    ] {
+        let err = client
+            .api_v3_write_lp("foo")
+            .body("cpu,host=a val=1i 123")
+            .send()
+            .await
+            .unwrap_err();
+        assert!(
+            matches!(err, influxdb3_client::Error::ApiError { code, .. } if code == StatusCode::UNAUTHORIZED),
+            "unexpected error: {err}"
+        );
+    }
+
+    // basic credentials that are not of the form <username>:<password> are malformed:
+    let resp = reqwest::Client::new()
+        .get(format!(
+            "{base}/api/v3/query_sql",
+            base = server.client_addr()
+        ))
+        .query(&[("db", "foo"), ("q", "SELECT * FROM cpu")])
+        // base64 encoding of "no-password":
+        .header("Authorization", "Basic bm8tcGFzc3dvcmQ=")
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn database_grants() {
+    const READER_HASHED_TOKEN: &str = "e4dc4d855adb032c9fae90ed942a434a6bf9c657fa10c76132873fea7cc251eb568f784337228ba591729c2a7da07f8f4c43e736191cdbdb7f29047eccb3f6b9";
+    const READER_TOKEN: &str = "apiv3_reader_HsmFjLw0aNkYyN3o";
+    const WRITER_HASHED_TOKEN: &str = "43d81227fe2252819f085f07ee750184059026e798d1d3c6cbf4d5d596a7c5e08a4d4db3b49f83300a0ebaa408a183a1b0b7f2ba4f4e1b1a6931eda50cf15f52";
+    const WRITER_TOKEN: &str = "apiv3_writer_qG2n6XvT0cBWe9Lr";
+    const ADMIN_HASHED_TOKEN: &str = "08fe95d0c1416f0ad9a26db5ac98489c43d41bc352a48678eeae59100bb0caf79f939a8729a0e33c9dbd3e31487c797c8e4ec07aa386bef3324e0fbc96650a5e";
+    const ADMIN_TOKEN: &str = "apiv3_admin_Vt8cKq3RwZp1Lm5d";
+
+    // the reader can read from foo, and the writer can read from and write to foo, but only
+    // write to bar, while the admin has full access:
+    let grants_path = std::env::temp_dir().join(format!(
+        "influxdb3-token-grants-{pid}.json",
+        pid = std::process::id()
+    ));
+    std::fs::write(
+        &grants_path,
+        format!(
+            r#"{{
+                "{READER_HASHED_TOKEN}": {{"foo": "read"}},
+                "{WRITER_HASHED_TOKEN}": {{"foo": "read_write", "bar": "write"}},
+                "{ADMIN_HASHED_TOKEN}": {{"*": "read_write"}}
+            }}"#
+        ),
+    )
+    .unwrap();
+    let server = TestServer::configure()
+        .token_grants_file(grants_path.to_str().unwrap())
+        .spawn()
+        .await;
+    std::fs::remove_file(&grants_path).unwrap();
+
+    let client = reqwest::Client::new();
+    let base = server.client_addr();
+    let write = |db: &'static str, token: &'static str| {
+        client
+            .post(format!("{base}/api/v3/write_lp"))
+            .query(&[("db", db)])
+            .body("cpu,host=a val=1i 123")
+            .bearer_auth(token)
+            .send()
+    };
+    let query_sql = |db: &'static str, token: &'static str| {
+        client
+            .get(format!("{base}/api/v3/query_sql"))
+            .query(&[("db", db), ("q", "SELECT * FROM cpu")])
+            .bearer_auth(token)
+            .send()
+    };
+    let query_influxql = |db: &'static str, token: &'static str| {
+        client
+            .get(format!("{base}/api/v3/query_influxql"))
+            .query(&[("db", db), ("q", "SELECT * FROM cpu")])
+            .bearer_auth(token)
+            .send()
+    };
+
+    // allowed writes:
+    assert_eq!(
+        write("foo", WRITER_TOKEN).await.unwrap().status(),
+        StatusCode::OK
+    );
+    assert_eq!(
+        write("bar", WRITER_TOKEN).await.unwrap().status(),
+        StatusCode::OK
+    );
+
+    // denied writes:
+    let resp = write("foo", READER_TOKEN).await.unwrap();
+    assert_eq!(resp.status(), StatusCode::FORBIDDEN);
+    assert_eq!(
+        resp.text().await.unwrap(),
+        r#"{"error":"not permitted to write to database 'foo'","data":null}"#
+    );
+    assert_eq!(
+        write("baz", WRITER_TOKEN).await.unwrap().status(),
+        StatusCode::FORBIDDEN
+    );
+
+    // allowed reads:
+    for token in [READER_TOKEN, WRITER_TOKEN] {
+        assert_eq!(
+            query_sql("foo", token).await.unwrap().status(),
+            StatusCode::OK
+        );
+        assert_eq!(
+            query_influxql("foo", token).await.unwrap().status(),
+            StatusCode::OK
+        );
+    }
+
+    // denied reads:
+    for token in [READER_TOKEN, WRITER_TOKEN] {
+        assert_eq!(
+            query_sql("bar", token).await.unwrap().status(),
+            StatusCode::FORBIDDEN
+        );
+        assert_eq!(
+            query_influxql("bar", token).await.unwrap().status(),
+            StatusCode::FORBIDDEN
+        );
+    }
+    // including when the database is given in the query, rather than as a parameter:
+    let resp = client
+        .get(format!("{base}/api/v3/query_influxql"))
+        .query(&[("q", "SELECT * FROM bar.autogen.cpu")])
+        .bearer_auth(WRITER_TOKEN)
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::FORBIDDEN);
+    let resp = client
+        .get(format!("{base}/query"))
+        .query(&[("db", "bar"), ("q", "SELECT * FROM cpu")])
+        .bearer_auth(WRITER_TOKEN)
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::FORBIDDEN);
+
+    // InfluxQL statements that change a database need to be permitted to write to it:
+    let influxql = |db: &'static str, q: &'static str, token: &'static str| {
+        client
+            .post(format!("{base}/query"))
+            .form(&[("db", db), ("q", q)])
+            .bearer_auth(token)
+            .send()
+    };
+    for q in [
+        "DELETE FROM cpu",
+        "DROP DATABASE foo",
+        "ALTER RETENTION POLICY autogen ON foo DURATION 1h",
+    ] {
+        let resp = influxql("foo", q, READER_TOKEN).await.unwrap();
+        assert_eq!(resp.status(), StatusCode::FORBIDDEN, "query: {q}");
+    }
+    // including the target of a SELECT INTO, as well as reading from the database it is run
+    // against:
+    let select_into = "SELECT * INTO bar.autogen.cpu_copy FROM cpu";
+    let resp = influxql("foo", select_into, READER_TOKEN).await.unwrap();
+    assert_eq!(resp.status(), StatusCode::FORBIDDEN);
+    let resp = influxql(
+        "bar",
+        "SELECT * INTO foo.autogen.cpu_copy FROM cpu",
+        WRITER_TOKEN,
+    )
+    .await
+    .unwrap();
+    assert_eq!(resp.status(), StatusCode::FORBIDDEN);
+    let resp = influxql("foo", select_into, WRITER_TOKEN).await.unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    // queries that are not run against a single database need full access:
+    let show_databases = |token: &'static str| {
+        client
+            .get(format!("{base}/api/v3/query_influxql"))
+            .query(&[("q", "SHOW DATABASES")])
+            .bearer_auth(token)
+            .send()
+    };
+    assert_eq!(
+        show_databases(WRITER_TOKEN).await.unwrap().status(),
+        StatusCode::FORBIDDEN
+    );
+    assert_eq!(
+        show_databases(ADMIN_TOKEN).await.unwrap().status(),
+        StatusCode::OK
+    );
+
+    // configuring a database needs to be permitted to write to it:
+    let configure = |token: &'static str| {
+        client
+            .post(format!("{base}/api/v3/configure/database"))
+            .query(&[("db", "foo"), ("max_series", "100")])
+            .bearer_auth(token)
+            .send()
+    };
+    assert_eq!(
+        configure(READER_TOKEN).await.unwrap().status(),
+        StatusCode::FORBIDDEN
+    );
+    assert_eq!(
+        configure(WRITER_TOKEN).await.unwrap().status(),
+        StatusCode::OK
+    );
+
+    // endpoints that act on the whole server need full access:
+    for token in [WRITER_TOKEN, ADMIN_TOKEN] {
+        let expected = if token == ADMIN_TOKEN {
+            StatusCode::OK
+        } else {
+            StatusCode::FORBIDDEN
+        };
+        let resp = client
+            .post(format!("{base}/api/v3/maintenance/compact"))
+            .bearer_auth(token)
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), expected);
+        let resp = client
+            .get(format!("{base}/debug/vars"))
+            .bearer_auth(token)
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), expected);
+    }
+
+    // unknown tokens are still unauthorized:
+    assert_eq!(
+        write("foo", "invalid-token").await.unwrap().status(),
+        StatusCode::UNAUTHORIZED
+    );
+}
@@ -1,7 +1,10 @@
+use std::time::Duration;
+
 use crate::TestServer;
 use hyper::StatusCode;
 use influxdb3_client::Error;
 use influxdb3_client::Precision;
+use serde_json::{json, Value};
 
 #[tokio::test]
 async fn limits() -> Result<(), Error> {
@@ -80,3 +83,607 @@ async fn limits() -> Result<(), Error> {
 
     Ok(())
 }
+
+#[tokio::test]
+async fn concurrent_write_limit() {
+    let server = TestServer::configure()
+        .max_concurrent_writes(1)
+        .spawn()
+        .await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    // large enough writes that they overlap with each other:
+    let lp = (0..10_000).fold(String::new(), |mut acc, i| {
+        acc.push_str(&format!("cpu,host=s{i} usage=0.9 {i}\n"));
+        acc
+    });
+
+    let responses = futures::future::join_all((0..20).map(|_| {
+        client
+            .post(&write_url)
+            .query(&[("db", "foo")])
+            .body(lp.clone())
+            .send()
+    }))
+    .await;
+
+    let mut rejected = 0;
+    for resp in responses {
+        let resp = resp.expect("send /api/v3/write_lp request");
+        match resp.status() {
+            StatusCode::OK => (),
+            StatusCode::TOO_MANY_REQUESTS => {
+                assert_eq!(resp.headers()["Retry-After"], "1");
+                rejected += 1;
+            }
+            status => panic!("unexpected status: {status}"),
+        }
+    }
+    assert!(rejected > 0, "expected some writes to be rejected");
+    assert!(rejected < 20, "expected some writes to succeed");
+}
+
+#[tokio::test]
+async fn concurrent_write_limit_import() {
+    let server = TestServer::configure()
+        .max_concurrent_writes(1)
+        .spawn()
+        .await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    // an import holds its place against the limit until its body has been written:
+    let (tx, rx) = futures::channel::mpsc::unbounded::<Result<String, std::io::Error>>();
+    let import = tokio::spawn(
+        client
+            .post(format!("{base}/api/v3/import", base = server.client_addr()))
+            .query(&[("db", "foo"), ("precision", "second")])
+            .body(reqwest::Body::wrap_stream(rx))
+            .send(),
+    );
+    // enough lines to fill a batch, so that they are written before the body ends:
+    let lp = (0..50_000).fold(String::new(), |mut acc, i| {
+        acc.push_str(&format!("cpu,host=s{i} usage=0.9 {i}\n"));
+        acc
+    });
+    tx.unbounded_send(Ok(lp)).unwrap();
+    let mut written = Value::Null;
+    for _ in 0..100 {
+        written = server
+            .api_v3_query_sql(&[
+                ("db", "foo"),
+                ("q", "SELECT COUNT(*) > 0 AS written FROM cpu"),
+                ("format", "json"),
+            ])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        if written == json!([{"written": true}]) {
+            break;
+        }
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+    assert_eq!(written, json!([{"written": true}]));
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=b usage=1 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::TOO_MANY_REQUESTS);
+
+    drop(tx);
+    let resp = import.await.unwrap().expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    // after which writes are accepted again:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=b usage=1 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+}
+
+#[tokio::test]
+async fn concurrent_write_limit_write_stream() {
+    let server = TestServer::configure()
+        .max_concurrent_writes(1)
+        .spawn()
+        .await;
+    let client = reqwest::Client::new();
+    let write_stream_url = format!("{base}/api/v3/write_stream", base = server.client_addr());
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    // a streaming write holds its place against the limit until its body ends:
+    let (tx, rx) = futures::channel::mpsc::unbounded::<Result<String, std::io::Error>>();
+    let stream = tokio::spawn(
+        client
+            .post(&write_stream_url)
+            .query(&[("db", "foo"), ("precision", "second")])
+            .body(reqwest::Body::wrap_stream(rx))
+            .send(),
+    );
+    tx.unbounded_send(Ok("cpu,host=a usage=1 1\n".to_string()))
+        .unwrap();
+    let mut written = Value::Null;
+    for _ in 0..100 {
+        written = server
+            .api_v3_query_sql(&[
+                ("db", "foo"),
+                ("q", "SELECT COUNT(*) AS n FROM cpu"),
+                ("format", "json"),
+            ])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        if written == json!([{"n": 1}]) {
+            break;
+        }
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+    assert_eq!(written, json!([{"n": 1}]));
+
+    for url in [&write_url, &write_stream_url] {
+        let resp = client
+            .post(url)
+            .query(&[("db", "foo")])
+            .body("cpu,host=b usage=1 1")
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), StatusCode::TOO_MANY_REQUESTS, "{url}");
+        assert_eq!(resp.headers()["Retry-After"], "1");
+    }
+
+    drop(tx);
+    let resp = stream
+        .await
+        .unwrap()
+        .expect("send /api/v3/write_stream request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    resp.text().await.unwrap();
+
+    // after which writes are accepted again, once the task writing the stream has finished:
+    let mut status = StatusCode::TOO_MANY_REQUESTS;
+    for _ in 0..100 {
+        status = client
+            .post(&write_url)
+            .query(&[("db", "foo")])
+            .body("cpu,host=b usage=1 1")
+            .send()
+            .await
+            .expect("send /api/v3/write_lp request")
+            .status();
+        if status != StatusCode::TOO_MANY_REQUESTS {
+            break;
+        }
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+    assert_eq!(status, StatusCode::OK);
+}
+
+#[tokio::test]
+async fn concurrent_query_limit() {
+    let server = TestServer::configure()
+        .max_concurrent_queries(1, 2)
+        .spawn()
+        .await;
+    let client = reqwest::Client::new();
+    let query_url = format!("{base}/api/v3/query_sql", base = server.client_addr());
+
+    let lp = (0..2_000).fold(String::new(), |mut acc, i| {
+        acc.push_str(&format!("cpu,host=s{i} usage=0.9 {i}\n"));
+        acc
+    });
+    server
+        .write_lp_to_db("foo", &lp, Precision::Nanosecond)
+        .await
+        .unwrap();
+
+    // slow enough queries that they overlap with each other:
+    let responses = futures::future::join_all((0..20).map(|_| {
+        client
+            .get(&query_url)
+            .query(&[
+                ("db", "foo"),
+                (
+                    "q",
+                    "SELECT a.host, count(*) FROM cpu a, cpu b GROUP BY a.host",
+                ),
+            ])
+            .send()
+    }))
+    .await;
+
+    let mut rejected = 0;
+    for resp in responses {
+        let resp = resp.expect("send /api/v3/query_sql request");
+        match resp.status() {
+            StatusCode::OK => (),
+            StatusCode::TOO_MANY_REQUESTS => {
+                assert_eq!(resp.headers()["Retry-After"], "1");
+                rejected += 1;
+            }
+            status => panic!("unexpected status: {status}"),
+        }
+    }
+    // at most one query runs, and two wait, while the others are rejected:
+    assert!(rejected > 0, "expected some queries to be rejected");
+    assert!(rejected <= 17, "expected queued queries to succeed");
+
+    // nothing is left running once the queries have finished:
+    let vars: Value = client
+        .get(format!("{base}/debug/vars", base = server.client_addr()))
+        .send()
+        .await
+        .expect("send /debug/vars request")
+        .json()
+        .await
+        .unwrap();
+    assert_eq!(vars["queries"], json!({"running": 0, "queued": 0}));
+}
+
+#[tokio::test]
+async fn max_http_request_size() {
+    let server = TestServer::configure()
+        .max_http_request_size(100)
+        .spawn()
+        .await;
+    let client = reqwest::Client::new();
+
+    // pad a line with a string field so that it is exactly the given size:
+    let lp = |size: usize| {
+        let lp = format!("cpu,host=a pad=\"{}\" 1", "x".repeat(size - 19));
+        assert_eq!(lp.len(), size);
+        lp
+    };
+
+    for (path, db_param) in [
+        ("/api/v3/write_lp", "db"),
+        ("/api/v2/write", "bucket"),
+        ("/write", "db"),
+    ] {
+        let url = format!("{base}{path}", base = server.client_addr());
+        let params = [(db_param, "foo")];
+
+        let resp = client
+            .post(&url)
+            .query(&params)
+            .body(lp(100))
+            .send()
+            .await
+            .unwrap();
+        assert!(resp.status().is_success(), "{path}: {}", resp.status());
+
+        let resp = client
+            .post(&url)
+            .query(&params)
+            .body(lp(101))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), StatusCode::PAYLOAD_TOO_LARGE, "{path}");
+        let body = resp.text().await.unwrap();
+        assert!(
+            body.contains("max request size (100 bytes) exceeded"),
+            "{path}: {body}"
+        );
+    }
+
+    // an import only limits each line, unless it is strict, when the body is written at once:
+    let url = format!("{base}/api/v3/import", base = server.client_addr());
+    let body = format!("{}\n{}", lp(100), lp(100));
+    let resp = client
+        .post(&url)
+        .query(&[("db", "foo")])
+        .body(body.clone())
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let resp = client
+        .post(&url)
+        .query(&[("db", "foo"), ("accept_partial", "false")])
+        .body(body)
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::PAYLOAD_TOO_LARGE);
+}
+
+#[tokio::test]
+async fn query_row_limit() {
+    let server = TestServer::configure()
+        .max_query_rows(3, false)
+        .spawn()
+        .await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=1 1\n\
+            cpu,host=a usage=2 2\n\
+            cpu,host=a usage=3 3\n\
+            cpu,host=a usage=4 4\n\
+            cpu,host=a usage=5 5",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    // the results are truncated to the limit, and marked as partial:
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT usage FROM cpu ORDER BY time"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(resp.headers()["X-Influxdb-Partial"], "true");
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([{"usage": 1.0}, {"usage": 2.0}, {"usage": 3.0}])
+    );
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            ("q", "SELECT usage FROM cpu"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(resp.headers()["X-Influxdb-Partial"], "true");
+    assert_eq!(
+        resp.json::<Value>()
+            .await
+            .unwrap()
+            .as_array()
+            .unwrap()
+            .len(),
+        3
+    );
+
+    // results up to the limit are complete:
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT usage FROM cpu ORDER BY time LIMIT 3"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert!(resp.headers().get("X-Influxdb-Partial").is_none());
+
+    // or, queries over the limit fail:
+    let server = TestServer::configure()
+        .max_query_rows(3, true)
+        .spawn()
+        .await;
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=1 1\n\
+            cpu,host=a usage=2 2\n\
+            cpu,host=a usage=3 3\n\
+            cpu,host=a usage=4 4",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+    let resp = server
+        .api_v3_query_sql(&[("db", "foo"), ("q", "SELECT usage FROM cpu")])
+        .await;
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "error": "query returned more than the maximum of 3 rows, add a LIMIT to the query",
+            "data": null
+        })
+    );
+}
+
+#[tokio::test]
+async fn query_row_limit_v1() {
+    let server = TestServer::configure()
+        .max_query_rows(3, false)
+        .spawn()
+        .await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=1 1\n\
+            cpu,host=a usage=2 2\n\
+            cpu,host=a usage=3 3\n\
+            cpu,host=a usage=4 4\n\
+            cpu,host=a usage=5 5",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    // the results are truncated to the limit, and marked as partial:
+    let resp = server
+        .api_v1_query(&[
+            ("db", "foo"),
+            ("q", "SELECT usage FROM cpu"),
+            ("epoch", "s"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(resp.headers()["X-Influxdb-Partial"], "true");
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "results": [
+                {
+                    "series": [
+                        {
+                            "columns": ["time", "usage"],
+                            "name": "cpu",
+                            "values": [[1, 1.0], [2, 2.0], [3, 3.0]]
+                        }
+                    ],
+                    "statement_id": 0
+                }
+            ]
+        })
+    );
+
+    // as are the results of each query in a bulk query:
+    let resp = reqwest::Client::new()
+        .post(format!("{base}/query", base = server.client_addr()))
+        .query(&[("epoch", "s")])
+        .json(&json!({
+            "queries": [
+                {"q": "SELECT usage FROM cpu", "db": "foo"},
+                {"q": "SELECT usage FROM cpu LIMIT 2", "db": "foo"}
+            ]
+        }))
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(body["results"][0]["partial"], json!(true));
+    assert_eq!(
+        body["results"][0]["series"][0]["values"]
+            .as_array()
+            .unwrap()
+            .len(),
+        3
+    );
+    assert!(body["results"][1].get("partial").is_none());
+
+    // or, queries over the limit fail:
+    let server = TestServer::configure()
+        .max_query_rows(3, true)
+        .spawn()
+        .await;
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=1 1\n\
+            cpu,host=a usage=2 2\n\
+            cpu,host=a usage=3 3\n\
+            cpu,host=a usage=4 4",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+    let resp = server
+        .api_v1_query(&[("db", "foo"), ("q", "SELECT usage FROM cpu")])
+        .await;
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap()["error"],
+        "query returned more than the maximum of 3 rows, add a LIMIT to the query"
+    );
+}
+
+#[tokio::test]
+async fn query_string_too_long() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.5 1\n\
+            cpu,host=b usage=0.7 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    // queries that are too long to send in the URL of a GET request:
+    let hosts = (0..1_500)
+        .map(|i| format!("'h{i}'"))
+        .collect::<Vec<_>>()
+        .join(", ");
+    let sql = format!("SELECT host, usage FROM cpu WHERE host IN ('a', {hosts})");
+    let influxql = format!(
+        "SELECT usage FROM cpu WHERE host =~ /^(a|{hosts})$/",
+        hosts = (0..3_000)
+            .map(|i| format!("h{i}"))
+            .collect::<Vec<_>>()
+            .join("|")
+    );
+
+    for (path, query) in [
+        ("/api/v3/query_sql", sql.as_str()),
+        ("/api/v3/query_influxql", influxql.as_str()),
+        ("/query", influxql.as_str()),
+    ] {
+        let resp = client
+            .get(format!("{base}{path}", base = server.client_addr()))
+            .query(&[("db", "foo"), ("q", query)])
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), StatusCode::URI_TOO_LONG, "{path}");
+        let body = resp.json::<Value>().await.unwrap();
+        assert!(
+            body["error"]
+                .as_str()
+                .is_some_and(|e| e.contains("send the query in the body of a POST request")),
+            "{path}: {body}"
+        );
+    }
+
+    // which can be sent in the body of a POST request instead:
+    for (path, query) in [
+        ("/api/v3/query_sql", sql.as_str()),
+        ("/api/v3/query_influxql", influxql.as_str()),
+    ] {
+        let resp = client
+            .post(format!("{base}{path}", base = server.client_addr()))
+            .json(&json!({"db": "foo", "q": query, "format": "json"}))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), StatusCode::OK, "{path}");
+        let rows = resp.json::<Value>().await.unwrap();
+        assert_eq!(rows.as_array().map(Vec::len), Some(1), "{path}: {rows}");
+    }
+    let resp = client
+        .post(format!("{base}/query", base = server.client_addr()))
+        .form(&[("db", "foo"), ("q", influxql.as_str())])
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        body["results"][0]["series"][0]["values"]
+            .as_array()
+            .map(Vec::len),
+        Some(1),
+        "{body}"
+    );
+
+    // the client sends short queries in GET requests, and falls back to POST requests for the
+    // queries that are too long:
+    let client = influxdb3_client::Client::new(server.client_addr())
+        .unwrap()
+        .with_get_queries();
+    for query in ["SELECT host, usage FROM cpu WHERE host = 'a'", sql.as_str()] {
+        let results = client
+            .api_v3_query_sql("foo", query)
+            .send_results()
+            .await
+            .unwrap();
+        assert_eq!(results.len(), 1);
+    }
+}
@@ -15,15 +15,30 @@ use reqwest::Response;
 mod auth;
 mod flight;
 mod limits;
+mod metrics;
 mod ping;
 mod query;
 mod system_tables;
+mod tls;
 mod write;
 
+/// A self-signed certificate for `localhost`, used by [`TestServer`]s that serve over TLS
+const TLS_CERT_PATH: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/tests/server/tls/cert.pem");
+/// The private key for [`TLS_CERT_PATH`]
+const TLS_KEY_PATH: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/tests/server/tls/key.pem");
+
 /// Configuration for a [`TestServer`]
 #[derive(Debug, Default)]
 pub struct TestConfig {
     auth_token: Option<(String, String)>,
+    max_concurrent_writes: Option<String>,
+    max_concurrent_queries: Option<(String, String)>,
+    max_query_rows: Option<(String, bool)>,
+    retention_check_interval: Option<String>,
+    query_cache_ttl: Option<String>,
+    max_http_request_size: Option<String>,
+    token_grants_file: Option<String>,
+    tls: bool,
 }
 
 impl TestConfig {
@@ -37,6 +52,56 @@ impl TestConfig {
         self
     }
 
+    /// Set the maximum number of writes that this [`TestServer`] handles at once
+    pub fn max_concurrent_writes(mut self, max_concurrent_writes: usize) -> Self {
+        self.max_concurrent_writes = Some(max_concurrent_writes.to_string());
+        self
+    }
+
+    /// Set the maximum number of queries that this [`TestServer`] runs at once, and how many
+    /// further queries wait to run
+    pub fn max_concurrent_queries(mut self, max_running: usize, max_queued: usize) -> Self {
+        self.max_concurrent_queries = Some((max_running.to_string(), max_queued.to_string()));
+        self
+    }
+
+    /// Set the maximum number of rows that a query to this [`TestServer`] returns, with the
+    /// query failing when over the limit if `error_when_exceeded` is set
+    pub fn max_query_rows(mut self, max_rows: usize, error_when_exceeded: bool) -> Self {
+        self.max_query_rows = Some((max_rows.to_string(), error_when_exceeded));
+        self
+    }
+
+    /// Set how often this [`TestServer`] removes data outside of retention periods, e.g., `1s`
+    pub fn retention_check_interval<S: Into<String>>(mut self, interval: S) -> Self {
+        self.retention_check_interval = Some(interval.into());
+        self
+    }
+
+    /// Set how long this [`TestServer`] caches query responses for, e.g., `1m`
+    pub fn query_cache_ttl<S: Into<String>>(mut self, ttl: S) -> Self {
+        self.query_cache_ttl = Some(ttl.into());
+        self
+    }
+
+    /// Set the maximum size of HTTP requests to this [`TestServer`] in bytes
+    pub fn max_http_request_size(mut self, max_http_request_size: usize) -> Self {
+        self.max_http_request_size = Some(max_http_request_size.to_string());
+        self
+    }
+
+    /// Set the path of the JSON file that scopes the tokens of this [`TestServer`] to databases
+    pub fn token_grants_file<S: Into<String>>(mut self, path: S) -> Self {
+        self.token_grants_file = Some(path.into());
+        self
+    }
+
+    /// Serve over HTTPS, using a self-signed certificate
+    pub fn tls(mut self) -> Self {
+        self.tls = true;
+        self
+    }
+
     /// Spawn a new [`TestServer`] with this configuration
     ///
     /// This will run the `influxdb3 serve` command, and bind its HTTP
@@ -50,6 +115,43 @@ impl TestConfig {
         if let Some((token, _)) = &self.auth_token {
             args.append(&mut vec!["--bearer-token", token]);
         }
+        if let Some(max_concurrent_writes) = &self.max_concurrent_writes {
+            args.append(&mut vec!["--max-concurrent-writes", max_concurrent_writes]);
+        }
+        if let Some((max_running, max_queued)) = &self.max_concurrent_queries {
+            args.append(&mut vec![
+                "--max-concurrent-queries",
+                max_running,
+                "--max-queued-queries",
+                max_queued,
+            ]);
+        }
+        if let Some((max_rows, error_when_exceeded)) = &self.max_query_rows {
+            args.append(&mut vec!["--max-query-rows", max_rows]);
+            if *error_when_exceeded {
+                args.push("--error-on-max-query-rows");
+            }
+        }
+        if let Some(interval) = &self.retention_check_interval {
+            args.append(&mut vec!["--retention-check-interval", interval]);
+        }
+        if let Some(ttl) = &self.query_cache_ttl {
+            args.append(&mut vec!["--query-cache-ttl", ttl]);
+        }
+        if let Some(max_http_request_size) = &self.max_http_request_size {
+            args.append(&mut vec!["--max-http-request-size", max_http_request_size]);
+        }
+        if let Some(path) = &self.token_grants_file {
+            args.append(&mut vec!["--token-grants-file", path]);
+        }
+        if self.tls {
+            args.append(&mut vec![
+                "--tls-cert",
+                TLS_CERT_PATH,
+                "--tls-key",
+                TLS_KEY_PATH,
+            ]);
+        }
         args
     }
 }
@@ -98,11 +200,16 @@ impl TestServer {
 
         let server_process = command.spawn().expect("spawn the influxdb3 server process");
 
+        // the certificate is self-signed, so cannot be verified:
+        let http_client = reqwest::Client::builder()
+            .danger_accept_invalid_certs(config.tls)
+            .build()
+            .expect("build the HTTP client");
         let server = Self {
             config,
             bind_addr,
             server_process,
-            http_client: reqwest::Client::new(),
+            http_client,
         };
 
         server.wait_until_ready().await;
@@ -111,7 +218,8 @@ impl TestServer {
 
     /// Get the URL of the running service for use with an HTTP client
     pub fn client_addr(&self) -> String {
-        format!("http://{addr}", addr = self.bind_addr)
+        let scheme = if self.config.tls { "https" } else { "http" };
+        format!("{scheme}://{addr}", addr = self.bind_addr)
     }
 
     /// Get a [`FlightSqlClient`] for making requests to the running service over gRPC
@@ -168,6 +276,9 @@ impl TestServer {
         precision: Precision,
     ) -> Result<(), influxdb3_client::Error> {
         let mut client = influxdb3_client::Client::new(self.client_addr()).unwrap();
+        if self.config.tls {
+            client = client.with_insecure_skip_verify().unwrap();
+        }
         if let Some((_, token)) = &self.config.auth_token {
             client = client.with_auth_token(token);
         }
@@ -179,6 +290,18 @@ impl TestServer {
             .await
     }
 
+    pub async fn api_v3_query_sql(&self, params: &[(&str, &str)]) -> Response {
+        self.http_client
+            .get(format!(
+                "{base}/api/v3/query_sql",
+                base = self.client_addr()
+            ))
+            .query(params)
+            .send()
+            .await
+            .expect("send /api/v3/query_sql request to server")
+    }
+
     pub async fn api_v3_query_influxql(&self, params: &[(&str, &str)]) -> Response {
         self.http_client
             .get(format!(
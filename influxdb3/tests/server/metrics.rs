@@ -0,0 +1,211 @@
+use hyper::StatusCode;
+use influxdb3_client::Precision;
+use pretty_assertions::assert_eq;
+use serde_json::{json, Value};
+
+use crate::TestServer;
+
+/// Get the value of the `influxdb3_http_requests` counter for the given path and status from
+/// the Prometheus text format output of the `/metrics` endpoint
+fn request_count(metrics: &str, path: &str, status: u16) -> u64 {
+    let path = format!("path=\"{path}\"");
+    let status = format!("status=\"{status}\"");
+    metrics
+        .lines()
+        .filter(|l| l.starts_with("influxdb3_http_requests"))
+        .find(|l| l.contains(&path) && l.contains(&status))
+        .and_then(|l| l.rsplit(' ').next())
+        .map(|v| v.parse::<f64>().unwrap() as u64)
+        .unwrap_or_default()
+}
+
+#[tokio::test]
+async fn api_metrics_http_requests() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let metrics_url = format!("{base}/metrics", base = server.client_addr());
+    let write_url = format!("{base}/write", base = server.client_addr());
+
+    for db in ["foo", "foo", "invalid/db/name"] {
+        client
+            .post(&write_url)
+            .query(&[("db", db)])
+            .body("cpu,host=a usage=0.5")
+            .send()
+            .await
+            .expect("send /write request");
+    }
+    let resp = server
+        .api_v3_query_influxql(&[("q", "SELECT * FROM cpu"), ("db", "foo")])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let metrics = client
+        .get(&metrics_url)
+        .send()
+        .await
+        .expect("send /metrics request")
+        .text()
+        .await
+        .unwrap();
+
+    assert_eq!(request_count(&metrics, "/write", 200), 2);
+    assert_eq!(request_count(&metrics, "/write", 400), 1);
+    assert_eq!(request_count(&metrics, "/api/v3/query_influxql", 200), 1);
+    assert!(metrics.contains("influxdb3_http_request_duration"));
+}
+
+#[tokio::test]
+async fn api_debug_vars() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let debug_vars_url = format!("{base}/debug/vars", base = server.client_addr());
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.5 1\nmem,host=a used=1i 1",
+            Precision::Nanosecond,
+        )
+        .await
+        .unwrap();
+
+    let resp = client
+        .get(&debug_vars_url)
+        .send()
+        .await
+        .expect("send /debug/vars request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    let vars = resp.json::<Value>().await.unwrap();
+    let mut keys = vars
+        .as_object()
+        .unwrap()
+        .keys()
+        .cloned()
+        .collect::<Vec<_>>();
+    keys.sort();
+    assert_eq!(
+        keys,
+        [
+            "catalog",
+            "memory",
+            "revision",
+            "runtime",
+            "start_time",
+            "uuid",
+            "version",
+            "writes"
+        ]
+    );
+    assert_eq!(vars["catalog"]["databases"], 1);
+    assert_eq!(vars["catalog"]["tables"], 2);
+    assert!(vars["catalog"]["sequence_number"].is_u64());
+    assert!(vars["memory"].is_object());
+    assert!(vars["runtime"]["alive_tasks"].is_u64());
+    assert_eq!(vars["writes"], json!({"in_progress": 0}));
+
+    let resp = client
+        .get(&debug_vars_url)
+        .query(&[("db", "foo")])
+        .send()
+        .await
+        .expect("send /debug/vars request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    let vars = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        vars["database"],
+        json!({
+            "name": "foo",
+            "retention_period_ns": null,
+            "enforce_field_types": false,
+            "max_series": 0,
+            "series": 2,
+            "tables": {"cpu": 3, "mem": 3}
+        })
+    );
+
+    let resp = client
+        .get(&debug_vars_url)
+        .query(&[("db", "bar")])
+        .send()
+        .await
+        .expect("send /debug/vars request");
+    assert_eq!(resp.status(), StatusCode::NOT_FOUND);
+}
+
+/// Get the value of the `influxdb3_query_cache_requests` counter for the given result from the
+/// Prometheus text format output of the `/metrics` endpoint
+fn query_cache_count(metrics: &str, result: &str) -> u64 {
+    let result = format!("result=\"{result}\"");
+    metrics
+        .lines()
+        .filter(|l| l.starts_with("influxdb3_query_cache_requests"))
+        .find(|l| l.contains(&result))
+        .and_then(|l| l.rsplit(' ').next())
+        .map(|v| v.parse::<f64>().unwrap() as u64)
+        .unwrap_or_default()
+}
+
+/// Get the Prometheus text format output of the `/metrics` endpoint
+async fn get_metrics(server: &TestServer) -> String {
+    reqwest::get(format!("{base}/metrics", base = server.client_addr()))
+        .await
+        .expect("send /metrics request")
+        .text()
+        .await
+        .unwrap()
+}
+
+async fn query_cpu(server: &TestServer, no_cache: &str) -> Value {
+    server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT host, usage FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+            ("no_cache", no_cache),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap()
+}
+
+#[tokio::test]
+async fn api_query_cache() {
+    let server = TestServer::configure().query_cache_ttl("1m").spawn().await;
+
+    server
+        .write_lp_to_db("foo", "cpu,host=a usage=0.5 1", Precision::Second)
+        .await
+        .unwrap();
+
+    // the second of two identical queries is served from the cache:
+    let first = query_cpu(&server, "false").await;
+    let second = query_cpu(&server, "false").await;
+    assert_eq!(first, second);
+    let metrics = get_metrics(&server).await;
+    assert_eq!(query_cache_count(&metrics, "miss"), 1);
+    assert_eq!(query_cache_count(&metrics, "hit"), 1);
+
+    // bypassing the cache does not look it up:
+    query_cpu(&server, "true").await;
+    let metrics = get_metrics(&server).await;
+    assert_eq!(query_cache_count(&metrics, "miss"), 1);
+    assert_eq!(query_cache_count(&metrics, "hit"), 1);
+
+    // writing to the database invalidates the cached response:
+    server
+        .write_lp_to_db("foo", "cpu,host=b usage=0.7 2", Precision::Second)
+        .await
+        .unwrap();
+    assert_eq!(
+        query_cpu(&server, "false").await,
+        json!([
+            {"iox::measurement": "cpu", "time": "1970-01-01T00:00:01", "host": "a", "usage": 0.5},
+            {"iox::measurement": "cpu", "time": "1970-01-01T00:00:02", "host": "b", "usage": 0.7}
+        ])
+    );
+    let metrics = get_metrics(&server).await;
+    assert_eq!(query_cache_count(&metrics, "miss"), 2);
+    assert_eq!(query_cache_count(&metrics, "hit"), 1);
+}
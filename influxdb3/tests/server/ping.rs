@@ -1,5 +1,7 @@
+use std::collections::HashSet;
+
 use hyper::Method;
-use serde_json::Value;
+use serde_json::{json, Value};
 
 use crate::TestServer;
 
@@ -40,3 +42,47 @@ async fn test_ping() {
         assert!(map.contains_key("revision"));
     }
 }
+
+#[tokio::test]
+async fn test_request_id_header() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let ping_url = format!("{base}/ping", base = server.client_addr());
+    let not_found_url = format!("{base}/not/a/path", base = server.client_addr());
+
+    let mut request_ids = HashSet::new();
+    for url in [&ping_url, &ping_url, &not_found_url] {
+        let resp = client.get(url).send().await.unwrap();
+        let request_id = resp
+            .headers()
+            .get("X-Request-Id")
+            .expect("response has a request id")
+            .to_str()
+            .unwrap()
+            .to_string();
+        assert!(!request_id.is_empty());
+        assert!(request_ids.insert(request_id), "request ids are unique");
+    }
+}
+
+#[tokio::test]
+async fn test_health() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+
+    for path in ["/health", "/api/v1/health"] {
+        let resp = client
+            .get(format!("{base}{path}", base = server.client_addr()))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(resp.status(), 200);
+        assert_eq!(
+            resp.json::<Value>().await.unwrap(),
+            json!({
+                "status": "pass",
+                "checks": [{"name": "object_store", "status": "pass"}],
+            })
+        );
+    }
+}
@@ -1,6 +1,10 @@
+use std::num::NonZeroUsize;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
 use crate::TestServer;
 use futures::StreamExt;
-use influxdb3_client::Precision;
+use hyper::StatusCode;
+use influxdb3_client::{Format, Precision};
 use pretty_assertions::assert_eq;
 use serde_json::{json, Value};
 use test_helpers::assert_contains;
@@ -170,6 +174,62 @@ async fn api_v3_query_sql_params() {
     }
 }
 
+#[tokio::test]
+async fn api_v3_query_etag() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let query_url = format!("{base}/api/v3/query_sql", base = server.client_addr());
+    let params = [
+        ("db", "foo"),
+        ("q", "SELECT usage FROM cpu ORDER BY time"),
+        ("format", "json"),
+    ];
+
+    server
+        .write_lp_to_db("foo", "cpu,host=a usage=0.5 1", Precision::Second)
+        .await
+        .unwrap();
+
+    let resp = client.get(&query_url).query(&params).send().await.unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    let etag = resp
+        .headers()
+        .get("etag")
+        .expect("response has an ETag")
+        .clone();
+
+    // the results have not changed, so are not sent again:
+    let resp = client
+        .get(&query_url)
+        .query(&params)
+        .header("if-none-match", etag.clone())
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::NOT_MODIFIED);
+    assert_eq!(resp.headers().get("etag"), Some(&etag));
+    assert!(resp.bytes().await.unwrap().is_empty());
+
+    // once the results change, they are sent with a new ETag:
+    server
+        .write_lp_to_db("foo", "cpu,host=a usage=0.7 2", Precision::Second)
+        .await
+        .unwrap();
+    let resp = client
+        .get(&query_url)
+        .query(&params)
+        .header("if-none-match", etag.clone())
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_ne!(resp.headers().get("etag"), Some(&etag));
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([{"usage": 0.5}, {"usage": 0.7}])
+    );
+}
+
 #[tokio::test]
 async fn api_v3_query_influxql() {
     let server = TestServer::spawn().await;
@@ -346,30 +406,30 @@ async fn api_v3_query_influxql() {
         TestCase {
             database: None,
             query: "SHOW RETENTION POLICIES",
-            expected: "+---------------+---------+----------+\n\
-                    | iox::database | name    | duration |\n\
-                    +---------------+---------+----------+\n\
-                    | bar           | autogen |          |\n\
-                    | foo           | autogen |          |\n\
-                    +---------------+---------+----------+",
+            expected: "+---------------+---------+----------+----------+---------+\n\
+                    | iox::database | name    | duration | replicaN | default |\n\
+                    +---------------+---------+----------+----------+---------+\n\
+                    | bar           | autogen |          | 1        | true    |\n\
+                    | foo           | autogen |          | 1        | true    |\n\
+                    +---------------+---------+----------+----------+---------+",
         },
         TestCase {
             database: None,
             query: "SHOW RETENTION POLICIES ON foo",
-            expected: "+---------------+---------+----------+\n\
-                    | iox::database | name    | duration |\n\
-                    +---------------+---------+----------+\n\
-                    | foo           | autogen |          |\n\
-                    +---------------+---------+----------+",
+            expected: "+---------------+---------+----------+----------+---------+\n\
+                    | iox::database | name    | duration | replicaN | default |\n\
+                    +---------------+---------+----------+----------+---------+\n\
+                    | foo           | autogen |          | 1        | true    |\n\
+                    +---------------+---------+----------+----------+---------+",
         },
         TestCase {
             database: Some("foo"),
             query: "SHOW RETENTION POLICIES",
-            expected: "+---------------+---------+----------+\n\
-                    | iox::database | name    | duration |\n\
-                    +---------------+---------+----------+\n\
-                    | foo           | autogen |          |\n\
-                    +---------------+---------+----------+",
+            expected: "+---------------+---------+----------+----------+---------+\n\
+                    | iox::database | name    | duration | replicaN | default |\n\
+                    +---------------+---------+----------+----------+---------+\n\
+                    | foo           | autogen |          | 1        | true    |\n\
+                    +---------------+---------+----------+----------+---------+",
         },
     ];
 
@@ -390,6 +450,114 @@ async fn api_v3_query_influxql() {
     }
 }
 
+#[tokio::test]
+async fn api_v3_query_influxql_qualified_measurement() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+
+    // write to the default retention policy of foo, and to its bar retention policy:
+    for (rp, lp) in [
+        (None, "cpu,host=a usage=0.9 1"),
+        (Some("bar"), "cpu,host=b usage=0.5 2"),
+    ] {
+        let mut params = vec![("db", "foo")];
+        if let Some(rp) = rp {
+            params.push(("rp", rp));
+        }
+        let resp = client
+            .post(format!("{base}/write", base = server.client_addr()))
+            .query(&params)
+            .body(lp)
+            .send()
+            .await
+            .expect("send /write request");
+        assert!(resp.status().is_success());
+    }
+
+    struct TestCase<'a> {
+        database: Option<&'a str>,
+        query: &'a str,
+        expected_status: StatusCode,
+        expected_body: Value,
+    }
+
+    let test_cases = [
+        // the database is given by the parameter:
+        TestCase {
+            database: Some("foo"),
+            query: "SELECT host, usage FROM cpu",
+            expected_status: StatusCode::OK,
+            expected_body: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00.000000001", "host": "a", "usage": 0.9}
+            ]),
+        },
+        // the database and retention policy are given by the measurement:
+        TestCase {
+            database: None,
+            query: "SELECT host, usage FROM \"foo\".\"bar\".cpu",
+            expected_status: StatusCode::OK,
+            expected_body: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00.000000002", "host": "b", "usage": 0.5}
+            ]),
+        },
+        TestCase {
+            database: None,
+            query: "SELECT host, usage FROM \"foo\".\"autogen\".cpu",
+            expected_status: StatusCode::OK,
+            expected_body: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00.000000001", "host": "a", "usage": 0.9}
+            ]),
+        },
+        // the parameter can give the database, with the retention policy in the measurement:
+        TestCase {
+            database: Some("foo"),
+            query: "SELECT host, usage FROM \"foo\".\"bar\".cpu",
+            expected_status: StatusCode::OK,
+            expected_body: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00.000000002", "host": "b", "usage": 0.5}
+            ]),
+        },
+        TestCase {
+            database: Some("qux"),
+            query: "SELECT host, usage FROM \"foo\".\"bar\".cpu",
+            expected_status: StatusCode::BAD_REQUEST,
+            expected_body: json!({
+                "error": "provided a database in both the parameters (qux) and \
+                    query string (foo/bar) that do not match, if providing a query \
+                    that specifies the database, you can omit the 'database' parameter \
+                    from your request",
+                "data": null
+            }),
+        },
+        // the database must be given by one or the other:
+        TestCase {
+            database: None,
+            query: "SELECT host, usage FROM cpu",
+            expected_status: StatusCode::BAD_REQUEST,
+            expected_body: json!({
+                "error": "must specify a 'db' parameter, or provide the database in the InfluxQL query",
+                "data": null
+            }),
+        },
+    ];
+
+    for t in test_cases {
+        let mut params = vec![("q", t.query), ("format", "json")];
+        if let Some(db) = t.database {
+            params.push(("db", db));
+        }
+        let resp = server.api_v3_query_influxql(&params).await;
+        assert_eq!(
+            t.expected_status,
+            resp.status(),
+            "query failed: {q}",
+            q = t.query
+        );
+        let body = resp.json::<Value>().await.unwrap();
+        assert_eq!(t.expected_body, body, "query failed: {q}", q = t.query);
+    }
+}
+
 #[tokio::test]
 async fn api_v3_query_influxql_params() {
     let server = TestServer::spawn().await;
@@ -513,6 +681,211 @@ async fn api_v3_query_influxql_params() {
     }
 }
 
+#[tokio::test]
+async fn api_v3_query_params_are_not_injected() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.9 1\n\
+            cpu,host=b usage=0.5 2\n\
+            cpu,host=o'brien usage=0.7 3",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let client = influxdb3_client::Client::new(server.client_addr()).unwrap();
+
+    struct TestCase {
+        sql: &'static str,
+        influxql: &'static str,
+        params: Value,
+        expected: Value,
+    }
+
+    let test_cases = [
+        TestCase {
+            sql: "SELECT host, usage FROM cpu WHERE host = $host ORDER BY time",
+            influxql: "SELECT host, usage FROM cpu WHERE host = $host",
+            params: json!({"host": "a"}),
+            expected: json!([{"host": "a", "usage": 0.9}]),
+        },
+        // quotes in string parameters are matched literally:
+        TestCase {
+            sql: "SELECT host, usage FROM cpu WHERE host = $host ORDER BY time",
+            influxql: "SELECT host, usage FROM cpu WHERE host = $host",
+            params: json!({"host": "o'brien"}),
+            expected: json!([{"host": "o'brien", "usage": 0.7}]),
+        },
+        // so they cannot be used to change the meaning of the statement:
+        TestCase {
+            sql: "SELECT host, usage FROM cpu WHERE host = $host ORDER BY time",
+            influxql: "SELECT host, usage FROM cpu WHERE host = $host",
+            params: json!({"host": "a' OR '1'='1"}),
+            expected: json!([]),
+        },
+        TestCase {
+            sql: "SELECT host, usage FROM cpu WHERE usage > $usage ORDER BY time",
+            influxql: "SELECT host, usage FROM cpu WHERE usage > $usage",
+            params: json!({"usage": 0.6}),
+            expected: json!([
+                {"host": "a", "usage": 0.9},
+                {"host": "o'brien", "usage": 0.7}
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let params = t.params.as_object().unwrap().clone();
+        let sql = client
+            .api_v3_query_sql("foo", t.sql)
+            .with_params_from(params.clone())
+            .unwrap()
+            .format(Format::Json)
+            .send()
+            .await
+            .unwrap();
+        let sql: Value = serde_json::from_slice(&sql).unwrap();
+        assert_eq!(t.expected, sql, "query failed: {q}", q = t.sql);
+
+        let influxql = client
+            .api_v3_query_influxql("foo", t.influxql)
+            .with_params_from(params)
+            .unwrap()
+            .format(Format::Json)
+            .send()
+            .await
+            .unwrap();
+        // ignore the measurement and time columns, which are always included by InfluxQL:
+        let mut influxql: Value = serde_json::from_slice(&influxql).unwrap();
+        for row in influxql.as_array_mut().unwrap() {
+            let row = row.as_object_mut().unwrap();
+            row.remove("iox::measurement");
+            row.remove("time");
+        }
+        assert_eq!(t.expected, influxql, "query failed: {q}", q = t.influxql);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_protobuf() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.9,cores=4i,uptime=10u,ok=true,status=\"fine\" 1\n\
+            cpu,host=b usage=0.5 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let client = influxdb3_client::Client::new(server.client_addr()).unwrap();
+
+    for (kind, query) in [
+        ("sql", "SELECT * FROM cpu ORDER BY time"),
+        ("influxql", "SELECT * FROM cpu"),
+    ] {
+        let builder = match kind {
+            "sql" => client.api_v3_query_sql("foo", query),
+            _ => client.api_v3_query_influxql("foo", query),
+        };
+        let protobuf = builder.format(Format::Protobuf).send().await.unwrap();
+        let builder = match kind {
+            "sql" => client.api_v3_query_sql("foo", query),
+            _ => client.api_v3_query_influxql("foo", query),
+        };
+        let json = builder.send_results().await.unwrap();
+
+        // the protobuf results decode to the same rows as the JSON results:
+        let results = influxdb3_client::QueryResults::from_protobuf(protobuf).unwrap();
+        assert_eq!(json, results, "query failed: {query}");
+        assert_eq!(results.len(), 2);
+        let row = &results.rows()[0];
+        assert_eq!(row.get_str("host").unwrap(), Some("a"));
+        assert_eq!(row.get_f64("usage").unwrap(), Some(0.9));
+        assert_eq!(row.get_i64("cores").unwrap(), Some(4));
+        assert_eq!(row.get_u64("uptime").unwrap(), Some(10));
+        assert_eq!(row.get_bool("ok").unwrap(), Some(true));
+        assert_eq!(row.get_str("status").unwrap(), Some("fine"));
+        assert_eq!(row.get_str("time").unwrap(), Some("1970-01-01T00:00:01"));
+        assert_eq!(results.rows()[1].get("cores"), None);
+    }
+
+    // the format can also be requested with the Accept header:
+    let resp = reqwest::Client::new()
+        .get(format!(
+            "{base}/api/v3/query_sql",
+            base = server.client_addr()
+        ))
+        .header("Accept", "application/x-protobuf")
+        .query(&[("db", "foo"), ("q", "SELECT host FROM cpu ORDER BY time")])
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.headers().get("content-type").unwrap(),
+        "application/x-protobuf"
+    );
+    let results =
+        influxdb3_client::QueryResults::from_protobuf(resp.bytes().await.unwrap()).unwrap();
+    assert_eq!(
+        results.column_values("host"),
+        [Some(&json!("a")), Some(&json!("b"))]
+    );
+}
+
+#[tokio::test]
+async fn api_v3_query_pretty() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.9 1\n\
+            cpu,host=b usage=0.5 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    for (kind, query) in [
+        ("sql", "SELECT host, usage FROM cpu ORDER BY time"),
+        ("influxql", "SELECT host, usage FROM cpu"),
+    ] {
+        let url = format!("{base}/api/v3/query_{kind}", base = server.client_addr());
+        let get = |pretty: &'static str| {
+            reqwest::Client::new()
+                .get(&url)
+                .query(&[("db", "foo"), ("q", query), ("pretty", pretty)])
+                .send()
+        };
+
+        let compact = get("false").await.unwrap().text().await.unwrap();
+        assert!(!compact.contains('\n'), "query failed: {query}");
+
+        let resp = get("true").await.unwrap();
+        assert_eq!(resp.status(), StatusCode::OK);
+        assert_eq!(
+            resp.headers().get("content-type").unwrap(),
+            "application/json"
+        );
+        let pretty = resp.text().await.unwrap();
+        assert_contains!(&pretty, "[\n  {\n    \"");
+
+        // both decode to the same results:
+        assert_eq!(
+            serde_json::from_str::<Value>(&pretty).unwrap(),
+            serde_json::from_str::<Value>(&compact).unwrap(),
+            "query failed: {query}"
+        );
+    }
+}
+
 #[tokio::test]
 async fn api_v1_query() {
     let server = TestServer::spawn().await;
@@ -686,6 +1059,118 @@ async fn api_v1_query() {
     }
 }
 
+#[tokio::test]
+async fn api_v1_query_group_by_tags() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a,region=us usage=0.9 1\n\
+            cpu,host=b,region=us usage=0.5 2\n\
+            cpu,host=a,region=us usage=0.8 3",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    let test_cases = [
+        // Each tag is expanded into the tags of the series, rather than being a column:
+        TestCase {
+            query: "SELECT * FROM cpu GROUP BY *",
+            expected: json!([
+                {
+                    "name": "cpu",
+                    "tags": {"host": "a", "region": "us"},
+                    "columns": ["time", "usage"],
+                    "values": [
+                        ["1970-01-01T00:00:01", 0.9],
+                        ["1970-01-01T00:00:03", 0.8]
+                    ]
+                },
+                {
+                    "name": "cpu",
+                    "tags": {"host": "b", "region": "us"},
+                    "columns": ["time", "usage"],
+                    "values": [
+                        ["1970-01-01T00:00:02", 0.5]
+                    ]
+                }
+            ]),
+        },
+        // Tags that are not grouped by remain columns:
+        TestCase {
+            query: "SELECT * FROM cpu GROUP BY host",
+            expected: json!([
+                {
+                    "name": "cpu",
+                    "tags": {"host": "a"},
+                    "columns": ["time", "region", "usage"],
+                    "values": [
+                        ["1970-01-01T00:00:01", "us", 0.9],
+                        ["1970-01-01T00:00:03", "us", 0.8]
+                    ]
+                },
+                {
+                    "name": "cpu",
+                    "tags": {"host": "b"},
+                    "columns": ["time", "region", "usage"],
+                    "values": [
+                        ["1970-01-01T00:00:02", "us", 0.5]
+                    ]
+                }
+            ]),
+        },
+        // Aggregates produce a row for each series:
+        TestCase {
+            query: "SELECT count(usage) FROM cpu GROUP BY host",
+            expected: json!([
+                {
+                    "name": "cpu",
+                    "tags": {"host": "a"},
+                    "columns": ["time", "count"],
+                    "values": [["1970-01-01T00:00:00", 2]]
+                },
+                {
+                    "name": "cpu",
+                    "tags": {"host": "b"},
+                    "columns": ["time", "count"],
+                    "values": [["1970-01-01T00:00:00", 1]]
+                }
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v1_query(&[("db", "foo"), ("q", t.query)])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        println!("\n{q}", q = t.query);
+        println!("{resp:#}");
+        // order the series by host, so the comparison does not depend on the order in which
+        // they are emitted:
+        let mut series = resp["results"][0]["series"]
+            .as_array()
+            .cloned()
+            .unwrap_or_default();
+        series.sort_by_key(|s| s["tags"]["host"].as_str().map(ToOwned::to_owned));
+        assert_eq!(
+            t.expected,
+            Value::Array(series),
+            "query failed: {q}",
+            q = t.query
+        );
+    }
+}
+
 #[tokio::test]
 async fn api_v1_query_chunked() {
     let server = TestServer::spawn().await;
@@ -914,3 +1399,1859 @@ async fn api_v1_query_chunked() {
         assert_eq!(t.expected, values, "query failed: {q}", q = t.query);
     }
 }
+
+#[tokio::test]
+async fn api_v1_query_drop_database_and_retention_policy() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+
+    // write to the default retention policy, and to the `bar` and `baz` retention policies
+    // of the `foo` database, as well as to another database, `qux`:
+    for (db, rp) in [
+        ("foo", None),
+        ("foo", Some("bar")),
+        ("foo", Some("baz")),
+        ("qux", None),
+    ] {
+        let mut params = vec![("db", db)];
+        if let Some(rp) = rp {
+            params.push(("rp", rp));
+        }
+        let resp = client
+            .post(format!("{base}/write", base = server.client_addr()))
+            .query(&params)
+            .body("cpu,host=a usage=0.9 1")
+            .send()
+            .await
+            .expect("send /write request");
+        assert!(resp.status().is_success());
+    }
+
+    async fn show_databases(server: &TestServer) -> Value {
+        server
+            .api_v3_query_influxql(&[("q", "SHOW DATABASES"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap()
+    }
+
+    let all_databases = json!([
+        {"iox::database": "foo"},
+        {"iox::database": "foo/bar"},
+        {"iox::database": "foo/baz"},
+        {"iox::database": "qux"}
+    ]);
+    assert_eq!(all_databases, show_databases(&server).await);
+
+    // databases are only dropped by POST requests:
+    let resp = server.api_v1_query(&[("q", "DROP DATABASE qux")]).await;
+    assert_eq!(StatusCode::METHOD_NOT_ALLOWED, resp.status());
+    let resp = server
+        .api_v3_query_influxql(&[("q", "DROP RETENTION POLICY bar ON foo")])
+        .await;
+    assert_eq!(StatusCode::METHOD_NOT_ALLOWED, resp.status());
+    assert_eq!(all_databases, show_databases(&server).await);
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected_status: StatusCode,
+        expected_body: Value,
+        expected_databases: &'a [&'a str],
+    }
+
+    let test_cases = [
+        TestCase {
+            query: "DROP RETENTION POLICY bar ON foo",
+            expected_status: StatusCode::OK,
+            expected_body: json!({"results": [{"statement_id": 0}]}),
+            expected_databases: &["foo", "foo/baz", "qux"],
+        },
+        TestCase {
+            query: "DROP RETENTION POLICY bar ON foo",
+            expected_status: StatusCode::NOT_FOUND,
+            expected_body: json!({"error": "database not found: foo/bar", "data": null}),
+            expected_databases: &["foo", "foo/baz", "qux"],
+        },
+        // dropping the database also drops its retention policies:
+        TestCase {
+            query: "DROP DATABASE foo",
+            expected_status: StatusCode::OK,
+            expected_body: json!({"results": [{"statement_id": 0}]}),
+            expected_databases: &["qux"],
+        },
+        TestCase {
+            query: "DROP DATABASE foo",
+            expected_status: StatusCode::NOT_FOUND,
+            expected_body: json!({"error": "database not found: foo", "data": null}),
+            expected_databases: &["qux"],
+        },
+        TestCase {
+            query: "DROP DATABASE",
+            expected_status: StatusCode::BAD_REQUEST,
+            expected_body: json!({
+                "error": "error in InfluxQL statement: expected database name in statement",
+                "data": null
+            }),
+            expected_databases: &["qux"],
+        },
+    ];
+
+    for t in test_cases {
+        println!("\n{q}", q = t.query);
+        let resp = client
+            .post(format!("{base}/query", base = server.client_addr()))
+            .form(&[("q", t.query)])
+            .send()
+            .await
+            .expect("send /query request");
+        assert_eq!(t.expected_status, resp.status(), "query: {q}", q = t.query);
+        let body = resp.json::<Value>().await.unwrap();
+        assert_eq!(t.expected_body, body, "query: {q}", q = t.query);
+        let expected_databases: Vec<Value> = t
+            .expected_databases
+            .iter()
+            .map(|db| json!({"iox::database": db}))
+            .collect();
+        assert_eq!(
+            Value::from(expected_databases),
+            show_databases(&server).await,
+            "query: {q}",
+            q = t.query
+        );
+    }
+}
+
+#[tokio::test]
+async fn api_v1_query_bulk() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.9 1\n\
+            cpu,host=a usage=0.89 2\n\
+            mem,host=a usage=0.5 4",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let client = reqwest::Client::new();
+    let resp = client
+        .post(format!("{base}/query", base = server.client_addr()))
+        .query(&[("epoch", "s")])
+        .json(&json!({
+            "queries": [
+                {
+                    "q": "SELECT time, host, usage FROM cpu",
+                    "db": "foo"
+                },
+                {
+                    "q": "SELECT time, host, usage FROM foo.autogen.mem WHERE host = $host",
+                    "params": {"host": "a"}
+                },
+                {
+                    "q": "SELECT time, usage FROM cpu"
+                }
+            ]
+        }))
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        json!({
+          "results": [
+            {
+              "series": [
+                {
+                  "columns": ["time", "host", "usage"],
+                  "name": "cpu",
+                  "values": [
+                    [1, "a", 0.9],
+                    [2, "a", 0.89]
+                  ]
+                }
+              ],
+              "statement_id": 0
+            },
+            {
+              "series": [
+                {
+                  "columns": ["time", "host", "usage"],
+                  "name": "mem",
+                  "values": [
+                    [4, "a", 0.5]
+                  ]
+                }
+              ],
+              "statement_id": 1
+            },
+            {
+              "error": "must specify a 'db' parameter, or provide the database in the InfluxQL query",
+              "statement_id": 2
+            }
+          ]
+        }),
+        body
+    );
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_alter_retention_policy() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+
+    for (db, rp) in [("foo", None), ("foo", Some("bar"))] {
+        let mut params = vec![("db", db)];
+        if let Some(rp) = rp {
+            params.push(("rp", rp));
+        }
+        let resp = client
+            .post(format!("{base}/write", base = server.client_addr()))
+            .query(&params)
+            .body("cpu,host=a usage=0.9 1")
+            .send()
+            .await
+            .expect("send /write request");
+        assert!(resp.status().is_success());
+    }
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected_status: StatusCode,
+        expected_policies: Value,
+    }
+
+    let test_cases = [
+        TestCase {
+            query: "ALTER RETENTION POLICY autogen ON foo DURATION 1h",
+            expected_status: StatusCode::OK,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "duration": 3_600_000_000_000_i64, "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "replicaN": 1, "default": false}
+            ]),
+        },
+        TestCase {
+            query: "ALTER RETENTION POLICY bar ON foo DURATION 2d REPLICATION 1",
+            expected_status: StatusCode::OK,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "duration": 3_600_000_000_000_i64, "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+            ]),
+        },
+        // setting the duration to INF clears it:
+        TestCase {
+            query: "ALTER RETENTION POLICY autogen ON foo DURATION INF DEFAULT",
+            expected_status: StatusCode::OK,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+            ]),
+        },
+        // only the autogen retention policy can be the default:
+        TestCase {
+            query: "ALTER RETENTION POLICY bar ON foo DEFAULT",
+            expected_status: StatusCode::BAD_REQUEST,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+            ]),
+        },
+        TestCase {
+            query: "ALTER RETENTION POLICY bar ON foo DURATION 0s",
+            expected_status: StatusCode::BAD_REQUEST,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+            ]),
+        },
+        TestCase {
+            query: "ALTER RETENTION POLICY baz ON foo DURATION 1h",
+            expected_status: StatusCode::NOT_FOUND,
+            expected_policies: json!([
+                {"iox::database": "foo", "name": "autogen", "replicaN": 1, "default": true},
+                {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        println!("\n{q}", q = t.query);
+        let resp = server.api_v3_query_influxql(&[("q", t.query)]).await;
+        let status = resp.status();
+        println!("{}", resp.text().await.unwrap());
+        assert_eq!(t.expected_status, status, "query: {q}", q = t.query);
+        let policies = server
+            .api_v3_query_influxql(&[("q", "SHOW RETENTION POLICIES"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected_policies, policies, "query: {q}", q = t.query);
+    }
+
+    // all of the retention policies of a database are listed, and only those:
+    server
+        .write_lp_to_db("baz", "cpu,host=a usage=0.9 1", Precision::Second)
+        .await
+        .unwrap();
+    let policies = server
+        .api_v3_query_influxql(&[("q", "SHOW RETENTION POLICIES ON foo"), ("format", "json")])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        json!([
+            {"iox::database": "foo", "name": "autogen", "replicaN": 1, "default": true},
+            {"iox::database": "foo", "name": "bar", "duration": 172_800_000_000_000_i64, "replicaN": 1, "default": false}
+        ]),
+        policies
+    );
+
+    let resp = server
+        .api_v3_query_influxql(&[("q", "SHOW RETENTION POLICIES ON qux")])
+        .await;
+    assert_eq!(StatusCode::NOT_FOUND, resp.status());
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_retention_enforcement() {
+    let server = TestServer::configure()
+        .retention_check_interval("100ms")
+        .spawn()
+        .await;
+
+    // write a point from an hour ago, and one that will be given the time of the write on
+    // the server:
+    let hour_ago = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap()
+        .as_secs()
+        - 3600;
+    server
+        .write_lp_to_db(
+            "foo",
+            &format!(
+                "cpu,host=a usage=0.1 {hour_ago}\n\
+                cpu,host=b usage=0.2"
+            ),
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "ALTER RETENTION POLICY autogen ON foo DURATION 1m"),
+            ("db", "foo"),
+        ])
+        .await;
+    assert_eq!(StatusCode::OK, resp.status());
+
+    // give the enforcer a chance to run:
+    tokio::time::sleep(Duration::from_millis(500)).await;
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT host, usage FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    let hosts: Vec<&str> = resp
+        .as_array()
+        .expect("response is a JSON array")
+        .iter()
+        .map(|row| row["host"].as_str().expect("host value is a string"))
+        .collect();
+    assert_eq!(vec!["b"], hosts);
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_time_range() {
+    let server = TestServer::spawn().await;
+
+    // write points across a span of time, the last two have no timestamp, so will be given
+    // the time of the write on the server:
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.1 1\n\
+            cpu,host=a usage=0.2 2\n\
+            cpu,host=a usage=0.3 3\n\
+            cpu,host=a usage=0.4 4\n\
+            cpu,host=b usage=0.5\n\
+            cpu,host=c usage=0.6",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: &'a [f64],
+    }
+
+    let test_cases = [
+        TestCase {
+            query: "SELECT usage FROM cpu",
+            expected: &[0.1, 0.2, 0.3, 0.4, 0.5, 0.6],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu \
+                WHERE time > '1970-01-01T00:00:01Z' AND time < '1970-01-01T00:00:04Z'",
+            expected: &[0.2, 0.3],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu \
+                WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:04Z'",
+            expected: &[0.1, 0.2, 0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu WHERE time > now() - 1h",
+            expected: &[0.5, 0.6],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu \
+                WHERE time < now() - 1h AND time > '1970-01-01T00:00:02Z'",
+            expected: &[0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu WHERE time > now()",
+            expected: &[],
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        println!("\n{q}", q = t.query);
+        println!("{resp:#}");
+        let actual: Vec<f64> = resp
+            .as_array()
+            .expect("response is a JSON array")
+            .iter()
+            .map(|row| row["usage"].as_f64().expect("usage value is a float"))
+            .collect();
+        assert_eq!(t.expected, actual, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_tag_filter() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=server01 usage=0.1 1\n\
+            cpu,host=server02 usage=0.2 2\n\
+            cpu,host=server01 usage=0.3 3\n\
+            cpu,host=server02 usage=0.4 4\n\
+            cpu,host=server01 usage=0.5 5",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: &'a [f64],
+    }
+
+    let test_cases = [
+        TestCase {
+            query: "SELECT usage FROM cpu WHERE host = 'server01'",
+            expected: &[0.1, 0.3, 0.5],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu WHERE host != 'server01'",
+            expected: &[0.2, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu WHERE host = 'server03'",
+            expected: &[],
+        },
+        // tag predicates combine with time predicates:
+        TestCase {
+            query: "SELECT usage FROM cpu \
+                WHERE host = 'server01' AND time > '1970-01-01T00:00:01Z'",
+            expected: &[0.3, 0.5],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu \
+                WHERE time < '1970-01-01T00:00:04Z' AND host != 'server01'",
+            expected: &[0.2],
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        println!("\n{q}", q = t.query);
+        println!("{resp:#}");
+        let actual: Vec<f64> = resp
+            .as_array()
+            .expect("response is a JSON array")
+            .iter()
+            .map(|row| row["usage"].as_f64().expect("usage value is a float"))
+            .collect();
+        assert_eq!(t.expected, actual, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_multiple_fields() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage_idle=90.5,usage_user=9.5,value=1i 1\n\
+            cpu,host=b value=2i,usage_user=19.5,usage_idle=80.5 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: &'a str,
+    }
+
+    let test_cases = [
+        // fields are returned in the order that they are selected:
+        TestCase {
+            query: "SELECT value, usage_idle FROM cpu",
+            expected: "+------------------+---------------------+-------+------------+\n\
+                | iox::measurement | time                | value | usage_idle |\n\
+                +------------------+---------------------+-------+------------+\n\
+                | cpu              | 1970-01-01T00:00:01 | 1     | 90.5       |\n\
+                | cpu              | 1970-01-01T00:00:02 | 2     | 80.5       |\n\
+                +------------------+---------------------+-------+------------+",
+        },
+        TestCase {
+            query: "SELECT usage_user FROM cpu",
+            expected: "+------------------+---------------------+------------+\n\
+                | iox::measurement | time                | usage_user |\n\
+                +------------------+---------------------+------------+\n\
+                | cpu              | 1970-01-01T00:00:01 | 9.5        |\n\
+                | cpu              | 1970-01-01T00:00:02 | 19.5       |\n\
+                +------------------+---------------------+------------+",
+        },
+        // with a wildcard, the tags and fields are ordered by name:
+        TestCase {
+            query: "SELECT * FROM cpu",
+            expected: "+------------------+---------------------+------+------------+------------+-------+\n\
+                | iox::measurement | time                | host | usage_idle | usage_user | value |\n\
+                +------------------+---------------------+------+------------+------------+-------+\n\
+                | cpu              | 1970-01-01T00:00:01 | a    | 90.5       | 9.5        | 1     |\n\
+                | cpu              | 1970-01-01T00:00:02 | b    | 80.5       | 19.5       | 2     |\n\
+                +------------------+---------------------+------+------------+------------+-------+",
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "pretty")])
+            .await
+            .text()
+            .await
+            .unwrap();
+        println!("\n{q}", q = t.query);
+        println!("{resp}");
+        assert_eq!(t.expected, resp, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_order_by_time() {
+    let server = TestServer::spawn().await;
+
+    // write points out of time order:
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.3 3\n\
+            cpu,host=a usage=0.1 1\n\
+            cpu,host=a usage=0.4 4\n\
+            cpu,host=a usage=0.2 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: &'a [f64],
+    }
+
+    let influxql_test_cases = [
+        TestCase {
+            query: "SELECT usage FROM cpu",
+            expected: &[0.1, 0.2, 0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time",
+            expected: &[0.1, 0.2, 0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time ASC",
+            expected: &[0.1, 0.2, 0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time DESC",
+            expected: &[0.4, 0.3, 0.2, 0.1],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time DESC LIMIT 2",
+            expected: &[0.4, 0.3],
+        },
+    ];
+    let sql_test_cases = [
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time ASC",
+            expected: &[0.1, 0.2, 0.3, 0.4],
+        },
+        TestCase {
+            query: "SELECT usage FROM cpu ORDER BY time DESC",
+            expected: &[0.4, 0.3, 0.2, 0.1],
+        },
+    ];
+
+    let usage = |resp: Value| -> Vec<f64> {
+        resp.as_array()
+            .expect("response is a JSON array")
+            .iter()
+            .map(|row| row["usage"].as_f64().expect("usage value is a float"))
+            .collect()
+    };
+
+    for t in influxql_test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, usage(resp), "query failed: {q}", q = t.query);
+    }
+    for t in sql_test_cases {
+        let resp = server
+            .api_v3_query_sql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, usage(resp), "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_regex_measurements() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu_user,host=a value=1 1\n\
+            cpu_system,host=a value=2 1\n\
+            cpu_system,host=a value=3 2\n\
+            mem,host=a value=4 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    let test_cases = [
+        TestCase {
+            query: "SELECT value FROM /cpu.*/",
+            expected: json!([
+                {"iox::measurement": "cpu_system", "time": "1970-01-01T00:00:01", "value": 2.0},
+                {"iox::measurement": "cpu_system", "time": "1970-01-01T00:00:02", "value": 3.0},
+                {"iox::measurement": "cpu_user", "time": "1970-01-01T00:00:01", "value": 1.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT value FROM /^cpu_u/, mem",
+            expected: json!([
+                {"iox::measurement": "cpu_user", "time": "1970-01-01T00:00:01", "value": 1.0},
+                {"iox::measurement": "mem", "time": "1970-01-01T00:00:01", "value": 4.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT value FROM /^disk/",
+            expected: json!([]),
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, resp, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_group_by_time() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=1 1\n\
+            cpu,host=a usage=3 2\n\
+            cpu,host=a usage=5 11\n\
+            cpu,host=a usage=7 12\n\
+            cpu,host=a usage=9 13\n\
+            cpu,host=a usage=2 31",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    let time_range = "WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T00:00:40Z'";
+    let test_cases = [
+        // empty windows are filled with nulls by default, which are omitted from the JSON rows:
+        TestCase {
+            query: "SELECT mean(usage), sum(usage), min(usage), max(usage) FROM cpu \
+                {time_range} GROUP BY time(10s)",
+            expected: json!([
+                {
+                    "iox::measurement": "cpu",
+                    "time": "1970-01-01T00:00:00",
+                    "mean": 2.0,
+                    "sum": 4.0,
+                    "min": 1.0,
+                    "max": 3.0
+                },
+                {
+                    "iox::measurement": "cpu",
+                    "time": "1970-01-01T00:00:10",
+                    "mean": 7.0,
+                    "sum": 21.0,
+                    "min": 5.0,
+                    "max": 9.0
+                },
+                {
+                    "iox::measurement": "cpu",
+                    "time": "1970-01-01T00:00:20"
+                },
+                {
+                    "iox::measurement": "cpu",
+                    "time": "1970-01-01T00:00:30",
+                    "mean": 2.0,
+                    "sum": 2.0,
+                    "min": 2.0,
+                    "max": 2.0
+                }
+            ]),
+        },
+        TestCase {
+            query: "SELECT count(usage) FROM cpu {time_range} GROUP BY time(10s) fill(none)",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "count": 2},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:10", "count": 3},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:30", "count": 1}
+            ]),
+        },
+        TestCase {
+            query: "SELECT mean(usage) FROM cpu {time_range} GROUP BY time(10s) fill(0)",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "mean": 2.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:10", "mean": 7.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:20", "mean": 0.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:30", "mean": 2.0}
+            ]),
+        },
+        // empty windows carry forward the value of the previous window:
+        TestCase {
+            query: "SELECT mean(usage) FROM cpu {time_range} GROUP BY time(10s) fill(previous)",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "mean": 2.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:10", "mean": 7.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:20", "mean": 7.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:30", "mean": 2.0}
+            ]),
+        },
+        TestCase {
+            query: "SELECT mean(usage) FROM cpu {time_range} GROUP BY time(10s) fill(linear)",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "mean": 2.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:10", "mean": 7.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:20", "mean": 4.5},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:30", "mean": 2.0}
+            ]),
+        },
+        TestCase {
+            query: "SELECT max(usage) FROM cpu {time_range} GROUP BY time(20s) fill(null)",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "max": 9.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:20", "max": 2.0}
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let query = t.query.replace("{time_range}", time_range);
+        let resp = server
+            .api_v3_query_influxql(&[("q", &query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        println!("\n{query}");
+        println!("{resp:#}");
+        assert_eq!(t.expected, resp, "query failed: {query}");
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_derivative() {
+    let server = TestServer::spawn().await;
+
+    // a counter that is reset between 3s and 4s:
+    server
+        .write_lp_to_db(
+            "foo",
+            "requests,host=a count=10 1\n\
+            requests,host=a count=20 2\n\
+            requests,host=a count=40 3\n\
+            requests,host=a count=5 4\n\
+            requests,host=a count=15 5",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    let test_cases = [
+        // the first point has no derivative:
+        TestCase {
+            query: "SELECT derivative(count) FROM requests",
+            expected: json!([
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:02", "derivative": 10.0},
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:03", "derivative": 20.0},
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:04", "derivative": -35.0},
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:05", "derivative": 10.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT derivative(count, 2s) FROM requests \
+                WHERE time <= '1970-01-01T00:00:03Z'",
+            expected: json!([
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:02", "derivative": 20.0},
+                {"iox::measurement": "requests", "time": "1970-01-01T00:00:03", "derivative": 40.0},
+            ]),
+        },
+        // the negative rate across the reset is omitted:
+        TestCase {
+            query: "SELECT non_negative_derivative(count, 1s) FROM requests",
+            expected: json!([
+                {
+                    "iox::measurement": "requests",
+                    "time": "1970-01-01T00:00:02",
+                    "non_negative_derivative": 10.0
+                },
+                {
+                    "iox::measurement": "requests",
+                    "time": "1970-01-01T00:00:03",
+                    "non_negative_derivative": 20.0
+                },
+                {
+                    "iox::measurement": "requests",
+                    "time": "1970-01-01T00:00:05",
+                    "non_negative_derivative": 10.0
+                },
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, resp, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_ungrouped_aggregates() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=3 1\n\
+            cpu,host=a usage=1 2\n\
+            cpu,host=a usage=4 3\n\
+            cpu,host=a usage=2 4",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    // aggregates have the start of the time range as their time, whereas selectors have the
+    // time of the point they select:
+    let test_cases = [
+        TestCase {
+            query: "SELECT count(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "count": 4},
+            ]),
+        },
+        TestCase {
+            query: "SELECT mean(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "mean": 2.5},
+            ]),
+        },
+        TestCase {
+            query: "SELECT sum(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "sum": 10.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT min(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:02", "min": 1.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT max(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:03", "max": 4.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT first(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:01", "first": 3.0},
+            ]),
+        },
+        TestCase {
+            query: "SELECT last(usage) FROM cpu",
+            expected: json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:04", "last": 2.0},
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, resp, "query failed: {q}", q = t.query);
+    }
+
+    // aggregating no rows gives a count of zero, and nulls for the rest, which are omitted
+    // from the JSON rows:
+    let resp = server
+        .api_v3_query_sql(&[
+            (
+                "q",
+                "SELECT count(usage) AS count, avg(usage) AS mean, sum(usage) AS sum, \
+                min(usage) AS min, max(usage) AS max FROM cpu WHERE host = 'b'",
+            ),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(resp, json!([{"count": 0}]));
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_show_tag_values() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=c,region=us-west usage=0.1 1\n\
+            cpu,host=a,region=us-east usage=0.2 1\n\
+            cpu,host=b,region=us-east usage=0.3 1\n\
+            cpu,host=a,region=us-east usage=0.4 2\n\
+            cpu,host=c,region=us-west usage=0.5 2\n\
+            mem,host=d,region=us-east usage=0.6 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    struct TestCase<'a> {
+        query: &'a str,
+        expected: Value,
+    }
+
+    // each value is listed once, however many points have it, in the order of the values:
+    let test_cases = [
+        TestCase {
+            query: "SHOW TAG VALUES FROM cpu WITH KEY = host",
+            expected: json!([
+                {"iox::measurement": "cpu", "key": "host", "value": "a"},
+                {"iox::measurement": "cpu", "key": "host", "value": "b"},
+                {"iox::measurement": "cpu", "key": "host", "value": "c"},
+            ]),
+        },
+        TestCase {
+            query: "SHOW TAG VALUES FROM cpu WITH KEY = host WHERE region = 'us-east'",
+            expected: json!([
+                {"iox::measurement": "cpu", "key": "host", "value": "a"},
+                {"iox::measurement": "cpu", "key": "host", "value": "b"},
+            ]),
+        },
+        TestCase {
+            query: "SHOW TAG VALUES FROM cpu WITH KEY = host LIMIT 2",
+            expected: json!([
+                {"iox::measurement": "cpu", "key": "host", "value": "a"},
+                {"iox::measurement": "cpu", "key": "host", "value": "b"},
+            ]),
+        },
+        TestCase {
+            query: "SHOW TAG VALUES FROM cpu WITH KEY = region",
+            expected: json!([
+                {"iox::measurement": "cpu", "key": "region", "value": "us-east"},
+                {"iox::measurement": "cpu", "key": "region", "value": "us-west"},
+            ]),
+        },
+    ];
+
+    for t in test_cases {
+        let resp = server
+            .api_v3_query_influxql(&[("q", t.query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(t.expected, resp, "query failed: {q}", q = t.query);
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_paginated() {
+    let server = TestServer::spawn().await;
+
+    let lp = (1..=7)
+        .map(|i| format!("cpu,host=s{i} usage={i} {i}"))
+        .collect::<Vec<_>>()
+        .join("\n");
+    server
+        .write_lp_to_db("foo", lp, Precision::Second)
+        .await
+        .unwrap();
+
+    let client = influxdb3_client::Client::new(server.client_addr()).unwrap();
+
+    // page sizes that do, and do not, evenly divide the number of rows:
+    for page_size in [1, 3, 7, 10] {
+        let page_size = NonZeroUsize::new(page_size).unwrap();
+
+        let mut sql_hosts = vec![];
+        let total = client
+            .api_v3_query_sql("foo", "SELECT host FROM cpu ORDER BY time")
+            .send_paginated(page_size, |row| {
+                sql_hosts.push(row.get_str("host")?.unwrap().to_string());
+                Ok(())
+            })
+            .await
+            .unwrap();
+        assert_eq!(total, 7, "page size: {page_size}");
+
+        let expected: Vec<String> = (1..=7).map(|i| format!("s{i}")).collect();
+        assert_eq!(sql_hosts, expected, "page size: {page_size}");
+    }
+
+    // InfluxQL limits each series rather than the results as a whole, so is not paginated:
+    let err = client
+        .api_v3_query_influxql("foo", "SELECT host, usage FROM cpu ORDER BY time")
+        .send_paginated(NonZeroUsize::new(3).unwrap(), |_| Ok(()))
+        .await
+        .unwrap_err();
+    assert!(
+        matches!(err, influxdb3_client::Error::PaginatedInfluxQl),
+        "{err}"
+    );
+}
+
+#[tokio::test]
+async fn api_v3_query_sql_cursor() {
+    let server = TestServer::spawn().await;
+
+    // rows of different series share each time, and only some have a region:
+    let lp = (1..=50)
+        .flat_map(|t| {
+            (0..3).map(move |h| match h {
+                0 => format!("cpu,host=h{h},region=us usage={t} {t}"),
+                _ => format!("cpu,host=h{h} usage={t} {t}"),
+            })
+        })
+        .collect::<Vec<_>>()
+        .join("\n");
+    server
+        .write_lp_to_db("foo", lp, Precision::Second)
+        .await
+        .unwrap();
+    let query = "SELECT host, region, usage, time FROM cpu";
+
+    let mut rows = vec![];
+    let mut pages = 0;
+    let mut cursor: Option<String> = None;
+    loop {
+        let mut params = vec![
+            ("db", "foo"),
+            ("q", query),
+            ("format", "json"),
+            ("page_size", "7"),
+        ];
+        if let Some(cursor) = &cursor {
+            params.push(("cursor", cursor.as_str()));
+        }
+        let resp = server.api_v3_query_sql(&params).await;
+        assert_eq!(resp.status(), StatusCode::OK);
+        cursor = resp
+            .headers()
+            .get("X-Influxdb-Next-Cursor")
+            .map(|c| c.to_str().unwrap().to_string());
+        let page = resp.json::<Vec<Value>>().await.unwrap();
+        assert!(page.len() <= 7);
+        rows.extend(page);
+        pages += 1;
+        if cursor.is_none() {
+            break;
+        }
+    }
+    assert_eq!(pages, 22);
+
+    // every row is returned exactly once, in order of time and then series:
+    let ordered_query = format!("{query} ORDER BY time, host");
+    let expected = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", ordered_query.as_str()),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Vec<Value>>()
+        .await
+        .unwrap();
+    assert_eq!(expected.len(), 150);
+    assert_eq!(rows, expected);
+
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", query),
+            ("page_size", "7"),
+            ("cursor", "not-a-cursor"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn api_v3_query_sql_cursor_repeated_rows() {
+    let server = TestServer::spawn().await;
+
+    // without the host, three rows share each time, and have the same usage at some times:
+    let lp = (1..=10)
+        .flat_map(|t| {
+            (0..3).map(move |h| {
+                let usage = if t % 2 == 0 { 0 } else { h };
+                format!("cpu,host=h{h} usage={usage} {t}")
+            })
+        })
+        .collect::<Vec<_>>()
+        .join("\n");
+    server
+        .write_lp_to_db("foo", lp, Precision::Second)
+        .await
+        .unwrap();
+
+    for (query, order_by) in [
+        ("SELECT usage, time FROM cpu", "time, usage"),
+        ("SELECT time FROM cpu", "time"),
+    ] {
+        for page_size in ["1", "2", "4"] {
+            let mut rows = vec![];
+            let mut cursor: Option<String> = None;
+            loop {
+                let mut params = vec![
+                    ("db", "foo"),
+                    ("q", query),
+                    ("format", "json"),
+                    ("page_size", page_size),
+                ];
+                if let Some(cursor) = &cursor {
+                    params.push(("cursor", cursor.as_str()));
+                }
+                let resp = server.api_v3_query_sql(&params).await;
+                assert_eq!(resp.status(), StatusCode::OK);
+                cursor = resp
+                    .headers()
+                    .get("X-Influxdb-Next-Cursor")
+                    .map(|c| c.to_str().unwrap().to_string());
+                rows.extend(resp.json::<Vec<Value>>().await.unwrap());
+                if cursor.is_none() {
+                    break;
+                }
+            }
+
+            // no row is skipped, or returned twice:
+            let ordered_query = format!("{query} ORDER BY {order_by}");
+            let expected = server
+                .api_v3_query_sql(&[
+                    ("db", "foo"),
+                    ("q", ordered_query.as_str()),
+                    ("format", "json"),
+                ])
+                .await
+                .json::<Vec<Value>>()
+                .await
+                .unwrap();
+            assert_eq!(expected.len(), 30);
+            assert_eq!(rows, expected, "{query} in pages of {page_size}");
+        }
+    }
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_select_into() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a,region=us usage=1 1\n\
+            cpu,host=a,region=us usage=3 2\n\
+            cpu,host=a,region=us usage=5 11\n\
+            cpu,host=b,region=us usage=7 12\n\
+            cpu,host=b,region=us usage=9 13",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            (
+                "q",
+                "SELECT mean(usage) INTO cpu_downsampled FROM cpu \
+                WHERE time >= '1970-01-01T00:00:00Z' AND time < '1970-01-01T00:00:20Z' \
+                GROUP BY time(10s), host",
+            ),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    // the empty window for host b is not written:
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "written": 3}])
+    );
+
+    // the GROUP BY tags are preserved, while the tags that were not grouped by are not:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT * FROM cpu_downsampled"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([
+            {
+                "iox::measurement": "cpu_downsampled",
+                "time": "1970-01-01T00:00:00",
+                "host": "a",
+                "mean": 2.0
+            },
+            {
+                "iox::measurement": "cpu_downsampled",
+                "time": "1970-01-01T00:00:10",
+                "host": "a",
+                "mean": 5.0
+            },
+            {
+                "iox::measurement": "cpu_downsampled",
+                "time": "1970-01-01T00:00:10",
+                "host": "b",
+                "mean": 8.0
+            }
+        ])
+    );
+
+    // the target can be in another retention policy:
+    let resp = server
+        .api_v3_query_influxql(&[
+            (
+                "q",
+                "SELECT usage INTO foo.archive.cpu_copy FROM cpu WHERE host = 'b'",
+            ),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "written": 2}])
+    );
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT usage FROM foo.archive.cpu_copy"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([
+            {"iox::measurement": "cpu_copy", "time": "1970-01-01T00:00:12", "usage": 7.0},
+            {"iox::measurement": "cpu_copy", "time": "1970-01-01T00:00:13", "usage": 9.0}
+        ])
+    );
+}
+
+#[tokio::test]
+async fn api_v3_query_influxql_delete() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a,region=us usage=1 1\n\
+            cpu,host=a,region=eu usage=2 2\n\
+            cpu,host=a,region=us usage=3 3\n\
+            cpu,host=b,region=us usage=4 1\n\
+            cpu,host=b,region=us usage=5 2\n\
+            mem,host=a used=6 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let delete = |q: &'static str| {
+        let server = &server;
+        async move {
+            server
+                .api_v3_query_influxql(&[("q", q), ("db", "foo"), ("format", "json")])
+                .await
+                .json::<Value>()
+                .await
+                .unwrap()
+        }
+    };
+
+    let resp = delete(
+        "DELETE FROM cpu WHERE host = 'a' AND region = 'us' AND time < '1970-01-01T00:00:03Z'",
+    )
+    .await;
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 1}])
+    );
+
+    // deleting points that do not exist, including those that were already deleted, has no
+    // effect:
+    for q in [
+        "DELETE FROM cpu WHERE host = 'c'",
+        "DELETE FROM cpu WHERE host = 'a' AND region = 'us' AND time = 1000000000",
+        "DELETE FROM cpu WHERE usage = '1'",
+        "DELETE FROM disk",
+    ] {
+        assert_eq!(
+            delete(q).await,
+            json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 0}]),
+            "query: {q}"
+        );
+    }
+
+    // a delete without FROM applies to every measurement:
+    assert_eq!(
+        delete("DELETE WHERE host = 'b'").await,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 2}])
+    );
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT host, region, usage FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([
+            {
+                "iox::measurement": "cpu",
+                "time": "1970-01-01T00:00:02",
+                "host": "a",
+                "region": "eu",
+                "usage": 2.0
+            },
+            {
+                "iox::measurement": "cpu",
+                "time": "1970-01-01T00:00:03",
+                "host": "a",
+                "region": "us",
+                "usage": 3.0
+            }
+        ])
+    );
+
+    // other measurements are not affected by deletes from the measurement:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT used FROM mem"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "mem", "time": "1970-01-01T00:00:01", "used": 6.0}])
+    );
+
+    // a whole measurement can be deleted:
+    assert_eq!(
+        delete("DELETE FROM cpu").await,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 2}])
+    );
+
+    // points written after a delete are not deleted by it, even if they match its predicate:
+    server
+        .write_lp_to_db("foo", "cpu,host=a,region=us usage=7 1", Precision::Second)
+        .await
+        .unwrap();
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT host, region, usage FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{
+            "iox::measurement": "cpu",
+            "time": "1970-01-01T00:00:01",
+            "host": "a",
+            "region": "us",
+            "usage": 7.0
+        }])
+    );
+}
+
+#[tokio::test]
+async fn api_v3_delete_series() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a,region=us usage=1 1\n\
+            cpu,host=a,region=eu usage=2 2\n\
+            cpu,host=b,region=us usage=3 1\n\
+            cpu,host=b,region=us usage=4 2\n\
+            cpu,host=c,region=us usage=5 1\n\
+            mem,host=a used=6 1\n\
+            disk,host=a free=7 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let client = reqwest::Client::new();
+    let delete_series = |selectors: Value| {
+        client
+            .post(format!(
+                "{base}/api/v3/delete_series",
+                base = server.client_addr()
+            ))
+            .query(&[("db", "foo")])
+            .json(&selectors)
+            .send()
+    };
+
+    let selectors = json!([
+        {"measurement": "cpu", "tags": {"host": "a", "region": "us"}},
+        {"measurement": "cpu", "tags": {"host": "b"}},
+        {"measurement": "mem"},
+        // selectors that match nothing:
+        {"measurement": "cpu", "tags": {"host": "d"}},
+        {"measurement": "cpu", "tags": {"zone": "a"}},
+        {"measurement": "net"}
+    ]);
+    let resp = delete_series(selectors.clone()).await.unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([
+            {"measurement": "cpu", "tags": {"host": "a", "region": "us"}, "points": 1},
+            {"measurement": "cpu", "tags": {"host": "b"}, "points": 2},
+            {"measurement": "mem", "tags": {}, "points": 1},
+            {"measurement": "cpu", "tags": {"host": "d"}, "points": 0},
+            {"measurement": "cpu", "tags": {"zone": "a"}, "points": 0},
+            {"measurement": "net", "tags": {}, "points": 0}
+        ])
+    );
+
+    // deleting the same series again deletes nothing:
+    let resp = delete_series(selectors).await.unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    let counts = resp.json::<Value>().await.unwrap();
+    assert!(
+        counts
+            .as_array()
+            .unwrap()
+            .iter()
+            .all(|deleted| deleted["points"] == 0),
+        "unexpected counts: {counts}"
+    );
+
+    // only the series that were not selected remain:
+    for (query, expected) in [
+        (
+            "SELECT host, region, usage FROM cpu",
+            json!([
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:01", "host": "c", "region": "us", "usage": 5.0},
+                {"iox::measurement": "cpu", "time": "1970-01-01T00:00:02", "host": "a", "region": "eu", "usage": 2.0}
+            ]),
+        ),
+        ("SELECT used FROM mem", json!([])),
+        (
+            "SELECT free FROM disk",
+            json!([{"iox::measurement": "disk", "time": "1970-01-01T00:00:01", "free": 7.0}]),
+        ),
+    ] {
+        let resp = server
+            .api_v3_query_influxql(&[("q", query), ("db", "foo"), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap();
+        assert_eq!(resp, expected, "query: {query}");
+    }
+
+    // the database must exist:
+    let resp = client
+        .post(format!(
+            "{base}/api/v3/delete_series",
+            base = server.client_addr()
+        ))
+        .query(&[("db", "bar")])
+        .json(&json!([{"measurement": "cpu"}]))
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::NOT_FOUND);
+}
+
+#[tokio::test]
+async fn api_v3_rename_table() {
+    let server = TestServer::spawn().await;
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.5 1\n\
+            cpu,host=b usage=0.9 2\n\
+            mem,host=a used=6 1",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let client = reqwest::Client::new();
+    let rename = |table: &'static str, new_name: &'static str| {
+        client
+            .post(format!(
+                "{base}/api/v3/rename_table",
+                base = server.client_addr()
+            ))
+            .query(&[("db", "foo"), ("table", table), ("new_name", new_name)])
+            .send()
+    };
+
+    let resp = rename("cpu", "cpu_old").await.unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    // the data is queried under the new name:
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT host, usage FROM cpu_old ORDER BY host"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([
+            {"host": "a", "usage": 0.5},
+            {"host": "b", "usage": 0.9},
+        ])
+    );
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            ("q", "SELECT host, usage FROM cpu_old"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([
+            {"iox::measurement": "cpu_old", "time": "1970-01-01T00:00:01", "host": "a", "usage": 0.5},
+            {"iox::measurement": "cpu_old", "time": "1970-01-01T00:00:02", "host": "b", "usage": 0.9},
+        ])
+    );
+
+    // and the old name is gone:
+    let resp = server
+        .api_v3_query_sql(&[("db", "foo"), ("q", "SELECT * FROM cpu")])
+        .await;
+    assert!(!resp.status().is_success());
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            ("q", "SHOW MEASUREMENTS"),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([
+            {"iox::measurement": "measurements", "name": "cpu_old"},
+            {"iox::measurement": "measurements", "name": "mem"},
+        ])
+    );
+
+    // a table cannot be renamed to the name of another table, or if it does not exist:
+    let resp = rename("mem", "cpu_old").await.unwrap();
+    assert_eq!(resp.status(), StatusCode::CONFLICT);
+    let resp = rename("cpu", "cpu_new").await.unwrap();
+    assert_eq!(resp.status(), StatusCode::NOT_FOUND);
+    let resp = rename("mem", "").await.unwrap();
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn api_v3_maintenance_compact() {
+    let server = TestServer::spawn().await;
+
+    let lp = (0..1000)
+        .map(|i| format!("cpu,host=h{h} usage={i} {i}", h = i % 10))
+        .collect::<Vec<_>>()
+        .join("\n");
+    server
+        .write_lp_to_db("foo", lp, Precision::Second)
+        .await
+        .unwrap();
+
+    let resp = server
+        .api_v3_query_influxql(&[("q", "DELETE FROM cpu"), ("db", "foo"), ("format", "json")])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 1000}])
+    );
+
+    let resp = reqwest::Client::new()
+        .post(format!(
+            "{base}/api/v3/maintenance/compact",
+            base = server.client_addr()
+        ))
+        .send()
+        .await
+        .unwrap();
+    assert_eq!(resp.status(), StatusCode::OK);
+    // nothing has been persisted yet, so there are no files to remove:
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "segments_rewritten": 0,
+            "files_rewritten": 0,
+            "deletes_applied": 0,
+            "files_removed": 0,
+            "rows_removed": 0,
+            "bytes_removed": 0
+        })
+    );
+
+    // the deleted data remains deleted after compacting:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT usage FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(resp, json!([]));
+}
+
+#[tokio::test]
+async fn api_v3_query_escaped_names() {
+    let server = TestServer::spawn().await;
+
+    // the space in the measurement name and tag key are escaped in line protocol:
+    server
+        .write_lp_to_db(
+            "foo",
+            "my\\ cpu.load,host\\ name=a usage=0.5 1\n\
+            my\\ cpu.load,host\\ name=b usage=0.9 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            (
+                "q",
+                "SELECT \"host name\", usage FROM \"my cpu.load\" ORDER BY time",
+            ),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([
+            {"host name": "a", "usage": 0.5},
+            {"host name": "b", "usage": 0.9}
+        ])
+    );
+
+    // the database and retention policy may qualify the quoted measurement:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            (
+                "q",
+                "SELECT \"host name\", usage FROM \"foo\".\"autogen\".\"my cpu.load\" \
+                WHERE \"host name\" = 'b'",
+            ),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{
+            "iox::measurement": "my cpu.load",
+            "time": "1970-01-01T00:00:02",
+            "host name": "b",
+            "usage": 0.9
+        }])
+    );
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            (
+                "q",
+                "DELETE FROM \"foo\".\"autogen\".\"my cpu.load\" WHERE \"host name\" = 'a'",
+            ),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "result", "time": "1970-01-01T00:00:00", "deleted": 1}])
+    );
+
+    // a qualified measurement in another database is rejected:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("db", "foo"),
+            ("q", "DELETE FROM \"bar\"..\"my cpu.load\""),
+            ("format", "json"),
+        ])
+        .await;
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+}
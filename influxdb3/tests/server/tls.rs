@@ -0,0 +1,49 @@
+use influxdb3_client::Precision;
+use pretty_assertions::assert_eq;
+use serde_json::{json, Value};
+
+use crate::TestServer;
+
+#[tokio::test]
+async fn api_v3_query_over_https() {
+    let server = TestServer::configure().tls().spawn().await;
+    assert!(server.client_addr().starts_with("https://"));
+
+    server
+        .write_lp_to_db(
+            "foo",
+            "cpu,host=a usage=0.5 1\n\
+            cpu,host=b usage=0.9 2",
+            Precision::Second,
+        )
+        .await
+        .unwrap();
+
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT host, usage FROM cpu ORDER BY host"),
+            ("format", "json"),
+        ])
+        .await;
+    assert!(resp.status().is_success());
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!([
+            {"host": "a", "usage": 0.5},
+            {"host": "b", "usage": 0.9},
+        ])
+    );
+
+    // the client must be told to accept the self-signed certificate:
+    let client = influxdb3_client::Client::new(server.client_addr()).unwrap();
+    assert!(client.ping().await.is_err());
+    let client = client.with_insecure_skip_verify().unwrap();
+    client.ping().await.unwrap();
+
+    // plaintext requests are not served:
+    let plaintext_addr = server.client_addr().replacen("https://", "http://", 1);
+    assert!(reqwest::get(format!("{plaintext_addr}/health"))
+        .await
+        .is_err());
+}
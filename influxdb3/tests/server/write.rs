@@ -1,5 +1,9 @@
+use std::time::Duration;
+
 use hyper::StatusCode;
+use influxdb3_client::Precision;
 use pretty_assertions::assert_eq;
+use serde_json::{json, Value};
 
 use crate::TestServer;
 
@@ -272,3 +276,585 @@ async fn api_v2_write_round_trip() {
         +------------------+-------------------------------+------+-------+"
     );
 }
+
+#[tokio::test]
+async fn api_v3_write_idempotency_key() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    // the line has no timestamp, so each time it is written it gets a new point:
+    let write = |key: &'static str| {
+        client
+            .post(&write_url)
+            .query(&[("db", "foo")])
+            .header("X-Influxdb-Idempotency-Key", key)
+            .body("cpu,host=a usage=0.5")
+            .send()
+    };
+
+    for key in ["a", "a", "b"] {
+        let resp = write(key).await.expect("send /api/v3/write_lp request");
+        assert_eq!(resp.status(), StatusCode::OK);
+    }
+
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT COUNT(usage) FROM cpu"),
+            ("db", "foo"),
+            ("format", "pretty"),
+        ])
+        .await
+        .text()
+        .await
+        .unwrap();
+
+    // the retry with key "a" is not written again:
+    assert_eq!(
+        resp,
+        "+------------------+---------------------+-------+\n\
+        | iox::measurement | time                | count |\n\
+        +------------------+---------------------+-------+\n\
+        | cpu              | 1970-01-01T00:00:00 | 2     |\n\
+        +------------------+---------------------+-------+"
+    );
+}
+
+#[tokio::test]
+async fn api_v3_write_dry_run() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    server
+        .write_lp_to_db("foo", "cpu,host=a usage=0.5 1", Precision::Nanosecond)
+        .await
+        .unwrap();
+
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo"), ("dry", "true"), ("precision", "nanosecond")])
+        .body(
+            "cpu,host=b usage=0.6 2\n\
+            cpu,host=b usage= 3\n\
+            mem,host=b used=1i,free=2i 2",
+        )
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    let report = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        report,
+        json!({
+            "line_count": 2,
+            "field_count": 3,
+            "tag_count": 2,
+            "invalid_lines": [
+                {
+                    "original_line": "cpu,host=b usage= 3",
+                    "line_number": 2,
+                    "error_message": "No fields were provided"
+                }
+            ]
+        })
+    );
+
+    // nothing from the dry run was written:
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SELECT COUNT(usage) FROM cpu"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "cpu", "time": "1970-01-01T00:00:00", "count": 1}])
+    );
+    let resp = server
+        .api_v3_query_influxql(&[
+            ("q", "SHOW MEASUREMENTS"),
+            ("db", "foo"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(
+        resp,
+        json!([{"iox::measurement": "measurements", "name": "cpu"}])
+    );
+}
+
+#[tokio::test]
+async fn api_v3_import() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let import_url = format!("{base}/api/v3/import", base = server.client_addr());
+
+    // the body is large enough to be written in several batches, with an invalid line in a
+    // later batch, to check that it is numbered from the start of the body:
+    let n_lines = 50_000;
+    let invalid_line = 40_000;
+    let body = (1..=n_lines)
+        .map(|i| {
+            if i == invalid_line {
+                "cpu,host=a usage= 1\n".to_string()
+            } else {
+                format!("cpu,host=h{host} usage={i}i {i}\n", host = i % 10)
+            }
+        })
+        .collect::<String>();
+    assert!(body.len() > 1024 * 1024);
+
+    let resp = client
+        .post(&import_url)
+        .query(&[("db", "foo"), ("precision", "second")])
+        .body(body)
+        .send()
+        .await
+        .expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "lines": n_lines,
+            "written": n_lines - 1,
+            "invalid": 1,
+            "errors": [
+                {
+                    "original_line": "cpu,host=a usage= 1",
+                    "line_number": invalid_line,
+                    "error_message": "No fields were provided"
+                }
+            ]
+        })
+    );
+
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT COUNT(*) AS n, SUM(usage) AS total FROM cpu"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    let total = (1..=n_lines).sum::<i64>() - invalid_line;
+    assert_eq!(resp, json!([{"n": n_lines - 1, "total": total}]));
+
+    // a body with only valid lines is accepted:
+    let resp = client
+        .post(&import_url)
+        .query(&[("db", "foo")])
+        .body("mem,host=a used=1i 1\nmem,host=a used=2i 2")
+        .send()
+        .await
+        .expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({"lines": 2, "written": 2, "invalid": 0, "errors": []})
+    );
+}
+
+#[tokio::test]
+async fn api_v3_import_multiple_measurements() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let import_url = format!("{base}/api/v3/import", base = server.client_addr());
+
+    async fn count_rows(server: &TestServer, table: &str) -> Value {
+        let query = format!("SELECT COUNT(*) AS n FROM {table}");
+        server
+            .api_v3_query_sql(&[("db", "foo"), ("q", query.as_str()), ("format", "json")])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap()
+    }
+
+    // the lines either side of the invalid line are written:
+    let resp = client
+        .post(&import_url)
+        .query(&[("db", "foo"), ("precision", "second")])
+        .body(
+            "cpu,host=a usage=1 1\n\
+            mem,host=a used=2i 1\n\
+            cpu,host=a usage= 2\n\
+            mem,host=a used=3i 2\n\
+            cpu,host=a usage=4 3",
+        )
+        .send()
+        .await
+        .expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "lines": 5,
+            "written": 4,
+            "invalid": 1,
+            "errors": [
+                {
+                    "original_line": "cpu,host=a usage= 2",
+                    "line_number": 3,
+                    "error_message": "No fields were provided"
+                }
+            ]
+        })
+    );
+    assert_eq!(count_rows(&server, "cpu").await, json!([{"n": 2}]));
+    assert_eq!(count_rows(&server, "mem").await, json!([{"n": 2}]));
+
+    // in strict mode, nothing is written if any line is invalid:
+    let resp = client
+        .post(&import_url)
+        .query(&[
+            ("db", "foo"),
+            ("precision", "second"),
+            ("accept_partial", "false"),
+        ])
+        .body(
+            "cpu,host=b usage=5 4\n\
+            mem,host=b used= 4\n\
+            mem,host=b used=6i 5",
+        )
+        .send()
+        .await
+        .expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({
+            "lines": 3,
+            "written": 0,
+            "invalid": 1,
+            "errors": [
+                {
+                    "original_line": "mem,host=b used= 4",
+                    "line_number": 2,
+                    "error_message": "No fields were provided"
+                }
+            ]
+        })
+    );
+    assert_eq!(count_rows(&server, "cpu").await, json!([{"n": 2}]));
+    assert_eq!(count_rows(&server, "mem").await, json!([{"n": 2}]));
+
+    let resp = client
+        .post(&import_url)
+        .query(&[
+            ("db", "foo"),
+            ("precision", "second"),
+            ("accept_partial", "false"),
+        ])
+        .body("cpu,host=b usage=5 4\nmem,host=b used=6i 5")
+        .send()
+        .await
+        .expect("send /api/v3/import request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(
+        resp.json::<Value>().await.unwrap(),
+        json!({"lines": 2, "written": 2, "invalid": 0, "errors": []})
+    );
+    assert_eq!(count_rows(&server, "cpu").await, json!([{"n": 3}]));
+    assert_eq!(count_rows(&server, "mem").await, json!([{"n": 3}]));
+}
+
+#[tokio::test]
+async fn api_v3_write_stream() {
+    let server = TestServer::spawn().await;
+    let (tx, rx) = futures::channel::mpsc::unbounded::<Result<String, std::io::Error>>();
+    let request = tokio::spawn(
+        reqwest::Client::new()
+            .post(format!(
+                "{base}/api/v3/write_stream",
+                base = server.client_addr()
+            ))
+            .query(&[("db", "foo"), ("precision", "second")])
+            .body(reqwest::Body::wrap_stream(rx))
+            .send(),
+    );
+
+    // each chunk is written as soon as it is received, including a line split across chunks:
+    let chunks = [
+        "cpu,host=a usage=1 1\ncpu,host=a usage=2 2\ncpu,host=a us",
+        "age=3 3\ncpu,host=a usage= 4\n",
+        "cpu,host=a usage=5 5\n",
+    ];
+    for (chunk, rows) in chunks.into_iter().zip([2, 3, 4]) {
+        tx.unbounded_send(Ok(chunk.to_string())).unwrap();
+        let mut written = Value::Null;
+        for _ in 0..100 {
+            written = server
+                .api_v3_query_sql(&[
+                    ("db", "foo"),
+                    ("q", "SELECT COUNT(*) AS n FROM cpu"),
+                    ("format", "json"),
+                ])
+                .await
+                .json::<Value>()
+                .await
+                .unwrap();
+            if written == json!([{"n": rows}]) {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        assert_eq!(written, json!([{"n": rows}]), "chunk not written: {chunk}");
+    }
+    drop(tx);
+
+    let resp = request
+        .await
+        .unwrap()
+        .expect("send /api/v3/write_stream request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(resp.headers()["Content-Type"], "application/x-ndjson");
+    let acks = resp
+        .text()
+        .await
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str::<Value>(line).unwrap())
+        .collect::<Vec<_>>();
+    assert_eq!(
+        acks,
+        [
+            json!({"lines": 2, "written": 2, "invalid": 0, "errors": []}),
+            json!({
+                "lines": 4,
+                "written": 3,
+                "invalid": 1,
+                "errors": [
+                    {
+                        "original_line": "cpu,host=a usage= 4",
+                        "line_number": 4,
+                        "error_message": "No fields were provided"
+                    }
+                ]
+            }),
+            json!({"lines": 5, "written": 4, "invalid": 1, "errors": []}),
+        ]
+    );
+}
+
+#[tokio::test]
+async fn api_v3_write_enforce_field_types() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    let resp = client
+        .post(format!(
+            "{base}/api/v3/configure/database",
+            base = server.client_addr()
+        ))
+        .query(&[("db", "foo"), ("enforce_field_types", "true")])
+        .send()
+        .await
+        .expect("send /api/v3/configure/database request");
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu value=100 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo"), ("accept_partial", "false")])
+        .body("cpu value=\"foo\" 2")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::CONFLICT);
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        body,
+        json!({
+            "error": "column type mismatch for column value: existing: F64, new: String",
+            "data": null
+        })
+    );
+
+    // a partial write only rejects the lines with a conflicting type:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu value=\"foo\" 2\ncpu value=200 3")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        body,
+        json!({
+            "error": "partial write of line protocol occurred",
+            "data": [{
+                "original_line": "cpu value=\"foo\" 2",
+                "line_number": 1,
+                "error_message": "column type mismatch for column value: existing: F64, new: String"
+            }]
+        })
+    );
+
+    // without enforcement, a line with a conflicting type is still invalid:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "bar"), ("accept_partial", "false")])
+        .body("cpu value=100 1\ncpu value=\"foo\" 2")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+
+    let resp = server
+        .api_v3_query_sql(&[
+            ("db", "foo"),
+            ("q", "SELECT value FROM cpu ORDER BY time"),
+            ("format", "json"),
+        ])
+        .await
+        .json::<Value>()
+        .await
+        .unwrap();
+    assert_eq!(resp, json!([{"value": 100.0}, {"value": 200.0}]));
+}
+
+#[tokio::test]
+async fn api_v3_write_max_series() {
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    let resp = client
+        .post(format!(
+            "{base}/api/v3/configure/database",
+            base = server.client_addr()
+        ))
+        .query(&[("db", "foo"), ("max_series", "2")])
+        .send()
+        .await
+        .expect("send /api/v3/configure/database request");
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=a usage=0.5 1\ncpu,host=b usage=0.9 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+
+    // a write to a new series is rejected:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=c usage=0.1 2")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+    let body = resp.json::<Value>().await.unwrap();
+    assert_eq!(
+        body,
+        json!({
+            "error": "partial write of line protocol occurred",
+            "data": [{
+                "original_line": "cpu,host=c usage=0.1 2",
+                "line_number": 1,
+                "error_message": "write would create a new series, exceeding the limit of 2 \
+                    series in database foo"
+            }]
+        })
+    );
+
+    // while writes to the existing series are still accepted:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=a usage=0.6 2")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+}
+
+#[tokio::test]
+async fn api_v3_write_no_sync() {
+    async fn count(server: &TestServer) -> Value {
+        server
+            .api_v3_query_sql(&[
+                ("db", "foo"),
+                ("q", "SELECT COUNT(*) AS n FROM cpu"),
+                ("format", "json"),
+            ])
+            .await
+            .json::<Value>()
+            .await
+            .unwrap()
+    }
+
+    let server = TestServer::spawn().await;
+    let client = reqwest::Client::new();
+    let write_url = format!("{base}/api/v3/write_lp", base = server.client_addr());
+
+    // by default a write is queryable as soon as it is acknowledged:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo")])
+        .body("cpu,host=a usage=0.5 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    assert_eq!(count(&server).await, json!([{"n": 1}]));
+
+    // a write without syncing is acknowledged before it is applied, so becomes queryable
+    // shortly afterwards:
+    let resp = client
+        .post(&write_url)
+        .query(&[("db", "foo"), ("no_sync", "true")])
+        .body("cpu,host=b usage=0.9 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::OK);
+    let mut n = count(&server).await;
+    for _ in 0..50 {
+        if n == json!([{"n": 2}]) {
+            break;
+        }
+        tokio::time::sleep(std::time::Duration::from_millis(20)).await;
+        n = count(&server).await;
+    }
+    assert_eq!(n, json!([{"n": 2}]));
+
+    // lines are still validated before the write is acknowledged:
+    let resp = client
+        .post(&write_url)
+        .query(&[
+            ("db", "foo"),
+            ("no_sync", "true"),
+            ("accept_partial", "false"),
+        ])
+        .body("cpu,host=c usage= 1")
+        .send()
+        .await
+        .expect("send /api/v3/write_lp request");
+    assert_eq!(resp.status(), StatusCode::BAD_REQUEST);
+}
@@ -0,0 +1,324 @@
+//! Building writes from typed points, which are encoded as line protocol
+
+use std::collections::BTreeMap;
+use std::fmt::{Display, Write};
+
+use crate::Precision;
+
+/// A batch of [`Point`]s to be sent to the server in a single write
+///
+/// # Example
+/// ```
+/// # use influxdb3_client::{Batch, Point};
+/// let mut batch = Batch::new();
+/// batch.add(
+///     Point::new("cpu")
+///         .tag("host", "a")
+///         .field("usage", 0.5)
+///         .timestamp(1),
+/// );
+/// assert_eq!(batch.to_line_protocol(), "cpu,host=a usage=0.5 1\n");
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct Batch {
+    points: Vec<Point>,
+    precision: Option<Precision>,
+}
+
+impl Batch {
+    /// Create an empty [`Batch`]
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Create an empty [`Batch`] with room for `capacity` points before reallocating
+    pub fn with_capacity(capacity: usize) -> Self {
+        Self {
+            points: Vec::with_capacity(capacity),
+            precision: None,
+        }
+    }
+
+    /// Set the precision of the timestamps of the points in the batch
+    ///
+    /// This is used as the precision of the write when the batch is sent with
+    /// [`WriteRequestBuilder::batch`][crate::WriteRequestBuilder::batch].
+    pub fn precision(mut self, precision: Precision) -> Self {
+        self.precision = Some(precision);
+        self
+    }
+
+    /// Add a [`Point`] to the batch
+    pub fn add(&mut self, point: Point) -> &mut Self {
+        self.points.push(point);
+        self
+    }
+
+    /// Get the [`Point`]s in the batch
+    pub fn points(&self) -> &[Point] {
+        &self.points
+    }
+
+    /// The number of points in the batch
+    pub fn len(&self) -> usize {
+        self.points.len()
+    }
+
+    /// Whether there are no points in the batch
+    pub fn is_empty(&self) -> bool {
+        self.points.is_empty()
+    }
+
+    pub(crate) fn get_precision(&self) -> Option<Precision> {
+        self.precision
+    }
+
+    /// Encode the points in the batch as line protocol, with one line per point
+    pub fn to_line_protocol(&self) -> String {
+        let mut lp = String::new();
+        self.write_line_protocol(&mut lp)
+            .expect("writing to a String does not fail");
+        lp
+    }
+
+    /// Encode the points in the batch as line protocol into the given writer, with one line per
+    /// point
+    pub fn write_line_protocol<W: Write>(&self, w: &mut W) -> std::fmt::Result {
+        for point in &self.points {
+            writeln!(w, "{point}")?;
+        }
+        Ok(())
+    }
+}
+
+impl FromIterator<Point> for Batch {
+    fn from_iter<I: IntoIterator<Item = Point>>(iter: I) -> Self {
+        Self {
+            points: iter.into_iter().collect(),
+            precision: None,
+        }
+    }
+}
+
+impl Extend<Point> for Batch {
+    fn extend<I: IntoIterator<Item = Point>>(&mut self, iter: I) {
+        self.points.extend(iter)
+    }
+}
+
+/// A single point to be written, made up of a measurement name, tags, fields, and an optional
+/// timestamp
+///
+/// A point must have at least one field to be accepted by the server. Points without a
+/// timestamp are given the time at which the server receives the write.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Point {
+    measurement: String,
+    tags: BTreeMap<String, String>,
+    fields: BTreeMap<String, FieldValue>,
+    timestamp: Option<i64>,
+}
+
+impl Point {
+    /// Create a new [`Point`] in the given measurement
+    pub fn new<M: Into<String>>(measurement: M) -> Self {
+        Self {
+            measurement: measurement.into(),
+            tags: BTreeMap::new(),
+            fields: BTreeMap::new(),
+            timestamp: None,
+        }
+    }
+
+    /// Set the value of a tag, replacing any previous value for the same key
+    pub fn tag<K: Into<String>, V: Into<String>>(mut self, key: K, value: V) -> Self {
+        self.tags.insert(key.into(), value.into());
+        self
+    }
+
+    /// Set the value of a field, replacing any previous value for the same key
+    pub fn field<K: Into<String>, V: Into<FieldValue>>(mut self, key: K, value: V) -> Self {
+        self.fields.insert(key.into(), value.into());
+        self
+    }
+
+    /// Set the timestamp, in the precision of the write
+    pub fn timestamp(mut self, timestamp: i64) -> Self {
+        self.timestamp = Some(timestamp);
+        self
+    }
+}
+
+impl Display for Point {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write_escaped(f, &self.measurement, &[',', ' '])?;
+        for (key, value) in &self.tags {
+            f.write_char(',')?;
+            write_escaped(f, key, &[',', '=', ' '])?;
+            f.write_char('=')?;
+            write_escaped(f, value, &[',', '=', ' '])?;
+        }
+        for (i, (key, value)) in self.fields.iter().enumerate() {
+            f.write_char(if i == 0 { ' ' } else { ',' })?;
+            write_escaped(f, key, &[',', '=', ' '])?;
+            write!(f, "={value}")?;
+        }
+        if let Some(timestamp) = self.timestamp {
+            write!(f, " {timestamp}")?;
+        }
+        Ok(())
+    }
+}
+
+/// The value of a field in a [`Point`]
+#[derive(Debug, Clone, PartialEq)]
+pub enum FieldValue {
+    Float(f64),
+    Integer(i64),
+    UInteger(u64),
+    String(String),
+    Boolean(bool),
+}
+
+impl Display for FieldValue {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            // `{:?}` always includes a decimal point or exponent, so floats that are whole
+            // numbers are not mistaken for integers:
+            Self::Float(v) => write!(f, "{v:?}"),
+            Self::Integer(v) => write!(f, "{v}i"),
+            Self::UInteger(v) => write!(f, "{v}u"),
+            Self::String(v) => {
+                f.write_char('"')?;
+                write_escaped(f, v, &['"', '\\'])?;
+                f.write_char('"')
+            }
+            Self::Boolean(v) => write!(f, "{v}"),
+        }
+    }
+}
+
+impl From<f64> for FieldValue {
+    fn from(value: f64) -> Self {
+        Self::Float(value)
+    }
+}
+
+impl From<i64> for FieldValue {
+    fn from(value: i64) -> Self {
+        Self::Integer(value)
+    }
+}
+
+impl From<u64> for FieldValue {
+    fn from(value: u64) -> Self {
+        Self::UInteger(value)
+    }
+}
+
+impl From<bool> for FieldValue {
+    fn from(value: bool) -> Self {
+        Self::Boolean(value)
+    }
+}
+
+impl From<String> for FieldValue {
+    fn from(value: String) -> Self {
+        Self::String(value)
+    }
+}
+
+impl From<&str> for FieldValue {
+    fn from(value: &str) -> Self {
+        Self::String(value.to_string())
+    }
+}
+
+/// Write `s`, escaping each of the `special` characters with a backslash
+fn write_escaped<W: Write>(w: &mut W, s: &str, special: &[char]) -> std::fmt::Result {
+    for c in s.chars() {
+        if special.contains(&c) {
+            w.write_char('\\')?;
+        }
+        w.write_char(c)?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{Batch, FieldValue, Point};
+
+    #[test]
+    fn encode_line_protocol() {
+        let mut batch = Batch::new();
+        batch
+            .add(
+                Point::new("cpu")
+                    .tag("region", "us-east")
+                    .tag("host", "a")
+                    .field("usage", 0.5)
+                    .field("cores", 4_i64)
+                    .field("uptime", 10_u64)
+                    .field("ok", true)
+                    .field("status", "fine")
+                    .timestamp(123),
+            )
+            .add(Point::new("mem").field("used", 1.0));
+
+        assert_eq!(
+            batch.to_line_protocol(),
+            "cpu,host=a,region=us-east cores=4i,ok=true,status=\"fine\",uptime=10u,usage=0.5 123\n\
+            mem used=1.0\n"
+        );
+    }
+
+    #[test]
+    fn encode_escaped() {
+        struct TestCase {
+            point: Point,
+            expected: &'static str,
+        }
+
+        let test_cases = [
+            TestCase {
+                point: Point::new("my cpu,total").field("v", 1_i64),
+                expected: r"my\ cpu\,total v=1i",
+            },
+            TestCase {
+                point: Point::new("cpu")
+                    .tag("host name", "a,b=c")
+                    .field("v", 1_i64),
+                expected: r"cpu,host\ name=a\,b\=c v=1i",
+            },
+            TestCase {
+                point: Point::new("cpu").field("the,usage=", 1_i64),
+                expected: r"cpu the\,usage\==1i",
+            },
+            TestCase {
+                point: Point::new("cpu").field("msg", r#"say "hi", \o/"#),
+                expected: r#"cpu msg="say \"hi\", \\o/""#,
+            },
+            TestCase {
+                point: Point::new("cpu").field("msg", FieldValue::String("a = b".into())),
+                expected: r#"cpu msg="a = b""#,
+            },
+        ];
+
+        for t in test_cases {
+            assert_eq!(t.point.to_string(), t.expected);
+        }
+    }
+
+    #[test]
+    fn collect_points() {
+        let batch: Batch = (0..3)
+            .map(|i| Point::new("cpu").field("v", i).timestamp(i))
+            .collect();
+        assert_eq!(batch.len(), 3);
+        assert_eq!(
+            batch.to_line_protocol(),
+            "cpu v=0i 0\ncpu v=1i 1\ncpu v=2i 2\n"
+        );
+    }
+}
@@ -1,18 +1,38 @@
-use std::{collections::HashMap, fmt::Display, string::FromUtf8Error};
+use std::{
+    collections::HashMap,
+    fmt::Display,
+    future::Future,
+    num::NonZeroUsize,
+    pin::pin,
+    string::FromUtf8Error,
+    task::Poll,
+    time::{Duration, Instant},
+};
 
 use bytes::Bytes;
 use iox_query_params::StatementParam;
-use reqwest::{Body, IntoUrl, StatusCode};
+use reqwest::{header::HeaderMap, Body, IntoUrl, StatusCode};
 use secrecy::{ExposeSecret, Secret};
 use serde::{Deserialize, Serialize};
+use tokio_util::sync::CancellationToken;
 use url::Url;
 
+mod batch;
+mod proto;
+mod results;
+
+pub use batch::{Batch, FieldValue, Point};
+pub use results::{QueryResults, Row, Series};
+
 /// Primary error type for the [`Client`]
 #[derive(Debug, thiserror::Error)]
 pub enum Error {
     #[error("base URL error: {0}")]
     BaseUrl(#[source] reqwest::Error),
 
+    #[error("failed to build the HTTP client: {0}")]
+    HttpClient(#[source] reqwest::Error),
+
     #[error("request URL error: {0}")]
     RequestUrl(#[from] url::ParseError),
 
@@ -53,10 +73,55 @@ pub enum Error {
 
     #[error("server responded with error [{code}]: {message}")]
     ApiError { code: StatusCode, message: String },
+
+    #[error(
+        "server failed to write {} line(s) [{code}]: {message}",
+        lines.len()
+    )]
+    WriteLines {
+        code: StatusCode,
+        message: String,
+        /// The lines that failed, any other lines were written if `accept_partial` was set
+        lines: Vec<WriteLineError>,
+    },
+
+    #[error("failed to decode JSON query results: {0}")]
+    DecodeResults(#[source] serde_json::Error),
+
+    #[error("failed to decode row {row} of the query results: {source}")]
+    DecodeRow {
+        row: usize,
+        #[source]
+        source: serde_json::Error,
+    },
+
+    #[error("failed to decode protobuf query results: {0}")]
+    DecodeProtobufResults(#[source] prost::DecodeError),
+
+    #[error("the request was cancelled")]
+    Cancelled,
+
+    #[error(
+        "only SQL queries can be paginated, as InfluxQL applies LIMIT and OFFSET to each series"
+    )]
+    PaginatedInfluxQl,
+
+    #[error("value in column '{column}' could not be read as {expected}: {value}")]
+    ColumnValue {
+        column: String,
+        expected: &'static str,
+        value: serde_json::Value,
+    },
 }
 
 pub type Result<T> = std::result::Result<T, Error>;
 
+/// The maximum length of the URL of a query sent in a `GET` request, see
+/// [`Client::with_get_queries`]
+///
+/// This is below the limit that the server has on the length of the query string of a URL.
+pub const MAX_GET_QUERY_URL_LEN: usize = 8 * 1024;
+
 /// The InfluxDB 3.0 Client
 ///
 /// For programmatic access to the HTTP API of InfluxDB 3.0
@@ -64,10 +129,26 @@ pub type Result<T> = std::result::Result<T, Error>;
 pub struct Client {
     /// The base URL for making requests to a running InfluxDB 3.0 server
     base_url: Url,
-    /// The `Bearer` token to use for authenticating on each request to the server
-    auth_token: Option<Secret<String>>,
+    /// The credentials to use for authenticating on each request to the server
+    auth: Option<Authorization>,
     /// A [`reqwest::Client`] for handling HTTP requests
     http_client: reqwest::Client,
+    /// Whether to send queries in `GET` requests, when their URL is short enough
+    get_queries: bool,
+}
+
+/// The credentials that the [`Client`] sends in the `Authorization` header of each request
+#[derive(Debug, Clone)]
+enum Authorization {
+    /// `Authorization: Bearer <token>`
+    Bearer(Secret<String>),
+    /// `Authorization: Token <token>`
+    Token(Secret<String>),
+    /// `Authorization: Basic <credentials>`
+    Basic {
+        username: String,
+        password: Secret<String>,
+    },
 }
 
 impl Client {
@@ -75,8 +156,9 @@ impl Client {
     pub fn new<U: IntoUrl>(base_url: U) -> Result<Self> {
         Ok(Self {
             base_url: base_url.into_url().map_err(Error::BaseUrl)?,
-            auth_token: None,
+            auth: None,
             http_client: reqwest::Client::new(),
+            get_queries: false,
         })
     }
 
@@ -95,10 +177,115 @@ impl Client {
     /// # }
     /// ```
     pub fn with_auth_token<S: Into<String>>(mut self, auth_token: S) -> Self {
-        self.auth_token = Some(Secret::new(auth_token.into()));
+        self.auth = Some(Authorization::Bearer(Secret::new(auth_token.into())));
+        self
+    }
+
+    /// Set the token that will be sent with each request to the server using the `Token` auth
+    /// scheme, i.e., in an `Authorization: Token <token>` header, as used by the v2 API
+    ///
+    /// # Example
+    /// ```
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let token = "secret-token-string";
+    /// let client = Client::new("http://localhost:8181")?
+    ///     .with_token_auth(token);
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn with_token_auth<S: Into<String>>(mut self, token: S) -> Self {
+        self.auth = Some(Authorization::Token(Secret::new(token.into())));
+        self
+    }
+
+    /// Set the HTTP Basic credentials that will be sent with each request to the server
+    ///
+    /// The server authenticates requests using the password as the token, as the v1 API does.
+    ///
+    /// # Example
+    /// ```
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?
+    ///     .with_basic_auth("username", "secret-token-string");
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn with_basic_auth<U: Into<String>, P: Into<String>>(
+        mut self,
+        username: U,
+        password: P,
+    ) -> Self {
+        self.auth = Some(Authorization::Basic {
+            username: username.into(),
+            password: Secret::new(password.into()),
+        });
+        self
+    }
+
+    /// Accept any certificate presented by the server when connecting over HTTPS, including
+    /// self-signed and expired certificates, or those issued for a different host
+    ///
+    /// This leaves connections open to man-in-the-middle attacks, so should only be used for
+    /// testing, or with servers that are reached over a trusted network.
+    ///
+    /// # Example
+    /// ```
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("https://localhost:8181")?
+    ///     .with_insecure_skip_verify()?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn with_insecure_skip_verify(mut self) -> Result<Self> {
+        self.http_client = reqwest::Client::builder()
+            .danger_accept_invalid_certs(true)
+            .build()
+            .map_err(Error::HttpClient)?;
+        Ok(self)
+    }
+
+    /// Send queries in `GET` requests, with their parameters in the URL, rather than in the
+    /// JSON body of `POST` requests
+    ///
+    /// This allows responses to be cached by HTTP caches between the client and the server.
+    /// Queries whose URL would be longer than [`MAX_GET_QUERY_URL_LEN`] are still sent in `POST`
+    /// requests, as URLs that are too long are rejected by the server, or by proxies.
+    ///
+    /// # Example
+    /// ```
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?.with_get_queries();
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn with_get_queries(mut self) -> Self {
+        self.get_queries = true;
         self
     }
 
+    /// Add the `Authorization` header to the request, if credentials were set on the client
+    fn authorize(&self, req: reqwest::RequestBuilder) -> reqwest::RequestBuilder {
+        match &self.auth {
+            Some(Authorization::Bearer(token)) => req.bearer_auth(token.expose_secret()),
+            Some(Authorization::Token(token)) => req.header(
+                reqwest::header::AUTHORIZATION,
+                format!("Token {}", token.expose_secret()),
+            ),
+            Some(Authorization::Basic { username, password }) => {
+                req.basic_auth(username, Some(password.expose_secret()))
+            }
+            None => req,
+        }
+    }
+
     /// Compose a request to the `/api/v3/write_lp` API
     ///
     /// # Example
@@ -125,6 +312,7 @@ impl Client {
             db: db.into(),
             precision: None,
             accept_partial: None,
+            cancel: None,
             body: NoBody,
         }
     }
@@ -157,6 +345,7 @@ impl Client {
             query: query.into(),
             format: None,
             params: None,
+            cancel: None,
         }
     }
 
@@ -188,20 +377,49 @@ impl Client {
             query: query.into(),
             format: None,
             params: None,
+            cancel: None,
         }
     }
 
     /// Send a `/ping` request to the target `influxdb3` server to check its
     /// status and gather `version` and `revision` information
     pub async fn ping(&self) -> Result<PingResponse> {
+        self.send_ping(None).await.map(|(_, resp)| resp)
+    }
+
+    /// Send a `/ping` request to the target `influxdb3` server, failing if no response is
+    /// received within `timeout`, and measure the round-trip time of the request
+    ///
+    /// The round-trip time is the time taken to receive the headers of the response, so is
+    /// useful for diagnosing the latency of the connection to the server.
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use std::time::Duration;
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let (latency, resp) = client.ping_latency(Duration::from_secs(5)).await?;
+    /// println!("influxdb3 {} responded in {latency:?}", resp.version());
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn ping_latency(&self, timeout: Duration) -> Result<(Duration, PingResponse)> {
+        self.send_ping(Some(timeout)).await
+    }
+
+    async fn send_ping(&self, timeout: Option<Duration>) -> Result<(Duration, PingResponse)> {
         let url = self.base_url.join("/ping")?;
-        let mut req = self.http_client.get(url);
-        if let Some(t) = &self.auth_token {
-            req = req.bearer_auth(t.expose_secret());
+        let mut req = self.authorize(self.http_client.get(url));
+        if let Some(timeout) = timeout {
+            req = req.timeout(timeout);
         }
+        let start = Instant::now();
         let resp = req.send().await.map_err(Error::PingSend)?;
+        let latency = start.elapsed();
         if resp.status().is_success() {
-            resp.json().await.map_err(Error::Json)
+            Ok((latency, resp.json().await.map_err(Error::Json)?))
         } else {
             Err(Error::ApiError {
                 code: resp.status(),
@@ -230,6 +448,33 @@ impl PingResponse {
     }
 }
 
+/// The status and headers of a response from the server, for reading those headers that the
+/// client does not otherwise expose, e.g., rate limit headers
+#[derive(Debug, Clone)]
+pub struct ResponseMetadata {
+    status: StatusCode,
+    headers: HeaderMap,
+}
+
+impl ResponseMetadata {
+    /// Get the status code of the response
+    pub fn status(&self) -> StatusCode {
+        self.status
+    }
+
+    /// Get the headers of the response
+    pub fn headers(&self) -> &HeaderMap {
+        &self.headers
+    }
+
+    /// Get the ID that the server assigned to the request, from the `X-Request-Id` header
+    pub fn request_id(&self) -> Option<&str> {
+        self.headers
+            .get("X-Request-Id")
+            .and_then(|id| id.to_str().ok())
+    }
+}
+
 /// The URL parameters of the request to the `/api/v3/write_lp` API
 // TODO - this should re-use a type defined in the server code, or a separate crate,
 //        central to both.
@@ -271,6 +516,7 @@ pub struct WriteRequestBuilder<'c, B> {
     db: String,
     precision: Option<Precision>,
     accept_partial: Option<bool>,
+    cancel: Option<CancellationToken>,
     body: B,
 }
 
@@ -286,6 +532,15 @@ impl<'c, B> WriteRequestBuilder<'c, B> {
         self.accept_partial = Some(set_to);
         self
     }
+
+    /// Abort the request if the given token is cancelled before it completes, in which case
+    /// [`Error::Cancelled`] is returned
+    ///
+    /// The write may or may not have been made if it is cancelled after being sent.
+    pub fn cancel_on(mut self, token: CancellationToken) -> Self {
+        self.cancel = Some(token);
+        self
+    }
 }
 
 impl<'c> WriteRequestBuilder<'c, NoBody> {
@@ -299,9 +554,39 @@ impl<'c> WriteRequestBuilder<'c, NoBody> {
             db: self.db,
             precision: self.precision,
             accept_partial: self.accept_partial,
+            cancel: self.cancel,
             body: body.into(),
         }
     }
+
+    /// Set the body of the request to the line protocol encoding of the given [`Batch`]
+    ///
+    /// The precision of the batch is used for the request, if it was set, unless a precision
+    /// has already been given for the request.
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use influxdb3_client::{Batch, Client, Point, Precision};
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let mut batch = Batch::new().precision(Precision::Second);
+    /// batch.add(Point::new("cpu").tag("host", "s1").field("usage", 0.5).timestamp(1));
+    /// client
+    ///     .api_v3_write_lp("db_name")
+    ///     .batch(&batch)
+    ///     .send()
+    ///     .await
+    ///     .expect("send write_lp request");
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn batch(mut self, batch: &Batch) -> WriteRequestBuilder<'c, Body> {
+        if self.precision.is_none() {
+            self.precision = batch.get_precision();
+        }
+        self.body(batch.to_line_protocol())
+    }
 }
 
 impl<'c> WriteRequestBuilder<'c, Body> {
@@ -309,28 +594,74 @@ impl<'c> WriteRequestBuilder<'c, Body> {
     pub async fn send(self) -> Result<()> {
         let url = self.client.base_url.join("/api/v3/write_lp")?;
         let params = WriteParams::from(&self);
-        let mut req = self.client.http_client.post(url).query(&params);
-        if let Some(token) = &self.client.auth_token {
-            req = req.bearer_auth(token.expose_secret());
-        }
-        let resp = req
-            .body(self.body)
-            .send()
-            .await
-            .map_err(Error::WriteLpSend)?;
-        let status = resp.status();
-        let content = resp.bytes().await.map_err(Error::Bytes)?;
+        let req = self
+            .client
+            .authorize(self.client.http_client.post(url).query(&params))
+            .body(self.body);
+        let (status, content) = cancellable(self.cancel.as_ref(), async {
+            let resp = req.send().await.map_err(Error::WriteLpSend)?;
+            let status = resp.status();
+            Ok((status, resp.bytes().await.map_err(Error::Bytes)?))
+        })
+        .await?;
         match status {
             // TODO - handle the OK response content, return to caller, etc.
             StatusCode::OK => Ok(()),
-            code => Err(Error::ApiError {
-                code,
-                message: String::from_utf8(content.to_vec())?,
-            }),
+            code => match serde_json::from_slice::<WriteErrorResponse>(&content) {
+                Ok(WriteErrorResponse { error, data }) => Err(Error::WriteLines {
+                    code,
+                    message: error,
+                    lines: match data {
+                        WriteErrorData::Many(lines) => lines,
+                        WriteErrorData::One(line) => vec![line],
+                    },
+                }),
+                Err(_) => Err(Error::ApiError {
+                    code,
+                    message: String::from_utf8(content.to_vec())?,
+                }),
+            },
         }
     }
 }
 
+/// A line of a write that the server failed to write
+///
+/// When the write was made from a [`Batch`], each line is a single [`Point`] of the batch, so
+/// [`WriteLineError::point_index`] gives the position of the point that failed.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+pub struct WriteLineError {
+    /// The line as it was sent to the server
+    pub original_line: String,
+    /// The number of the line in the request body, starting from 1
+    pub line_number: usize,
+    /// Why the line could not be written
+    pub error_message: String,
+}
+
+impl WriteLineError {
+    /// The index of the line in the request body, or of the point in a [`Batch`], starting from 0
+    pub fn point_index(&self) -> usize {
+        self.line_number.saturating_sub(1)
+    }
+}
+
+/// The body of an error response from `/api/v3/write_lp` that gives the lines that failed
+#[derive(Debug, Deserialize)]
+struct WriteErrorResponse {
+    error: String,
+    data: WriteErrorData,
+}
+
+/// The server gives all of the lines that failed for a partial write, otherwise it gives the
+/// first line that failed
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum WriteErrorData {
+    Many(Vec<WriteLineError>),
+    One(WriteLineError),
+}
+
 #[doc(hidden)]
 /// Typestate type for [`WriteRequestBuilder`]
 #[derive(Debug, Copy, Clone)]
@@ -347,6 +678,7 @@ pub struct QueryRequestBuilder<'c> {
     query: String,
     format: Option<Format>,
     params: Option<HashMap<String, StatementParam>>,
+    cancel: Option<CancellationToken>,
 }
 
 // TODO - for now the send method just returns the bytes from the response.
@@ -359,6 +691,43 @@ impl<'c> QueryRequestBuilder<'c> {
         self
     }
 
+    /// Abort the request if the given token is cancelled before it completes, in which case
+    /// [`Error::Cancelled`] is returned
+    ///
+    /// Dropping the future returned by sending the request also aborts it, so this is for
+    /// cancelling the request from elsewhere, e.g., another task.
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use std::time::Duration;
+    /// # use influxdb3_client::{Client, Error};
+    /// # use tokio_util::sync::CancellationToken;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let token = CancellationToken::new();
+    /// let cancel = token.clone();
+    /// tokio::spawn(async move {
+    ///     tokio::time::sleep(Duration::from_secs(10)).await;
+    ///     cancel.cancel();
+    /// });
+    /// match client
+    ///     .api_v3_query_sql("db_name", "SELECT * FROM foo")
+    ///     .cancel_on(token)
+    ///     .send()
+    ///     .await
+    /// {
+    ///     Err(Error::Cancelled) => println!("query took too long"),
+    ///     result => println!("{:?}", result?),
+    /// }
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn cancel_on(mut self, token: CancellationToken) -> Self {
+        self.cancel = Some(token);
+        self
+    }
+
     /// Set a query parameter value with the given `name`
     ///
     /// # Example
@@ -470,24 +839,171 @@ impl<'c> QueryRequestBuilder<'c> {
 
     /// Send the request to `/api/v3/query_sql` or `/api/v3/query_influxql`
     pub async fn send(self) -> Result<Bytes> {
+        self.send_with_params(QueryParams::from(&self)).await
+    }
+
+    /// Send the request, and decode the rows of the response into [`QueryResults`]
+    ///
+    /// Results are always requested in the [`Format::Json`] format, regardless of the format
+    /// set on the builder. Integer values in the response are kept as integers, and can be read
+    /// without loss of precision with [`Row::get_i64`] or [`Row::get_u64`].
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let results = client
+    ///     .api_v3_query_influxql("db_name", "SELECT host, usage FROM cpu")
+    ///     .send_results()
+    ///     .await?;
+    /// for row in results.rows() {
+    ///     println!("{:?}: {:?}", row.get_str("host")?, row.get_f64("usage")?);
+    /// }
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn send_results(self) -> Result<QueryResults> {
+        let bytes = self
+            .send_with_params(QueryParams {
+                format: Some(Format::Json),
+                ..QueryParams::from(&self)
+            })
+            .await?;
+        QueryResults::from_json(bytes)
+    }
+
+    /// Send the request, and decode the rows of the response into [`QueryResults`], along with
+    /// the status and headers of the response
+    ///
+    /// This is the same as [`QueryRequestBuilder::send_results`], but for when the headers of
+    /// the response are needed too.
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let (results, metadata) = client
+    ///     .api_v3_query_sql("db_name", "SELECT host, usage FROM cpu")
+    ///     .send_results_with_metadata()
+    ///     .await?;
+    /// println!("request {:?} returned {} rows", metadata.request_id(), results.len());
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn send_results_with_metadata(self) -> Result<(QueryResults, ResponseMetadata)> {
+        let (metadata, bytes) = self
+            .send_with_params_and_metadata(QueryParams {
+                format: Some(Format::Json),
+                ..QueryParams::from(&self)
+            })
+            .await?;
+        Ok((QueryResults::from_json(bytes)?, metadata))
+    }
+
+    /// Send the query one page at a time, by appending `LIMIT` and `OFFSET` clauses to it, and
+    /// call `f` with each row of the results as it is received
+    ///
+    /// Pages of up to `page_size` rows are requested with an increasing `OFFSET` until a page
+    /// with fewer than `page_size` rows is returned. The query should therefore not have a
+    /// `LIMIT` or `OFFSET` clause of its own, and should have an `ORDER BY` clause, so that
+    /// rows are returned in the same order for each page. Results are always requested in the
+    /// [`Format::Json`] format, regardless of the format set on the builder.
+    ///
+    /// Only SQL queries can be paginated, and [`Error::PaginatedInfluxQl`] is returned for
+    /// InfluxQL queries. InfluxQL applies `LIMIT` and `OFFSET` to each series, rather than to the
+    /// results as a whole, so the pages of results with many series would overlap.
+    ///
+    /// Returns the total number of rows in the results.
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use influxdb3_client::Client;
+    /// # use std::num::NonZeroUsize;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let mut hosts = vec![];
+    /// client
+    ///     .api_v3_query_sql("db_name", "SELECT host FROM foo ORDER BY time")
+    ///     .send_paginated(NonZeroUsize::new(1000).unwrap(), |row| {
+    ///         hosts.push(row.get_str("host")?.map(ToString::to_string));
+    ///         Ok(())
+    ///     })
+    ///     .await?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn send_paginated<F>(self, page_size: NonZeroUsize, mut f: F) -> Result<usize>
+    where
+        F: FnMut(Row) -> Result<()>,
+    {
+        if matches!(self.kind, QueryKind::InfluxQl) {
+            return Err(Error::PaginatedInfluxQl);
+        }
+        let query = self.query.trim_end().trim_end_matches(';');
+        let mut offset = 0;
+        loop {
+            let page_query = format!("{query} LIMIT {page_size} OFFSET {offset}");
+            let bytes = self
+                .send_with_params(QueryParams {
+                    query: &page_query,
+                    format: Some(Format::Json),
+                    ..QueryParams::from(&self)
+                })
+                .await?;
+            let page = QueryResults::from_json(bytes)?;
+            let page_len = page.len();
+            for row in page {
+                f(row)?;
+            }
+            offset += page_len;
+            if page_len < page_size.get() {
+                return Ok(offset);
+            }
+        }
+    }
+
+    async fn send_with_params(&self, params: QueryParams<'_>) -> Result<Bytes> {
+        self.send_with_params_and_metadata(params)
+            .await
+            .map(|(_, content)| content)
+    }
+
+    async fn send_with_params_and_metadata(
+        &self,
+        params: QueryParams<'_>,
+    ) -> Result<(ResponseMetadata, Bytes)> {
         let url = match self.kind {
             QueryKind::Sql => self.client.base_url.join("/api/v3/query_sql")?,
             QueryKind::InfluxQl => self.client.base_url.join("/api/v3/query_influxql")?,
         };
-        let params = QueryParams::from(&self);
-        let mut req = self.client.http_client.post(url).json(&params);
-        if let Some(token) = &self.client.auth_token {
-            req = req.bearer_auth(token.expose_secret());
-        }
-        let resp = req.send().await.map_err(|source| Error::QuerySend {
-            kind: self.kind,
-            source,
-        })?;
-        let status = resp.status();
-        let content = resp.bytes().await.map_err(Error::Bytes)?;
+        let get_url = self.client.get_queries.then(|| params.get_url(url.clone()));
+        let req = match get_url {
+            Some(get_url) if get_url.as_str().len() <= MAX_GET_QUERY_URL_LEN => {
+                self.client.http_client.get(get_url)
+            }
+            _ => self.client.http_client.post(url).json(&params),
+        };
+        let req = self.client.authorize(req);
+        let (metadata, content) = cancellable(self.cancel.as_ref(), async {
+            let resp = req.send().await.map_err(|source| Error::QuerySend {
+                kind: self.kind,
+                source,
+            })?;
+            let metadata = ResponseMetadata {
+                status: resp.status(),
+                headers: resp.headers().clone(),
+            };
+            Ok((metadata, resp.bytes().await.map_err(Error::Bytes)?))
+        })
+        .await?;
 
-        match status {
-            StatusCode::OK => Ok(content),
+        match metadata.status {
+            StatusCode::OK => Ok((metadata, content)),
             code => Err(Error::ApiError {
                 code,
                 message: String::from_utf8(content.to_vec()).map_err(Error::InvalidUtf8)?,
@@ -496,6 +1012,26 @@ impl<'c> QueryRequestBuilder<'c> {
     }
 }
 
+/// Run the future to completion, unless the token is cancelled first, in which case the future
+/// is dropped and [`Error::Cancelled`] is returned
+async fn cancellable<T>(
+    token: Option<&CancellationToken>,
+    fut: impl Future<Output = Result<T>>,
+) -> Result<T> {
+    let Some(token) = token else {
+        return fut.await;
+    };
+    let mut fut = pin!(fut);
+    let mut cancelled = pin!(token.cancelled());
+    std::future::poll_fn(|cx| {
+        if cancelled.as_mut().poll(cx).is_ready() {
+            return Poll::Ready(Err(Error::Cancelled));
+        }
+        fut.as_mut().poll(cx)
+    })
+    .await
+}
+
 /// Query parameters for the `/api/v3/query_sql` API
 #[derive(Debug, Serialize)]
 pub struct QueryParams<'a> {
@@ -517,6 +1053,26 @@ impl<'a> From<&'a QueryRequestBuilder<'a>> for QueryParams<'a> {
     }
 }
 
+impl QueryParams<'_> {
+    /// The URL to send the query to in a `GET` request, with the parameters in its query string
+    fn get_url(&self, mut url: Url) -> Url {
+        {
+            let mut pairs = url.query_pairs_mut();
+            pairs
+                .append_pair("db", self.db)
+                .append_pair("q", self.query);
+            if let Some(format) = self.format {
+                pairs.append_pair("format", format.as_str());
+            }
+            if let Some(params) = self.params {
+                let params = serde_json::to_string(params).expect("serialize query parameters");
+                pairs.append_pair("params", &params);
+            }
+        }
+        url
+    }
+}
+
 /// The type of query, SQL or InfluxQL
 #[derive(Debug, Copy, Clone)]
 pub enum QueryKind {
@@ -541,14 +1097,32 @@ pub enum Format {
     Csv,
     Parquet,
     Pretty,
+    /// Protobuf encoded results, which can be decoded with [`QueryResults::from_protobuf`]
+    Protobuf,
+}
+
+impl Format {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Json => "json",
+            Self::Csv => "csv",
+            Self::Parquet => "parquet",
+            Self::Pretty => "pretty",
+            Self::Protobuf => "protobuf",
+        }
+    }
 }
 
 #[cfg(test)]
 mod tests {
+    use std::num::NonZeroUsize;
+    use std::time::{Duration, Instant};
+
     use mockito::{Matcher, Server};
     use serde_json::json;
+    use tokio_util::sync::CancellationToken;
 
-    use crate::{Client, Format, Precision};
+    use crate::{Batch, Client, Error, Format, Point, Precision, MAX_GET_QUERY_URL_LEN};
 
     #[tokio::test]
     async fn api_v3_write_lp() {
@@ -587,6 +1161,260 @@ mod tests {
         mock.assert_async().await;
     }
 
+    #[tokio::test]
+    async fn api_v3_write_lp_line_errors() {
+        let db = "stats";
+        let mut batch = Batch::new();
+        batch
+            .add(Point::new("cpu").field("usage", 0.5))
+            .add(Point::new("cpu").field("usage", "high"))
+            .add(Point::new("cpu").field("usage", 0.7))
+            .add(Point::new("cpu").field("usage", true));
+
+        let mut mock_server = Server::new_async().await;
+        let partial_mock = mock_server
+            .mock("POST", "/api/v3/write_lp")
+            .match_query(Matcher::UrlEncoded("accept_partial".into(), "true".into()))
+            .with_status(400)
+            .with_body(
+                json!({
+                    "error": "partial write of line protocol occurred",
+                    "data": [
+                        {
+                            "original_line": "cpu usage=\"high\"",
+                            "line_number": 2,
+                            "error_message": "invalid column type for column 'usage'"
+                        },
+                        {
+                            "original_line": "cpu usage=true",
+                            "line_number": 4,
+                            "error_message": "invalid column type for column 'usage'"
+                        }
+                    ]
+                })
+                .to_string(),
+            )
+            .create_async()
+            .await;
+        let error_mock = mock_server
+            .mock("POST", "/api/v3/write_lp")
+            .match_query(Matcher::UrlEncoded("accept_partial".into(), "false".into()))
+            .with_status(400)
+            .with_body(
+                json!({
+                    "error": "parsing failed for write_lp endpoint",
+                    "data": {
+                        "original_line": "cpu usage=\"high\"",
+                        "line_number": 2,
+                        "error_message": "invalid column type for column 'usage'"
+                    }
+                })
+                .to_string(),
+            )
+            .create_async()
+            .await;
+        let other_mock = mock_server
+            .mock("POST", "/api/v3/write_lp")
+            .match_query(Matcher::UrlEncoded("db".into(), "other".into()))
+            .with_status(500)
+            .with_body("internal error")
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url()).expect("create client");
+
+        let err = client
+            .api_v3_write_lp(db)
+            .accept_partial(true)
+            .batch(&batch)
+            .send()
+            .await
+            .unwrap_err();
+        match err {
+            Error::WriteLines {
+                code,
+                message,
+                lines,
+            } => {
+                assert_eq!(code, 400);
+                assert_eq!(message, "partial write of line protocol occurred");
+                assert_eq!(
+                    lines.iter().map(|l| l.point_index()).collect::<Vec<_>>(),
+                    [1, 3]
+                );
+                assert_eq!(lines[0].original_line, batch.points()[1].to_string());
+            }
+            err => panic!("unexpected error: {err}"),
+        }
+        partial_mock.assert_async().await;
+
+        let err = client
+            .api_v3_write_lp(db)
+            .accept_partial(false)
+            .batch(&batch)
+            .send()
+            .await
+            .unwrap_err();
+        match err {
+            Error::WriteLines { lines, .. } => {
+                assert_eq!(
+                    lines.iter().map(|l| l.point_index()).collect::<Vec<_>>(),
+                    [1]
+                );
+            }
+            err => panic!("unexpected error: {err}"),
+        }
+        error_mock.assert_async().await;
+
+        // errors that are not about particular lines are left as they are:
+        let err = client
+            .api_v3_write_lp("other")
+            .batch(&batch)
+            .send()
+            .await
+            .unwrap_err();
+        assert!(
+            matches!(err, Error::ApiError { code, ref message } if code == 500 && message == "internal error"),
+            "unexpected error: {err}"
+        );
+        other_mock.assert_async().await;
+    }
+
+    #[tokio::test]
+    async fn api_v3_write_lp_batch() {
+        let db = "stats";
+
+        let mut mock_server = Server::new_async().await;
+        let mock = mock_server
+            .mock("POST", "/api/v3/write_lp")
+            .match_query(Matcher::AllOf(vec![
+                Matcher::UrlEncoded("precision".into(), "second".into()),
+                Matcher::UrlEncoded("db".into(), db.into()),
+            ]))
+            .match_body("cpu,host=s1 usage=0.5 1\ncpu,host=s2 usage=0.7 2\n")
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url()).expect("create client");
+
+        let mut batch = Batch::new().precision(Precision::Second);
+        batch
+            .add(
+                Point::new("cpu")
+                    .tag("host", "s1")
+                    .field("usage", 0.5)
+                    .timestamp(1),
+            )
+            .add(
+                Point::new("cpu")
+                    .tag("host", "s2")
+                    .field("usage", 0.7)
+                    .timestamp(2),
+            );
+        client
+            .api_v3_write_lp(db)
+            .batch(&batch)
+            .send()
+            .await
+            .expect("send write_lp request");
+
+        mock.assert_async().await;
+    }
+
+    #[tokio::test]
+    async fn auth_schemes() {
+        let token = "super-secret-token";
+        let db = "stats";
+        let body = "cpu,host=s1 usage=0.5";
+
+        let mut mock_server = Server::new_async().await;
+        let client = Client::new(mock_server.url()).expect("create client");
+        for (client, header) in [
+            (
+                client.clone().with_token_auth(token),
+                format!("Token {token}"),
+            ),
+            (
+                client.clone().with_basic_auth("user", token),
+                // base64 encoding of "user:super-secret-token":
+                "Basic dXNlcjpzdXBlci1zZWNyZXQtdG9rZW4=".to_string(),
+            ),
+        ] {
+            let mock = mock_server
+                .mock("POST", "/api/v3/write_lp")
+                .match_header("Authorization", header.as_str())
+                .match_query(Matcher::UrlEncoded("db".into(), db.into()))
+                .match_body(body)
+                .create_async()
+                .await;
+
+            client
+                .api_v3_write_lp(db)
+                .body(body)
+                .send()
+                .await
+                .expect("send write_lp request");
+
+            mock.assert_async().await;
+            mock.remove_async().await;
+        }
+
+        // without credentials no Authorization header is sent:
+        let mock = mock_server
+            .mock("POST", "/api/v3/write_lp")
+            .match_header("Authorization", Matcher::Missing)
+            .match_body(body)
+            .with_status(401)
+            .create_async()
+            .await;
+        let err = client
+            .api_v3_write_lp(db)
+            .body(body)
+            .send()
+            .await
+            .unwrap_err();
+        assert!(matches!(
+            err,
+            crate::Error::ApiError { code, .. } if code == reqwest::StatusCode::UNAUTHORIZED
+        ));
+        mock.assert_async().await;
+    }
+
+    #[tokio::test]
+    async fn ping_latency() {
+        let mut mock_server = Server::new_async().await;
+        let mock = mock_server
+            .mock("GET", "/ping")
+            .with_status(200)
+            .with_body(r#"{"version":"3.0.0","revision":"abc123"}"#)
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url()).expect("create client");
+        let (latency, resp) = client
+            .ping_latency(Duration::from_secs(5))
+            .await
+            .expect("send ping request");
+        assert!(latency < Duration::from_secs(5));
+        assert_eq!(resp.version(), "3.0.0");
+        assert_eq!(resp.revision(), "abc123");
+
+        mock.assert_async().await;
+
+        // requests that are not responded to in time fail:
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let client = Client::new(format!("http://{}", listener.local_addr().unwrap()))
+            .expect("create client");
+        let err = client
+            .ping_latency(Duration::from_millis(50))
+            .await
+            .unwrap_err();
+        assert!(
+            matches!(&err, Error::PingSend(source) if source.is_timeout()),
+            "unexpected error: {err}"
+        );
+    }
+
     #[tokio::test]
     async fn api_v3_query_sql() {
         let token = "super-secret-token";
@@ -628,6 +1456,72 @@ mod tests {
         mock.assert_async().await;
     }
 
+    #[tokio::test]
+    async fn api_v3_query_get_falls_back_to_post() {
+        let db = "stats";
+        let short_query = "SELECT * FROM foo WHERE bar = $bar";
+        let long_query = format!(
+            "SELECT * FROM foo WHERE bar IN ({values})",
+            values = (0..MAX_GET_QUERY_URL_LEN / 5)
+                .map(|i| format!("'bar{i}'"))
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+        let body = r#"[{"host": "foo", "time": "1990-07-23T06:00:00:000", "val": 1}]"#;
+
+        let mut mock_server = Server::new_async().await;
+        let get_mock = mock_server
+            .mock("GET", "/api/v3/query_sql")
+            .match_query(Matcher::AllOf(vec![
+                Matcher::UrlEncoded("db".into(), db.into()),
+                Matcher::UrlEncoded("q".into(), short_query.into()),
+                Matcher::UrlEncoded("format".into(), "json".into()),
+                Matcher::UrlEncoded("params".into(), r#"{"bar":"baz"}"#.into()),
+            ]))
+            .with_status(200)
+            .with_body(body)
+            .create_async()
+            .await;
+        let post_mock = mock_server
+            .mock("POST", "/api/v3/query_sql")
+            .match_body(Matcher::Json(serde_json::json!({
+                "db": db,
+                "q": long_query,
+                "format": "json",
+                "params": null,
+            })))
+            .with_status(200)
+            .with_body(body)
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url())
+            .expect("create client")
+            .with_get_queries();
+
+        // short queries are sent in the URL of a GET request:
+        let r = client
+            .api_v3_query_sql(db, short_query)
+            .format(Format::Json)
+            .with_param("bar", "baz")
+            .send()
+            .await
+            .expect("send GET request to server");
+        assert_eq!(&r, body);
+
+        // queries that would make the URL too long are sent in the body of a POST request:
+        let r = client
+            .api_v3_query_sql(db, long_query.as_str())
+            .format(Format::Json)
+            .send()
+            .await
+            .expect("send POST request to server");
+        assert_eq!(&r, body);
+
+        get_mock.assert_async().await;
+        post_mock.assert_async().await;
+    }
+
     #[tokio::test]
     async fn api_v3_query_sql_params() {
         let db = "stats";
@@ -665,6 +1559,99 @@ mod tests {
         r.expect("sent request successfully");
     }
 
+    #[tokio::test]
+    async fn api_v3_query_send_results() {
+        let db = "stats";
+        let query = "SELECT host, count FROM foo";
+        let body = r#"[{"host": "a", "count": 9007199254740993}, {"host": "b", "count": 2}]"#;
+
+        let mut mock_server = Server::new_async().await;
+        let mock = mock_server
+            .mock("POST", "/api/v3/query_influxql")
+            .match_body(Matcher::Json(serde_json::json!({
+                "db": db,
+                "q": query,
+                "format": "json",
+                "params": null,
+            })))
+            .with_status(200)
+            .with_body(body)
+            .create_async()
+            .await;
+        let error_mock = mock_server
+            .mock("POST", "/api/v3/query_sql")
+            .with_status(404)
+            .with_body("database not found")
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url()).expect("create client");
+
+        // the JSON format is requested even if another format was set:
+        let results = client
+            .api_v3_query_influxql(db, query)
+            .format(Format::Csv)
+            .send_results()
+            .await
+            .expect("send request to server");
+        assert_eq!(results.len(), 2);
+        let rows = results.rows();
+        assert_eq!(rows[0].get_str("host").unwrap(), Some("a"));
+        // integers larger than can be represented exactly by a float are not rounded:
+        assert_eq!(rows[0].get_i64("count").unwrap(), Some(9007199254740993));
+        assert_eq!(rows[1].get_i64("count").unwrap(), Some(2));
+        mock.assert_async().await;
+
+        let err = client
+            .api_v3_query_sql("missing", query)
+            .send_results()
+            .await
+            .unwrap_err();
+        match err {
+            Error::ApiError { code, message } => {
+                assert_eq!(code, 404);
+                assert_eq!(message, "database not found");
+            }
+            err => panic!("unexpected error: {err}"),
+        }
+        error_mock.assert_async().await;
+    }
+
+    #[tokio::test]
+    async fn api_v3_query_send_results_with_metadata() {
+        let db = "stats";
+        let query = "SELECT host FROM foo";
+
+        let mut mock_server = Server::new_async().await;
+        let mock = mock_server
+            .mock("POST", "/api/v3/query_sql")
+            .with_status(200)
+            .with_header("X-Request-Id", "42")
+            .with_header("X-RateLimit-Remaining", "9")
+            .with_body(r#"[{"host": "a"}]"#)
+            .create_async()
+            .await;
+
+        let client = Client::new(mock_server.url()).expect("create client");
+
+        let (results, metadata) = client
+            .api_v3_query_sql(db, query)
+            .send_results_with_metadata()
+            .await
+            .expect("send request to server");
+        assert_eq!(results.len(), 1);
+        assert_eq!(metadata.status(), 200);
+        assert_eq!(metadata.request_id(), Some("42"));
+        assert_eq!(
+            metadata
+                .headers()
+                .get("X-RateLimit-Remaining")
+                .and_then(|v| v.to_str().ok()),
+            Some("9")
+        );
+        mock.assert_async().await;
+    }
+
     #[tokio::test]
     async fn api_v3_query_influxql() {
         let db = "stats";
@@ -784,4 +1771,109 @@ mod tests {
 
         r.expect("sent request successfully");
     }
+
+    #[tokio::test]
+    async fn api_v3_query_sql_paginated() {
+        let db = "stats";
+        let query = "SELECT val FROM foo ORDER BY val;";
+
+        // the number of rows is an exact multiple of the page size, so a final, empty, page is
+        // needed to know that there are no more rows:
+        let pages = [
+            (0, json!([{"val": 1}, {"val": 2}])),
+            (2, json!([{"val": 3}, {"val": 4}])),
+            (4, json!([])),
+        ];
+
+        let mut mock_server = Server::new_async().await;
+        let mut mocks = vec![];
+        for (offset, body) in pages {
+            mocks.push(
+                mock_server
+                    .mock("POST", "/api/v3/query_sql")
+                    .match_body(Matcher::Json(json!({
+                        "db": db,
+                        "q": format!("SELECT val FROM foo ORDER BY val LIMIT 2 OFFSET {offset}"),
+                        "format": "json",
+                        "params": null,
+                    })))
+                    .with_status(200)
+                    .with_body(body.to_string())
+                    .expect(1)
+                    .create_async()
+                    .await,
+            );
+        }
+
+        let client = Client::new(mock_server.url()).expect("create client");
+
+        let mut values = vec![];
+        let total = client
+            .api_v3_query_sql(db, query)
+            .format(Format::Csv)
+            .send_paginated(NonZeroUsize::new(2).unwrap(), |row| {
+                values.push(row.get_i64("val")?.unwrap());
+                Ok(())
+            })
+            .await
+            .expect("send paginated requests");
+
+        for mock in mocks {
+            mock.assert_async().await;
+        }
+        assert_eq!(total, 4);
+        assert_eq!(values, [1, 2, 3, 4]);
+    }
+
+    #[tokio::test]
+    async fn cancel_requests() {
+        // a server that never responds:
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let client = Client::new(format!("http://{}", listener.local_addr().unwrap()))
+            .expect("create client");
+
+        let token = CancellationToken::new();
+        let cancel = token.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(50)).await;
+            cancel.cancel();
+        });
+        let start = Instant::now();
+        let err = client
+            .api_v3_query_sql("foo", "SELECT * FROM bar")
+            .cancel_on(token.clone())
+            .send()
+            .await
+            .unwrap_err();
+        assert!(matches!(err, Error::Cancelled), "unexpected error: {err}");
+        assert!(start.elapsed() < Duration::from_secs(5));
+
+        // requests made with a token that is already cancelled are not sent:
+        let err = client
+            .api_v3_write_lp("foo")
+            .cancel_on(token)
+            .body("cpu usage=0.5 1")
+            .send()
+            .await
+            .unwrap_err();
+        assert!(matches!(err, Error::Cancelled), "unexpected error: {err}");
+
+        // an uncancelled token has no effect:
+        let mut mock_server = Server::new_async().await;
+        let mock = mock_server
+            .mock("POST", "/api/v3/query_sql")
+            .with_status(200)
+            .with_body("[]")
+            .create_async()
+            .await;
+        let client = Client::new(mock_server.url()).expect("create client");
+        let bytes = client
+            .api_v3_query_sql("foo", "SELECT * FROM bar")
+            .cancel_on(CancellationToken::new())
+            .send()
+            .await
+            .expect("send query_sql request");
+        assert_eq!(bytes, "[]");
+        mock.assert_async().await;
+    }
 }
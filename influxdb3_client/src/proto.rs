@@ -0,0 +1,43 @@
+//! The messages of the [`Format::Protobuf`][crate::Format::Protobuf] query output format
+//!
+//! These mirror the messages in `influxdb3_server/proto/query_results.proto`, and must be kept in
+//! sync with it.
+
+/// The results of a query
+#[derive(Clone, PartialEq, prost::Message)]
+pub(crate) struct QueryResults {
+    #[prost(string, repeated, tag = "1")]
+    pub(crate) columns: Vec<String>,
+    #[prost(message, repeated, tag = "2")]
+    pub(crate) rows: Vec<Row>,
+}
+
+/// A single row of the results, with a value for each column
+#[derive(Clone, PartialEq, prost::Message)]
+pub(crate) struct Row {
+    #[prost(message, repeated, tag = "1")]
+    pub(crate) values: Vec<Value>,
+}
+
+/// A single value in a row, which is `None` if the value is null
+#[derive(Clone, PartialEq, prost::Message)]
+pub(crate) struct Value {
+    #[prost(oneof = "value::Value", tags = "1, 2, 3, 4, 5")]
+    pub(crate) value: Option<value::Value>,
+}
+
+pub(crate) mod value {
+    #[derive(Clone, PartialEq, prost::Oneof)]
+    pub(crate) enum Value {
+        #[prost(double, tag = "1")]
+        FloatValue(f64),
+        #[prost(int64, tag = "2")]
+        IntegerValue(i64),
+        #[prost(uint64, tag = "3")]
+        UnsignedValue(u64),
+        #[prost(string, tag = "4")]
+        StringValue(String),
+        #[prost(bool, tag = "5")]
+        BooleanValue(bool),
+    }
+}
@@ -0,0 +1,539 @@
+//! Typed access to the results of queries made with the [`Format::Json`][crate::Format::Json]
+//! or [`Format::Protobuf`][crate::Format::Protobuf] output formats
+
+use prost::Message;
+use serde::de::DeserializeOwned;
+use serde::Deserialize;
+use serde_json::{Map, Number, Value};
+
+use crate::proto::{self, value};
+use crate::{Error, Result};
+
+/// The name of the column that gives the measurement name of each row in the results of
+/// InfluxQL queries
+const MEASUREMENT_COLUMN_NAME: &str = "iox::measurement";
+
+/// The rows produced by a query, decoded from the JSON or protobuf output formats
+///
+/// # Example
+/// ```
+/// # use influxdb3_client::QueryResults;
+/// # fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+/// let results = QueryResults::from_json(br#"[{"host": "a", "usage": 0.5}]"#)?;
+/// let row = &results.rows()[0];
+/// assert_eq!(row.get_str("host")?, Some("a"));
+/// assert_eq!(row.get_f64("usage")?, Some(0.5));
+/// # Ok(())
+/// # }
+/// ```
+#[derive(Debug, Clone, Default, PartialEq, Deserialize)]
+#[serde(transparent)]
+pub struct QueryResults {
+    rows: Vec<Row>,
+}
+
+impl QueryResults {
+    /// Decode [`QueryResults`] from the body of a response to a query made with the
+    /// [`Format::Json`][crate::Format::Json] output format
+    pub fn from_json(bytes: impl AsRef<[u8]>) -> Result<Self> {
+        serde_json::from_slice(bytes.as_ref()).map_err(Error::DecodeResults)
+    }
+
+    /// Decode [`QueryResults`] from the body of a response to a query made with the
+    /// [`Format::Protobuf`][crate::Format::Protobuf] output format
+    ///
+    /// As with the JSON output format, `null` values are omitted from the decoded rows, so the
+    /// results compare equal to those decoded from JSON with [`QueryResults::from_json`].
+    pub fn from_protobuf(bytes: impl AsRef<[u8]>) -> Result<Self> {
+        let results =
+            proto::QueryResults::decode(bytes.as_ref()).map_err(Error::DecodeProtobufResults)?;
+        let rows = results
+            .rows
+            .into_iter()
+            .map(|row| {
+                Row(results
+                    .columns
+                    .iter()
+                    .zip(row.values)
+                    .filter_map(|(column, v)| Some((column.clone(), json_value(v.value?)?)))
+                    .collect())
+            })
+            .collect();
+        Ok(Self { rows })
+    }
+
+    /// Get all of the [`Row`]s in the results
+    pub fn rows(&self) -> &[Row] {
+        &self.rows
+    }
+
+    /// The number of rows in the results
+    pub fn len(&self) -> usize {
+        self.rows.len()
+    }
+
+    /// Whether there are no rows in the results
+    pub fn is_empty(&self) -> bool {
+        self.rows.is_empty()
+    }
+
+    /// Decode each row of the results into a `T`
+    ///
+    /// See [`Row::decode`] for how the columns of each row are mapped to the fields of `T`.
+    ///
+    /// # Example
+    /// ```
+    /// # use influxdb3_client::QueryResults;
+    /// # use serde::Deserialize;
+    /// # fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// #[derive(Debug, PartialEq, Deserialize)]
+    /// struct Cpu {
+    ///     host: String,
+    ///     #[serde(rename = "usage_percent", default)]
+    ///     usage: f64,
+    /// }
+    ///
+    /// let results = QueryResults::from_json(
+    ///     br#"[{"host": "a", "usage_percent": 0.5}, {"host": "b"}]"#,
+    /// )?;
+    /// let cpus: Vec<Cpu> = results.decode()?;
+    /// assert_eq!(cpus[0], Cpu { host: "a".into(), usage: 0.5 });
+    /// assert_eq!(cpus[1], Cpu { host: "b".into(), usage: 0.0 });
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn decode<T: DeserializeOwned>(&self) -> Result<Vec<T>> {
+        self.rows
+            .iter()
+            .enumerate()
+            .map(|(i, row)| {
+                row.decode()
+                    .map_err(|source| Error::DecodeRow { row: i, source })
+            })
+            .collect()
+    }
+
+    /// Get the value of the given column for each row in the results
+    ///
+    /// The value will be `None` for rows that have a `null` value in the column.
+    pub fn column_values(&self, column: &str) -> Vec<Option<&Value>> {
+        self.rows.iter().map(|row| row.get(column)).collect()
+    }
+
+    /// Group the rows into [`Series`] by the `iox::measurement` column that is output by
+    /// InfluxQL queries, in the order that each measurement first appears
+    ///
+    /// Rows without a measurement are grouped into a series with an empty name.
+    pub fn series(&self) -> Vec<Series<'_>> {
+        let mut series: Vec<Series<'_>> = vec![];
+        for row in &self.rows {
+            let name = row
+                .get(MEASUREMENT_COLUMN_NAME)
+                .and_then(Value::as_str)
+                .unwrap_or_default();
+            match series.iter_mut().find(|s| s.name == name) {
+                Some(s) => s.rows.push(row),
+                None => series.push(Series {
+                    name,
+                    rows: vec![row],
+                }),
+            }
+        }
+        series
+    }
+}
+
+impl IntoIterator for QueryResults {
+    type Item = Row;
+    type IntoIter = std::vec::IntoIter<Row>;
+
+    fn into_iter(self) -> Self::IntoIter {
+        self.rows.into_iter()
+    }
+}
+
+/// The rows in a set of [`QueryResults`] that belong to a single measurement
+#[derive(Debug, Clone, PartialEq)]
+pub struct Series<'a> {
+    name: &'a str,
+    rows: Vec<&'a Row>,
+}
+
+impl<'a> Series<'a> {
+    /// The name of the measurement
+    pub fn name(&self) -> &'a str {
+        self.name
+    }
+
+    /// The rows for the measurement
+    pub fn rows(&self) -> &[&'a Row] {
+        &self.rows
+    }
+}
+
+/// A single row in a set of [`QueryResults`]
+#[derive(Debug, Clone, Default, PartialEq, Deserialize)]
+#[serde(transparent)]
+pub struct Row(Map<String, Value>);
+
+impl Row {
+    /// Get the raw JSON value of the given column
+    ///
+    /// Returns `None` if the row does not have the column, or its value is `null`; the JSON
+    /// output format omits `null` values from rows.
+    pub fn get(&self, column: &str) -> Option<&Value> {
+        self.0.get(column).filter(|v| !v.is_null())
+    }
+
+    /// Decode the row into a `T`, such as a struct that derives [`Deserialize`]
+    ///
+    /// Each column is mapped to the field of the same name, which can be changed with
+    /// `#[serde(rename = "column")]`. Columns without a field are ignored, while `null` values
+    /// are treated as missing, so the fields for columns that may be `null` should be an
+    /// `Option` or have `#[serde(default)]` to be given their default value. Integer values
+    /// can be decoded into floating point fields, and the `time` column can be decoded into
+    /// a `String`, or a `chrono::NaiveDateTime` when using the `serde` feature of `chrono`.
+    pub fn decode<T: DeserializeOwned>(&self) -> std::result::Result<T, serde_json::Error> {
+        let values = self
+            .0
+            .iter()
+            .filter(|(_, v)| !v.is_null())
+            .map(|(k, v)| (k.clone(), v.clone()))
+            .collect();
+        serde_json::from_value(Value::Object(values))
+    }
+
+    /// The names of the columns that have a value in this row
+    pub fn columns(&self) -> impl Iterator<Item = &str> {
+        self.0
+            .iter()
+            .filter(|(_, v)| !v.is_null())
+            .map(|(k, _)| k.as_str())
+    }
+
+    /// Get the value of the given column as an `f64`
+    ///
+    /// Any numeric value will be converted, including integers.
+    pub fn get_f64(&self, column: &str) -> Result<Option<f64>> {
+        self.get_as(column, "f64", Value::as_f64)
+    }
+
+    /// Get the value of the given column as an `i64`
+    ///
+    /// Floating point values are converted if they have no fractional part, and are in
+    /// range for an `i64`.
+    pub fn get_i64(&self, column: &str) -> Result<Option<i64>> {
+        self.get_as(column, "i64", |v| {
+            v.as_i64().or_else(|| {
+                v.as_f64()
+                    .filter(|f| f.fract() == 0.0 && *f >= i64::MIN as f64 && *f < i64::MAX as f64)
+                    .map(|f| f as i64)
+            })
+        })
+    }
+
+    /// Get the value of the given column as a `u64`
+    ///
+    /// Floating point values are converted if they have no fractional part, and are in
+    /// range for a `u64`.
+    pub fn get_u64(&self, column: &str) -> Result<Option<u64>> {
+        self.get_as(column, "u64", |v| {
+            v.as_u64().or_else(|| {
+                v.as_f64()
+                    .filter(|f| f.fract() == 0.0 && *f >= 0.0 && *f < u64::MAX as f64)
+                    .map(|f| f as u64)
+            })
+        })
+    }
+
+    /// Get the value of the given column as a string
+    pub fn get_str(&self, column: &str) -> Result<Option<&str>> {
+        self.get_as(column, "string", Value::as_str)
+    }
+
+    /// Get the value of the given column as a `bool`
+    pub fn get_bool(&self, column: &str) -> Result<Option<bool>> {
+        self.get_as(column, "bool", Value::as_bool)
+    }
+
+    fn get_as<'a, T>(
+        &'a self,
+        column: &str,
+        expected: &'static str,
+        f: impl FnOnce(&'a Value) -> Option<T>,
+    ) -> Result<Option<T>> {
+        self.get(column)
+            .map(|v| {
+                f(v).ok_or_else(|| Error::ColumnValue {
+                    column: column.to_string(),
+                    expected,
+                    value: v.clone(),
+                })
+            })
+            .transpose()
+    }
+}
+
+/// Convert a protobuf value to the JSON value it would have in the JSON output format
+///
+/// Returns `None` for floats that are not finite, which have no JSON representation.
+fn json_value(v: value::Value) -> Option<Value> {
+    Some(match v {
+        value::Value::FloatValue(f) => Value::Number(Number::from_f64(f)?),
+        value::Value::IntegerValue(i) => Value::from(i),
+        value::Value::UnsignedValue(u) => Value::from(u),
+        value::Value::StringValue(s) => Value::String(s),
+        value::Value::BooleanValue(b) => Value::Bool(b),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::NaiveDateTime;
+    use prost::Message;
+    use serde::Deserialize;
+    use serde_json::json;
+
+    use crate::proto::{self, value};
+    use crate::Error;
+
+    use super::QueryResults;
+
+    #[test]
+    fn row_accessors() {
+        let results = QueryResults::from_json(
+            json!([
+                {
+                    "float": 1.5,
+                    "whole_float": 2.0,
+                    "int": -3,
+                    "uint": 18446744073709551615_u64,
+                    "string": "foo",
+                    "bool": true,
+                    "null": null
+                }
+            ])
+            .to_string(),
+        )
+        .unwrap();
+        assert_eq!(results.len(), 1);
+        let row = &results.rows()[0];
+
+        // numeric values:
+        assert_eq!(row.get_f64("float").unwrap(), Some(1.5));
+        assert_eq!(row.get_f64("int").unwrap(), Some(-3.0));
+        assert_eq!(row.get_i64("int").unwrap(), Some(-3));
+        assert_eq!(row.get_i64("whole_float").unwrap(), Some(2));
+        assert_eq!(row.get_u64("whole_float").unwrap(), Some(2));
+        assert_eq!(row.get_u64("uint").unwrap(), Some(u64::MAX));
+        assert!(matches!(
+            row.get_i64("float"),
+            Err(Error::ColumnValue { column, expected: "i64", .. }) if column == "float"
+        ));
+        assert!(matches!(
+            row.get_u64("int"),
+            Err(Error::ColumnValue { column, expected: "u64", .. }) if column == "int"
+        ));
+        assert!(matches!(
+            row.get_i64("uint"),
+            Err(Error::ColumnValue { column, expected: "i64", .. }) if column == "uint"
+        ));
+
+        // string values:
+        assert_eq!(row.get_str("string").unwrap(), Some("foo"));
+        assert!(matches!(
+            row.get_f64("string"),
+            Err(Error::ColumnValue { column, expected: "f64", .. }) if column == "string"
+        ));
+
+        // boolean values:
+        assert_eq!(row.get_bool("bool").unwrap(), Some(true));
+        assert!(matches!(
+            row.get_str("bool"),
+            Err(Error::ColumnValue { column, expected: "string", .. }) if column == "bool"
+        ));
+
+        // null and missing values:
+        assert_eq!(row.get("null"), None);
+        assert_eq!(row.get_f64("null").unwrap(), None);
+        assert_eq!(row.get_str("null").unwrap(), None);
+        assert_eq!(row.get_bool("missing").unwrap(), None);
+
+        let mut columns: Vec<&str> = row.columns().collect();
+        columns.sort_unstable();
+        assert_eq!(
+            columns,
+            ["bool", "float", "int", "string", "uint", "whole_float"]
+        );
+    }
+
+    #[test]
+    fn series_and_column_values() {
+        let results = QueryResults::from_json(
+            json!([
+                {"iox::measurement": "cpu", "host": "a", "usage": 0.5},
+                {"iox::measurement": "cpu", "host": "b"},
+                {"iox::measurement": "mem", "host": "a", "usage": 10}
+            ])
+            .to_string(),
+        )
+        .unwrap();
+
+        let series = results.series();
+        assert_eq!(series.len(), 2);
+        assert_eq!(series[0].name(), "cpu");
+        assert_eq!(series[0].rows().len(), 2);
+        assert_eq!(series[1].name(), "mem");
+        assert_eq!(series[1].rows().len(), 1);
+        assert_eq!(series[1].rows()[0].get_i64("usage").unwrap(), Some(10));
+
+        assert_eq!(
+            results.column_values("usage"),
+            [Some(&json!(0.5)), None, Some(&json!(10))]
+        );
+    }
+
+    #[test]
+    fn decode_into_struct() {
+        #[derive(Debug, PartialEq, Deserialize)]
+        struct Cpu {
+            time: NaiveDateTime,
+            host: String,
+            #[serde(default)]
+            usage: f64,
+            #[serde(rename = "region")]
+            location: Option<String>,
+        }
+
+        let results = QueryResults::from_json(
+            json!([
+                {
+                    "time": "1970-01-01T00:00:01",
+                    "host": "a",
+                    "usage": 0.5,
+                    "region": "west",
+                    "ignored": true
+                },
+                // integers are coerced to floats:
+                {"time": "1970-01-01T00:00:02.5", "host": "b", "usage": 2},
+                // null values map to the default:
+                {"time": "1970-01-01T00:00:03", "host": "c", "usage": null}
+            ])
+            .to_string(),
+        )
+        .unwrap();
+
+        let time = |s: &str| s.parse::<NaiveDateTime>().unwrap();
+        assert_eq!(
+            results.decode::<Cpu>().unwrap(),
+            [
+                Cpu {
+                    time: time("1970-01-01T00:00:01"),
+                    host: "a".into(),
+                    usage: 0.5,
+                    location: Some("west".into()),
+                },
+                Cpu {
+                    time: time("1970-01-01T00:00:02.5"),
+                    host: "b".into(),
+                    usage: 2.0,
+                    location: None,
+                },
+                Cpu {
+                    time: time("1970-01-01T00:00:03"),
+                    host: "c".into(),
+                    usage: 0.0,
+                    location: None,
+                },
+            ]
+        );
+
+        // a missing column without a default, or a value of the wrong type, is an error:
+        let results =
+            QueryResults::from_json(json!([{"time": "1970-01-01T00:00:01"}]).to_string()).unwrap();
+        assert!(matches!(
+            results.decode::<Cpu>(),
+            Err(Error::DecodeRow { row: 0, .. })
+        ));
+        let results = QueryResults::from_json(
+            json!([
+                {"time": "1970-01-01T00:00:01", "host": "a"},
+                {"time": "1970-01-01T00:00:01", "host": "a", "usage": "high"}
+            ])
+            .to_string(),
+        )
+        .unwrap();
+        assert!(matches!(
+            results.decode::<Cpu>(),
+            Err(Error::DecodeRow { row: 1, .. })
+        ));
+    }
+
+    #[test]
+    fn decode_error() {
+        assert!(matches!(
+            QueryResults::from_json("not json"),
+            Err(Error::DecodeResults(_))
+        ));
+        assert!(QueryResults::from_json("[]").unwrap().is_empty());
+        assert!(matches!(
+            QueryResults::from_protobuf([0xff]),
+            Err(Error::DecodeProtobufResults(_))
+        ));
+        assert!(QueryResults::from_protobuf([]).unwrap().is_empty());
+    }
+
+    #[test]
+    fn decode_protobuf() {
+        let row = |values: Vec<Option<value::Value>>| proto::Row {
+            values: values
+                .into_iter()
+                .map(|value| proto::Value { value })
+                .collect(),
+        };
+        let bytes = proto::QueryResults {
+            columns: ["host", "usage", "cores", "uptime", "ok", "time"]
+                .map(String::from)
+                .to_vec(),
+            rows: vec![
+                row(vec![
+                    Some(value::Value::StringValue("a".into())),
+                    Some(value::Value::FloatValue(0.5)),
+                    Some(value::Value::IntegerValue(-4)),
+                    Some(value::Value::UnsignedValue(u64::MAX)),
+                    Some(value::Value::BooleanValue(true)),
+                    Some(value::Value::StringValue("1970-01-01T00:00:01".into())),
+                ]),
+                row(vec![
+                    Some(value::Value::StringValue("b".into())),
+                    None,
+                    None,
+                    None,
+                    None,
+                    Some(value::Value::StringValue("1970-01-01T00:00:02".into())),
+                ]),
+            ],
+        }
+        .encode_to_vec();
+
+        let results = QueryResults::from_protobuf(bytes).unwrap();
+        // null values are omitted, as in the JSON output format:
+        let expected = QueryResults::from_json(
+            json!([
+                {
+                    "host": "a",
+                    "usage": 0.5,
+                    "cores": -4,
+                    "uptime": 18446744073709551615_u64,
+                    "ok": true,
+                    "time": "1970-01-01T00:00:01"
+                },
+                {"host": "b", "time": "1970-01-01T00:00:02"}
+            ])
+            .to_string(),
+        )
+        .unwrap();
+        assert_eq!(results, expected);
+        assert_eq!(results.rows()[0].get_u64("uptime").unwrap(), Some(u64::MAX));
+    }
+}
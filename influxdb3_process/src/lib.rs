@@ -68,6 +68,10 @@ pub static PROCESS_UUID: Lazy<&'static str> = Lazy::new(|| {
 /// Process start time.
 pub static PROCESS_START_TIME: Lazy<Time> = Lazy::new(|| SystemProvider::new().now());
 
+/// The name that the jemalloc memory statistics are registered under
+#[cfg(all(feature = "jemalloc_replacing_malloc", not(target_env = "msvc")))]
+const JEMALLOC_METRICS: &str = "jemalloc_metrics";
+
 pub fn setup_metric_registry() -> Arc<metric::Registry> {
     let registry = Arc::new(metric::Registry::default());
 
@@ -86,7 +90,7 @@ pub fn setup_metric_registry() -> Arc<metric::Registry> {
 
     // Register jemalloc metrics
     #[cfg(all(feature = "jemalloc_replacing_malloc", not(target_env = "msvc")))]
-    registry.register_instrument("jemalloc_metrics", crate::jemalloc::JemallocMetrics::new);
+    registry.register_instrument(JEMALLOC_METRICS, crate::jemalloc::JemallocMetrics::new);
 
     // Register tokio metric for main runtime
     #[cfg(tokio_unstable)]
@@ -99,6 +103,19 @@ pub fn setup_metric_registry() -> Arc<metric::Registry> {
     registry
 }
 
+/// Report the memory statistics of the allocator registered by [`setup_metric_registry`], without
+/// reporting the rest of the metrics in the registry
+///
+/// Nothing is reported if jemalloc is not the allocator.
+pub fn report_memory_stats(registry: &metric::Registry, reporter: &mut dyn metric::Reporter) {
+    #[cfg(all(feature = "jemalloc_replacing_malloc", not(target_env = "msvc")))]
+    if let Some(stats) = registry.get_instrument::<jemalloc::JemallocMetrics>(JEMALLOC_METRICS) {
+        metric::Instrument::report(&stats, reporter);
+    }
+    #[cfg(any(not(feature = "jemalloc_replacing_malloc"), target_env = "msvc"))]
+    let _ = (registry, reporter);
+}
+
 /// String version of [`usize::MAX`].
 #[allow(dead_code)]
 pub static USIZE_MAX: Lazy<&'static str> = Lazy::new(|| {
@@ -1,6 +1,10 @@
+use std::collections::HashMap;
+
 use async_trait::async_trait;
-use authz::{Authorizer, Error, Permission};
+use authz::{Action, Authorizer, Error, Permission, Resource};
+use iox_http::write::v1::V1_NAMESPACE_RP_SEPARATOR;
 use observability_deps::tracing::{debug, warn};
+use serde::Deserialize;
 use sha2::{Digest, Sha512};
 
 /// An [`Authorizer`] implementation that will grant access to all
@@ -56,3 +60,241 @@ impl Authorizer for DefaultAuthorizer {
         Ok(())
     }
 }
+
+/// The database name that a token can be granted access to in order to have that access to every
+/// database. A token with read and write access to it has full access, which is needed for the
+/// endpoints that act on the whole server, e.g., `/api/v3/maintenance/compact`.
+pub const ALL_DATABASES: &str = "*";
+
+/// The access to a database that is granted to a token by a [`DatabaseGrantsAuthorizer`]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum DatabaseAccess {
+    Read,
+    Write,
+    ReadWrite,
+}
+
+impl DatabaseAccess {
+    fn allows(&self, action: &Action) -> bool {
+        match action {
+            Action::Read => matches!(self, Self::Read | Self::ReadWrite),
+            Action::Write => matches!(self, Self::Write | Self::ReadWrite),
+            _ => false,
+        }
+    }
+}
+
+#[derive(Debug, thiserror::Error)]
+pub enum TokenGrantsError {
+    #[error("invalid token grants JSON: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("invalid token hash '{hash}': {source}")]
+    TokenHash {
+        hash: String,
+        #[source]
+        source: hex::FromHexError,
+    },
+}
+
+/// An [`Authorizer`] implementation that scopes each token to the databases it has been
+/// granted access to
+///
+/// Requests with a token that has no grants are not authorized. Requests with a known token
+/// are authorized, but are only given the permissions to read or write the databases that
+/// the token has been granted; grants apply to all retention policies of a database, and a
+/// grant to [`ALL_DATABASES`] applies to every database.
+#[derive(Debug, Default)]
+pub struct DatabaseGrantsAuthorizer {
+    /// The access granted to each database, keyed on the SHA-512 digest of the token
+    grants: HashMap<Vec<u8>, HashMap<String, DatabaseAccess>>,
+}
+
+impl DatabaseGrantsAuthorizer {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Create a [`DatabaseGrantsAuthorizer`] from a JSON object that maps the hex encoded
+    /// SHA-512 digest of each token to its grants, e.g.,
+    ///
+    /// ```json
+    /// {
+    ///     "<hashed token>": { "foo": "read_write", "bar": "read" },
+    ///     "<hashed admin token>": { "*": "read_write" }
+    /// }
+    /// ```
+    pub fn from_json(json: &[u8]) -> Result<Self, TokenGrantsError> {
+        let tokens: HashMap<String, HashMap<String, DatabaseAccess>> =
+            serde_json::from_slice(json)?;
+        let mut authorizer = Self::new();
+        for (hash, grants) in tokens {
+            let token_hash = hex::decode(&hash)
+                .map_err(|source| TokenGrantsError::TokenHash { hash, source })?;
+            for (database, access) in grants {
+                authorizer = authorizer.grant(token_hash.clone(), database, access);
+            }
+        }
+        Ok(authorizer)
+    }
+
+    /// Grant `access` to `database` for the token with the given SHA-512 digest, replacing any
+    /// access that was previously granted to the database
+    pub fn grant(
+        mut self,
+        token_hash: Vec<u8>,
+        database: impl Into<String>,
+        access: DatabaseAccess,
+    ) -> Self {
+        self.grants
+            .entry(token_hash)
+            .or_default()
+            .insert(database.into(), access);
+        self
+    }
+}
+
+#[async_trait]
+impl Authorizer for DatabaseGrantsAuthorizer {
+    async fn permissions(
+        &self,
+        token: Option<Vec<u8>>,
+        perms: &[Permission],
+    ) -> Result<Vec<Permission>, Error> {
+        debug!(?perms, "requesting permissions");
+        let provided = token.as_deref().ok_or(Error::NoToken)?;
+        let Some(grants) = self.grants.get(&Sha512::digest(provided)[..]) else {
+            warn!("invalid token provided");
+            return Err(Error::InvalidToken);
+        };
+        Ok(perms
+            .iter()
+            .filter(|perm| {
+                let Permission::ResourceAction(Resource::Database(database), action) = perm;
+                let database = database
+                    .split(V1_NAMESPACE_RP_SEPARATOR)
+                    .next()
+                    .unwrap_or_default();
+                let allows = |database: &str| {
+                    grants
+                        .get(database)
+                        .map_or(false, |access| access.allows(action))
+                };
+                allows(database) || allows(ALL_DATABASES)
+            })
+            .cloned()
+            .collect())
+    }
+
+    async fn probe(&self) -> Result<(), Error> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use authz::{Action, Authorizer, Error, Permission, Resource};
+    use sha2::{Digest, Sha512};
+
+    use super::{DatabaseAccess, DatabaseGrantsAuthorizer, ALL_DATABASES};
+
+    fn permission(database: &str, action: Action) -> Permission {
+        Permission::ResourceAction(Resource::Database(database.to_string()), action)
+    }
+
+    #[tokio::test]
+    async fn database_grants() {
+        let json = format!(
+            r#"{{"{}": {{"foo": "read_write", "bar": "read"}}, "{}": {{"bar": "write"}}}}"#,
+            hex::encode(Sha512::digest("reader")),
+            hex::encode(Sha512::digest("writer")),
+        );
+        let authorizer = DatabaseGrantsAuthorizer::from_json(json.as_bytes()).unwrap();
+
+        let perms = [
+            permission("foo", Action::Read),
+            permission("foo", Action::Write),
+            permission("bar/autogen", Action::Read),
+            permission("bar", Action::Write),
+            permission("baz", Action::Read),
+        ];
+        assert_eq!(
+            authorizer
+                .permissions(Some(b"reader".to_vec()), &perms)
+                .await
+                .unwrap(),
+            &perms[..3]
+        );
+        assert_eq!(
+            authorizer
+                .permissions(Some(b"writer".to_vec()), &perms)
+                .await
+                .unwrap(),
+            &perms[3..4]
+        );
+        // a known token is authorized, even when no permissions are requested:
+        assert!(authorizer
+            .permissions(Some(b"writer".to_vec()), &[])
+            .await
+            .unwrap()
+            .is_empty());
+
+        // only a grant to all databases gives access to all of them:
+        assert!(authorizer
+            .permissions(
+                Some(b"reader".to_vec()),
+                &[permission(ALL_DATABASES, Action::Read)]
+            )
+            .await
+            .unwrap()
+            .is_empty());
+        let authorizer = authorizer.grant(
+            Sha512::digest("admin").to_vec(),
+            ALL_DATABASES,
+            DatabaseAccess::ReadWrite,
+        );
+        let all_perms = [
+            permission(ALL_DATABASES, Action::Read),
+            permission(ALL_DATABASES, Action::Write),
+        ];
+        assert_eq!(
+            authorizer
+                .permissions(Some(b"admin".to_vec()), &perms)
+                .await
+                .unwrap(),
+            perms
+        );
+        assert_eq!(
+            authorizer
+                .permissions(Some(b"admin".to_vec()), &all_perms)
+                .await
+                .unwrap(),
+            all_perms
+        );
+
+        assert!(matches!(
+            authorizer
+                .permissions(Some(b"other".to_vec()), &perms)
+                .await,
+            Err(Error::InvalidToken)
+        ));
+        assert!(matches!(
+            authorizer.permissions(None, &perms).await,
+            Err(Error::NoToken)
+        ));
+    }
+
+    #[test]
+    fn invalid_grants() {
+        assert!(DatabaseGrantsAuthorizer::from_json(b"[]").is_err());
+        assert!(DatabaseGrantsAuthorizer::from_json(br#"{"zz": {"foo": "read"}}"#).is_err());
+        assert!(DatabaseGrantsAuthorizer::from_json(br#"{"00": {"foo": "admin"}}"#).is_err());
+        assert_eq!(
+            DatabaseGrantsAuthorizer::from_json(br#"{"00": {"foo": "write"}}"#)
+                .unwrap()
+                .grants[&vec![0]]["foo"],
+            DatabaseAccess::Write
+        );
+    }
+}
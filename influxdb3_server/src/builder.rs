@@ -1,18 +1,31 @@
+use std::num::NonZeroUsize;
 use std::sync::Arc;
+use std::time::Duration;
 
 use authz::Authorizer;
+use influxdb3_write::Persister;
+use tokio_rustls::rustls::ServerConfig;
 
-use crate::{auth::DefaultAuthorizer, http::HttpApi, CommonServerState, Server};
+use crate::{
+    auth::DefaultAuthorizer,
+    http::{HttpApi, QueryCacheConfig, QueryLimitConfig, QueryRowLimit},
+    CommonServerState, Server,
+};
 
 #[derive(Debug)]
 pub struct ServerBuilder<W, Q, P, T> {
     common_state: CommonServerState,
     time_provider: T,
     max_request_size: usize,
+    max_concurrent_writes: Option<usize>,
+    query_limit: Option<QueryLimitConfig>,
+    query_row_limit: Option<QueryRowLimit>,
+    query_cache: Option<QueryCacheConfig>,
     write_buffer: W,
     query_executor: Q,
     persister: P,
     authorizer: Arc<dyn Authorizer>,
+    tls_config: Option<Arc<ServerConfig>>,
 }
 
 impl ServerBuilder<NoWriteBuf, NoQueryExec, NoPersister, NoTimeProvider> {
@@ -21,10 +34,15 @@ impl ServerBuilder<NoWriteBuf, NoQueryExec, NoPersister, NoTimeProvider> {
             common_state,
             time_provider: NoTimeProvider,
             max_request_size: usize::MAX,
+            max_concurrent_writes: None,
+            query_limit: None,
+            query_row_limit: None,
+            query_cache: None,
             write_buffer: NoWriteBuf,
             query_executor: NoQueryExec,
             persister: NoPersister,
             authorizer: Arc::new(DefaultAuthorizer),
+            tls_config: None,
         }
     }
 }
@@ -35,10 +53,51 @@ impl<W, Q, P, T> ServerBuilder<W, Q, P, T> {
         self
     }
 
+    /// Limit the number of writes that are handled at once, with any further writes being
+    /// rejected until one completes
+    pub fn max_concurrent_writes(mut self, max_concurrent_writes: usize) -> Self {
+        self.max_concurrent_writes = Some(max_concurrent_writes);
+        self
+    }
+
+    /// Limit the number of queries that run at once, with up to `max_queued` further queries
+    /// waiting for one to complete, and any beyond that being rejected
+    pub fn max_concurrent_queries(mut self, max_running: usize, max_queued: usize) -> Self {
+        self.query_limit = Some(QueryLimitConfig {
+            max_running,
+            max_queued,
+        });
+        self
+    }
+
+    /// Limit the number of rows that a query returns to `max_rows`, with the results of queries
+    /// that return more being truncated to the limit, or, if `error_when_exceeded` is set,
+    /// the queries failing
+    pub fn max_query_rows(mut self, max_rows: NonZeroUsize, error_when_exceeded: bool) -> Self {
+        self.query_row_limit = Some(QueryRowLimit {
+            max_rows,
+            error_when_exceeded,
+        });
+        self
+    }
+
+    /// Cache the responses to queries for up to `ttl`, keeping at most `capacity` responses
+    pub fn query_cache(mut self, ttl: Duration, capacity: usize) -> Self {
+        self.query_cache = Some(QueryCacheConfig { ttl, capacity });
+        self
+    }
+
     pub fn authorizer(mut self, a: Arc<dyn Authorizer>) -> Self {
         self.authorizer = a;
         self
     }
+
+    /// Serve over TLS with the given configuration, e.g., as loaded by
+    /// [`load_server_config`][crate::tls::load_server_config]
+    pub fn tls_config(mut self, config: Arc<ServerConfig>) -> Self {
+        self.tls_config = Some(config);
+        self
+    }
 }
 
 #[derive(Debug)]
@@ -64,10 +123,15 @@ impl<Q, P, T> ServerBuilder<NoWriteBuf, Q, P, T> {
             common_state: self.common_state,
             time_provider: self.time_provider,
             max_request_size: self.max_request_size,
+            max_concurrent_writes: self.max_concurrent_writes,
+            query_limit: self.query_limit,
+            query_row_limit: self.query_row_limit,
+            query_cache: self.query_cache,
             write_buffer: WithWriteBuf(wb),
             query_executor: self.query_executor,
             persister: self.persister,
             authorizer: self.authorizer,
+            tls_config: self.tls_config,
         }
     }
 }
@@ -78,10 +142,15 @@ impl<W, P, T> ServerBuilder<W, NoQueryExec, P, T> {
             common_state: self.common_state,
             time_provider: self.time_provider,
             max_request_size: self.max_request_size,
+            max_concurrent_writes: self.max_concurrent_writes,
+            query_limit: self.query_limit,
+            query_row_limit: self.query_row_limit,
+            query_cache: self.query_cache,
             write_buffer: self.write_buffer,
             query_executor: WithQueryExec(qe),
             persister: self.persister,
             authorizer: self.authorizer,
+            tls_config: self.tls_config,
         }
     }
 }
@@ -92,10 +161,15 @@ impl<W, Q, T> ServerBuilder<W, Q, NoPersister, T> {
             common_state: self.common_state,
             time_provider: self.time_provider,
             max_request_size: self.max_request_size,
+            max_concurrent_writes: self.max_concurrent_writes,
+            query_limit: self.query_limit,
+            query_row_limit: self.query_row_limit,
+            query_cache: self.query_cache,
             write_buffer: self.write_buffer,
             query_executor: self.query_executor,
             persister: WithPersister(p),
             authorizer: self.authorizer,
+            tls_config: self.tls_config,
         }
     }
 }
@@ -106,16 +180,23 @@ impl<W, Q, P> ServerBuilder<W, Q, P, NoTimeProvider> {
             common_state: self.common_state,
             time_provider: WithTimeProvider(tp),
             max_request_size: self.max_request_size,
+            max_concurrent_writes: self.max_concurrent_writes,
+            query_limit: self.query_limit,
+            query_row_limit: self.query_row_limit,
+            query_cache: self.query_cache,
             write_buffer: self.write_buffer,
             query_executor: self.query_executor,
             persister: self.persister,
             authorizer: self.authorizer,
+            tls_config: self.tls_config,
         }
     }
 }
 
 impl<W, Q, P, T>
     ServerBuilder<WithWriteBuf<W>, WithQueryExec<Q>, WithPersister<P>, WithTimeProvider<T>>
+where
+    P: Persister,
 {
     pub fn build(self) -> Server<W, Q, P, T> {
         let persister = Arc::clone(&self.persister.0);
@@ -125,7 +206,12 @@ impl<W, Q, P, T>
             Arc::clone(&self.time_provider.0),
             Arc::clone(&self.write_buffer.0),
             Arc::clone(&self.query_executor.0),
+            persister.object_store(),
             self.max_request_size,
+            self.max_concurrent_writes,
+            self.query_limit,
+            self.query_row_limit,
+            self.query_cache,
             Arc::clone(&authorizer),
         ));
         Server {
@@ -133,6 +219,7 @@ impl<W, Q, P, T>
             http,
             persister,
             authorizer,
+            tls_config: self.tls_config,
         }
     }
 }
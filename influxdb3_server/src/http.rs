@@ -1,51 +1,96 @@
 //! HTTP API service implementations for `server`
 
+use crate::auth::ALL_DATABASES;
+use crate::http::ddl::{DdlStatement, DdlStatementError};
+use crate::http::debug_vars::{DebugVars, InProgress};
+use crate::http::delete::{DeleteStatement, DeleteStatementError};
+use crate::http::health::HealthChecker;
+use crate::http::idempotency::{
+    EarlierWrite, IdempotencyKeys, WriteOutcome, DEFAULT_IDEMPOTENCY_WINDOW,
+    DEFAULT_MAX_IDEMPOTENCY_KEYS, IDEMPOTENCY_KEY_HEADER,
+};
+use crate::http::metrics::HttpMetrics;
+use crate::http::pagination::{Cursor, PageKey, PaginationError};
+use crate::http::protobuf::record_batches_to_protobuf;
+use crate::http::query_cache::{CacheGeneration, QueryCache, QueryCacheKey};
+use crate::http::query_limit::{QueryLimit, QueryPermit};
+use crate::http::request_log::RequestLog;
+use crate::http::select_into::{record_batches_to_lp, IntoTarget, SelectInto, SelectIntoError};
+use crate::query_executor::AUTOGEN_RETENTION_POLICY;
 use crate::{query_executor, QueryKind};
 use crate::{CommonServerState, QueryExecutor};
+use arrow::array::{Int64Array, StringArray, TimestampNanosecondArray};
+use arrow::datatypes::{DataType, Field, Schema, TimeUnit};
 use arrow::record_batch::RecordBatch;
 use arrow::util::pretty;
 use authz::http::AuthorizationHeaderExtension;
-use authz::Authorizer;
+use authz::{Action, Authorizer, Permission, Resource};
+use base64::Engine;
 use bytes::{Bytes, BytesMut};
 use data_types::NamespaceName;
 use datafusion::error::DataFusionError;
 use datafusion::execution::memory_pool::UnboundedMemoryPool;
 use datafusion::execution::RecordBatchStream;
 use datafusion::physical_plan::SendableRecordBatchStream;
+use datafusion_util::MemoryStream;
 use futures::{StreamExt, TryStreamExt};
 use hyper::header::ACCEPT;
 use hyper::header::AUTHORIZATION;
 use hyper::header::CONTENT_ENCODING;
+use hyper::header::CONTENT_LENGTH;
 use hyper::header::CONTENT_TYPE;
+use hyper::header::ETAG;
+use hyper::header::IF_NONE_MATCH;
+use hyper::header::RETRY_AFTER;
 use hyper::http::HeaderValue;
 use hyper::HeaderMap;
 use hyper::{Body, Method, Request, Response, StatusCode};
 use influxdb3_process::{INFLUXDB3_GIT_HASH_SHORT, INFLUXDB3_VERSION};
-use influxdb3_write::catalog::Error as CatalogError;
+use influxdb3_write::catalog::{DatabaseSchema, DeletePredicate, Error as CatalogError};
 use influxdb3_write::persister::TrackedMemoryArrowWriter;
 use influxdb3_write::write_buffer::Error as WriteBufferError;
 use influxdb3_write::BufferedWriteRequest;
 use influxdb3_write::Precision;
 use influxdb3_write::WriteBuffer;
+use influxdb3_write::WriteLineError;
 use iox_http::write::single_tenant::SingleTenantRequestUnifier;
 use iox_http::write::v1::V1_NAMESPACE_RP_SEPARATOR;
 use iox_http::write::{WriteParseError, WriteRequestUnifier};
 use iox_query_influxql_rewrite as rewrite;
 use iox_query_params::StatementParams;
 use iox_time::TimeProvider;
+use object_store::ObjectStore;
 use observability_deps::tracing::{debug, error, info};
+use schema::{InfluxColumnType, INFLUXQL_MEASUREMENT_COLUMN_NAME, TIME_COLUMN_NAME};
 use serde::de::DeserializeOwned;
 use serde::Deserialize;
 use serde::Serialize;
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
 use std::convert::Infallible;
 use std::fmt::Debug;
-use std::pin::Pin;
+use std::num::NonZeroUsize;
 use std::str::Utf8Error;
 use std::string::FromUtf8Error;
 use std::sync::Arc;
+use std::time::Duration;
 use thiserror::Error;
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
 use unicode_segmentation::UnicodeSegmentation;
 
+mod ddl;
+mod debug_vars;
+mod delete;
+mod health;
+mod idempotency;
+mod import;
+mod metrics;
+mod pagination;
+mod protobuf;
+mod query_cache;
+mod query_limit;
+mod request_log;
+mod select_into;
 mod v1;
 
 #[derive(Debug, Error)]
@@ -62,6 +107,10 @@ pub enum Error {
     #[error("invalid content-encoding header: {0}")]
     NonUtf8ContentHeader(hyper::header::ToStrError),
 
+    /// The idempotency key header is invalid and cannot be read.
+    #[error("invalid {IDEMPOTENCY_KEY_HEADER} header: {0}")]
+    InvalidIdempotencyKey(hyper::header::ToStrError),
+
     /// The specified `Content-Encoding` is not acceptable.
     #[error("unacceptable content-encoding: {0}")]
     InvalidContentEncoding(String),
@@ -74,6 +123,13 @@ pub enum Error {
     #[error("max request size ({0} bytes) exceeded")]
     RequestSizeExceeded(usize),
 
+    /// The client sent a query in a URL that is too long.
+    #[error(
+        "query string of {0} bytes exceeds the maximum of {MAX_QUERY_STRING_BYTES} bytes, \
+        send the query in the body of a POST request instead"
+    )]
+    QueryStringTooLong(usize),
+
     /// Decoding a gzip-compressed stream of data failed.
     #[error("error decoding gzip stream: {0}")]
     InvalidGzip(std::io::Error),
@@ -91,6 +147,19 @@ pub enum Error {
     #[error("this service is overloaded, please try again later")]
     RequestLimit,
 
+    /// The maximum number of queries are running, and the queue of queries waiting to run
+    /// is full.
+    #[error("too many queries are running, please try again later")]
+    QueryLimit,
+
+    /// A query returned more rows than the configured maximum.
+    #[error("query returned more than the maximum of {0} rows, add a LIMIT to the query")]
+    QueryRowLimit(usize),
+
+    /// A table cannot be renamed to have an empty name.
+    #[error("table name must not be empty")]
+    EmptyTableName,
+
     /// The request has no authentication, but authorization is configured.
     #[error("authentication required")]
     Unauthenticated,
@@ -165,15 +234,42 @@ pub enum Error {
     #[error("partial write of line protocol occurred")]
     PartialLpWrite(BufferedWriteRequest),
 
+    /// A retry of a write that was only partially made, the invalid lines of which are not kept.
+    #[error("partial write of line protocol occurred, with {0} invalid lines")]
+    RetriedPartialLpWrite(usize),
+
+    /// A write with the same idempotency key as a write that has not yet completed.
+    #[error("a write with the same {IDEMPOTENCY_KEY_HEADER} header is in progress")]
+    IdempotencyKeyInProgress,
+
     #[error("error in InfluxQL statement: {0}")]
     InfluxqlRewrite(#[from] rewrite::Error),
 
+    #[error("error in InfluxQL statement: {0}")]
+    InfluxqlDdl(#[from] DdlStatementError),
+
+    #[error("only the '{AUTOGEN_RETENTION_POLICY}' retention policy can be the DEFAULT")]
+    InfluxqlDefaultRetentionPolicy,
+
+    #[error("error in InfluxQL DELETE statement: {0}")]
+    InfluxqlDelete(#[from] DeleteStatementError),
+
+    #[error("error in InfluxQL SELECT INTO statement: {0}")]
+    InfluxqlSelectInto(#[from] SelectIntoError),
+
+    #[error("error paginating query results: {0}")]
+    Pagination(#[from] PaginationError),
+
     #[error("must provide only one InfluxQl statement per query")]
     InfluxqlSingleStatement,
 
     #[error("must specify a 'db' parameter, or provide the database in the InfluxQL query")]
     InfluxqlNoDatabase,
 
+    /// A `DROP` statement was sent in a request other than a `POST`
+    #[error("InfluxQL DROP statements must be sent in a POST request")]
+    InfluxqlDropRequiresPost,
+
     #[error(
         "provided a database in both the parameters ({param_db}) and \
         query string ({query_db}) that do not match, if providing a query \
@@ -184,13 +280,30 @@ pub enum Error {
 
     #[error("v1 query API error: {0}")]
     V1Query(#[from] v1::QueryError),
+
+    #[error("not permitted to {action} database '{database}'")]
+    DatabaseForbidden {
+        database: String,
+        action: &'static str,
+    },
+
+    /// The request is for an endpoint that acts on the whole server, and its token does not have
+    /// full access
+    #[error("not permitted without full access")]
+    FullAccessForbidden,
+
+    #[error("authorization error: {0}")]
+    Authorization(#[from] AuthorizationError),
 }
 
 #[derive(Debug, Error)]
 pub enum AuthorizationError {
     #[error("the request was not authorized")]
     Unauthorized,
-    #[error("the request was not in the form of 'Authorization: Bearer <token>'")]
+    #[error(
+        "the request was not in the form of 'Authorization: Bearer <token>', \
+        'Authorization: Token <token>', or 'Authorization: Basic <credentials>'"
+    )]
     MalformedRequest,
     #[error("requestor is forbidden from requested resource")]
     Forbidden,
@@ -224,6 +337,23 @@ impl Error {
                     .body(body)
                     .unwrap()
             }
+            Self::WriteBuffer(
+                err @ (WriteBufferError::ColumnTypeMismatch { .. }
+                | WriteBufferError::CatalogUpdateError(CatalogError::TableAlreadyExists {
+                    ..
+                })),
+            ) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: err.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::CONFLICT)
+                    .body(body)
+                    .unwrap()
+            }
             Self::WriteBuffer(WriteBufferError::ParseError(err)) => {
                 let err = ErrorMessage {
                     error: "parsing failed for write_lp endpoint".into(),
@@ -236,6 +366,53 @@ impl Error {
                     .body(body)
                     .unwrap()
             }
+            Self::WriteBuffer(WriteBufferError::CatalogUpdateError(
+                err @ (CatalogError::DatabaseNotFound { .. } | CatalogError::TableNotFound { .. }),
+            )) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: err.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::NOT_FOUND)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::Query(err @ query_executor::Error::DatabaseNotFound { .. }) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: err.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::NOT_FOUND)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::InfluxqlDdl(_)
+            | Self::InfluxqlDefaultRetentionPolicy
+            | Self::InfluxqlSelectInto(_)
+            | Self::InfluxqlDelete(_)
+            | Self::InfluxqlNoDatabase
+            | Self::InfluxqlDatabaseMismatch { .. }
+            | Self::InvalidIdempotencyKey(_)
+            | Self::QueryRowLimit(_)
+            | Self::Pagination(_)
+            | Self::EmptyTableName => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::BAD_REQUEST)
+                    .body(body)
+                    .unwrap()
+            }
             Self::DbName(e) => {
                 let err: ErrorMessage<()> = ErrorMessage {
                     error: e.to_string(),
@@ -260,7 +437,94 @@ impl Error {
                     .body(body)
                     .unwrap()
             }
-            Self::UnsupportedMethod => {
+            Self::RetriedPartialLpWrite(_) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::BAD_REQUEST)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::IdempotencyKeyInProgress => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::CONFLICT)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::RequestLimit | Self::QueryLimit => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::TOO_MANY_REQUESTS)
+                    .header(RETRY_AFTER, LIMIT_RETRY_AFTER_SECONDS)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::RequestSizeExceeded(_) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::PAYLOAD_TOO_LARGE)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::QueryStringTooLong(_) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::URI_TOO_LONG)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::DatabaseForbidden { .. }
+            | Self::FullAccessForbidden
+            | Self::Authorization(AuthorizationError::Forbidden) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::FORBIDDEN)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::Authorization(_) => {
+                let err: ErrorMessage<()> = ErrorMessage {
+                    error: self.to_string(),
+                    data: None,
+                };
+                let serialized = serde_json::to_string(&err).unwrap();
+                let body = Body::from(serialized);
+                Response::builder()
+                    .status(StatusCode::UNAUTHORIZED)
+                    .body(body)
+                    .unwrap()
+            }
+            Self::UnsupportedMethod | Self::InfluxqlDropRequiresPost => {
                 let err: ErrorMessage<()> = ErrorMessage {
                     error: self.to_string(),
                     data: None,
@@ -285,35 +549,115 @@ impl Error {
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
 
+/// The number of seconds that clients are asked to wait before retrying a write or query that
+/// was rejected for being over the limit on concurrent writes or queries
+const LIMIT_RETRY_AFTER_SECONDS: &str = "1";
+
+/// The header that marks the results of a query as partial, as they were truncated to the limit
+/// on the number of rows that a query returns
+const PARTIAL_RESULTS_HEADER: &str = "X-Influxdb-Partial";
+
+/// The header with the cursor to pass back to get the next page of the results of a query
+const NEXT_CURSOR_HEADER: &str = "X-Influxdb-Next-Cursor";
+
+/// The maximum length of the query string of a `GET` request for a query
+///
+/// Much longer URIs are rejected by `hyper` with an empty response, or by proxies along the way,
+/// so longer queries are rejected with an error that says to send them in the body of a `POST`
+/// request instead.
+const MAX_QUERY_STRING_BYTES: usize = 16 * 1024;
+
 #[derive(Debug)]
 pub(crate) struct HttpApi<W, Q, T> {
     common_state: CommonServerState,
     write_buffer: Arc<W>,
     time_provider: Arc<T>,
     pub(crate) query_executor: Arc<Q>,
+    /// Checks that the object store that data is persisted to is writable
+    health: HealthChecker,
     max_request_bytes: usize,
     authorizer: Arc<dyn Authorizer>,
     legacy_write_param_unifier: SingleTenantRequestUnifier,
+    idempotency_keys: IdempotencyKeys,
+    http_metrics: HttpMetrics,
+    /// Limits the number of writes that are handled at once, if set
+    write_limit: Option<Arc<Semaphore>>,
+    /// The number of writes being handled, reported by `/debug/vars`
+    writes_in_progress: InProgress,
+    /// Limits the number of queries that run at once, if set
+    query_limit: Option<QueryLimit>,
+    /// Limits the number of rows returned by a query, if set
+    query_row_limit: Option<QueryRowLimit>,
+    /// Caches the responses to queries, if enabled
+    query_cache: Option<QueryCache>,
+}
+
+/// The settings of the limit on the number of queries that run at once
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct QueryLimitConfig {
+    pub(crate) max_running: usize,
+    pub(crate) max_queued: usize,
+}
+
+/// The settings of the limit on the number of rows returned by a query
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct QueryRowLimit {
+    pub(crate) max_rows: NonZeroUsize,
+    /// Fail queries that return more than `max_rows`, rather than truncating their results
+    pub(crate) error_when_exceeded: bool,
+}
+
+/// The settings of the cache of query responses
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct QueryCacheConfig {
+    pub(crate) ttl: Duration,
+    pub(crate) capacity: usize,
 }
 
 impl<W, Q, T> HttpApi<W, Q, T> {
+    #[allow(clippy::too_many_arguments)]
     pub(crate) fn new(
         common_state: CommonServerState,
         time_provider: Arc<T>,
         write_buffer: Arc<W>,
         query_executor: Arc<Q>,
+        object_store: Arc<dyn ObjectStore>,
         max_request_bytes: usize,
+        max_concurrent_writes: Option<usize>,
+        query_limit: Option<QueryLimitConfig>,
+        query_row_limit: Option<QueryRowLimit>,
+        query_cache: Option<QueryCacheConfig>,
         authorizer: Arc<dyn Authorizer>,
     ) -> Self {
         let legacy_write_param_unifier = SingleTenantRequestUnifier::new(Arc::clone(&authorizer));
+        let http_metrics = HttpMetrics::new(&common_state.metrics);
+        let query_cache = query_cache.map(|QueryCacheConfig { ttl, capacity }| {
+            QueryCache::new(ttl, capacity, &common_state.metrics)
+        });
         Self {
             common_state,
             time_provider,
             write_buffer,
             query_executor,
+            health: HealthChecker::new(object_store),
             max_request_bytes,
             authorizer,
             legacy_write_param_unifier,
+            idempotency_keys: IdempotencyKeys::new(
+                DEFAULT_IDEMPOTENCY_WINDOW,
+                DEFAULT_MAX_IDEMPOTENCY_KEYS,
+            ),
+            http_metrics,
+            write_limit: max_concurrent_writes.map(|max| Arc::new(Semaphore::new(max))),
+            writes_in_progress: InProgress::default(),
+            query_limit: query_limit.map(
+                |QueryLimitConfig {
+                     max_running,
+                     max_queued,
+                 }| QueryLimit::new(max_running, max_queued),
+            ),
+            query_row_limit,
+            query_cache,
         }
     }
 }
@@ -331,6 +675,22 @@ where
         self.write_lp_inner(params, req, false).await
     }
 
+    /// Acquire a permit to handle a write, if there is a limit on the number of writes handled
+    /// at once
+    ///
+    /// Rather than queuing writes when at the limit, the client is told to retry later. The
+    /// permit is owned, so that it can be held by a task that outlives the request handler.
+    fn try_acquire_write_permit(&self) -> Result<Option<OwnedSemaphorePermit>> {
+        self.write_limit
+            .as_ref()
+            .map(|limit| {
+                Arc::clone(limit)
+                    .try_acquire_owned()
+                    .map_err(|_| Error::RequestLimit)
+            })
+            .transpose()
+    }
+
     async fn write_lp_inner(
         &self,
         params: WriteParams,
@@ -339,6 +699,53 @@ where
     ) -> Result<Response<Body>> {
         validate_db_name(&params.db, accept_rp)?;
         info!("write_lp to {}", params.db);
+        self.authorize_database(RequestToken::get(&req), &params.db, Action::Write)
+            .await?;
+
+        let _permit = self.try_acquire_write_permit()?;
+        let _in_progress = self.writes_in_progress.start();
+
+        let DryRunParams { dry } = req
+            .uri()
+            .query()
+            .map(serde_urlencoded::from_str)
+            .transpose()?
+            .unwrap_or_default();
+        if dry {
+            return self.validate_lp(params, req).await;
+        }
+        let NoSyncParams { no_sync } = req
+            .uri()
+            .query()
+            .map(serde_urlencoded::from_str)
+            .transpose()?
+            .unwrap_or_default();
+
+        // a retry of a write that was already made with the same idempotency key gets the
+        // outcome of the original write, rather than being written again:
+        let idempotency_key = req
+            .headers()
+            .get(IDEMPOTENCY_KEY_HEADER)
+            .map(|v| v.to_str().map(ToString::to_string))
+            .transpose()
+            .map_err(Error::InvalidIdempotencyKey)?;
+        let reservation = match &idempotency_key {
+            Some(key) => {
+                let now = self.time_provider.now();
+                match self.idempotency_keys.reserve(&params.db, key, now) {
+                    Ok(reservation) => Some(reservation),
+                    Err(EarlierWrite::InProgress) => return Err(Error::IdempotencyKeyInProgress),
+                    Err(EarlierWrite::Written(outcome)) => {
+                        debug!(db = %params.db, %key, "write with idempotency key already made");
+                        return match outcome.invalid_line_count {
+                            0 => Ok(Response::new(Body::empty())),
+                            n => Err(Error::RetriedPartialLpWrite(n)),
+                        };
+                    }
+                }
+            }
+            None => None,
+        };
 
         let body = self.read_body(req).await?;
         let body = std::str::from_utf8(&body).map_err(Error::NonUtf8Body)?;
@@ -347,70 +754,366 @@ where
 
         let default_time = self.time_provider.now();
 
-        let result = self
-            .write_buffer
-            .write_lp(
-                database,
-                body,
-                default_time,
-                params.accept_partial,
-                params.precision,
-            )
-            .await?;
-
-        if result.invalid_lines.is_empty() {
-            Ok(Response::new(Body::empty()))
+        let result = if no_sync {
+            self.write_buffer
+                .write_lp_no_sync(
+                    database,
+                    body,
+                    default_time,
+                    params.accept_partial,
+                    params.precision,
+                )
+                .await?
         } else {
-            Err(Error::PartialLpWrite(result))
+            self.write_buffer
+                .write_lp(
+                    database,
+                    body,
+                    default_time,
+                    params.accept_partial,
+                    params.precision,
+                )
+                .await?
+        };
+        self.invalidate_query_cache(Some(result.db_name.as_str()));
+
+        if let Some(reservation) = reservation {
+            reservation.complete(WriteOutcome::from(&result));
         }
+
+        write_lp_response(result)
+    }
+
+    /// Validate a write of line protocol without writing anything, responding with a summary
+    /// of what would have been written along with any lines that were invalid
+    async fn validate_lp(&self, params: WriteParams, req: Request<Body>) -> Result<Response<Body>> {
+        let body = self.read_body(req).await?;
+        let body = std::str::from_utf8(&body).map_err(Error::NonUtf8Body)?;
+
+        let database = NamespaceName::new(params.db)?;
+
+        let default_time = self.time_provider.now();
+
+        let result = self.write_buffer.validate_lp(
+            database,
+            body,
+            default_time,
+            params.accept_partial,
+            params.precision,
+        )?;
+
+        let body = serde_json::to_string(&DryRunResponse {
+            line_count: result.line_count,
+            field_count: result.field_count,
+            tag_count: result.tag_count,
+            invalid_lines: result.invalid_lines,
+        })?;
+        Response::builder()
+            .status(StatusCode::OK)
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(body))
+            .map_err(Into::into)
     }
 
     async fn query_sql(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let token = RequestToken::get(&req);
+        let if_none_match = req.headers().get(IF_NONE_MATCH).cloned();
         let QueryRequest {
             database,
             query_str,
             format,
             params,
+            no_cache,
+            pretty,
+            page_size,
+            cursor,
         } = self.extract_query_request::<String>(req).await?;
 
         info!(%database, %query_str, ?format, "handling query_sql");
+        self.authorize_database(token, &database, Action::Read)
+            .await?;
+
+        if let Some(page_size) = page_size {
+            return self
+                .query_sql_page(
+                    &database,
+                    &query_str,
+                    params,
+                    &format,
+                    pretty,
+                    page_size,
+                    cursor.as_deref(),
+                )
+                .await;
+        }
+
+        let cache_key = self.query_cache_key(
+            &database,
+            "sql",
+            &query_str,
+            &format,
+            params.as_ref(),
+            no_cache || pretty,
+        );
+        let cache_generation = self.query_cache_generation(cache_key.as_ref());
+        if let Some(body) = self.cached_query_response(cache_key.as_ref()) {
+            return query_response(&format, body, if_none_match.as_ref(), false);
+        }
 
+        let _permit = self.acquire_query_permit().await?;
         let stream = self
             .query_executor
             .query(&database, &query_str, params, QueryKind::Sql, None, None)
             .await?;
+        let (batches, partial) = collect_record_batches(stream, self.query_row_limit).await?;
+        let body = record_batches_to_bytes(batches, &format, pretty)?;
+        if !partial {
+            self.cache_query_response(cache_key, cache_generation, &body);
+        }
 
-        Response::builder()
-            .status(StatusCode::OK)
-            .header(CONTENT_TYPE, format.as_content_type())
-            .body(record_batch_stream_to_body(stream, format).await?)
-            .map_err(Into::into)
+        query_response(&format, body, if_none_match.as_ref(), partial)
     }
 
     async fn query_influxql(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let token = RequestToken::get(&req);
+        let method = req.method().clone();
+        let if_none_match = req.headers().get(IF_NONE_MATCH).cloned();
         let QueryRequest {
             database,
             query_str,
             format,
             params,
+            no_cache,
+            pretty,
+            page_size,
+            cursor,
         } = self.extract_query_request::<Option<String>>(req).await?;
 
         info!(?database, %query_str, ?format, "handling query_influxql");
+        if page_size.is_some() || cursor.is_some() {
+            return Err(PaginationError::UnsupportedQueryKind.into());
+        }
+        check_influxql_drop_method(&method, &query_str)?;
+        self.authorize_influxql(token, database.as_deref(), &query_str)
+            .await?;
+
+        // only `SELECT` statements are cached, as the others either have side effects or do not
+        // run against a single database:
+        let cache_key = match parse_influxql_statement(database.clone(), &query_str) {
+            Ok((Some(database), statement))
+                if matches!(statement.statement(), rewrite::InfluxQlStatement::Select(_))
+                    && matches!(SelectInto::parse(&query_str), Ok(None)) =>
+            {
+                self.query_cache_key(
+                    &database,
+                    "influxql",
+                    &query_str,
+                    &format,
+                    params.as_ref(),
+                    no_cache || pretty,
+                )
+            }
+            _ => None,
+        };
+        let cache_generation = self.query_cache_generation(cache_key.as_ref());
+        if let Some(body) = self.cached_query_response(cache_key.as_ref()) {
+            return query_response(&format, body, if_none_match.as_ref(), false);
+        }
 
         let stream = self
             .query_influxql_inner(database, &query_str, params)
             .await?;
+        let (batches, partial) = collect_record_batches(stream, self.query_row_limit).await?;
+        let body = record_batches_to_bytes(batches, &format, pretty)?;
+        if !partial {
+            self.cache_query_response(cache_key, cache_generation, &body);
+        }
 
-        Response::builder()
-            .status(StatusCode::OK)
-            .header(CONTENT_TYPE, format.as_content_type())
-            .body(record_batch_stream_to_body(stream, format).await?)
-            .map_err(Into::into)
+        query_response(&format, body, if_none_match.as_ref(), partial)
+    }
+
+    /// Run a SQL query for a page of at most `page_size` rows of its results, starting after the
+    /// `cursor` returned with the previous page, or from the first row if there is no cursor
+    ///
+    /// The response has the cursor for the next page in the [`NEXT_CURSOR_HEADER`], if there
+    /// are more rows. Pages are never cached, and are no larger than the limit on the number of
+    /// rows a query returns.
+    #[allow(clippy::too_many_arguments)]
+    async fn query_sql_page(
+        &self,
+        database: &str,
+        query_str: &str,
+        params: Option<StatementParams>,
+        format: &QueryFormat,
+        pretty: bool,
+        page_size: NonZeroUsize,
+        cursor: Option<&str>,
+    ) -> Result<Response<Body>> {
+        let cursor = cursor.map(Cursor::decode).transpose()?;
+        let page_size = match self.query_row_limit {
+            Some(limit) => page_size.min(limit.max_rows),
+            None => page_size,
+        };
+
+        let _permit = self.acquire_query_permit().await?;
+        // the query is planned to find the columns to order by, but is never run:
+        let key = PageKey::from_schema(
+            &self
+                .query_executor
+                .query(
+                    database,
+                    query_str,
+                    params.clone(),
+                    QueryKind::Sql,
+                    None,
+                    None,
+                )
+                .await?
+                .schema(),
+        )?;
+        // one more row than fits on the page is queried for, to tell if there is another page:
+        let page_query = key.page_query(query_str, cursor.as_ref(), page_size.get() + 1)?;
+        let stream = self
+            .query_executor
+            .query(database, &page_query, params, QueryKind::Sql, None, None)
+            .await?;
+        let (batches, more) = collect_record_batches(
+            stream,
+            Some(QueryRowLimit {
+                max_rows: page_size,
+                error_when_exceeded: false,
+            }),
+        )
+        .await?;
+        let next_cursor = if more {
+            key.next_cursor(&batches, cursor.as_ref())?
+                .map(|cursor| cursor.encode())
+        } else {
+            None
+        };
+
+        let body = record_batches_to_bytes(batches, format, pretty)?;
+        let mut response = query_response(format, body, None, false)?;
+        if let Some(next_cursor) = next_cursor {
+            response.headers_mut().insert(
+                NEXT_CURSOR_HEADER,
+                HeaderValue::from_str(&next_cursor).expect("cursors are base64 encoded"),
+            );
+        }
+        Ok(response)
+    }
+
+    /// The key that the response to a query is cached under, or `None` if the query cache is
+    /// disabled, or the client asked for the cache to be bypassed
+    ///
+    /// Pretty printed responses are not cached, as they are only meant for debugging by hand.
+    fn query_cache_key(
+        &self,
+        database: &str,
+        kind: &'static str,
+        query_str: &str,
+        format: &QueryFormat,
+        params: Option<&StatementParams>,
+        no_cache: bool,
+    ) -> Option<QueryCacheKey> {
+        if self.query_cache.is_none() || no_cache {
+            return None;
+        }
+        // parameters are sorted by name, so that the key does not depend on their order:
+        let params = match params {
+            Some(params) => match serde_json::to_value(params) {
+                Ok(serde_json::Value::Object(params)) => serde_json::to_string(
+                    &params
+                        .into_iter()
+                        .collect::<std::collections::BTreeMap<_, _>>(),
+                )
+                .ok()?,
+                _ => return None,
+            },
+            None => String::new(),
+        };
+        Some(QueryCacheKey::new(
+            database,
+            kind,
+            query_str,
+            format.as_content_type(),
+            params,
+        ))
+    }
+
+    fn cached_query_response(&self, key: Option<&QueryCacheKey>) -> Option<Bytes> {
+        let (cache, key) = self.query_cache.as_ref().zip(key)?;
+        let body = cache.get(key, self.time_provider.now())?;
+        debug!(?key, "serving query response from cache");
+        Some(body)
+    }
+
+    /// The generation of the responses cached for the database of a query, taken before the
+    /// query is run so that its response is only cached if the database was not written to
+    /// while it ran
+    fn query_cache_generation(&self, key: Option<&QueryCacheKey>) -> Option<CacheGeneration> {
+        let (cache, key) = self.query_cache.as_ref().zip(key)?;
+        Some(cache.generation(key))
+    }
+
+    fn cache_query_response(
+        &self,
+        key: Option<QueryCacheKey>,
+        generation: Option<CacheGeneration>,
+        body: &Bytes,
+    ) {
+        if let Some(((cache, key), generation)) = self.query_cache.as_ref().zip(key).zip(generation)
+        {
+            cache.insert(key, body.clone(), self.time_provider.now(), generation);
+        }
+    }
+
+    /// Remove the cached query responses for the given database, or all cached responses if no
+    /// database is given
+    fn invalidate_query_cache(&self, database: Option<&str>) {
+        match (&self.query_cache, database) {
+            (Some(cache), Some(database)) => cache.invalidate_database(database),
+            (Some(cache), None) => cache.clear(),
+            (None, _) => (),
+        }
+    }
+
+    /// Update the settings of a database, creating the database if it does not exist
+    async fn configure_database(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query = req.uri().query().ok_or(Error::MissingWriteParams)?;
+        let params: ConfigureDatabaseParams = serde_urlencoded::from_str(query)?;
+        validate_db_name(&params.db, false)?;
+        self.authorize_database(RequestToken::get(&req), &params.db, Action::Write)
+            .await?;
+        info!(?params, "configure database");
+
+        if let Some(enforce_field_types) = params.enforce_field_types {
+            self.write_buffer
+                .set_enforce_field_types(&params.db, enforce_field_types)?;
+        }
+        if let Some(max_series) = params.max_series {
+            self.write_buffer.set_max_series(&params.db, max_series)?;
+        }
+        self.invalidate_query_cache(Some(&params.db));
+
+        Ok(Response::new(Body::empty()))
     }
 
-    fn health(&self) -> Result<Response<Body>> {
-        let response_body = "OK";
-        Ok(Response::new(Body::from(response_body.to_string())))
+    /// Respond with whether the server is ready to handle writes and queries, with a
+    /// `503 Service Unavailable` status if it is not
+    async fn health(&self) -> Result<Response<Body>> {
+        let health = self.health.check().await;
+        let status = if health.is_healthy() {
+            StatusCode::OK
+        } else {
+            StatusCode::SERVICE_UNAVAILABLE
+        };
+
+        Response::builder()
+            .status(status)
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(serde_json::to_string(&health)?))
+            .map_err(Into::into)
     }
 
     fn ping(&self) -> Result<Response<Body>> {
@@ -437,6 +1140,116 @@ where
         Ok(Response::new(Body::from(body)))
     }
 
+    /// Respond with the internal state of the server as JSON, including the details of a
+    /// single database if one is given in the `db` parameter
+    async fn debug_vars(&self, req: Request<Body>) -> Result<Response<Body>> {
+        self.authorize_full_access(RequestToken::get(&req)).await?;
+        let DebugVarsParams { db } = req
+            .uri()
+            .query()
+            .map(serde_urlencoded::from_str)
+            .transpose()?
+            .unwrap_or_default();
+        let vars = DebugVars::gather(
+            &self.write_buffer.catalog(),
+            &self.common_state.metrics,
+            self.query_limit.as_ref(),
+            &self.writes_in_progress,
+            db.as_deref(),
+        )
+        .ok_or_else(|| {
+            WriteBufferError::from(CatalogError::DatabaseNotFound {
+                db_name: db.unwrap_or_default(),
+            })
+        })?;
+
+        Response::builder()
+            .status(StatusCode::OK)
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(serde_json::to_string(&vars)?))
+            .map_err(Into::into)
+    }
+
+    /// Delete each of the series selected by the request's body from the database given by
+    /// the `db` parameter, responding with the number of points deleted for each selector
+    ///
+    /// Selectors that match nothing, including those that have already been deleted, are given
+    /// a count of zero rather than being an error, so that a request can be safely repeated.
+    async fn delete_series(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query = req.uri().query().ok_or(Error::MissingWriteParams)?;
+        let DeleteSeriesParams { db } = serde_urlencoded::from_str(query)?;
+        validate_db_name(&db, true)?;
+        self.authorize_database(RequestToken::get(&req), &db, Action::Write)
+            .await?;
+        let body = self.read_body(req).await?;
+        let selectors: Vec<SeriesSelector> = serde_json::from_slice(&body)?;
+        info!(%db, n_selectors = selectors.len(), "delete series");
+
+        let db_schema = self.write_buffer.catalog().db_schema(&db).ok_or_else(|| {
+            WriteBufferError::from(CatalogError::DatabaseNotFound {
+                db_name: db.clone(),
+            })
+        })?;
+        let mut deleted = Vec::with_capacity(selectors.len());
+        for selector in selectors {
+            let predicate = DeletePredicate {
+                min_time: i64::MIN,
+                max_time: i64::MAX,
+                tags: selector.tags.clone(),
+            };
+            let points = self
+                .delete_from_table(&db, &db_schema, &selector.measurement, &predicate)
+                .await?;
+            deleted.push(DeletedSeries { selector, points });
+        }
+        self.invalidate_query_cache(Some(&db));
+
+        Response::builder()
+            .status(StatusCode::OK)
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(serde_json::to_string(&deleted)?))
+            .map_err(Into::into)
+    }
+
+    /// Rename a table, keeping the data that has already been written to it
+    ///
+    /// Queries of the table must use the new name once this returns, and writes to the old name
+    /// create a new table.
+    async fn rename_table(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query = req.uri().query().ok_or(Error::MissingWriteParams)?;
+        let RenameTableParams {
+            db,
+            table,
+            new_name,
+        } = serde_urlencoded::from_str(query)?;
+        validate_db_name(&db, true)?;
+        self.authorize_database(RequestToken::get(&req), &db, Action::Write)
+            .await?;
+        if new_name.is_empty() {
+            return Err(Error::EmptyTableName);
+        }
+        info!(%db, %table, %new_name, "rename table");
+
+        self.write_buffer.rename_table(&db, &table, &new_name)?;
+        self.invalidate_query_cache(Some(&db));
+
+        Ok(Response::new(Body::empty()))
+    }
+
+    /// Reclaim the object storage used by data that has been dropped, deleted, or has expired,
+    /// responding with a summary of what was removed once it is complete
+    async fn compact(&self, req: Request<Body>) -> Result<Response<Body>> {
+        self.authorize_full_access(RequestToken::get(&req)).await?;
+        info!("compact persisted data");
+        let summary = self.write_buffer.compact().await?;
+
+        Response::builder()
+            .status(StatusCode::OK)
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(serde_json::to_string(&summary)?))
+            .map_err(Into::into)
+    }
+
     /// Parse the request's body into raw bytes, applying the configured size
     /// limits and decoding any content encoding.
     async fn read_body(&self, req: hyper::Request<Body>) -> Result<Bytes> {
@@ -451,6 +1264,16 @@ where
             Some(v) => return Err(Error::InvalidContentEncoding(v.to_string())),
         };
 
+        // reject bodies that are declared to be too large without reading them:
+        let content_length = req
+            .headers()
+            .get(&CONTENT_LENGTH)
+            .and_then(|v| v.to_str().ok())
+            .and_then(|v| v.parse::<usize>().ok());
+        if content_length.is_some_and(|len| len > self.max_request_bytes) {
+            return Err(Error::RequestSizeExceeded(self.max_request_bytes));
+        }
+
         let mut payload = req.into_body();
 
         let mut body = BytesMut::new();
@@ -512,9 +1335,10 @@ where
                 .transpose()?
         };
 
-        // Currently we pass an empty permissions list, but in future we may be able to derive
-        // the permissions based on the incoming request
-        let permissions = self.authorizer.permissions(auth, &[]).await?;
+        // No permissions are requested here, as they depend on the database that the request
+        // is for; handlers check them with `authorize_database` once the database is known
+        let permissions = self.authorizer.permissions(auth.clone(), &[]).await?;
+        req.extensions_mut().insert(RequestToken(auth));
 
         // Extend the request with the permissions, which may be useful in future
         req.extensions_mut().insert(permissions);
@@ -522,6 +1346,96 @@ where
         Ok(())
     }
 
+    /// Check that the request's token is permitted to perform `action` on `database`
+    async fn authorize_database(
+        &self,
+        token: Option<Vec<u8>>,
+        database: &str,
+        action: Action,
+    ) -> Result<()> {
+        let action_name = match action {
+            Action::Write => "write to",
+            _ => "read from",
+        };
+        let perms = [Permission::ResourceAction(
+            Resource::Database(database.to_string()),
+            action,
+        )];
+        let forbidden = || Error::DatabaseForbidden {
+            database: database.to_string(),
+            action: action_name,
+        };
+        match self.authorizer.permissions(token, &perms).await {
+            Ok(permitted) if permitted.is_empty() => Err(forbidden()),
+            Ok(_) => Ok(()),
+            Err(authz::Error::Forbidden) => Err(forbidden()),
+            Err(e) => Err(AuthorizationError::from(e).into()),
+        }
+    }
+
+    /// Check that the request's token has full access, being permitted to read from and write to
+    /// every database, as is needed for the endpoints that act on the whole server
+    async fn authorize_full_access(&self, token: Option<Vec<u8>>) -> Result<()> {
+        let perms = [Action::Read, Action::Write].map(|action| {
+            Permission::ResourceAction(Resource::Database(ALL_DATABASES.to_string()), action)
+        });
+        match self.authorizer.permissions(token, &perms).await {
+            Ok(permitted) if permitted.len() == perms.len() => Ok(()),
+            Ok(_) | Err(authz::Error::Forbidden) => Err(Error::FullAccessForbidden),
+            Err(e) => Err(AuthorizationError::from(e).into()),
+        }
+    }
+
+    /// Check that the request's token is permitted to run an InfluxQL query, by being permitted
+    /// to write to each database that the query changes, and to read from the database that it
+    /// is run against. A query that is not run against a database, e.g., `SHOW DATABASES`,
+    /// needs full access.
+    async fn authorize_influxql(
+        &self,
+        token: Option<Vec<u8>>,
+        database: Option<&str>,
+        query_str: &str,
+    ) -> Result<()> {
+        // the query is resolved in the same way as when it is run, so a query that can not be
+        // resolved here would fail to run anyway:
+        let database = database.map(String::from);
+        let checks = if let Some(statement) = DdlStatement::parse(query_str)? {
+            let changed = match statement {
+                DdlStatement::DropDatabase { name } => name,
+                DdlStatement::DropRetentionPolicy { name, database }
+                | DdlStatement::AlterRetentionPolicy { name, database, .. } => {
+                    retention_policy_db_name(&database, &name)
+                }
+            };
+            vec![(changed, Action::Write)]
+        } else if let Some(statement) = DeleteStatement::parse(query_str)? {
+            let database =
+                resolve_delete_database(database, &statement)?.ok_or(Error::InfluxqlNoDatabase)?;
+            vec![(database, Action::Write)]
+        } else if let Some(select_into) = SelectInto::parse(query_str)? {
+            let (database, _) = parse_influxql_statement(database, &select_into.select)?;
+            let database = database.ok_or(Error::InfluxqlNoDatabase)?;
+            vec![
+                (
+                    select_into_target_database(&database, &select_into.target),
+                    Action::Write,
+                ),
+                (database, Action::Read),
+            ]
+        } else {
+            match parse_influxql_statement(database, query_str)?.0 {
+                Some(database) => vec![(database, Action::Read)],
+                None => return self.authorize_full_access(token).await,
+            }
+        };
+
+        for (database, action) in checks {
+            self.authorize_database(token.clone(), &database, action)
+                .await?;
+        }
+        Ok(())
+    }
+
     async fn extract_query_request<D: DeserializeOwned>(
         &self,
         req: Request<Body>,
@@ -529,7 +1443,7 @@ where
         let header_format = QueryFormat::try_from_headers(req.headers())?;
         let request = match *req.method() {
             Method::GET => {
-                let query = req.uri().query().ok_or(Error::MissingQueryParams)?;
+                let query = query_string(&req)?;
                 let r = serde_urlencoded::from_str::<QueryRequest<D, Option<QueryFormat>, String>>(
                     query,
                 )?;
@@ -538,6 +1452,10 @@ where
                     query_str: r.query_str,
                     format: r.format,
                     params: r.params.map(|s| serde_json::from_str(&s)).transpose()?,
+                    no_cache: r.no_cache,
+                    pretty: r.pretty,
+                    page_size: r.page_size,
+                    cursor: r.cursor,
                 }
             }
             Method::POST => {
@@ -552,40 +1470,92 @@ where
             query_str: request.query_str,
             format: request.format.unwrap_or(header_format),
             params: request.params,
+            no_cache: request.no_cache,
+            pretty: request.pretty,
+            page_size: request.page_size,
+            cursor: request.cursor,
         })
     }
 
+    /// Wait to be allowed to run a query, if the number of queries that run at once is limited
+    ///
+    /// The query may run for as long as the returned permit is held.
+    async fn acquire_query_permit(&self) -> Result<Option<QueryPermit>> {
+        let Some(limit) = &self.query_limit else {
+            return Ok(None);
+        };
+        limit
+            .acquire()
+            .await
+            .map(Some)
+            .map_err(|_| Error::QueryLimit)
+    }
+
     /// Inner function for performing InfluxQL queries
     ///
     /// This is used by both the `/api/v3/query_influxql` and `/api/v1/query`
-    /// APIs.
+    /// APIs. The query counts towards the limit on running queries until the returned stream
+    /// is dropped.
     async fn query_influxql_inner(
         &self,
         database: Option<String>,
         query_str: &str,
         params: Option<StatementParams>,
     ) -> Result<SendableRecordBatchStream> {
-        let mut statements = rewrite::parse_statements(query_str)?;
-
-        if statements.len() != 1 {
-            return Err(Error::InfluxqlSingleStatement);
-        }
-        let statement = statements.pop().unwrap();
-
-        let database = match (database, statement.resolve_dbrp()) {
-            (None, None) => None,
-            (None, Some(db)) | (Some(db), None) => Some(db),
-            (Some(p), Some(q)) => {
-                if p == q {
-                    Some(p)
-                } else {
-                    return Err(Error::InfluxqlDatabaseMismatch {
-                        param_db: p,
-                        query_db: q,
-                    });
-                }
-            }
-        };
+        let permit = self.acquire_query_permit().await?;
+        let stream = self
+            .run_influxql_statement(database, query_str, params)
+            .await?;
+        Ok(match permit {
+            Some(permit) => permit.hold_for(stream),
+            None => stream,
+        })
+    }
+
+    /// Apply the limit on the number of rows that a query returns, if one is set, to the results
+    /// of a query
+    ///
+    /// The results are collected, so that a query over the limit fails before any of them are
+    /// sent, and `true` is returned along with them if they were truncated to the limit.
+    async fn limit_query_rows(
+        &self,
+        stream: SendableRecordBatchStream,
+    ) -> Result<(SendableRecordBatchStream, bool)> {
+        if self.query_row_limit.is_none() {
+            return Ok((stream, false));
+        }
+        let schema = stream.schema();
+        let (batches, partial) = collect_record_batches(stream, self.query_row_limit).await?;
+        Ok((
+            Box::pin(MemoryStream::new_with_schema(batches, schema)),
+            partial,
+        ))
+    }
+
+    /// Run an InfluxQL query, without regard to the limit on running queries
+    async fn run_influxql_statement(
+        &self,
+        database: Option<String>,
+        query_str: &str,
+        params: Option<StatementParams>,
+    ) -> Result<SendableRecordBatchStream> {
+        if let Some(statement) = DdlStatement::parse(query_str)? {
+            let result = self.influxql_ddl(statement);
+            self.invalidate_query_cache(None);
+            return result;
+        }
+        if let Some(statement) = DeleteStatement::parse(query_str)? {
+            let result = self.influxql_delete(database, statement).await;
+            self.invalidate_query_cache(None);
+            return result;
+        }
+        if let Some(select_into) = SelectInto::parse(query_str)? {
+            return self
+                .influxql_select_into(database, select_into, params)
+                .await;
+        }
+
+        let (database, statement) = parse_influxql_statement(database, query_str)?;
 
         if statement.statement().is_show_databases() {
             self.query_executor.show_databases()
@@ -613,6 +1583,413 @@ where
         }
         .map_err(Into::into)
     }
+
+    /// Handle an InfluxQL `SELECT` statement with an `INTO` clause, by running the `SELECT` and
+    /// writing its results to the target measurement
+    ///
+    /// Responds with the number of points that were written to the target.
+    async fn influxql_select_into(
+        &self,
+        database: Option<String>,
+        select_into: SelectInto,
+        params: Option<StatementParams>,
+    ) -> Result<SendableRecordBatchStream> {
+        info!(?select_into, "handling InfluxQL SELECT INTO statement");
+        let SelectInto { target, select } = select_into;
+
+        let (database, statement) = parse_influxql_statement(database, &select)?;
+        let Some(database) = database else {
+            return Err(Error::InfluxqlNoDatabase);
+        };
+        let target_db = select_into_target_database(&database, &target);
+        validate_db_name(&target_db, true)?;
+
+        let batches: Vec<RecordBatch> = self
+            .query_executor
+            .query(
+                &database,
+                &statement.to_statement().to_string(),
+                params,
+                QueryKind::InfluxQl,
+                None,
+                None,
+            )
+            .await?
+            .try_collect()
+            .await?;
+        let (lp, line_count) = record_batches_to_lp(&target.measurement, &batches)?;
+
+        if line_count > 0 {
+            self.write_buffer
+                .write_lp(
+                    NamespaceName::new(target_db.clone())?,
+                    &lp,
+                    self.time_provider.now(),
+                    false,
+                    Precision::Nanosecond,
+                )
+                .await?;
+            self.invalidate_query_cache(Some(&target_db));
+        }
+
+        influxql_count_result("written", line_count as i64)
+    }
+
+    /// Handle an InfluxQL `DELETE` statement, by deleting the points matching its predicate from
+    /// each of the measurements that it applies to
+    ///
+    /// Responds with the number of points that were deleted, which is approximate, see
+    /// [`Self::delete_from_table`]. Points written after the delete are not deleted by it.
+    async fn influxql_delete(
+        &self,
+        database: Option<String>,
+        statement: DeleteStatement,
+    ) -> Result<SendableRecordBatchStream> {
+        info!(?statement, "handling InfluxQL DELETE statement");
+        let Some(database) = resolve_delete_database(database, &statement)? else {
+            return Err(Error::InfluxqlNoDatabase);
+        };
+        let DeleteStatement {
+            measurement,
+            predicate,
+            ..
+        } = statement;
+        let catalog = self.write_buffer.catalog();
+        let db_schema = catalog.db_schema(&database).ok_or_else(|| {
+            WriteBufferError::from(CatalogError::DatabaseNotFound {
+                db_name: database.clone(),
+            })
+        })?;
+
+        let tables = match measurement {
+            Some(measurement) => vec![measurement],
+            None => db_schema.table_names(),
+        };
+        let mut deleted = 0;
+        for table in tables {
+            deleted += self
+                .delete_from_table(&database, &db_schema, &table, &predicate)
+                .await?;
+        }
+
+        influxql_count_result("deleted", deleted)
+    }
+
+    /// Delete the points of the given table that match the predicate, returning the number of
+    /// points that were deleted
+    ///
+    /// Points that have already been deleted are not counted, so repeating a delete gives a
+    /// count of zero, as does a table that does not exist.
+    ///
+    /// The count is approximate: the points are counted by a query made before the delete, not
+    /// by the delete itself, so points that match the predicate and are written, or deleted by
+    /// another delete, between the two are counted wrongly. If none are counted, nothing is
+    /// deleted, so a matching point written in between is also left in place.
+    async fn delete_from_table(
+        &self,
+        database: &str,
+        db_schema: &DatabaseSchema,
+        table: &str,
+        predicate: &DeletePredicate,
+    ) -> Result<i64> {
+        // a predicate on a tag that the table does not have can not match any points:
+        let Some(schema) = db_schema.get_table_schema(table) else {
+            return Ok(0);
+        };
+        if !predicate
+            .tags
+            .keys()
+            .all(|tag| matches!(schema.field_by_name(tag), Some((InfluxColumnType::Tag, _))))
+        {
+            return Ok(0);
+        }
+
+        let count = self
+            .count_influxql_delete(database, table, predicate)
+            .await?;
+        // nothing is deleted from tables without matching points, so that there is nothing
+        // for queries of those tables to filter out:
+        if count > 0 {
+            self.write_buffer
+                .delete_rows(database, table, predicate.clone())?;
+        }
+        Ok(count)
+    }
+
+    /// Count the points of the given table that would be deleted by the given predicate,
+    /// excluding those that have already been deleted, as of the time of the count
+    async fn count_influxql_delete(
+        &self,
+        database: &str,
+        table: &str,
+        predicate: &DeletePredicate,
+    ) -> Result<i64> {
+        let mut conditions = vec![];
+        if predicate.min_time != i64::MIN {
+            conditions.push(format!(
+                "{TIME_COLUMN_NAME} >= arrow_cast({}, 'Timestamp(Nanosecond, None)')",
+                predicate.min_time
+            ));
+        }
+        if predicate.max_time != i64::MAX {
+            conditions.push(format!(
+                "{TIME_COLUMN_NAME} <= arrow_cast({}, 'Timestamp(Nanosecond, None)')",
+                predicate.max_time
+            ));
+        }
+        for (tag, value) in &predicate.tags {
+            conditions.push(format!(
+                "\"{}\" = '{}'",
+                tag.replace('"', "\"\""),
+                value.replace('\'', "''")
+            ));
+        }
+        let mut query = format!("SELECT COUNT(*) FROM \"{}\"", table.replace('"', "\"\""));
+        if !conditions.is_empty() {
+            query.push_str(" WHERE ");
+            query.push_str(&conditions.join(" AND "));
+        }
+
+        let batches: Vec<RecordBatch> = self
+            .query_executor
+            .query(database, &query, None, QueryKind::Sql, None, None)
+            .await?
+            .try_collect()
+            .await?;
+        Ok(batches
+            .iter()
+            .find(|batch| batch.num_rows() > 0)
+            .and_then(|batch| batch.column(0).as_any().downcast_ref::<Int64Array>())
+            .map(|counts| counts.value(0))
+            .unwrap_or_default())
+    }
+
+    /// Handle an InfluxQL `DROP DATABASE`, `DROP RETENTION POLICY`, or `ALTER RETENTION POLICY`
+    /// statement
+    ///
+    /// Retention policies are stored as databases named `<db_name>/<rp_name>`, so dropping
+    /// a database will also drop each of its retention policies. The `autogen` retention policy
+    /// refers to the database itself, and is always the default retention policy.
+    fn influxql_ddl(&self, statement: DdlStatement) -> Result<SendableRecordBatchStream> {
+        info!(?statement, "handling InfluxQL DDL statement");
+        match statement {
+            DdlStatement::DropDatabase { name } => {
+                let rp_prefix = format!("{name}{V1_NAMESPACE_RP_SEPARATOR}");
+                let mut db_names: Vec<String> = self
+                    .write_buffer
+                    .catalog()
+                    .list_databases()
+                    .into_iter()
+                    .filter(|db| db == &name || db.starts_with(&rp_prefix))
+                    .collect();
+                // if nothing matched, the drop below will produce a not found error:
+                if db_names.is_empty() {
+                    db_names.push(name);
+                }
+                for db_name in db_names {
+                    self.write_buffer.drop_database(&db_name)?;
+                }
+            }
+            DdlStatement::DropRetentionPolicy { name, database } => {
+                self.write_buffer
+                    .drop_database(&retention_policy_db_name(&database, &name))?;
+            }
+            DdlStatement::AlterRetentionPolicy {
+                name,
+                database,
+                duration,
+                // there is only ever a single replica of the data, so this has no effect
+                replication: _,
+                default,
+            } => {
+                if default && name != AUTOGEN_RETENTION_POLICY {
+                    return Err(Error::InfluxqlDefaultRetentionPolicy);
+                }
+                let db_name = retention_policy_db_name(&database, &name);
+                match duration {
+                    Some(retention_period_ns) => self
+                        .write_buffer
+                        .set_retention_period(&db_name, retention_period_ns)?,
+                    None if self.write_buffer.catalog().db_schema(&db_name).is_none() => {
+                        return Err(WriteBufferError::from(CatalogError::DatabaseNotFound {
+                            db_name,
+                        })
+                        .into())
+                    }
+                    None => (),
+                }
+            }
+        }
+
+        Ok(Box::pin(MemoryStream::new_with_schema(
+            vec![],
+            Arc::new(Schema::empty()),
+        )))
+    }
+}
+
+/// The result of an InfluxQL statement that modifies data, being a single row giving the number
+/// of points that were modified in the column with the given name
+fn influxql_count_result(column: &str, count: i64) -> Result<SendableRecordBatchStream> {
+    let schema = Arc::new(Schema::new(vec![
+        Field::new(INFLUXQL_MEASUREMENT_COLUMN_NAME, DataType::Utf8, false),
+        Field::new(
+            TIME_COLUMN_NAME,
+            DataType::Timestamp(TimeUnit::Nanosecond, None),
+            false,
+        ),
+        Field::new(column, DataType::Int64, false),
+    ]));
+    let batch = RecordBatch::try_new(
+        Arc::clone(&schema),
+        vec![
+            Arc::new(StringArray::from(vec!["result"])),
+            Arc::new(TimestampNanosecondArray::from(vec![0])),
+            Arc::new(Int64Array::from(vec![count])),
+        ],
+    )?;
+    Ok(Box::pin(MemoryStream::new_with_schema(vec![batch], schema)))
+}
+
+/// Parse a single InfluxQL statement from the query string, and resolve the database that it
+/// is run against, from either the given `database` or the statement itself
+///
+/// A database and retention policy given in the statement, e.g., `"foo"."bar".cpu`, take
+/// precedence over the given `database`, so long as they refer to the same database.
+fn parse_influxql_statement(
+    database: Option<String>,
+    query_str: &str,
+) -> Result<(
+    Option<String>,
+    rewrite::Rewritten<rewrite::InfluxQlStatement>,
+)> {
+    let mut statements = rewrite::parse_statements(query_str)?;
+
+    if statements.len() != 1 {
+        return Err(Error::InfluxqlSingleStatement);
+    }
+    let statement = statements.pop().unwrap();
+
+    let query_db =
+        statement
+            .resolve_dbrp()
+            .map(|dbrp| match dbrp.split_once(V1_NAMESPACE_RP_SEPARATOR) {
+                Some((db, rp)) => retention_policy_db_name(db, rp),
+                None => dbrp,
+            });
+
+    Ok((resolve_influxql_database(database, query_db)?, statement))
+}
+
+/// Resolve the database that a `DELETE` statement is run against, from the `database` it was
+/// given and the database and retention policy that may qualify its measurement
+fn resolve_delete_database(
+    database: Option<String>,
+    statement: &DeleteStatement,
+) -> Result<Option<String>> {
+    let query_db = match (&statement.database, &statement.retention_policy) {
+        (Some(db), Some(rp)) => Some(retention_policy_db_name(db, rp)),
+        (Some(db), None) => Some(db.clone()),
+        // a retention policy without a database is in the database the statement is run against:
+        (None, Some(rp)) => {
+            let Some(db) = &database else {
+                return Err(Error::InfluxqlNoDatabase);
+            };
+            let db = db
+                .split(V1_NAMESPACE_RP_SEPARATOR)
+                .next()
+                .unwrap_or_default();
+            Some(retention_policy_db_name(db, rp))
+        }
+        (None, None) => None,
+    };
+    resolve_influxql_database(database, query_db)
+}
+
+/// Resolve the database that a `SELECT INTO` statement run against `database` writes to
+///
+/// A target without a database is written to the database that the query is run against, and
+/// the default retention policy of that database if it has no retention policy.
+fn select_into_target_database(database: &str, target: &IntoTarget) -> String {
+    let target_db = target.database.clone().unwrap_or_else(|| {
+        database
+            .split(V1_NAMESPACE_RP_SEPARATOR)
+            .next()
+            .unwrap_or_default()
+            .to_string()
+    });
+    match &target.retention_policy {
+        Some(rp) => retention_policy_db_name(&target_db, rp),
+        None => target_db,
+    }
+}
+
+/// Resolve the database that an InfluxQL statement is run against, from the `database` it was
+/// given and the `query_db` named in the statement itself, which take precedence so long as
+/// they refer to the same database
+fn resolve_influxql_database(
+    database: Option<String>,
+    query_db: Option<String>,
+) -> Result<Option<String>> {
+    let database = match (database, query_db) {
+        (None, None) => None,
+        (None, Some(db)) | (Some(db), None) => Some(db),
+        (Some(p), Some(q)) => {
+            // the parameter may only give the database, with the retention policy in the query:
+            let q_base = q
+                .split(V1_NAMESPACE_RP_SEPARATOR)
+                .next()
+                .unwrap_or_default();
+            if p == q || p == q_base {
+                Some(q)
+            } else {
+                return Err(Error::InfluxqlDatabaseMismatch {
+                    param_db: p,
+                    query_db: q,
+                });
+            }
+        }
+    };
+
+    Ok(database)
+}
+
+/// Check that an InfluxQL `DROP` statement was sent in a `POST` request, so that data can not be
+/// dropped by a request that is expected to be safe, e.g., by following a link
+fn check_influxql_drop_method(method: &Method, query_str: &str) -> Result<()> {
+    if *method != Method::POST
+        && DdlStatement::parse(query_str)?.is_some_and(|statement| statement.is_drop())
+    {
+        return Err(Error::InfluxqlDropRequiresPost);
+    }
+    Ok(())
+}
+
+/// Get the query string of the URI of a request for a query
+fn query_string(req: &Request<Body>) -> Result<&str> {
+    let query = req.uri().query().ok_or(Error::MissingQueryParams)?;
+    if query.len() > MAX_QUERY_STRING_BYTES {
+        return Err(Error::QueryStringTooLong(query.len()));
+    }
+    Ok(query)
+}
+
+/// Produce the response for a write of line protocol from its result
+fn write_lp_response(result: BufferedWriteRequest) -> Result<Response<Body>> {
+    if result.invalid_lines.is_empty() {
+        Ok(Response::new(Body::empty()))
+    } else {
+        Err(Error::PartialLpWrite(result))
+    }
+}
+
+/// Get the name of the database that stores the data for the given retention policy
+fn retention_policy_db_name(database: &str, retention_policy: &str) -> String {
+    if retention_policy == AUTOGEN_RETENTION_POLICY {
+        database.to_string()
+    } else {
+        format!("{database}{V1_NAMESPACE_RP_SEPARATOR}{retention_policy}")
+    }
 }
 
 #[derive(Debug, Deserialize)]
@@ -638,28 +2015,68 @@ fn extract_v1_auth_token(req: &mut Request<Body>) -> Option<Vec<u8>> {
         .map(String::into_bytes)
 }
 
+/// Get the token from an `Authorization` header, which may use any of the following schemes:
+///
+/// - `Bearer <token>`
+/// - `Token <token>`, as used by the v2 API
+/// - `Basic <credentials>`, where the password in the credentials is the token, as with the
+///   `p` parameter of the v1 API
 fn validate_auth_header(header: HeaderValue) -> Result<Vec<u8>, AuthorizationError> {
     // Split the header value into two parts
     let mut header = header.to_str()?.split(' ');
 
-    // Check that the header is the 'Bearer' auth scheme
-    let bearer = header.next().ok_or(AuthorizationError::MalformedRequest)?;
-    if bearer != "Bearer" {
+    // Check that the header is one of the supported auth schemes
+    let scheme = header.next().ok_or(AuthorizationError::MalformedRequest)?;
+    if !matches!(scheme, "Bearer" | "Token" | "Basic") {
         return Err(AuthorizationError::MalformedRequest);
     }
 
     // Get the token that we want to hash to check the request is valid
     let token = header.next().ok_or(AuthorizationError::MalformedRequest)?;
 
-    // There should only be two parts the 'Bearer' scheme and the actual
+    // There should only be two parts the auth scheme and the actual
     // token, error otherwise
     if header.next().is_some() {
         return Err(AuthorizationError::MalformedRequest);
     }
 
+    if scheme == "Basic" {
+        // Basic credentials are base64 encoded as `<username>:<password>`, the username is
+        // ignored as tokens are not associated with users
+        let credentials = base64::engine::general_purpose::STANDARD
+            .decode(token)
+            .map_err(|_| AuthorizationError::MalformedRequest)?;
+        let password_start = credentials
+            .iter()
+            .position(|b| *b == b':')
+            .ok_or(AuthorizationError::MalformedRequest)?
+            + 1;
+        return Ok(credentials[password_start..].to_vec());
+    }
+
     Ok(token.as_bytes().to_vec())
 }
 
+/// The token that a request was authorized with, kept so that handlers can check the
+/// permissions that it has on the database that the request is for
+#[derive(Clone)]
+struct RequestToken(Option<Vec<u8>>);
+
+impl RequestToken {
+    fn get(req: &Request<Body>) -> Option<Vec<u8>> {
+        req.extensions()
+            .get::<Self>()
+            .and_then(|token| token.0.clone())
+    }
+}
+
+// The token is not included, so that it is not logged by accident:
+impl Debug for RequestToken {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("RequestToken(..)")
+    }
+}
+
 impl From<authz::Error> for AuthorizationError {
     fn from(auth_error: authz::Error) -> Self {
         match auth_error {
@@ -747,6 +2164,19 @@ pub(crate) struct QueryRequest<D, F, P> {
     pub(crate) query_str: String,
     pub(crate) format: F,
     pub(crate) params: Option<P>,
+    /// Bypass the query cache, neither serving the response from it nor caching the response
+    #[serde(default)]
+    pub(crate) no_cache: bool,
+    /// Indent the response, which only applies to the `json` format
+    #[serde(default)]
+    pub(crate) pretty: bool,
+    /// Return a page of at most this many rows of the results, which is only supported for SQL
+    /// queries
+    #[serde(default)]
+    pub(crate) page_size: Option<NonZeroUsize>,
+    /// The cursor returned with the previous page of the results, to get the page after it
+    #[serde(default)]
+    pub(crate) cursor: Option<String>,
 }
 
 #[derive(Debug, thiserror::Error)]
@@ -767,6 +2197,7 @@ pub(crate) enum QueryFormat {
     Csv,
     Pretty,
     Json,
+    Protobuf,
 }
 
 impl QueryFormat {
@@ -776,6 +2207,7 @@ impl QueryFormat {
             Self::Csv => "text/csv",
             Self::Pretty => "text/plain; charset=utf-8",
             Self::Json => "application/json",
+            Self::Protobuf => "application/x-protobuf",
         }
     }
 
@@ -789,6 +2221,7 @@ impl QueryFormat {
             Some(b"application/vnd.apache.parquet") => Ok(Self::Parquet),
             Some(b"text/csv") => Ok(Self::Csv),
             Some(b"text/plain") => Ok(Self::Pretty),
+            Some(b"application/x-protobuf") => Ok(Self::Protobuf),
             Some(b"application/json" | b"*/*") | None => Ok(Self::Json),
             Some(mime_type) => match String::from_utf8(mime_type.to_vec()) {
                 Ok(s) => Err(QueryParamsError::InvalidMimeType(s).into()),
@@ -798,17 +2231,101 @@ impl QueryFormat {
     }
 }
 
-async fn record_batch_stream_to_body(
-    stream: Pin<Box<dyn RecordBatchStream + Send>>,
-    format: QueryFormat,
-) -> Result<Body, Error> {
-    fn to_json(batches: Vec<RecordBatch>) -> Result<Bytes> {
+/// Produce the response to a query from its serialized results
+///
+/// The response has an `ETag` derived from the results, so that clients polling the same query
+/// can send it back in an `If-None-Match` header, and get a `304 Not Modified` response with no
+/// body if the results have not changed. Results that were truncated by the limit on the number
+/// of rows a query returns are marked as `partial` with a header.
+fn query_response(
+    format: &QueryFormat,
+    body: Bytes,
+    if_none_match: Option<&HeaderValue>,
+    partial: bool,
+) -> Result<Response<Body>> {
+    let etag = format!("\"{}\"", hex::encode(&Sha256::digest(&body)[..16]));
+    if if_none_match
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|v| etag_matches(v, &etag))
+    {
+        return Response::builder()
+            .status(StatusCode::NOT_MODIFIED)
+            .header(ETAG, etag)
+            .body(Body::empty())
+            .map_err(Into::into);
+    }
+    let mut builder = Response::builder()
+        .status(StatusCode::OK)
+        .header(CONTENT_TYPE, format.as_content_type())
+        .header(ETAG, etag);
+    if partial {
+        builder = builder.header(PARTIAL_RESULTS_HEADER, "true");
+    }
+    builder.body(Body::from(body)).map_err(Into::into)
+}
+
+/// Whether the value of an `If-None-Match` header, which is a list of entity tags or `*`,
+/// matches the given entity tag
+///
+/// As per RFC 9110, the comparison is weak, so a `W/` prefix on the tags is ignored.
+fn etag_matches(if_none_match: &str, etag: &str) -> bool {
+    let etag = etag.trim_start_matches("W/");
+    if_none_match
+        .split(',')
+        .map(str::trim)
+        .any(|tag| tag == "*" || tag.trim_start_matches("W/") == etag)
+}
+
+/// Collect the results of a query, up to the limit on the number of rows if one is set
+///
+/// Once the limit is exceeded the rest of the results are not read, and either an error is
+/// returned, or the results are truncated to the limit, and `true` is returned to say that
+/// they are partial.
+async fn collect_record_batches(
+    mut stream: SendableRecordBatchStream,
+    row_limit: Option<QueryRowLimit>,
+) -> Result<(Vec<RecordBatch>, bool)> {
+    let Some(QueryRowLimit {
+        max_rows,
+        error_when_exceeded,
+    }) = row_limit
+    else {
+        return Ok((stream.try_collect().await?, false));
+    };
+
+    let max_rows = max_rows.get();
+    let mut batches = vec![];
+    let mut rows = 0;
+    while let Some(batch) = stream.try_next().await? {
+        if rows + batch.num_rows() > max_rows {
+            if error_when_exceeded {
+                return Err(Error::QueryRowLimit(max_rows));
+            }
+            batches.push(batch.slice(0, max_rows - rows));
+            return Ok((batches, true));
+        }
+        rows += batch.num_rows();
+        batches.push(batch);
+    }
+    Ok((batches, false))
+}
+
+fn record_batches_to_bytes(
+    batches: Vec<RecordBatch>,
+    format: &QueryFormat,
+    pretty: bool,
+) -> Result<Bytes, Error> {
+    fn to_json(batches: Vec<RecordBatch>, pretty: bool) -> Result<Bytes> {
         let batches: Vec<&RecordBatch> = batches.iter().collect();
         // See https://github.com/influxdata/influxdb/issues/24981
         #[allow(deprecated)]
-        Ok(Bytes::from(serde_json::to_string(
-            &arrow_json::writer::record_batches_to_json_rows(batches.as_slice())?,
-        )?))
+        let rows = arrow_json::writer::record_batches_to_json_rows(batches.as_slice())?;
+        let json = if pretty {
+            serde_json::to_string_pretty(&rows)?
+        } else {
+            serde_json::to_string(&rows)?
+        };
+        Ok(Bytes::from(json))
     }
 
     fn to_csv(batches: Vec<RecordBatch>) -> Result<Bytes> {
@@ -839,15 +2356,17 @@ async fn record_batch_stream_to_body(
         Ok(Bytes::from(bytes))
     }
 
-    let batches = stream.try_collect::<Vec<RecordBatch>>().await?;
+    fn to_protobuf(batches: Vec<RecordBatch>) -> Result<Bytes> {
+        Ok(Bytes::from(record_batches_to_protobuf(&batches)?))
+    }
 
     match format {
         QueryFormat::Pretty => to_pretty(batches),
         QueryFormat::Parquet => to_parquet(batches),
         QueryFormat::Csv => to_csv(batches),
-        QueryFormat::Json => to_json(batches),
+        QueryFormat::Json => to_json(batches, pretty),
+        QueryFormat::Protobuf => to_protobuf(batches),
     }
-    .map(Body::from)
 }
 
 // This is a hack around the fact that bool default is false not true
@@ -863,6 +2382,82 @@ pub(crate) struct WriteParams {
     pub(crate) precision: Precision,
 }
 
+/// The `dry` parameter that can be passed to any of the write endpoints, to validate a write
+/// without performing it
+#[derive(Debug, Default, Deserialize)]
+struct DryRunParams {
+    #[serde(default)]
+    dry: bool,
+}
+
+/// The `no_sync` parameter that can be passed to any of the write endpoints, to have the write
+/// acknowledged once it is validated and queued, rather than once it is durable in the WAL and
+/// can be queried, trading durability for lower latency
+///
+/// A write acknowledged this way is lost if the server stops before it reaches the WAL, and if
+/// it then fails to be written, the client is never told, as the error is only logged.
+#[derive(Debug, Default, Deserialize)]
+struct NoSyncParams {
+    #[serde(default)]
+    no_sync: bool,
+}
+
+/// The parameters of the `/debug/vars` endpoint
+#[derive(Debug, Default, Deserialize)]
+struct DebugVarsParams {
+    db: Option<String>,
+}
+
+/// The summary of a write of line protocol that was validated without being performed
+#[derive(Debug, Serialize)]
+struct DryRunResponse {
+    line_count: usize,
+    field_count: usize,
+    tag_count: usize,
+    invalid_lines: Vec<WriteLineError>,
+}
+
+/// The parameters of the delete series endpoint
+#[derive(Debug, Deserialize)]
+struct DeleteSeriesParams {
+    db: String,
+}
+
+/// The parameters of the rename table endpoint
+#[derive(Debug, Deserialize)]
+struct RenameTableParams {
+    db: String,
+    table: String,
+    new_name: String,
+}
+
+/// Selects the series of a measurement to delete, being those with all of the given tag
+/// values, or every series of the measurement if no tags are given
+#[derive(Debug, Serialize, Deserialize)]
+struct SeriesSelector {
+    measurement: String,
+    #[serde(default)]
+    tags: BTreeMap<String, String>,
+}
+
+/// The number of points deleted for a [`SeriesSelector`]
+#[derive(Debug, Serialize)]
+struct DeletedSeries {
+    #[serde(flatten)]
+    selector: SeriesSelector,
+    points: i64,
+}
+
+/// The settings of a database that can be updated through the configure database endpoint,
+/// each being left unchanged if not provided
+#[derive(Debug, Deserialize)]
+struct ConfigureDatabaseParams {
+    db: String,
+    enforce_field_types: Option<bool>,
+    /// The most series that can be written to the database, `0` meaning there is no limit
+    max_series: Option<usize>,
+}
+
 impl From<iox_http::write::WriteParams> for WriteParams {
     fn from(legacy: iox_http::write::WriteParams) -> Self {
         Self {
@@ -875,6 +2470,22 @@ impl From<iox_http::write::WriteParams> for WriteParams {
 }
 
 pub(crate) async fn route_request<W: WriteBuffer, Q: QueryExecutor, T: TimeProvider>(
+    http_server: Arc<HttpApi<W, Q, T>>,
+    req: Request<Body>,
+) -> Result<Response<Body>, Infallible>
+where
+    Error: From<<Q as QueryExecutor>::Error>,
+{
+    let request_log = RequestLog::new(&req);
+    let mut response = route_request_inner(Arc::clone(&http_server), req).await?;
+    http_server
+        .http_metrics
+        .record(request_log.path(), response.status(), request_log.elapsed());
+    request_log.finish(&mut response);
+    Ok(response)
+}
+
+async fn route_request_inner<W: WriteBuffer, Q: QueryExecutor, T: TimeProvider>(
     http_server: Arc<HttpApi<W, Q, T>>,
     mut req: Request<Body>,
 ) -> Result<Response<Body>, Infallible>
@@ -893,7 +2504,8 @@ where
                 return Ok(Response::builder()
                     .status(StatusCode::BAD_REQUEST)
                     .body(Body::from("{\"error\":\
-                        \"Authorization header was malformed and should be in the form 'Authorization: Bearer <token>'\"\
+                        \"Authorization header was malformed and should be in the form 'Authorization: Bearer <token>', \
+                        'Authorization: Token <token>', or 'Authorization: Basic <credentials>'\"\
                     }"))
                     .unwrap());
             }
@@ -937,14 +2549,22 @@ where
             http_server.write_lp_inner(params, req, false).await
         }
         (Method::POST, "/api/v3/write_lp") => http_server.write_lp(req).await,
+        (Method::POST, "/api/v3/import") => http_server.import_lp(req).await,
+        (Method::POST, "/api/v3/write_stream") => Arc::clone(&http_server).write_stream(req).await,
+        (Method::POST, "/api/v3/configure/database") => http_server.configure_database(req).await,
         (Method::GET | Method::POST, "/api/v3/query_sql") => http_server.query_sql(req).await,
         (Method::GET | Method::POST, "/api/v3/query_influxql") => {
             http_server.query_influxql(req).await
         }
         (Method::GET, "/query") => http_server.v1_query(req).await,
-        (Method::GET, "/health" | "/api/v1/health") => http_server.health(),
+        (Method::POST, "/query") => http_server.v1_query_post(req).await,
+        (Method::GET, "/health" | "/api/v1/health") => http_server.health().await,
         (Method::GET | Method::POST, "/ping") => http_server.ping(),
         (Method::GET, "/metrics") => http_server.handle_metrics(),
+        (Method::GET, "/debug/vars") => http_server.debug_vars(req).await,
+        (Method::POST, "/api/v3/maintenance/compact") => http_server.compact(req).await,
+        (Method::POST, "/api/v3/delete_series") => http_server.delete_series(req).await,
+        (Method::POST, "/api/v3/rename_table") => http_server.rename_table(req).await,
         _ => {
             let body = Body::from("not found");
             Ok(Response::builder()
@@ -984,6 +2604,7 @@ fn legacy_write_error_to_response(e: WriteParseError) -> Response<Body> {
 
 #[cfg(test)]
 mod tests {
+    use super::etag_matches;
     use super::validate_db_name;
     use super::ValidateDbNameError;
 
@@ -1013,4 +2634,15 @@ mod tests {
         assert_validate_db_name!("_foo", false, Err(ValidateDbNameError::InvalidStartChar));
         assert_validate_db_name!("", false, Err(ValidateDbNameError::Empty));
     }
+
+    #[test]
+    fn test_etag_matches() {
+        let etag = r#""abc""#;
+        assert!(etag_matches(r#""abc""#, etag));
+        assert!(etag_matches(r#"W/"abc""#, etag));
+        assert!(etag_matches(r#""xyz", "abc""#, etag));
+        assert!(etag_matches("*", etag));
+        assert!(!etag_matches(r#""xyz""#, etag));
+        assert!(!etag_matches("", etag));
+    }
 }
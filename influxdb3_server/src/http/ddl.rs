@@ -0,0 +1,476 @@
+//! Parsing of InfluxQL statements that manage databases and retention policies
+//!
+//! The `DROP DATABASE`, `DROP RETENTION POLICY`, and `ALTER RETENTION POLICY` statements are
+//! not supported by the InfluxQL parser used for query planning, so they are detected and
+//! handled before a query string is passed along to be parsed and planned.
+
+use std::iter::Peekable;
+use std::str::Chars;
+
+/// A statement that manages a database, or one of its retention policies
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) enum DdlStatement {
+    /// `DROP DATABASE <name>`
+    DropDatabase { name: String },
+    /// `DROP RETENTION POLICY <name> ON <database>`
+    DropRetentionPolicy { name: String, database: String },
+    /// `ALTER RETENTION POLICY <name> ON <database> [DURATION <duration>]
+    /// [REPLICATION <n>] [DEFAULT]`
+    AlterRetentionPolicy {
+        name: String,
+        database: String,
+        /// The new duration of the retention policy, `Some(None)` means infinite
+        duration: Option<Option<i64>>,
+        replication: Option<u32>,
+        default: bool,
+    },
+}
+
+#[derive(Debug, thiserror::Error)]
+pub enum DdlStatementError {
+    #[error("expected {0} in statement")]
+    Expected(&'static str),
+    #[error("unexpected token in statement: {0}")]
+    UnexpectedToken(String),
+    #[error("unterminated quoted identifier in statement")]
+    UnterminatedIdentifier,
+    #[error("invalid duration: {0}")]
+    InvalidDuration(String),
+    #[error("retention policy duration must be positive, or INF")]
+    NonPositiveDuration,
+    #[error("invalid replication factor: {0}, must be a positive integer")]
+    InvalidReplication(String),
+    #[error("{0} specified more than once in ALTER RETENTION POLICY statement")]
+    DuplicateOption(&'static str),
+    #[error("ALTER RETENTION POLICY statement must specify at least one option to alter")]
+    NothingToAlter,
+}
+
+impl DdlStatement {
+    /// Returns true if the statement drops data, which is only done for `POST` requests
+    pub(crate) fn is_drop(&self) -> bool {
+        matches!(
+            self,
+            Self::DropDatabase { .. } | Self::DropRetentionPolicy { .. }
+        )
+    }
+
+    /// Attempt to parse a [`DdlStatement`] from the given query string
+    ///
+    /// Returns `Ok(None)` if the query string is some other statement, including other
+    /// `DROP` statements, e.g., `DROP MEASUREMENT`, so that it can be handled by the
+    /// regular InfluxQL parser.
+    pub(crate) fn parse(query_str: &str) -> Result<Option<Self>, DdlStatementError> {
+        let mut tokens = Tokens::new(query_str);
+
+        let statement = if tokens.next_is_keyword("DROP")? {
+            if tokens.next_is_keyword("DATABASE")? {
+                let name = tokens.identifier("database name")?;
+                Self::DropDatabase { name }
+            } else if tokens.next_is_keyword("RETENTION")? {
+                let (name, database) = tokens.retention_policy_on_database()?;
+                Self::DropRetentionPolicy { name, database }
+            } else {
+                return Ok(None);
+            }
+        } else if tokens.next_is_keyword("ALTER")? {
+            if !tokens.next_is_keyword("RETENTION")? {
+                return Err(DdlStatementError::Expected("RETENTION"));
+            }
+            let (name, database) = tokens.retention_policy_on_database()?;
+            let mut duration = None;
+            let mut replication = None;
+            let mut default = false;
+            loop {
+                if tokens.next_is_keyword("DURATION")? {
+                    if duration.is_some() {
+                        return Err(DdlStatementError::DuplicateOption("DURATION"));
+                    }
+                    duration = Some(parse_duration(&tokens.word("duration")?)?);
+                } else if tokens.next_is_keyword("REPLICATION")? {
+                    if replication.is_some() {
+                        return Err(DdlStatementError::DuplicateOption("REPLICATION"));
+                    }
+                    let n = tokens.word("replication factor")?;
+                    replication = Some(
+                        n.parse::<u32>()
+                            .ok()
+                            .filter(|n| *n > 0)
+                            .ok_or(DdlStatementError::InvalidReplication(n))?,
+                    );
+                } else if tokens.next_is_keyword("DEFAULT")? {
+                    if default {
+                        return Err(DdlStatementError::DuplicateOption("DEFAULT"));
+                    }
+                    default = true;
+                } else {
+                    break;
+                }
+            }
+            if duration.is_none() && replication.is_none() && !default {
+                return Err(DdlStatementError::NothingToAlter);
+            }
+            Self::AlterRetentionPolicy {
+                name,
+                database,
+                duration,
+                replication,
+                default,
+            }
+        } else {
+            return Ok(None);
+        };
+
+        match tokens.next()? {
+            None => Ok(Some(statement)),
+            Some(Token::Semicolon) if tokens.next()?.is_none() => Ok(Some(statement)),
+            Some(t) => Err(DdlStatementError::UnexpectedToken(t.to_string())),
+        }
+    }
+}
+
+/// Parse an InfluxQL duration literal, e.g., `1h30m`, into nanoseconds
+///
+/// `INF` produces `None`, for an infinite duration.
+fn parse_duration(s: &str) -> Result<Option<i64>, DdlStatementError> {
+    if s.eq_ignore_ascii_case("INF") {
+        return Ok(None);
+    }
+    let invalid = || DdlStatementError::InvalidDuration(s.to_string());
+
+    let mut total: i64 = 0;
+    let mut rest = s;
+    while !rest.is_empty() {
+        let digits = rest
+            .find(|c: char| !c.is_ascii_digit())
+            .ok_or_else(invalid)?;
+        if digits == 0 {
+            return Err(invalid());
+        }
+        let value: i64 = rest[..digits].parse().map_err(|_| invalid())?;
+        rest = &rest[digits..];
+        let unit_len = rest
+            .find(|c: char| c.is_ascii_digit())
+            .unwrap_or(rest.len());
+        let multiplier: i64 = match &rest[..unit_len] {
+            "ns" => 1,
+            "u" | "µ" => 1_000,
+            "ms" => 1_000_000,
+            "s" => 1_000_000_000,
+            "m" => 60 * 1_000_000_000,
+            "h" => 60 * 60 * 1_000_000_000,
+            "d" => 24 * 60 * 60 * 1_000_000_000,
+            "w" => 7 * 24 * 60 * 60 * 1_000_000_000,
+            _ => return Err(invalid()),
+        };
+        rest = &rest[unit_len..];
+        total = value
+            .checked_mul(multiplier)
+            .and_then(|v| total.checked_add(v))
+            .ok_or_else(invalid)?;
+    }
+
+    if total <= 0 {
+        return Err(DdlStatementError::NonPositiveDuration);
+    }
+
+    Ok(Some(total))
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum Token {
+    Word(String),
+    Quoted(String),
+    Semicolon,
+}
+
+impl std::fmt::Display for Token {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Word(w) => write!(f, "{w}"),
+            Self::Quoted(q) => write!(f, "\"{q}\""),
+            Self::Semicolon => write!(f, ";"),
+        }
+    }
+}
+
+/// A minimal tokenizer, splitting the input on whitespace, and handling double-quoted
+/// identifiers, which may contain escaped double quotes, e.g., `"my \"db\""`
+struct Tokens<'a> {
+    chars: Peekable<Chars<'a>>,
+    peeked: Option<Token>,
+}
+
+impl<'a> Tokens<'a> {
+    fn new(input: &'a str) -> Self {
+        Self {
+            chars: input.chars().peekable(),
+            peeked: None,
+        }
+    }
+
+    fn next(&mut self) -> Result<Option<Token>, DdlStatementError> {
+        if let Some(t) = self.peeked.take() {
+            return Ok(Some(t));
+        }
+        while self.chars.next_if(|c| c.is_whitespace()).is_some() {}
+        match self.chars.next() {
+            None => Ok(None),
+            Some(';') => Ok(Some(Token::Semicolon)),
+            Some('"') => {
+                let mut ident = String::new();
+                loop {
+                    match self.chars.next() {
+                        None => return Err(DdlStatementError::UnterminatedIdentifier),
+                        Some('"') => return Ok(Some(Token::Quoted(ident))),
+                        Some('\\') => match self.chars.next() {
+                            Some(c @ ('"' | '\\')) => ident.push(c),
+                            Some(c) => {
+                                ident.push('\\');
+                                ident.push(c);
+                            }
+                            None => return Err(DdlStatementError::UnterminatedIdentifier),
+                        },
+                        Some(c) => ident.push(c),
+                    }
+                }
+            }
+            Some(c) => {
+                let mut word = String::from(c);
+                while let Some(c) = self
+                    .chars
+                    .next_if(|c| !c.is_whitespace() && *c != ';' && *c != '"')
+                {
+                    word.push(c);
+                }
+                Ok(Some(Token::Word(word)))
+            }
+        }
+    }
+
+    /// Check if the next token is the given keyword, ignoring case, and consume it if so
+    fn next_is_keyword(&mut self, keyword: &str) -> Result<bool, DdlStatementError> {
+        match self.next()? {
+            Some(Token::Word(w)) if w.eq_ignore_ascii_case(keyword) => Ok(true),
+            t => {
+                self.peeked = t;
+                Ok(false)
+            }
+        }
+    }
+
+    fn identifier(&mut self, expected: &'static str) -> Result<String, DdlStatementError> {
+        match self.next()? {
+            Some(Token::Word(w) | Token::Quoted(w)) => Ok(w),
+            _ => Err(DdlStatementError::Expected(expected)),
+        }
+    }
+
+    fn word(&mut self, expected: &'static str) -> Result<String, DdlStatementError> {
+        match self.next()? {
+            Some(Token::Word(w)) => Ok(w),
+            _ => Err(DdlStatementError::Expected(expected)),
+        }
+    }
+
+    /// Parse the `POLICY <name> ON <database>` that follows `RETENTION`
+    fn retention_policy_on_database(&mut self) -> Result<(String, String), DdlStatementError> {
+        if !self.next_is_keyword("POLICY")? {
+            return Err(DdlStatementError::Expected("POLICY"));
+        }
+        let name = self.identifier("retention policy name")?;
+        if !self.next_is_keyword("ON")? {
+            return Err(DdlStatementError::Expected("ON"));
+        }
+        let database = self.identifier("database name")?;
+        Ok((name, database))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{parse_duration, DdlStatement, DdlStatementError};
+
+    #[test]
+    fn parse_drop_statements() {
+        struct TestCase {
+            input: &'static str,
+            expected: Option<DdlStatement>,
+        }
+
+        let test_cases = [
+            TestCase {
+                input: "DROP DATABASE foo",
+                expected: Some(DdlStatement::DropDatabase { name: "foo".into() }),
+            },
+            TestCase {
+                input: "drop database \"foo bar\";",
+                expected: Some(DdlStatement::DropDatabase {
+                    name: "foo bar".into(),
+                }),
+            },
+            TestCase {
+                input: "DROP DATABASE \"a \\\"quoted\\\" db\"",
+                expected: Some(DdlStatement::DropDatabase {
+                    name: "a \"quoted\" db".into(),
+                }),
+            },
+            TestCase {
+                input: "DROP RETENTION POLICY bar ON foo",
+                expected: Some(DdlStatement::DropRetentionPolicy {
+                    name: "bar".into(),
+                    database: "foo".into(),
+                }),
+            },
+            TestCase {
+                input: "  Drop Retention Policy \"bar\" on \"foo\" ; ",
+                expected: Some(DdlStatement::DropRetentionPolicy {
+                    name: "bar".into(),
+                    database: "foo".into(),
+                }),
+            },
+            TestCase {
+                input: "DROP MEASUREMENT cpu",
+                expected: None,
+            },
+            TestCase {
+                input: "SELECT * FROM cpu",
+                expected: None,
+            },
+            TestCase {
+                input: "",
+                expected: None,
+            },
+        ];
+
+        for t in test_cases {
+            let actual = DdlStatement::parse(t.input).unwrap();
+            assert_eq!(t.expected, actual, "input: {}", t.input);
+        }
+    }
+
+    #[test]
+    fn parse_drop_statement_errors() {
+        assert!(matches!(
+            DdlStatement::parse("DROP DATABASE"),
+            Err(DdlStatementError::Expected("database name"))
+        ));
+        assert!(matches!(
+            DdlStatement::parse("DROP DATABASE foo bar"),
+            Err(DdlStatementError::UnexpectedToken(t)) if t == "bar"
+        ));
+        assert!(matches!(
+            DdlStatement::parse("DROP DATABASE foo; DROP DATABASE bar"),
+            Err(DdlStatementError::UnexpectedToken(t)) if t == ";"
+        ));
+        assert!(matches!(
+            DdlStatement::parse("DROP RETENTION bar ON foo"),
+            Err(DdlStatementError::Expected("POLICY"))
+        ));
+        assert!(matches!(
+            DdlStatement::parse("DROP RETENTION POLICY bar foo"),
+            Err(DdlStatementError::Expected("ON"))
+        ));
+        assert!(matches!(
+            DdlStatement::parse("DROP DATABASE \"foo"),
+            Err(DdlStatementError::UnterminatedIdentifier)
+        ));
+    }
+
+    #[test]
+    fn parse_alter_retention_policy_statements() {
+        struct TestCase {
+            input: &'static str,
+            expected: DdlStatement,
+        }
+
+        let test_cases = [
+            TestCase {
+                input: "ALTER RETENTION POLICY bar ON foo DURATION 1h",
+                expected: DdlStatement::AlterRetentionPolicy {
+                    name: "bar".into(),
+                    database: "foo".into(),
+                    duration: Some(Some(3_600_000_000_000)),
+                    replication: None,
+                    default: false,
+                },
+            },
+            TestCase {
+                input:
+                    "alter retention policy \"autogen\" on foo duration 1d12h replication 1 default",
+                expected: DdlStatement::AlterRetentionPolicy {
+                    name: "autogen".into(),
+                    database: "foo".into(),
+                    duration: Some(Some(129_600_000_000_000)),
+                    replication: Some(1),
+                    default: true,
+                },
+            },
+            TestCase {
+                input: "ALTER RETENTION POLICY bar ON foo DEFAULT DURATION INF;",
+                expected: DdlStatement::AlterRetentionPolicy {
+                    name: "bar".into(),
+                    database: "foo".into(),
+                    duration: Some(None),
+                    replication: None,
+                    default: true,
+                },
+            },
+        ];
+
+        for t in test_cases {
+            let actual = DdlStatement::parse(t.input).unwrap();
+            assert_eq!(Some(t.expected), actual, "input: {}", t.input);
+        }
+    }
+
+    #[test]
+    fn parse_alter_retention_policy_errors() {
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo"),
+            Err(DdlStatementError::NothingToAlter)
+        ));
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo DURATION 0s"),
+            Err(DdlStatementError::NonPositiveDuration)
+        ));
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo REPLICATION 0"),
+            Err(DdlStatementError::InvalidReplication(n)) if n == "0"
+        ));
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo REPLICATION -1"),
+            Err(DdlStatementError::InvalidReplication(n)) if n == "-1"
+        ));
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo DURATION 1h DURATION 2h"),
+            Err(DdlStatementError::DuplicateOption("DURATION"))
+        ));
+        assert!(matches!(
+            DdlStatement::parse("ALTER RETENTION POLICY bar ON foo SHARD DURATION 1h"),
+            Err(DdlStatementError::NothingToAlter)
+        ));
+    }
+
+    #[test]
+    fn parse_durations() {
+        assert_eq!(parse_duration("1ns").unwrap(), Some(1));
+        assert_eq!(parse_duration("10u").unwrap(), Some(10_000));
+        assert_eq!(parse_duration("5ms").unwrap(), Some(5_000_000));
+        assert_eq!(parse_duration("1m30s").unwrap(), Some(90_000_000_000));
+        assert_eq!(parse_duration("2w").unwrap(), Some(1_209_600_000_000_000));
+        assert_eq!(parse_duration("inf").unwrap(), None);
+        assert!(matches!(
+            parse_duration("1y"),
+            Err(DdlStatementError::InvalidDuration(_))
+        ));
+        assert!(matches!(
+            parse_duration("h"),
+            Err(DdlStatementError::InvalidDuration(_))
+        ));
+        assert!(matches!(
+            parse_duration("10"),
+            Err(DdlStatementError::InvalidDuration(_))
+        ));
+    }
+}
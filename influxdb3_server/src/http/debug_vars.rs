@@ -0,0 +1,305 @@
+//! Runtime introspection of the server, served as JSON from `/debug/vars`
+
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use influxdb3_process::{
+    report_memory_stats, INFLUXDB3_GIT_HASH_SHORT, INFLUXDB3_VERSION, PROCESS_START_TIME,
+    PROCESS_UUID,
+};
+use influxdb3_write::catalog::{Catalog, DatabaseSchema};
+use influxdb3_write::SequenceNumber;
+use metric::{Attributes, MetricKind, Observation, Registry, Reporter};
+use serde::Serialize;
+
+use super::query_limit::QueryLimit;
+
+/// The name of the metric that memory statistics are taken from, which is only registered
+/// when jemalloc is the allocator
+const MEMORY_STATS_METRIC: &str = "jemalloc_memstats_bytes";
+
+/// The internal state of the server, only containing values that are cheap to compute
+#[derive(Debug, Serialize)]
+pub(crate) struct DebugVars {
+    version: &'static str,
+    revision: &'static str,
+    uuid: &'static str,
+    start_time: String,
+    catalog: CatalogVars,
+    /// Memory statistics from the allocator in bytes, keyed on the name of the statistic
+    memory: BTreeMap<String, u64>,
+    /// The tasks of the async runtime, only given when built with `--cfg tokio_unstable`, as
+    /// the counts of tasks are unstable in tokio
+    #[serde(skip_serializing_if = "Option::is_none")]
+    runtime: Option<RuntimeVars>,
+    writes: WriteVars,
+    /// The number of queries running and waiting to run, only given when the number of
+    /// queries that run at once is limited
+    #[serde(skip_serializing_if = "Option::is_none")]
+    queries: Option<QueryVars>,
+    /// The details of a single database, only given when requested
+    #[serde(skip_serializing_if = "Option::is_none")]
+    database: Option<DatabaseVars>,
+}
+
+#[derive(Debug, Serialize)]
+struct CatalogVars {
+    sequence_number: SequenceNumber,
+    databases: usize,
+    tables: usize,
+}
+
+#[derive(Debug, Serialize)]
+struct RuntimeVars {
+    workers: usize,
+    /// The number of tasks that have been spawned and have not yet completed
+    alive_tasks: usize,
+    blocking_threads: usize,
+}
+
+#[derive(Debug, Serialize)]
+struct WriteVars {
+    /// The number of writes that have started being handled, and are yet to be buffered
+    in_progress: usize,
+}
+
+#[derive(Debug, Serialize)]
+struct QueryVars {
+    running: usize,
+    queued: usize,
+}
+
+#[derive(Debug, Serialize)]
+struct DatabaseVars {
+    name: String,
+    retention_period_ns: Option<i64>,
+    enforce_field_types: bool,
+    max_series: usize,
+    /// The number of series written to the database
+    series: usize,
+    /// The number of columns in each table of the database, keyed on the table name
+    tables: BTreeMap<String, usize>,
+}
+
+impl DebugVars {
+    /// Gather the state of the server, including the details of the database `db` if given
+    ///
+    /// Returns `None` if the given database does not exist.
+    pub(crate) fn gather(
+        catalog: &Catalog,
+        registry: &Registry,
+        query_limit: Option<&QueryLimit>,
+        writes: &InProgress,
+        db: Option<&str>,
+    ) -> Option<Self> {
+        let database = match db {
+            Some(db) => Some(DatabaseVars::new(
+                &catalog.db_schema(db)?,
+                catalog.series_count(db),
+            )),
+            None => None,
+        };
+
+        let db_names = catalog.list_databases();
+        let tables = db_names
+            .iter()
+            .filter_map(|name| catalog.db_schema(name))
+            .map(|db| db.table_names().len())
+            .sum();
+
+        let mut memory = MemoryStatsReporter::default();
+        report_memory_stats(registry, &mut memory);
+
+        Some(Self {
+            version: &INFLUXDB3_VERSION,
+            revision: INFLUXDB3_GIT_HASH_SHORT,
+            uuid: &PROCESS_UUID,
+            start_time: PROCESS_START_TIME.to_rfc3339(),
+            catalog: CatalogVars {
+                sequence_number: catalog.sequence_number(),
+                databases: db_names.len(),
+                tables,
+            },
+            memory: memory.stats,
+            runtime: RuntimeVars::gather(),
+            writes: WriteVars {
+                in_progress: writes.count(),
+            },
+            queries: query_limit.map(|limit| QueryVars {
+                running: limit.running(),
+                queued: limit.queued(),
+            }),
+            database,
+        })
+    }
+}
+
+impl RuntimeVars {
+    #[cfg(tokio_unstable)]
+    fn gather() -> Option<Self> {
+        let metrics = tokio::runtime::Handle::try_current().ok()?.metrics();
+        Some(Self {
+            workers: metrics.num_workers(),
+            alive_tasks: metrics.active_tasks_count(),
+            blocking_threads: metrics.num_blocking_threads(),
+        })
+    }
+
+    #[cfg(not(tokio_unstable))]
+    fn gather() -> Option<Self> {
+        None
+    }
+}
+
+/// A count of the requests of some kind that are being handled
+#[derive(Debug, Default)]
+pub(crate) struct InProgress {
+    count: AtomicUsize,
+}
+
+/// Counts a request as in progress until it is dropped
+#[derive(Debug)]
+pub(crate) struct InProgressGuard<'a> {
+    in_progress: &'a InProgress,
+}
+
+impl InProgress {
+    pub(crate) fn start(&self) -> InProgressGuard<'_> {
+        self.count.fetch_add(1, Ordering::Relaxed);
+        InProgressGuard { in_progress: self }
+    }
+
+    pub(crate) fn count(&self) -> usize {
+        self.count.load(Ordering::Relaxed)
+    }
+}
+
+impl Drop for InProgressGuard<'_> {
+    fn drop(&mut self) {
+        self.in_progress.count.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+impl DatabaseVars {
+    fn new(db: &DatabaseSchema, series: usize) -> Self {
+        Self {
+            name: db.name.clone(),
+            retention_period_ns: db.retention_period_ns,
+            enforce_field_types: db.enforce_field_types,
+            max_series: db.max_series,
+            series,
+            tables: db
+                .table_names()
+                .into_iter()
+                .filter_map(|name| {
+                    let columns = db.get_table(&name)?.schema.len();
+                    Some((name, columns))
+                })
+                .collect(),
+        }
+    }
+}
+
+/// A [`Reporter`] that only keeps the observations of the allocator memory statistics
+#[derive(Debug, Default)]
+struct MemoryStatsReporter {
+    in_memory_stats: bool,
+    stats: BTreeMap<String, u64>,
+}
+
+impl Reporter for MemoryStatsReporter {
+    fn start_metric(
+        &mut self,
+        metric_name: &'static str,
+        _description: &'static str,
+        _kind: MetricKind,
+    ) {
+        self.in_memory_stats = metric_name == MEMORY_STATS_METRIC;
+    }
+
+    fn report_observation(&mut self, attributes: &Attributes, observation: Observation) {
+        if !self.in_memory_stats {
+            return;
+        }
+        let Observation::U64Gauge(value) = observation else {
+            return;
+        };
+        if let Some((_, stat)) = attributes.iter().find(|(key, _)| **key == "stat") {
+            self.stats.insert(stat.to_string(), value);
+        }
+    }
+
+    fn finish_metric(&mut self) {
+        self.in_memory_stats = false;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use influxdb3_write::catalog::Catalog;
+    use metric::{Attributes, MetricKind, Observation, Registry, Reporter};
+
+    use super::{DebugVars, InProgress, MemoryStatsReporter, QueryLimit, MEMORY_STATS_METRIC};
+
+    #[test]
+    fn memory_stats_reporter() {
+        let mut reporter = MemoryStatsReporter::default();
+        reporter.start_metric("other", "", MetricKind::U64Gauge);
+        reporter.report_observation(
+            &Attributes::from(&[("stat", "active")]),
+            Observation::U64Gauge(1),
+        );
+        reporter.finish_metric();
+        reporter.start_metric(MEMORY_STATS_METRIC, "", MetricKind::U64Gauge);
+        reporter.report_observation(
+            &Attributes::from(&[("stat", "active")]),
+            Observation::U64Gauge(2),
+        );
+        reporter.report_observation(
+            &Attributes::from(&[("stat", "resident")]),
+            Observation::U64Gauge(3),
+        );
+        reporter.finish_metric();
+
+        assert_eq!(
+            reporter.stats.into_iter().collect::<Vec<_>>(),
+            vec![("active".to_string(), 2), ("resident".to_string(), 3)]
+        );
+    }
+
+    #[test]
+    fn gather_database() {
+        let catalog = Catalog::new();
+        catalog.set_enforce_field_types("foo", true).unwrap();
+        catalog.set_max_series("foo", 100).unwrap();
+        let registry = Registry::new();
+        let writes = InProgress::default();
+
+        let vars = DebugVars::gather(&catalog, &registry, None, &writes, None).unwrap();
+        assert_eq!(vars.catalog.databases, 1);
+        assert!(vars.database.is_none());
+        assert!(vars.queries.is_none());
+        assert_eq!(vars.writes.in_progress, 0);
+
+        let limit = QueryLimit::new(2, 1);
+        let vars = DebugVars::gather(&catalog, &registry, Some(&limit), &writes, None).unwrap();
+        let queries = vars.queries.unwrap();
+        assert_eq!((queries.running, queries.queued), (0, 0));
+
+        // writes are counted until they are finished:
+        let write = writes.start();
+        let vars = DebugVars::gather(&catalog, &registry, None, &writes, None).unwrap();
+        assert_eq!(vars.writes.in_progress, 1);
+        drop(write);
+        assert_eq!(writes.count(), 0);
+
+        let vars = DebugVars::gather(&catalog, &registry, None, &writes, Some("foo")).unwrap();
+        let database = vars.database.unwrap();
+        assert_eq!(database.name, "foo");
+        assert!(database.enforce_field_types);
+        assert_eq!(database.max_series, 100);
+        assert_eq!(database.series, 0);
+
+        assert!(DebugVars::gather(&catalog, &registry, None, &writes, Some("bar")).is_none());
+    }
+}
@@ -0,0 +1,465 @@
+//! Parsing of InfluxQL `DELETE` statements
+//!
+//! The `DELETE` statement is not supported by the InfluxQL parser used for query planning, so
+//! it is detected and handled before a query string is passed along to be parsed and planned.
+//! The `WHERE` clause of a `DELETE` can only compare tags to string values using `=`, and
+//! `time` to either RFC3339 timestamp strings or integer nanosecond timestamps, with each
+//! comparison being combined using `AND`.
+
+use std::collections::BTreeMap;
+use std::iter::Peekable;
+use std::str::Chars;
+
+use influxdb3_write::catalog::DeletePredicate;
+use schema::TIME_COLUMN_NAME;
+
+/// `DELETE [FROM [[<database>.]<retention_policy>.]<measurement>] [WHERE <condition> [AND
+/// <condition>]...]`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct DeleteStatement {
+    /// The database given with the measurement, `None` meaning the database the statement is
+    /// run against
+    pub(crate) database: Option<String>,
+    /// The retention policy given with the measurement, `None` meaning the default retention
+    /// policy
+    pub(crate) retention_policy: Option<String>,
+    /// The measurement to delete from, `None` meaning every measurement in the database
+    pub(crate) measurement: Option<String>,
+    pub(crate) predicate: DeletePredicate,
+}
+
+#[derive(Debug, thiserror::Error)]
+pub enum DeleteStatementError {
+    #[error("expected {0} in DELETE statement")]
+    Expected(&'static str),
+    #[error("unexpected token in DELETE statement: {0}")]
+    UnexpectedToken(String),
+    #[error("unterminated quoted identifier or string in DELETE statement")]
+    Unterminated,
+    #[error("measurement has too many segments, expected [[<database>.]<retention_policy>.]<measurement>")]
+    TooManySegments,
+    #[error("DELETE statement must have a FROM or WHERE clause")]
+    MissingFromOrWhere,
+    #[error("tags can only be compared using '=' in a DELETE statement, got: {0}")]
+    TagOperator(String),
+    #[error("tag {0} is compared more than once in DELETE statement")]
+    DuplicateTag(String),
+    #[error("invalid time in DELETE statement: {0}")]
+    InvalidTime(String),
+}
+
+impl DeleteStatement {
+    /// Attempt to parse a [`DeleteStatement`] from the given query string
+    ///
+    /// Returns `Ok(None)` if the query string is some other statement.
+    pub(crate) fn parse(query_str: &str) -> Result<Option<Self>, DeleteStatementError> {
+        let mut tokens = Tokens::new(query_str);
+        if !tokens.next_is_keyword("DELETE")? {
+            return Ok(None);
+        }
+
+        let (database, retention_policy, measurement) = if tokens.next_is_keyword("FROM")? {
+            tokens.qualified_measurement()?
+        } else {
+            (None, None, None)
+        };
+
+        let mut predicate = DeletePredicate {
+            min_time: i64::MIN,
+            max_time: i64::MAX,
+            tags: BTreeMap::new(),
+        };
+        if tokens.next_is_keyword("WHERE")? {
+            loop {
+                tokens.condition(&mut predicate)?;
+                if !tokens.next_is_keyword("AND")? {
+                    break;
+                }
+            }
+        } else if measurement.is_none() {
+            return Err(DeleteStatementError::MissingFromOrWhere);
+        }
+
+        match tokens.next()? {
+            None => Ok(Some(Self {
+                database,
+                retention_policy,
+                measurement,
+                predicate,
+            })),
+            Some(Token::Semicolon) if tokens.next()?.is_none() => Ok(Some(Self {
+                measurement,
+                predicate,
+            })),
+            Some(t) => Err(DeleteStatementError::UnexpectedToken(t.to_string())),
+        }
+    }
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum Token {
+    /// An unquoted identifier, keyword, or number
+    Word(String),
+    /// A double-quoted identifier
+    Quoted(String),
+    /// A single-quoted string
+    String(String),
+    Operator(String),
+    /// The separator between the segments of a qualified measurement name
+    Dot,
+    Semicolon,
+}
+
+impl std::fmt::Display for Token {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Word(w) | Self::Operator(w) => write!(f, "{w}"),
+            Self::Quoted(q) => write!(f, "\"{q}\""),
+            Self::String(s) => write!(f, "'{s}'"),
+            Self::Dot => write!(f, "."),
+            Self::Semicolon => write!(f, ";"),
+        }
+    }
+}
+
+/// A minimal tokenizer for `DELETE` statements
+struct Tokens<'a> {
+    chars: Peekable<Chars<'a>>,
+    peeked: Option<Token>,
+}
+
+impl<'a> Tokens<'a> {
+    fn new(input: &'a str) -> Self {
+        Self {
+            chars: input.chars().peekable(),
+            peeked: None,
+        }
+    }
+
+    fn next(&mut self) -> Result<Option<Token>, DeleteStatementError> {
+        if let Some(t) = self.peeked.take() {
+            return Ok(Some(t));
+        }
+        while self.chars.next_if(|c| c.is_whitespace()).is_some() {}
+        match self.chars.next() {
+            None => Ok(None),
+            Some(';') => Ok(Some(Token::Semicolon)),
+            Some('.') => Ok(Some(Token::Dot)),
+            Some('"') => self.quoted('"').map(|q| Some(Token::Quoted(q))),
+            Some('\'') => self.quoted('\'').map(|s| Some(Token::String(s))),
+            Some(c @ ('=' | '!' | '<' | '>')) => {
+                let mut op = String::from(c);
+                while let Some(c) = self.chars.next_if(|c| matches!(c, '=' | '<' | '>' | '~')) {
+                    op.push(c);
+                }
+                Ok(Some(Token::Operator(op)))
+            }
+            Some(c) if is_word_char(c) => {
+                let mut word = String::from(c);
+                while let Some(c) = self.chars.next_if(|c| is_word_char(*c)) {
+                    word.push(c);
+                }
+                Ok(Some(Token::Word(word)))
+            }
+            Some(c) => Err(DeleteStatementError::UnexpectedToken(c.to_string())),
+        }
+    }
+
+    /// Read the rest of a string or identifier quoted with `quote`, which may contain escaped
+    /// quotes
+    fn quoted(&mut self, quote: char) -> Result<String, DeleteStatementError> {
+        let mut s = String::new();
+        loop {
+            match self.chars.next() {
+                None => return Err(DeleteStatementError::Unterminated),
+                Some(c) if c == quote => return Ok(s),
+                Some('\\') => match self.chars.next() {
+                    Some(c) if c == quote || c == '\\' => s.push(c),
+                    Some(c) => {
+                        s.push('\\');
+                        s.push(c);
+                    }
+                    None => return Err(DeleteStatementError::Unterminated),
+                },
+                Some(c) => s.push(c),
+            }
+        }
+    }
+
+    /// Check if the next token is the given keyword, ignoring case, and consume it if so
+    fn next_is_keyword(&mut self, keyword: &str) -> Result<bool, DeleteStatementError> {
+        match self.next()? {
+            Some(Token::Word(w)) if w.eq_ignore_ascii_case(keyword) => Ok(true),
+            t => {
+                self.peeked = t;
+                Ok(false)
+            }
+        }
+    }
+
+    /// Parse the `[[<database>.]<retention_policy>.]<measurement>` that follows `FROM`, where
+    /// any of the segments may be quoted, and the retention policy may be empty, e.g.,
+    /// `"my db".."my cpu"`
+    #[allow(clippy::type_complexity)]
+    fn qualified_measurement(
+        &mut self,
+    ) -> Result<(Option<String>, Option<String>, Option<String>), DeleteStatementError> {
+        let mut segments = vec![];
+        loop {
+            match self.next()? {
+                Some(Token::Word(w) | Token::Quoted(w)) => {
+                    segments.push(w);
+                    match self.next()? {
+                        Some(Token::Dot) => (),
+                        t => {
+                            self.peeked = t;
+                            break;
+                        }
+                    }
+                }
+                // an empty segment, which can only be the retention policy:
+                Some(Token::Dot) if segments.len() == 1 => segments.push(String::new()),
+                _ => return Err(DeleteStatementError::Expected("measurement name")),
+            }
+        }
+
+        let non_empty = |s: String| (!s.is_empty()).then_some(s);
+        let measurement = segments
+            .pop()
+            .and_then(non_empty)
+            .ok_or(DeleteStatementError::Expected("measurement name"))?;
+        match segments.len() {
+            0 => Ok((None, None, Some(measurement))),
+            1 => Ok((None, segments.pop().and_then(non_empty), Some(measurement))),
+            2 => {
+                let retention_policy = segments.pop().and_then(non_empty);
+                Ok((
+                    segments.pop().and_then(non_empty),
+                    retention_policy,
+                    Some(measurement),
+                ))
+            }
+            _ => Err(DeleteStatementError::TooManySegments),
+        }
+    }
+
+    /// Parse a single `<tag> = '<value>'` or `time <op> <timestamp>` condition, and add it to
+    /// the predicate
+    fn condition(&mut self, predicate: &mut DeletePredicate) -> Result<(), DeleteStatementError> {
+        let (name, quoted) = match self.next()? {
+            Some(Token::Word(w)) => (w, false),
+            Some(Token::Quoted(q)) => (q, true),
+            _ => return Err(DeleteStatementError::Expected("tag name or time")),
+        };
+        let Some(Token::Operator(op)) = self.next()? else {
+            return Err(DeleteStatementError::Expected("comparison operator"));
+        };
+
+        let is_time = if quoted {
+            name == TIME_COLUMN_NAME
+        } else {
+            name.eq_ignore_ascii_case(TIME_COLUMN_NAME)
+        };
+        if !is_time {
+            if op != "=" {
+                return Err(DeleteStatementError::TagOperator(op));
+            }
+            let Some(Token::String(value)) = self.next()? else {
+                return Err(DeleteStatementError::Expected("string tag value"));
+            };
+            if predicate.tags.insert(name.clone(), value).is_some() {
+                return Err(DeleteStatementError::DuplicateTag(name));
+            }
+            return Ok(());
+        }
+
+        let time = match self.next()? {
+            Some(Token::String(s)) => chrono::DateTime::parse_from_rfc3339(&s)
+                .ok()
+                .and_then(|t| t.timestamp_nanos_opt())
+                .ok_or(DeleteStatementError::InvalidTime(s))?,
+            Some(Token::Word(w)) => w
+                .parse::<i64>()
+                .map_err(|_| DeleteStatementError::InvalidTime(w))?,
+            _ => return Err(DeleteStatementError::Expected("time value")),
+        };
+        let (min_time, max_time) = match op.as_str() {
+            "=" => (time, time),
+            ">" => (time.saturating_add(1), i64::MAX),
+            ">=" => (time, i64::MAX),
+            "<" => (i64::MIN, time.saturating_sub(1)),
+            "<=" => (i64::MIN, time),
+            _ => return Err(DeleteStatementError::UnexpectedToken(op)),
+        };
+        predicate.min_time = predicate.min_time.max(min_time);
+        predicate.max_time = predicate.max_time.min(max_time);
+        Ok(())
+    }
+}
+
+fn is_word_char(c: char) -> bool {
+    c.is_alphanumeric() || matches!(c, '_' | '-')
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use influxdb3_write::catalog::DeletePredicate;
+
+    use super::{DeleteStatement, DeleteStatementError};
+
+    fn statement(
+        measurement: Option<&str>,
+        min_time: i64,
+        max_time: i64,
+        tags: &[(&str, &str)],
+    ) -> DeleteStatement {
+        DeleteStatement {
+            database: None,
+            retention_policy: None,
+            measurement: measurement.map(ToString::to_string),
+            predicate: DeletePredicate {
+                min_time,
+                max_time,
+                tags: tags
+                    .iter()
+                    .map(|(k, v)| (k.to_string(), v.to_string()))
+                    .collect::<BTreeMap<_, _>>(),
+            },
+        }
+    }
+
+    #[test]
+    fn parse_delete_statements() {
+        struct TestCase {
+            input: &'static str,
+            expected: Option<DeleteStatement>,
+        }
+
+        let test_cases = [
+            TestCase {
+                input: "DELETE FROM cpu",
+                expected: Some(statement(Some("cpu"), i64::MIN, i64::MAX, &[])),
+            },
+            TestCase {
+                input: "delete from \"my cpu\" where host = 'a';",
+                expected: Some(statement(
+                    Some("my cpu"),
+                    i64::MIN,
+                    i64::MAX,
+                    &[("host", "a")],
+                )),
+            },
+            TestCase {
+                input: "DELETE FROM cpu WHERE host='a' AND \"region\"='us \\'west\\''",
+                expected: Some(statement(
+                    Some("cpu"),
+                    i64::MIN,
+                    i64::MAX,
+                    &[("host", "a"), ("region", "us 'west'")],
+                )),
+            },
+            TestCase {
+                input: "DELETE FROM \"my db\".\"my rp\".\"my cpu.load\" WHERE host = 'a'",
+                expected: Some(DeleteStatement {
+                    database: Some("my db".into()),
+                    retention_policy: Some("my rp".into()),
+                    ..statement(Some("my cpu.load"), i64::MIN, i64::MAX, &[("host", "a")])
+                }),
+            },
+            TestCase {
+                input: "DELETE FROM foo..cpu",
+                expected: Some(DeleteStatement {
+                    database: Some("foo".into()),
+                    ..statement(Some("cpu"), i64::MIN, i64::MAX, &[])
+                }),
+            },
+            TestCase {
+                input: "DELETE FROM autogen.\"cpu \\\"total\\\"\"",
+                expected: Some(DeleteStatement {
+                    retention_policy: Some("autogen".into()),
+                    ..statement(Some("cpu \"total\""), i64::MIN, i64::MAX, &[])
+                }),
+            },
+            TestCase {
+                input: "DELETE WHERE time >= 10 AND time < 20",
+                expected: Some(statement(None, 10, 19, &[])),
+            },
+            TestCase {
+                input: "DELETE FROM cpu WHERE time > '1970-01-01T00:00:01Z' AND host = 'a'",
+                expected: Some(statement(
+                    Some("cpu"),
+                    1_000_000_001,
+                    i64::MAX,
+                    &[("host", "a")],
+                )),
+            },
+            TestCase {
+                input: "DELETE FROM cpu WHERE time = 5",
+                expected: Some(statement(Some("cpu"), 5, 5, &[])),
+            },
+            TestCase {
+                input: "SELECT * FROM cpu",
+                expected: None,
+            },
+            TestCase {
+                input: "DROP MEASUREMENT cpu",
+                expected: None,
+            },
+        ];
+
+        for t in test_cases {
+            let actual = DeleteStatement::parse(t.input).unwrap();
+            assert_eq!(t.expected, actual, "input: {}", t.input);
+        }
+    }
+
+    #[test]
+    fn parse_delete_statement_errors() {
+        assert!(matches!(
+            DeleteStatement::parse("DELETE"),
+            Err(DeleteStatementError::MissingFromOrWhere)
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM"),
+            Err(DeleteStatementError::Expected("measurement name"))
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM \"\""),
+            Err(DeleteStatementError::Expected("measurement name"))
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM a.b.c.d"),
+            Err(DeleteStatementError::TooManySegments)
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host != 'a'"),
+            Err(DeleteStatementError::TagOperator(op)) if op == "!="
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host =~ /a/"),
+            Err(DeleteStatementError::TagOperator(op)) if op == "=~"
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host = a"),
+            Err(DeleteStatementError::Expected("string tag value"))
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host = 'a' AND host = 'b'"),
+            Err(DeleteStatementError::DuplicateTag(t)) if t == "host"
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE time > 'yesterday'"),
+            Err(DeleteStatementError::InvalidTime(t)) if t == "yesterday"
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host = 'a' OR host = 'b'"),
+            Err(DeleteStatementError::UnexpectedToken(t)) if t == "OR"
+        ));
+        assert!(matches!(
+            DeleteStatement::parse("DELETE FROM cpu WHERE host = 'a"),
+            Err(DeleteStatementError::Unterminated)
+        ));
+    }
+}
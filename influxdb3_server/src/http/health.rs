@@ -0,0 +1,210 @@
+//! Checks of whether the server is ready to handle writes and queries, served as JSON from
+//! `/health`
+
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use bytes::Bytes;
+use object_store::path::Path;
+use object_store::ObjectStore;
+use serde::Serialize;
+use tokio::sync::Mutex;
+
+/// The object that is written and removed again to check that the object store is writable,
+/// which is beneath its own directory, alongside the `catalogs`, `segments`, and `dbs`
+/// directories that the server persists to
+const HEALTH_CHECK_OBJECT: &str = "health/check";
+
+/// How long the result of checking the health of the server is reused for, so that frequent
+/// probes, e.g., from load balancers, do not each write to the object store
+const HEALTH_CACHE_DURATION: Duration = Duration::from_secs(5);
+
+/// How long the object store has to respond before it is considered unhealthy
+const OBJECT_STORE_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Checks the health of the server, reusing the last result for [`HEALTH_CACHE_DURATION`]
+#[derive(Debug)]
+pub(crate) struct HealthChecker {
+    object_store: Arc<dyn ObjectStore>,
+    last: Mutex<Option<(Instant, Health)>>,
+}
+
+impl HealthChecker {
+    pub(crate) fn new(object_store: Arc<dyn ObjectStore>) -> Self {
+        Self {
+            object_store,
+            last: Mutex::new(None),
+        }
+    }
+
+    /// Get the health of the server, running the checks again if the last result has expired
+    ///
+    /// The lock is held while the checks run, so concurrent probes wait for a single run of the
+    /// checks rather than each running their own.
+    pub(crate) async fn check(&self) -> Health {
+        let mut last = self.last.lock().await;
+        if let Some((checked_at, health)) = last.as_ref() {
+            if checked_at.elapsed() < HEALTH_CACHE_DURATION {
+                return health.clone();
+            }
+        }
+        let health = Health::check(self.object_store.as_ref()).await;
+        *last = Some((Instant::now(), health.clone()));
+        health
+    }
+}
+
+/// The result of checking the health of the server, which is only healthy if every check
+/// passed
+#[derive(Debug, Clone, Serialize)]
+pub(crate) struct Health {
+    status: Status,
+    checks: Vec<Check>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+enum Status {
+    Pass,
+    Fail,
+}
+
+/// The result of a single check, with a message describing why it failed
+#[derive(Debug, Clone, Serialize)]
+struct Check {
+    name: &'static str,
+    status: Status,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    message: Option<String>,
+}
+
+impl Check {
+    fn new(name: &'static str, result: Result<(), String>) -> Self {
+        match result {
+            Ok(()) => Self {
+                name,
+                status: Status::Pass,
+                message: None,
+            },
+            Err(message) => Self {
+                name,
+                status: Status::Fail,
+                message: Some(message),
+            },
+        }
+    }
+}
+
+impl Health {
+    /// Run each of the checks of the health of the server
+    pub(crate) async fn check(object_store: &dyn ObjectStore) -> Self {
+        let checks = vec![Check::new(
+            "object_store",
+            check_object_store(object_store).await,
+        )];
+        let status = if checks.iter().all(|check| check.status == Status::Pass) {
+            Status::Pass
+        } else {
+            Status::Fail
+        };
+        Self { status, checks }
+    }
+
+    pub(crate) fn is_healthy(&self) -> bool {
+        self.status == Status::Pass
+    }
+}
+
+/// Check that the object store can be written to, by writing an object and then removing it,
+/// failing if that takes longer than [`OBJECT_STORE_TIMEOUT`]
+async fn check_object_store(object_store: &dyn ObjectStore) -> Result<(), String> {
+    tokio::time::timeout(OBJECT_STORE_TIMEOUT, write_and_delete(object_store))
+        .await
+        .map_err(|_| format!("object store did not respond within {OBJECT_STORE_TIMEOUT:?}"))?
+}
+
+/// Write the health check object and remove it again
+///
+/// Servers that share the object store write the same object, so it having already been
+/// removed by another server is not a failure.
+async fn write_and_delete(object_store: &dyn ObjectStore) -> Result<(), String> {
+    let path = Path::from(HEALTH_CHECK_OBJECT);
+    object_store
+        .put(&path, Bytes::from_static(b"ok"))
+        .await
+        .map_err(|e| format!("failed to write to object store: {e}"))?;
+    match object_store.delete(&path).await {
+        Ok(()) | Err(object_store::Error::NotFound { .. }) => Ok(()),
+        Err(e) => Err(format!("failed to delete from object store: {e}")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use futures::StreamExt;
+    use object_store::local::LocalFileSystem;
+    use object_store::memory::InMemory;
+    use object_store::ObjectStore;
+    use serde_json::json;
+
+    use super::{Health, HealthChecker};
+
+    #[tokio::test]
+    async fn healthy() {
+        let object_store = InMemory::new();
+        let health = Health::check(&object_store).await;
+        assert!(health.is_healthy());
+        assert_eq!(
+            serde_json::to_value(&health).unwrap(),
+            json!({
+                "status": "pass",
+                "checks": [{"name": "object_store", "status": "pass"}],
+            })
+        );
+
+        // the object written by the check is removed:
+        assert!(object_store.list(None).collect::<Vec<_>>().await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn cached() {
+        let path = std::env::temp_dir().join(format!(
+            "influxdb3-health-cached-{pid}",
+            pid = std::process::id()
+        ));
+        std::fs::create_dir_all(&path).unwrap();
+        let checker =
+            HealthChecker::new(Arc::new(LocalFileSystem::new_with_prefix(&path).unwrap()));
+        assert!(checker.check().await.is_healthy());
+
+        // the object store is no longer writable, but the last result is still used:
+        std::fs::remove_dir_all(&path).unwrap();
+        std::fs::write(&path, "not a directory").unwrap();
+        let health = checker.check().await;
+        std::fs::remove_file(&path).unwrap();
+        assert!(health.is_healthy());
+    }
+
+    #[tokio::test]
+    async fn object_store_not_writable() {
+        // objects cannot be written beneath a file:
+        let path =
+            std::env::temp_dir().join(format!("influxdb3-health-{pid}", pid = std::process::id()));
+        std::fs::write(&path, "not a directory").unwrap();
+        let object_store = LocalFileSystem::new_with_prefix(&path).unwrap();
+
+        let health = Health::check(&object_store).await;
+        std::fs::remove_file(&path).unwrap();
+        assert!(!health.is_healthy());
+        let health = serde_json::to_value(&health).unwrap();
+        assert_eq!(health["status"], "fail");
+        assert_eq!(health["checks"][0]["name"], "object_store");
+        assert_eq!(health["checks"][0]["status"], "fail");
+        assert!(health["checks"][0]["message"]
+            .as_str()
+            .unwrap()
+            .starts_with("failed to write to object store"));
+    }
+}
@@ -0,0 +1,304 @@
+//! Tracking of idempotency keys sent with writes, so that retried writes are only applied once
+
+use std::collections::{HashMap, VecDeque};
+use std::time::Duration;
+
+use influxdb3_write::BufferedWriteRequest;
+use iox_time::Time;
+use parking_lot::Mutex;
+
+/// The header that clients can set on write requests to have retries of the request deduplicated
+pub(crate) const IDEMPOTENCY_KEY_HEADER: &str = "X-Influxdb-Idempotency-Key";
+
+/// How long an idempotency key is remembered after the write that it was sent with
+pub(crate) const DEFAULT_IDEMPOTENCY_WINDOW: Duration = Duration::from_secs(5 * 60);
+
+/// The maximum number of idempotency keys that are remembered, beyond which the oldest are
+/// forgotten before their window has elapsed
+pub(crate) const DEFAULT_MAX_IDEMPOTENCY_KEYS: usize = 100_000;
+
+/// The database name and the idempotency key
+type Key = (String, String);
+
+/// The outcomes of recent writes made with an idempotency key, keyed on the database name and
+/// the idempotency key
+///
+/// A key is reserved before the write is made, so that a concurrent request with the same key
+/// is not written as well. Keys are forgotten once their window has elapsed, or, oldest first,
+/// to make room for a new key when there are already the maximum number of keys.
+#[derive(Debug)]
+pub(crate) struct IdempotencyKeys {
+    window: Duration,
+    max_keys: usize,
+    state: Mutex<State>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    writes: HashMap<Key, Entry>,
+    /// The reservations of the keys in `writes`, in the order that they were made, which is the
+    /// order they expire in
+    ///
+    /// Reservations are removed from here when they are released, so there is one for each
+    /// entry in `writes`.
+    order: VecDeque<(ReservationId, Time, Key)>,
+    /// The ID of the next reservation
+    next_id: ReservationId,
+}
+
+/// Identifies a reservation of a key, so that a key that was released and then reserved again,
+/// even at the same time, is not mistaken for its earlier reservation
+type ReservationId = u64;
+
+#[derive(Debug)]
+struct Entry {
+    id: ReservationId,
+    /// The outcome of the write, or `None` while it is in progress
+    outcome: Option<WriteOutcome>,
+}
+
+/// The part of the result of a write that is needed to respond to a retry of it
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct WriteOutcome {
+    pub(crate) invalid_line_count: usize,
+}
+
+impl From<&BufferedWriteRequest> for WriteOutcome {
+    fn from(result: &BufferedWriteRequest) -> Self {
+        Self {
+            invalid_line_count: result.invalid_lines.len(),
+        }
+    }
+}
+
+/// A write already made, or being made, with the same idempotency key
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum EarlierWrite {
+    InProgress,
+    Written(WriteOutcome),
+}
+
+/// A reservation of an idempotency key for a write, which is released when dropped unless the
+/// write was completed
+#[derive(Debug)]
+pub(crate) struct Reservation<'a> {
+    keys: &'a IdempotencyKeys,
+    key: Key,
+    id: ReservationId,
+    completed: bool,
+}
+
+impl IdempotencyKeys {
+    pub(crate) fn new(window: Duration, max_keys: usize) -> Self {
+        Self {
+            window,
+            max_keys,
+            state: Default::default(),
+        }
+    }
+
+    /// Reserve `key` for a write to `db` at time `now`, unless a write was already made with it
+    /// within the window
+    pub(crate) fn reserve(
+        &self,
+        db: &str,
+        key: &str,
+        now: Time,
+    ) -> Result<Reservation<'_>, EarlierWrite> {
+        let mut state = self.state.lock();
+        self.evict_expired(&mut state, now);
+        let key = (db.to_string(), key.to_string());
+        if let Some(entry) = state.writes.get(&key) {
+            return Err(entry
+                .outcome
+                .map_or(EarlierWrite::InProgress, EarlierWrite::Written));
+        }
+        self.make_room(&mut state);
+        let id = state.next_id;
+        state.next_id += 1;
+        state
+            .writes
+            .insert(key.clone(), Entry { id, outcome: None });
+        state.order.push_back((id, now, key.clone()));
+        Ok(Reservation {
+            keys: self,
+            key,
+            id,
+            completed: false,
+        })
+    }
+
+    /// Forget keys whose window has elapsed as of `now`
+    ///
+    /// Only the oldest keys are looked at, so this does not scan every key.
+    fn evict_expired(&self, state: &mut State, now: Time) {
+        while let Some((_, reserved_at, _)) = state.order.front() {
+            let expired = now
+                .checked_duration_since(*reserved_at)
+                .is_some_and(|elapsed| elapsed >= self.window);
+            if !expired {
+                break;
+            }
+            state.forget_oldest();
+        }
+    }
+
+    /// Forget the oldest keys beyond the maximum number of keys, leaving room for one more
+    fn make_room(&self, state: &mut State) {
+        while state.writes.len() >= self.max_keys && state.forget_oldest() {}
+    }
+}
+
+impl State {
+    /// Forget the oldest key, returning `false` if there are no keys
+    fn forget_oldest(&mut self) -> bool {
+        let Some((id, _, key)) = self.order.pop_front() else {
+            return false;
+        };
+        self.remove(&key, id);
+        true
+    }
+
+    /// Remove the entry for `key`, if it is still the one for reservation `id`
+    fn remove(&mut self, key: &Key, id: ReservationId) {
+        if self.writes.get(key).is_some_and(|entry| entry.id == id) {
+            self.writes.remove(key);
+        }
+    }
+
+    /// Release reservation `id` of `key`, removing both its entry and its place in the order
+    /// that keys expire in
+    fn release(&mut self, key: &Key, id: ReservationId) {
+        self.remove(key, id);
+        // reservations are made in the order of their IDs, so the order is sorted by them:
+        if let Ok(i) = self.order.binary_search_by_key(&id, |(id, _, _)| *id) {
+            self.order.remove(i);
+        }
+    }
+}
+
+impl Reservation<'_> {
+    /// Record the outcome of the write, so that retries of it are given the same outcome
+    pub(crate) fn complete(mut self, outcome: WriteOutcome) {
+        self.completed = true;
+        let mut state = self.keys.state.lock();
+        if let Some(entry) = state.writes.get_mut(&self.key) {
+            if entry.id == self.id {
+                entry.outcome = Some(outcome);
+            }
+        }
+    }
+}
+
+impl Drop for Reservation<'_> {
+    fn drop(&mut self) {
+        // the write failed, or the request was dropped, so a retry should be written:
+        if !self.completed {
+            self.keys.state.lock().release(&self.key, self.id);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use iox_time::Time;
+
+    use super::{EarlierWrite, IdempotencyKeys, WriteOutcome};
+
+    const WRITTEN: WriteOutcome = WriteOutcome {
+        invalid_line_count: 0,
+    };
+
+    #[test]
+    fn keys_expire_after_window() {
+        let keys = IdempotencyKeys::new(Duration::from_secs(60), 10);
+        let start = Time::from_timestamp_nanos(0);
+        keys.reserve("foo", "a", start)
+            .unwrap()
+            .complete(WriteOutcome {
+                invalid_line_count: 2,
+            });
+
+        // the key is scoped to the database it was written to:
+        let later = start + Duration::from_secs(30);
+        assert_eq!(
+            keys.reserve("foo", "a", later).unwrap_err(),
+            EarlierWrite::Written(WriteOutcome {
+                invalid_line_count: 2
+            })
+        );
+        keys.reserve("bar", "a", later).unwrap().complete(WRITTEN);
+        keys.reserve("foo", "b", later).unwrap().complete(WRITTEN);
+
+        // once the window has elapsed the key is forgotten:
+        let expired = start + Duration::from_secs(60);
+        keys.reserve("foo", "a", expired).unwrap().complete(WRITTEN);
+        assert_eq!(keys.state.lock().writes.len(), 3);
+    }
+
+    #[test]
+    fn reserved_until_released() {
+        let keys = IdempotencyKeys::new(Duration::from_secs(60), 10);
+        let now = Time::from_timestamp_nanos(0);
+
+        // a concurrent write with the same key is not made:
+        let reservation = keys.reserve("foo", "a", now).unwrap();
+        assert_eq!(
+            keys.reserve("foo", "a", now).unwrap_err(),
+            EarlierWrite::InProgress
+        );
+
+        // a write that fails does not complete its reservation, so can be retried:
+        drop(reservation);
+        let reservation = keys.reserve("foo", "a", now).unwrap();
+        reservation.complete(WRITTEN);
+        assert_eq!(
+            keys.reserve("foo", "a", now).unwrap_err(),
+            EarlierWrite::Written(WRITTEN)
+        );
+    }
+
+    #[test]
+    fn oldest_keys_evicted_beyond_max() {
+        let keys = IdempotencyKeys::new(Duration::from_secs(60), 2);
+        let start = Time::from_timestamp_nanos(0);
+        for (i, key) in ["a", "b", "c"].into_iter().enumerate() {
+            keys.reserve("foo", key, start + Duration::from_secs(i as u64))
+                .unwrap()
+                .complete(WRITTEN);
+        }
+
+        let now = start + Duration::from_secs(3);
+        assert!(keys.reserve("foo", "b", now).is_err());
+        assert!(keys.reserve("foo", "c", now).is_err());
+        // "a" was forgotten to make room for "c":
+        assert_eq!(keys.state.lock().writes.len(), 2);
+        assert!(keys.reserve("foo", "a", now).is_ok());
+    }
+
+    #[test]
+    fn released_keys_not_counted_towards_max() {
+        let keys = IdempotencyKeys::new(Duration::from_secs(60), 2);
+        let now = Time::from_timestamp_nanos(0);
+
+        // a key released and then reserved again at the same time leaves nothing behind from
+        // its first reservation:
+        drop(keys.reserve("foo", "a", now).unwrap());
+        keys.reserve("foo", "a", now).unwrap().complete(WRITTEN);
+        drop(keys.reserve("foo", "b", now).unwrap());
+        keys.reserve("foo", "c", now).unwrap().complete(WRITTEN);
+        assert_eq!(keys.state.lock().order.len(), 2);
+
+        // so neither of the live keys is evicted to make room for the other:
+        assert_eq!(
+            keys.reserve("foo", "a", now).unwrap_err(),
+            EarlierWrite::Written(WRITTEN)
+        );
+        assert_eq!(
+            keys.reserve("foo", "c", now).unwrap_err(),
+            EarlierWrite::Written(WRITTEN)
+        );
+    }
+}
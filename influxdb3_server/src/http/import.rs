@@ -0,0 +1,363 @@
+//! Bulk import of line protocol, for backfilling large amounts of historical data in a single
+//! request, or for streaming data continuously over a long-lived one
+
+use std::convert::Infallible;
+use std::sync::Arc;
+
+use authz::Action;
+use bytes::{Bytes, BytesMut};
+use data_types::NamespaceName;
+use futures::StreamExt;
+use hyper::header::{CONTENT_ENCODING, CONTENT_TYPE};
+use hyper::{Body, Request, Response, StatusCode};
+use influxdb3_write::{BufferedWriteRequest, Precision, WriteBuffer, WriteLineError};
+use iox_time::TimeProvider;
+use observability_deps::tracing::info;
+use serde::Serialize;
+use tokio::sync::mpsc;
+
+use crate::QueryExecutor;
+
+use super::{validate_db_name, Error, ErrorMessage, HttpApi, RequestToken, Result, WriteParams};
+
+/// The size that the line protocol read from the request body is batched up to before it is
+/// written
+const IMPORT_BATCH_BYTES: usize = 1024 * 1024;
+
+/// The most invalid lines that are reported in the response to an import, any further
+/// invalid lines are only counted
+const MAX_REPORTED_IMPORT_ERRORS: usize = 1_000;
+
+/// The number of acknowledgements of a streaming write that are buffered for the client to read
+const STREAM_ACK_BUFFER: usize = 16;
+
+/// The response to an import, which is also the acknowledgement of each batch of a streaming
+/// write
+#[derive(Debug, Default, Serialize)]
+struct ImportResponse {
+    /// The number of lines read from the request body
+    lines: usize,
+    /// The number of lines that were written
+    written: usize,
+    /// The number of lines that were invalid, and so were not written
+    invalid: usize,
+    /// The first of the invalid lines, numbered from the start of the request body
+    errors: Vec<WriteLineError>,
+}
+
+impl ImportResponse {
+    /// Count the lines of a batch, and the invalid lines amongst them, which are numbered from
+    /// the start of the batch
+    fn record_batch(&mut self, lp: &str, invalid_lines: Vec<WriteLineError>) {
+        let offset = self.lines;
+        self.lines += lp.lines().count();
+        self.invalid += invalid_lines.len();
+        let reportable = MAX_REPORTED_IMPORT_ERRORS.saturating_sub(self.errors.len());
+        self.errors
+            .extend(invalid_lines.into_iter().take(reportable).map(|mut e| {
+                e.line_number += offset;
+                e
+            }));
+    }
+}
+
+impl<W, Q, T> HttpApi<W, Q, T>
+where
+    W: WriteBuffer,
+    Q: QueryExecutor,
+    T: TimeProvider,
+    Error: From<<Q as QueryExecutor>::Error>,
+{
+    /// Import newline delimited line protocol from the request body, which is written in
+    /// batches as it is read, rather than being buffered in full
+    ///
+    /// This accepts the same parameters as `/api/v3/write_lp`, but the body is not subject to
+    /// the maximum request size, only each line is. Invalid lines are skipped, and are reported
+    /// in the response along with their line numbers. If a batch fails to be written then the
+    /// import stops, but the batches before it remain written.
+    ///
+    /// With `accept_partial=false`, nothing is written if any line is invalid. The whole body
+    /// is then validated and written at once, as a single write, so it is subject to the maximum
+    /// request size.
+    ///
+    /// An import counts as a single write against the limit on the number of writes handled at
+    /// once for as long as it runs, and is rejected if at the limit when it starts.
+    pub(super) async fn import_lp(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let params = self.import_params(&req).await?;
+        info!(db = %params.db, "import line protocol");
+        let _permit = self.try_acquire_write_permit()?;
+        let _in_progress = self.writes_in_progress.start();
+
+        let database = NamespaceName::new(params.db)?;
+        let mut response = ImportResponse::default();
+        if params.accept_partial {
+            let mut batcher = LineBatcher::new(IMPORT_BATCH_BYTES, self.max_request_bytes);
+            let mut body = req.into_body();
+            while let Some(batch) = next_batch(&mut body, &mut batcher).await? {
+                self.import_batch(database.clone(), &batch, params.precision, &mut response)
+                    .await?;
+            }
+        } else {
+            // validating batches separately would check each against the schema from before
+            // the import, rather than with the columns added by the batches before it, so the
+            // body is validated and written as a whole:
+            let body = self.read_body(req).await?;
+            let lp = std::str::from_utf8(&body).map_err(Error::NonUtf8Body)?;
+            let result = self.write_buffer.validate_lp(
+                database.clone(),
+                lp,
+                self.time_provider.now(),
+                true,
+                params.precision,
+            )?;
+            response.record_batch(lp, result.invalid_lines);
+            if response.invalid == 0 {
+                let result = self
+                    .write_batch(database, lp, false, params.precision)
+                    .await?;
+                response.written += result.line_count;
+            }
+        }
+
+        Response::builder()
+            .status(if response.invalid == 0 {
+                StatusCode::OK
+            } else {
+                StatusCode::BAD_REQUEST
+            })
+            .header(CONTENT_TYPE, "application/json")
+            .body(Body::from(serde_json::to_string(&response)?))
+            .map_err(Into::into)
+    }
+
+    /// Write line protocol from a request body that the client streams over a long-lived
+    /// connection, e.g., with chunked transfer encoding, acknowledging each batch of lines as it
+    /// is written
+    ///
+    /// This accepts the same parameters as `/api/v3/import`, except that invalid lines are
+    /// always skipped. Rather than waiting for a batch to fill, the complete lines in each chunk
+    /// of the body are written as soon as it is received. The response is newline delimited
+    /// JSON, with a line for each batch that counts the lines read and written so far, and
+    /// reports the invalid lines in that batch, or a final line with the error that ended the
+    /// write.
+    ///
+    /// The body is read by a task of its own, rather than as the response is sent, so if the
+    /// client disconnects, the lines received up to then are still written, and only an
+    /// incomplete line at the end is dropped.
+    ///
+    /// A streaming write counts as a single write against the limit on the number of writes
+    /// handled at once until its body ends, and is rejected if at the limit when it starts, so
+    /// long-lived streams take up part of the limit for as long as they are open.
+    pub(super) async fn write_stream(
+        self: Arc<Self>,
+        req: Request<Body>,
+    ) -> Result<Response<Body>> {
+        let params = self.import_params(&req).await?;
+        info!(db = %params.db, "streaming write of line protocol");
+        let permit = self.try_acquire_write_permit()?;
+
+        let database = NamespaceName::new(params.db)?;
+        let (tx, mut rx) = mpsc::channel::<Result<Bytes, Infallible>>(STREAM_ACK_BUFFER);
+        let mut body = req.into_body();
+        tokio::spawn(async move {
+            let _permit = permit;
+            let _in_progress = self.writes_in_progress.start();
+            let mut batcher = LineBatcher::new(0, self.max_request_bytes);
+            let mut progress = ImportResponse::default();
+            let result = loop {
+                let batch = match next_batch(&mut body, &mut batcher).await {
+                    Ok(Some(batch)) => batch,
+                    Ok(None) => break Ok(()),
+                    Err(e) => break Err(e),
+                };
+                if let Err(e) = self
+                    .import_batch(database.clone(), &batch, params.precision, &mut progress)
+                    .await
+                {
+                    break Err(e);
+                }
+                // invalid lines are only reported in the acknowledgement of their batch:
+                let ack = ndjson_line(&progress);
+                progress.errors.clear();
+                // the client may have disconnected, but the rest of the body is still written:
+                let _ = tx.send(Ok(ack)).await;
+            };
+            match result {
+                Ok(()) => (),
+                Err(Error::ClientHangup(e)) => {
+                    info!(%e, db = database.as_str(), "client disconnected from streaming write");
+                }
+                Err(e) => {
+                    let err: ErrorMessage<()> = ErrorMessage {
+                        error: e.to_string(),
+                        data: None,
+                    };
+                    let _ = tx.send(Ok(ndjson_line(&err))).await;
+                }
+            }
+        });
+
+        Response::builder()
+            .status(StatusCode::OK)
+            .header(CONTENT_TYPE, "application/x-ndjson")
+            .body(Body::wrap_stream(futures::stream::poll_fn(move |cx| {
+                rx.poll_recv(cx)
+            })))
+            .map_err(Into::into)
+    }
+
+    /// Parse and check the parameters of an import, and that the request is authorized
+    async fn import_params(&self, req: &Request<Body>) -> Result<WriteParams> {
+        let query = req.uri().query().ok_or(Error::MissingWriteParams)?;
+        let params: WriteParams = serde_urlencoded::from_str(query)?;
+        validate_db_name(&params.db, false)?;
+        self.authorize_database(RequestToken::get(req), &params.db, Action::Write)
+            .await?;
+        // the body is streamed, so cannot be decompressed as a whole:
+        if let Some(encoding) = req.headers().get(&CONTENT_ENCODING) {
+            let encoding = encoding.to_str().map_err(Error::NonUtf8ContentHeader)?;
+            if encoding != "identity" {
+                return Err(Error::InvalidContentEncoding(encoding.to_string()));
+            }
+        }
+        Ok(params)
+    }
+
+    /// Write a batch of lines, skipping any that are invalid, and count them in the response
+    async fn import_batch(
+        &self,
+        database: NamespaceName<'static>,
+        batch: &[u8],
+        precision: Precision,
+        response: &mut ImportResponse,
+    ) -> Result<()> {
+        let lp = std::str::from_utf8(batch).map_err(Error::NonUtf8Body)?;
+        let result = self.write_batch(database, lp, true, precision).await?;
+        response.written += result.line_count;
+        response.record_batch(lp, result.invalid_lines);
+        Ok(())
+    }
+
+    /// Write a batch of lines, invalidating the cached query results for the database
+    async fn write_batch(
+        &self,
+        database: NamespaceName<'static>,
+        lp: &str,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> Result<BufferedWriteRequest> {
+        let result = self
+            .write_buffer
+            .write_lp(
+                database.clone(),
+                lp,
+                self.time_provider.now(),
+                accept_partial,
+                precision,
+            )
+            .await;
+        // invalidate after each batch, as earlier batches stay written if a later one fails:
+        self.invalidate_query_cache(Some(database.as_str()));
+        result.map_err(Into::into)
+    }
+}
+
+/// Serialize a line of newline delimited JSON
+fn ndjson_line<S: Serialize>(value: &S) -> Bytes {
+    let mut line = serde_json::to_vec(value).unwrap();
+    line.push(b'\n');
+    Bytes::from(line)
+}
+
+/// Read the request body up to the end of the next batch of lines, returning `None` once the
+/// whole body has been read
+async fn next_batch(body: &mut Body, batcher: &mut LineBatcher) -> Result<Option<Bytes>> {
+    while let Some(chunk) = body.next().await {
+        if let Some(batch) = batcher.push(chunk.map_err(Error::ClientHangup)?)? {
+            return Ok(Some(batch));
+        }
+    }
+    Ok(batcher.finish())
+}
+
+/// Splits a stream of chunks of bytes into batches of whole lines
+#[derive(Debug)]
+struct LineBatcher {
+    pending: BytesMut,
+    batch_bytes: usize,
+    max_line_bytes: usize,
+}
+
+impl LineBatcher {
+    /// Produce batches of at least `batch_bytes`, unless the input ends first, rejecting any
+    /// line that is longer than `max_line_bytes`
+    fn new(batch_bytes: usize, max_line_bytes: usize) -> Self {
+        Self {
+            pending: BytesMut::new(),
+            batch_bytes,
+            max_line_bytes,
+        }
+    }
+
+    /// Add a chunk of the input, returning a batch of lines if there are enough to fill one
+    fn push(&mut self, chunk: Bytes) -> Result<Option<Bytes>> {
+        self.pending.extend_from_slice(&chunk);
+        if self.pending.len() < self.batch_bytes {
+            return Ok(None);
+        }
+        match self.pending.iter().rposition(|b| *b == b'\n') {
+            Some(i) => {
+                let batch = self.pending.split_to(i + 1).freeze();
+                self.check_line_len()?;
+                Ok(Some(batch))
+            }
+            None => {
+                self.check_line_len()?;
+                Ok(None)
+            }
+        }
+    }
+
+    /// The input has ended, so return whatever lines remain
+    fn finish(&mut self) -> Option<Bytes> {
+        (!self.pending.is_empty()).then(|| self.pending.split().freeze())
+    }
+
+    /// Check that the incomplete line that is pending has not already exceeded the limit
+    fn check_line_len(&self) -> Result<()> {
+        if self.pending.len() > self.max_line_bytes {
+            return Err(Error::RequestSizeExceeded(self.max_line_bytes));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use bytes::Bytes;
+
+    use super::{Error, LineBatcher};
+
+    #[test]
+    fn batch_whole_lines() {
+        let mut batcher = LineBatcher::new(8, 100);
+        assert_eq!(batcher.push(Bytes::from("a 1\nb")).unwrap(), None);
+        assert_eq!(
+            batcher.push(Bytes::from(" 2\nc 3")).unwrap(),
+            Some(Bytes::from("a 1\nb 2\n"))
+        );
+        assert_eq!(batcher.push(Bytes::from("\n")).unwrap(), None);
+        assert_eq!(batcher.finish(), Some(Bytes::from("c 3\n")));
+        assert_eq!(batcher.finish(), None);
+    }
+
+    #[test]
+    fn line_too_long() {
+        let mut batcher = LineBatcher::new(4, 10);
+        assert_eq!(batcher.push(Bytes::from("abcdef")).unwrap(), None);
+        assert!(matches!(
+            batcher.push(Bytes::from("ghijkl")),
+            Err(Error::RequestSizeExceeded(10))
+        ));
+    }
+}
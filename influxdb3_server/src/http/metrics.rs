@@ -0,0 +1,100 @@
+//! Metrics for requests made to the write and query endpoints of the HTTP API
+
+use std::time::Duration;
+
+use hyper::StatusCode;
+use metric::{Attributes, DurationHistogram, Metric, Registry, U64Counter};
+
+/// The endpoints that request metrics are recorded for
+///
+/// For a streaming write, the duration is the time taken to start the response, not the time
+/// that the stream was open for.
+const TRACKED_ENDPOINTS: [&str; 8] = [
+    "/write",
+    "/api/v2/write",
+    "/api/v3/write_lp",
+    "/api/v3/import",
+    "/api/v3/write_stream",
+    "/query",
+    "/api/v3/query_sql",
+    "/api/v3/query_influxql",
+];
+
+/// Request counts and latencies for the write and query endpoints, broken down by endpoint and
+/// response status code
+#[derive(Debug)]
+pub(crate) struct HttpMetrics {
+    requests: Metric<U64Counter>,
+    duration: Metric<DurationHistogram>,
+}
+
+impl HttpMetrics {
+    pub(crate) fn new(registry: &Registry) -> Self {
+        Self {
+            requests: registry.register_metric(
+                "influxdb3_http_requests",
+                "number of requests made to the HTTP write and query endpoints",
+            ),
+            duration: registry.register_metric(
+                "influxdb3_http_request_duration",
+                "time taken to handle requests made to the HTTP write and query endpoints",
+            ),
+        }
+    }
+
+    /// Record a request made to the given `path` that got a response with the given `status`
+    ///
+    /// Requests made to paths other than the write and query endpoints are ignored.
+    pub(crate) fn record(&self, path: &str, status: StatusCode, duration: Duration) {
+        let Some(endpoint) = TRACKED_ENDPOINTS.into_iter().find(|e| *e == path) else {
+            return;
+        };
+        let mut attributes = Attributes::from(&[("path", endpoint)]);
+        attributes.insert("status", status.as_u16().to_string());
+        self.requests.recorder(attributes.clone()).inc(1);
+        self.duration.recorder(attributes).record(duration);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use hyper::StatusCode;
+    use metric::{Attributes, DurationHistogram, Metric, Registry, U64Counter};
+
+    use super::HttpMetrics;
+
+    #[test]
+    fn record_requests() {
+        let registry = Registry::new();
+        let metrics = HttpMetrics::new(&registry);
+        metrics.record("/write", StatusCode::OK, Duration::from_millis(1));
+        metrics.record("/write", StatusCode::OK, Duration::from_millis(2));
+        metrics.record("/write", StatusCode::BAD_REQUEST, Duration::from_millis(3));
+        metrics.record("/health", StatusCode::OK, Duration::from_millis(4));
+        metrics.record("/api/v3/import", StatusCode::OK, Duration::from_millis(5));
+
+        let requests = registry
+            .get_instrument::<Metric<U64Counter>>("influxdb3_http_requests")
+            .unwrap();
+        let count = |path: &'static str, status: &'static str| {
+            requests
+                .get_observer(&Attributes::from(&[("path", path), ("status", status)]))
+                .map(|c| c.fetch())
+        };
+        assert_eq!(count("/write", "200"), Some(2));
+        assert_eq!(count("/write", "400"), Some(1));
+        assert_eq!(count("/health", "200"), None);
+        assert_eq!(count("/api/v3/import", "200"), Some(1));
+
+        let duration = registry
+            .get_instrument::<Metric<DurationHistogram>>("influxdb3_http_request_duration")
+            .unwrap()
+            .get_observer(&Attributes::from(&[("path", "/write"), ("status", "200")]))
+            .unwrap()
+            .fetch();
+        assert_eq!(duration.sample_count(), 2);
+        assert_eq!(duration.total, Duration::from_millis(3));
+    }
+}
@@ -0,0 +1,444 @@
+//! Keyset pagination of the results of SQL queries
+//!
+//! Rather than skipping over the earlier pages with `OFFSET`, which scans them again for every
+//! page, each page is selected with a predicate on the position of the last row of the page
+//! before it. Rows are ordered by their time, then by their series, i.e., by the values of their
+//! tag columns, which are the columns with string dictionary types, and then by the values of
+//! the rest of their columns, so that no two rows have the same position unless they are the
+//! same in every column. Values other than the time are compared as strings, with nulls first.
+//!
+//! The position of the last row of a page is given to the client as an opaque cursor, along with
+//! the number of rows on the pages so far that have that position, which the next page skips.
+
+use arrow::array::{Array, AsArray, StringArray, TimestampNanosecondArray};
+use arrow::compute::{can_cast_types, cast};
+use arrow::datatypes::{DataType, Schema, TimeUnit, TimestampNanosecondType};
+use arrow::error::ArrowError;
+use arrow::record_batch::RecordBatch;
+use base64::engine::general_purpose::URL_SAFE_NO_PAD;
+use base64::Engine;
+use schema::TIME_COLUMN_NAME;
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, thiserror::Error)]
+pub enum PaginationError {
+    #[error("paginated query results must have a nanosecond '{TIME_COLUMN_NAME}' column")]
+    MissingTimeColumn,
+    #[error("paginated query results can not be ordered by the values of column '{0}'")]
+    UnorderedColumn(String),
+    #[error("the '{TIME_COLUMN_NAME}' of the last row of a page must not be null")]
+    NullTime,
+    #[error("invalid pagination cursor")]
+    InvalidCursor,
+    #[error("pagination cursor does not match the columns of the query results")]
+    CursorMismatch,
+    #[error("pagination is only supported for SQL queries")]
+    UnsupportedQueryKind,
+    #[error("error reading the last row of a page: {0}")]
+    Arrow(#[from] ArrowError),
+}
+
+/// The columns that the results of a query are ordered by when paginating them
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct PageKey {
+    /// The columns other than the time, which order the rows that have the same time, with the
+    /// tag columns first
+    columns: Vec<String>,
+}
+
+/// The position of the last row of a page, which the next page starts at
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub(crate) struct Cursor {
+    time: i64,
+    columns: Vec<(String, Option<String>)>,
+    /// The number of rows at this position that have already been returned, which are skipped
+    skip: usize,
+}
+
+/// The time of a row, and the values of the rest of its columns as strings
+type Position = (i64, Vec<Option<String>>);
+
+impl PageKey {
+    /// Get the columns to order the rows with the given schema by
+    pub(crate) fn from_schema(schema: &Schema) -> Result<Self, PaginationError> {
+        match schema
+            .field_with_name(TIME_COLUMN_NAME)
+            .map(|f| f.data_type())
+        {
+            Ok(DataType::Timestamp(TimeUnit::Nanosecond, _)) => (),
+            _ => return Err(PaginationError::MissingTimeColumn),
+        }
+        let (tags, fields): (Vec<_>, Vec<_>) = schema
+            .fields()
+            .iter()
+            .filter(|field| field.name() != TIME_COLUMN_NAME)
+            .partition(|field| {
+                matches!(
+                    field.data_type(),
+                    DataType::Dictionary(_, value) if value.as_ref() == &DataType::Utf8
+                )
+            });
+        let columns = tags
+            .into_iter()
+            .chain(fields)
+            .map(|field| {
+                if can_cast_types(field.data_type(), &DataType::Utf8) {
+                    Ok(field.name().clone())
+                } else {
+                    Err(PaginationError::UnorderedColumn(field.name().clone()))
+                }
+            })
+            .collect::<Result<_, _>>()?;
+        Ok(Self { columns })
+    }
+
+    /// The query for the page of at most `limit` rows of the results of `query` that follow the
+    /// cursor, or for the first page if there is no cursor
+    pub(crate) fn page_query(
+        &self,
+        query: &str,
+        cursor: Option<&Cursor>,
+        limit: usize,
+    ) -> Result<String, PaginationError> {
+        let query = query.trim_end().trim_end_matches(';');
+        let mut page_query = format!("SELECT * FROM ({query}) AS page");
+        if let Some(cursor) = cursor {
+            if cursor.columns.len() != self.columns.len()
+                || cursor
+                    .columns
+                    .iter()
+                    .zip(&self.columns)
+                    .any(|((name, _), column)| name != column)
+            {
+                return Err(PaginationError::CursorMismatch);
+            }
+            page_query.push_str(" WHERE ");
+            page_query.push_str(&self.at_or_after(cursor));
+        }
+        let order_by = std::iter::once(quote_ident(TIME_COLUMN_NAME))
+            .chain(
+                self.columns
+                    .iter()
+                    .map(|column| format!("{} NULLS FIRST", column_expr(column))),
+            )
+            .collect::<Vec<_>>()
+            .join(", ");
+        page_query.push_str(&format!(" ORDER BY {order_by} LIMIT {limit}"));
+        if let Some(cursor) = cursor.filter(|cursor| cursor.skip > 0) {
+            page_query.push_str(&format!(" OFFSET {}", cursor.skip));
+        }
+        Ok(page_query)
+    }
+
+    /// The predicate for the rows that are at the position of the cursor, or ordered after it,
+    /// i.e., `time > t OR (time = t AND (column_1 > v_1 OR (column_1 = v_1 AND (...))))`, with
+    /// the last comparison being `>=`
+    fn at_or_after(&self, cursor: &Cursor) -> String {
+        let time = format!(
+            "arrow_cast({time}, 'Timestamp(Nanosecond, None)')",
+            time = cursor.time
+        );
+        let mut keys =
+            std::iter::once((quote_ident(TIME_COLUMN_NAME), Some(time)))
+                .chain(cursor.columns.iter().map(|(column, value)| {
+                    (column_expr(column), value.as_deref().map(quote_literal))
+                }))
+                .rev();
+        let at_or_after = match keys.next().expect("the time is always a key") {
+            (column, Some(value)) => format!("{column} >= {value}"),
+            // every value is at or after null:
+            (_, None) => "TRUE".to_string(),
+        };
+        keys.fold(at_or_after, |after, (column, value)| match value {
+            Some(value) => {
+                format!("{column} > {value} OR ({column} = {value} AND ({after}))")
+            }
+            None => format!("{column} IS NOT NULL OR ({column} IS NULL AND ({after}))"),
+        })
+    }
+
+    /// The cursor for the position of the last row of a page that started at `cursor`, or
+    /// `None` if the page is empty
+    ///
+    /// The rows at the same position as the last row are at the end of the page, and are
+    /// counted so that the next page skips them, along with those on earlier pages if every row
+    /// on the page is at that position.
+    pub(crate) fn next_cursor(
+        &self,
+        page: &[RecordBatch],
+        cursor: Option<&Cursor>,
+    ) -> Result<Option<Cursor>, PaginationError> {
+        let mut last: Option<Position> = None;
+        let mut skip = 0;
+        for batch in page.iter().rev() {
+            let rows = Rows::try_new(self, batch)?;
+            for row in (0..batch.num_rows()).rev() {
+                let position = rows.position(row)?;
+                match &last {
+                    None => last = Some(position),
+                    Some(end) if end == &position => (),
+                    Some(end) => return Ok(Some(self.cursor(end.clone(), skip))),
+                }
+                skip += 1;
+            }
+        }
+        Ok(last.map(|last| {
+            let skip = match cursor {
+                Some(cursor) if cursor.position() == last => cursor.skip + skip,
+                _ => skip,
+            };
+            self.cursor(last, skip)
+        }))
+    }
+
+    fn cursor(&self, (time, values): Position, skip: usize) -> Cursor {
+        Cursor {
+            time,
+            columns: self.columns.iter().cloned().zip(values).collect(),
+            skip,
+        }
+    }
+}
+
+/// The columns of a batch of rows that their positions are read from
+struct Rows {
+    time: TimestampNanosecondArray,
+    columns: Vec<StringArray>,
+}
+
+impl Rows {
+    fn try_new(key: &PageKey, batch: &RecordBatch) -> Result<Self, PaginationError> {
+        let time = batch
+            .column_by_name(TIME_COLUMN_NAME)
+            .and_then(|c| c.as_primitive_opt::<TimestampNanosecondType>())
+            .ok_or(PaginationError::MissingTimeColumn)?
+            .clone();
+        let columns = key
+            .columns
+            .iter()
+            .map(|name| {
+                let column = batch
+                    .column_by_name(name)
+                    .ok_or(PaginationError::CursorMismatch)?;
+                Ok(cast(column, &DataType::Utf8)?.as_string::<i32>().clone())
+            })
+            .collect::<Result<_, PaginationError>>()?;
+        Ok(Self { time, columns })
+    }
+
+    fn position(&self, row: usize) -> Result<Position, PaginationError> {
+        if self.time.is_null(row) {
+            return Err(PaginationError::NullTime);
+        }
+        let values = self
+            .columns
+            .iter()
+            .map(|column| (!column.is_null(row)).then(|| column.value(row).to_string()))
+            .collect();
+        Ok((self.time.value(row), values))
+    }
+}
+
+impl Cursor {
+    pub(crate) fn encode(&self) -> String {
+        URL_SAFE_NO_PAD.encode(serde_json::to_vec(self).unwrap())
+    }
+
+    pub(crate) fn decode(cursor: &str) -> Result<Self, PaginationError> {
+        URL_SAFE_NO_PAD
+            .decode(cursor)
+            .ok()
+            .and_then(|json| serde_json::from_slice(&json).ok())
+            .ok_or(PaginationError::InvalidCursor)
+    }
+
+    fn position(&self) -> Position {
+        (
+            self.time,
+            self.columns
+                .iter()
+                .map(|(_, value)| value.clone())
+                .collect(),
+        )
+    }
+}
+
+/// A column compared by its value as a string, which is how the values of the positions of rows
+/// are compared
+fn column_expr(column: &str) -> String {
+    format!("CAST({column} AS VARCHAR)", column = quote_ident(column))
+}
+
+fn quote_ident(ident: &str) -> String {
+    format!("\"{}\"", ident.replace('"', "\"\""))
+}
+
+fn quote_literal(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "''"))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use arrow::array::{DictionaryArray, Float64Array, TimestampNanosecondArray};
+    use arrow::datatypes::{DataType, Field, Int32Type, Schema, TimeUnit};
+    use arrow::record_batch::RecordBatch;
+
+    use super::{Cursor, PageKey, PaginationError};
+
+    fn schema() -> Schema {
+        Schema::new(vec![
+            Field::new("usage", DataType::Float64, true),
+            Field::new(
+                "host",
+                DataType::Dictionary(Box::new(DataType::Int32), Box::new(DataType::Utf8)),
+                true,
+            ),
+            Field::new(
+                "time",
+                DataType::Timestamp(TimeUnit::Nanosecond, None),
+                false,
+            ),
+        ])
+    }
+
+    fn batch(hosts: Vec<Option<&str>>, times: Vec<i64>, usages: Vec<f64>) -> RecordBatch {
+        RecordBatch::try_new(
+            Arc::new(schema()),
+            vec![
+                Arc::new(Float64Array::from(usages)),
+                Arc::new(DictionaryArray::<Int32Type>::from_iter(hosts)),
+                Arc::new(TimestampNanosecondArray::from(times)),
+            ],
+        )
+        .unwrap()
+    }
+
+    fn cursor(time: i64, host: Option<&str>, usage: &str, skip: usize) -> Cursor {
+        Cursor {
+            time,
+            columns: vec![
+                ("host".to_string(), host.map(str::to_string)),
+                ("usage".to_string(), Some(usage.to_string())),
+            ],
+            skip,
+        }
+    }
+
+    #[test]
+    fn page_queries() {
+        let key = PageKey::from_schema(&schema()).unwrap();
+        assert_eq!(
+            key.page_query("SELECT * FROM cpu;", None, 11).unwrap(),
+            "SELECT * FROM (SELECT * FROM cpu) AS page \
+            ORDER BY \"time\", CAST(\"host\" AS VARCHAR) NULLS FIRST, \
+            CAST(\"usage\" AS VARCHAR) NULLS FIRST LIMIT 11"
+        );
+
+        assert_eq!(
+            key.page_query(
+                "SELECT * FROM cpu",
+                Some(&cursor(5, Some("o'brien"), "0.5", 2)),
+                11
+            )
+            .unwrap(),
+            "SELECT * FROM (SELECT * FROM cpu) AS page WHERE \
+            \"time\" > arrow_cast(5, 'Timestamp(Nanosecond, None)') OR \
+            (\"time\" = arrow_cast(5, 'Timestamp(Nanosecond, None)') AND \
+            (CAST(\"host\" AS VARCHAR) > 'o''brien' OR \
+            (CAST(\"host\" AS VARCHAR) = 'o''brien' AND \
+            (CAST(\"usage\" AS VARCHAR) >= '0.5')))) \
+            ORDER BY \"time\", CAST(\"host\" AS VARCHAR) NULLS FIRST, \
+            CAST(\"usage\" AS VARCHAR) NULLS FIRST LIMIT 11 OFFSET 2"
+        );
+
+        // nulls are ordered before every other value:
+        assert_eq!(
+            key.page_query("SELECT * FROM cpu", Some(&cursor(5, None, "0.5", 1)), 11)
+                .unwrap(),
+            "SELECT * FROM (SELECT * FROM cpu) AS page WHERE \
+            \"time\" > arrow_cast(5, 'Timestamp(Nanosecond, None)') OR \
+            (\"time\" = arrow_cast(5, 'Timestamp(Nanosecond, None)') AND \
+            (CAST(\"host\" AS VARCHAR) IS NOT NULL OR \
+            (CAST(\"host\" AS VARCHAR) IS NULL AND \
+            (CAST(\"usage\" AS VARCHAR) >= '0.5')))) \
+            ORDER BY \"time\", CAST(\"host\" AS VARCHAR) NULLS FIRST, \
+            CAST(\"usage\" AS VARCHAR) NULLS FIRST LIMIT 11 OFFSET 1"
+        );
+
+        // the cursor must be for the same columns:
+        let cursor = Cursor {
+            time: 5,
+            columns: vec![("region".to_string(), Some("us".to_string()))],
+            skip: 1,
+        };
+        assert!(matches!(
+            key.page_query("SELECT * FROM cpu", Some(&cursor), 11),
+            Err(PaginationError::CursorMismatch)
+        ));
+    }
+
+    #[test]
+    fn next_cursor() {
+        let key = PageKey::from_schema(&schema()).unwrap();
+
+        let page = [
+            batch(vec![Some("a"), None], vec![1, 2], vec![0.5, 0.7]),
+            batch(vec![], vec![], vec![]),
+        ];
+        let next = key.next_cursor(&page, None).unwrap().unwrap();
+        assert_eq!(next, cursor(2, None, "0.7", 1));
+        assert_eq!(Cursor::decode(&next.encode()).unwrap(), next);
+        assert!(matches!(
+            Cursor::decode("not a cursor"),
+            Err(PaginationError::InvalidCursor)
+        ));
+
+        // rows that are the same in every column are counted, across batches:
+        let page = [
+            batch(vec![Some("a"), Some("a")], vec![1, 2], vec![0.5, 0.5]),
+            batch(vec![Some("a")], vec![2], vec![0.5]),
+        ];
+        let next = key.next_cursor(&page, None).unwrap().unwrap();
+        assert_eq!(next, cursor(2, Some("a"), "0.5", 2));
+
+        // and those on earlier pages too, if the whole page is the same row:
+        let page = [batch(vec![Some("a"); 3], vec![2; 3], vec![0.5; 3])];
+        assert_eq!(
+            key.next_cursor(&page, Some(&next)).unwrap().unwrap(),
+            cursor(2, Some("a"), "0.5", 5)
+        );
+
+        assert_eq!(key.next_cursor(&[], Some(&next)).unwrap(), None);
+    }
+
+    #[test]
+    fn time_column_required() {
+        let schema = Schema::new(vec![Field::new("usage", DataType::Float64, true)]);
+        assert!(matches!(
+            PageKey::from_schema(&schema),
+            Err(PaginationError::MissingTimeColumn)
+        ));
+    }
+
+    #[test]
+    fn columns_must_be_ordered() {
+        let schema = Schema::new(vec![
+            Field::new(
+                "time",
+                DataType::Timestamp(TimeUnit::Nanosecond, None),
+                false,
+            ),
+            Field::new(
+                "values",
+                DataType::Struct(vec![Field::new("usage", DataType::Float64, true)].into()),
+                true,
+            ),
+        ]);
+        assert!(matches!(
+            PageKey::from_schema(&schema),
+            Err(PaginationError::UnorderedColumn(column)) if column == "values"
+        ));
+    }
+}
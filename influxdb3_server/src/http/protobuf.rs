@@ -0,0 +1,226 @@
+//! Serialization of query results to the protobuf output format, which is described by
+//! `proto/query_results.proto`
+//!
+//! The messages are declared by hand, rather than generated at build time, as they are small
+//! and not expected to change often; they must be kept in sync with the `.proto` file.
+
+use arrow::array::{Array, ArrayRef, AsArray};
+use arrow::compute::cast;
+use arrow::datatypes::{DataType, Float64Type, Int64Type, UInt64Type};
+use arrow::error::ArrowError;
+use arrow::record_batch::RecordBatch;
+use arrow::util::display::{ArrayFormatter, FormatOptions};
+use prost::Message;
+
+/// The results of a query
+#[derive(Clone, PartialEq, Message)]
+pub(crate) struct QueryResults {
+    #[prost(string, repeated, tag = "1")]
+    pub(crate) columns: Vec<String>,
+    #[prost(message, repeated, tag = "2")]
+    pub(crate) rows: Vec<Row>,
+}
+
+/// A single row of the results, with a value for each column
+#[derive(Clone, PartialEq, Message)]
+pub(crate) struct Row {
+    #[prost(message, repeated, tag = "1")]
+    pub(crate) values: Vec<Value>,
+}
+
+/// A single value in a row, which is `None` if the value is null
+#[derive(Clone, PartialEq, Message)]
+pub(crate) struct Value {
+    #[prost(oneof = "value::Value", tags = "1, 2, 3, 4, 5")]
+    pub(crate) value: Option<value::Value>,
+}
+
+pub(crate) mod value {
+    #[derive(Clone, PartialEq, prost::Oneof)]
+    pub(crate) enum Value {
+        #[prost(double, tag = "1")]
+        FloatValue(f64),
+        #[prost(int64, tag = "2")]
+        IntegerValue(i64),
+        #[prost(uint64, tag = "3")]
+        UnsignedValue(u64),
+        #[prost(string, tag = "4")]
+        StringValue(String),
+        #[prost(bool, tag = "5")]
+        BooleanValue(bool),
+    }
+}
+
+/// Encode the given batches as a protobuf [`QueryResults`] message
+///
+/// The columns are taken from the schema of the first batch; all batches are expected to share
+/// the same schema.
+pub(crate) fn record_batches_to_protobuf(batches: &[RecordBatch]) -> Result<Vec<u8>, ArrowError> {
+    let columns = batches
+        .first()
+        .map(|batch| {
+            batch
+                .schema()
+                .fields()
+                .iter()
+                .map(|field| field.name().to_string())
+                .collect()
+        })
+        .unwrap_or_default();
+
+    let mut rows = Vec::with_capacity(batches.iter().map(RecordBatch::num_rows).sum());
+    for batch in batches {
+        let mut batch_rows = vec![
+            Row {
+                values: Vec::with_capacity(batch.num_columns())
+            };
+            batch.num_rows()
+        ];
+        for array in batch.columns() {
+            for (row, value) in batch_rows.iter_mut().zip(column_values(array)?) {
+                row.values.push(value);
+            }
+        }
+        rows.extend(batch_rows);
+    }
+
+    Ok(QueryResults { columns, rows }.encode_to_vec())
+}
+
+/// Convert each value in the array to a protobuf [`Value`]
+fn column_values(array: &ArrayRef) -> Result<Vec<Value>, ArrowError> {
+    fn to_value<T>(v: Option<T>, f: impl FnOnce(T) -> value::Value) -> Value {
+        Value { value: v.map(f) }
+    }
+
+    let values = match array.data_type() {
+        DataType::Float64 => array
+            .as_primitive::<Float64Type>()
+            .iter()
+            .map(|v| to_value(v, value::Value::FloatValue))
+            .collect(),
+        DataType::Int64 => array
+            .as_primitive::<Int64Type>()
+            .iter()
+            .map(|v| to_value(v, value::Value::IntegerValue))
+            .collect(),
+        DataType::UInt64 => array
+            .as_primitive::<UInt64Type>()
+            .iter()
+            .map(|v| to_value(v, value::Value::UnsignedValue))
+            .collect(),
+        DataType::Boolean => array
+            .as_boolean()
+            .iter()
+            .map(|v| to_value(v, value::Value::BooleanValue))
+            .collect(),
+        DataType::Utf8 => array
+            .as_string::<i32>()
+            .iter()
+            .map(|v| to_value(v, |s| value::Value::StringValue(s.to_string())))
+            .collect(),
+        // tags are dictionary encoded:
+        DataType::Dictionary(_, value_type) if value_type.as_ref() == &DataType::Utf8 => {
+            return column_values(&cast(array, &DataType::Utf8)?);
+        }
+        // anything else, such as timestamps, is formatted the same way as in the JSON format:
+        _ => {
+            let formatter = ArrayFormatter::try_new(array.as_ref(), &FormatOptions::default())?;
+            (0..array.len())
+                .map(|i| {
+                    let v = array.is_valid(i).then(|| formatter.value(i).to_string());
+                    to_value(v, value::Value::StringValue)
+                })
+                .collect()
+        }
+    };
+    Ok(values)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use arrow::array::{
+        BooleanArray, DictionaryArray, Float64Array, Int64Array, StringArray,
+        TimestampNanosecondArray, UInt64Array,
+    };
+    use arrow::datatypes::{DataType, Field, Int32Type, Schema, TimeUnit};
+    use arrow::record_batch::RecordBatch;
+    use prost::Message;
+
+    use super::{record_batches_to_protobuf, value, QueryResults, Row, Value};
+
+    #[test]
+    fn encode_batches() {
+        let schema = Arc::new(Schema::new(vec![
+            Field::new(
+                "host",
+                DataType::Dictionary(Box::new(DataType::Int32), Box::new(DataType::Utf8)),
+                true,
+            ),
+            Field::new("f", DataType::Float64, true),
+            Field::new("i", DataType::Int64, true),
+            Field::new("u", DataType::UInt64, true),
+            Field::new("s", DataType::Utf8, true),
+            Field::new("b", DataType::Boolean, true),
+            Field::new(
+                "time",
+                DataType::Timestamp(TimeUnit::Nanosecond, None),
+                false,
+            ),
+        ]));
+        let batch = |host: &str, f: Option<f64>, time: i64| {
+            RecordBatch::try_new(
+                Arc::clone(&schema),
+                vec![
+                    Arc::new(DictionaryArray::<Int32Type>::from_iter([host])),
+                    Arc::new(Float64Array::from(vec![f])),
+                    Arc::new(Int64Array::from(vec![Some(-1)])),
+                    Arc::new(UInt64Array::from(vec![Some(1)])),
+                    Arc::new(StringArray::from(vec![Some("x")])),
+                    Arc::new(BooleanArray::from(vec![Some(true)])),
+                    Arc::new(TimestampNanosecondArray::from(vec![time])),
+                ],
+            )
+            .unwrap()
+        };
+
+        let bytes = record_batches_to_protobuf(&[
+            batch("a", Some(0.5), 1_000_000_000),
+            batch("b", None, 2_000_000_000),
+        ])
+        .unwrap();
+        let results = QueryResults::decode(bytes.as_slice()).unwrap();
+
+        assert_eq!(results.columns, ["host", "f", "i", "u", "s", "b", "time"]);
+        let row = |host: &str, f: Option<f64>, time: &str| Row {
+            values: [
+                Some(value::Value::StringValue(host.to_string())),
+                f.map(value::Value::FloatValue),
+                Some(value::Value::IntegerValue(-1)),
+                Some(value::Value::UnsignedValue(1)),
+                Some(value::Value::StringValue("x".to_string())),
+                Some(value::Value::BooleanValue(true)),
+                Some(value::Value::StringValue(time.to_string())),
+            ]
+            .into_iter()
+            .map(|value| Value { value })
+            .collect(),
+        };
+        assert_eq!(
+            results.rows,
+            [
+                row("a", Some(0.5), "1970-01-01T00:00:01"),
+                row("b", None, "1970-01-01T00:00:02"),
+            ]
+        );
+
+        // no batches gives empty results:
+        let bytes = record_batches_to_protobuf(&[]).unwrap();
+        assert_eq!(
+            QueryResults::decode(bytes.as_slice()).unwrap(),
+            QueryResults::default()
+        );
+    }
+}
@@ -0,0 +1,369 @@
+//! Caching of the responses to repeated queries, so that identical queries made within a short
+//! time of each other do not need to scan the same data again
+
+use std::collections::HashMap;
+use std::time::Duration;
+
+use bytes::Bytes;
+use iox_http::write::v1::V1_NAMESPACE_RP_SEPARATOR;
+use iox_time::Time;
+use metric::{Registry, U64Counter};
+use parking_lot::Mutex;
+
+/// Identifies a query whose response can be cached
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub(crate) struct QueryCacheKey {
+    /// The database that the query is run against
+    database: String,
+    /// The query language, e.g., `sql`
+    kind: &'static str,
+    /// The query, with insignificant whitespace removed
+    query: String,
+    /// The content type of the response
+    content_type: String,
+    /// The parameters that were bound to the query, encoded as JSON
+    params: String,
+}
+
+impl QueryCacheKey {
+    pub(crate) fn new(
+        database: &str,
+        kind: &'static str,
+        query: &str,
+        content_type: &str,
+        params: String,
+    ) -> Self {
+        Self {
+            database: database.to_string(),
+            kind,
+            query: normalize_query(query),
+            content_type: content_type.to_string(),
+            params,
+        }
+    }
+}
+
+#[derive(Debug)]
+struct CacheEntry {
+    inserted_at: Time,
+    /// Increases each time any entry is used, so that the least recently used entry has the
+    /// lowest value
+    last_used: u64,
+    body: Bytes,
+}
+
+#[derive(Debug, Default)]
+struct CacheState {
+    entries: HashMap<QueryCacheKey, CacheEntry>,
+    uses: u64,
+    /// The number of times that the responses for each database were invalidated, keyed on the
+    /// name of the database without any retention policy
+    invalidations: HashMap<String, u64>,
+    /// The number of times that the cache was cleared
+    clears: u64,
+}
+
+/// The generation of the responses cached for a database, which changes each time they are
+/// invalidated
+///
+/// This is taken before a query is run, so that its response is not cached if the database was
+/// written to while it ran, as the response might not include the write.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct CacheGeneration {
+    clears: u64,
+    invalidations: u64,
+}
+
+impl CacheState {
+    fn generation(&self, database: &str) -> CacheGeneration {
+        CacheGeneration {
+            clears: self.clears,
+            invalidations: self
+                .invalidations
+                .get(base_database_name(database))
+                .copied()
+                .unwrap_or_default(),
+        }
+    }
+}
+
+/// A least recently used cache of query responses, which are kept for up to `ttl`
+///
+/// Writes to a database should invalidate the responses cached for it with
+/// [`QueryCache::invalidate_database`], so that they are not served stale results.
+#[derive(Debug)]
+pub(crate) struct QueryCache {
+    ttl: Duration,
+    capacity: usize,
+    state: Mutex<CacheState>,
+    hits: U64Counter,
+    misses: U64Counter,
+}
+
+impl QueryCache {
+    pub(crate) fn new(ttl: Duration, capacity: usize, registry: &Registry) -> Self {
+        let requests = registry.register_metric::<U64Counter>(
+            "influxdb3_query_cache_requests",
+            "number of queries that were looked up in the query cache",
+        );
+        Self {
+            ttl,
+            capacity,
+            state: Default::default(),
+            hits: requests.recorder(&[("result", "hit")]),
+            misses: requests.recorder(&[("result", "miss")]),
+        }
+    }
+
+    /// Get the cached response for the given query, if it was cached within the TTL as of `now`
+    pub(crate) fn get(&self, key: &QueryCacheKey, now: Time) -> Option<Bytes> {
+        let mut state = self.state.lock();
+        state.uses += 1;
+        let uses = state.uses;
+        let body = match state.entries.get_mut(key) {
+            Some(entry) if !self.is_expired(entry, now) => {
+                entry.last_used = uses;
+                Some(entry.body.clone())
+            }
+            Some(_) => {
+                state.entries.remove(key);
+                None
+            }
+            None => None,
+        };
+        match body {
+            Some(_) => self.hits.inc(1),
+            None => self.misses.inc(1),
+        }
+        body
+    }
+
+    /// The current generation of the responses cached for the database of the given query
+    pub(crate) fn generation(&self, key: &QueryCacheKey) -> CacheGeneration {
+        self.state.lock().generation(&key.database)
+    }
+
+    /// Cache the response to the given query, evicting the least recently used response if
+    /// the cache is full
+    ///
+    /// The response is not cached if the responses for its database were invalidated since
+    /// `generation`, which was taken before the query was run.
+    pub(crate) fn insert(
+        &self,
+        key: QueryCacheKey,
+        body: Bytes,
+        now: Time,
+        generation: CacheGeneration,
+    ) {
+        if self.capacity == 0 {
+            return;
+        }
+        let mut state = self.state.lock();
+        if state.generation(&key.database) != generation {
+            return;
+        }
+        state
+            .entries
+            .retain(|_, entry| !self.is_expired(entry, now));
+        if !state.entries.contains_key(&key) && state.entries.len() >= self.capacity {
+            let lru = state
+                .entries
+                .iter()
+                .min_by_key(|(_, entry)| entry.last_used)
+                .map(|(key, _)| key.clone());
+            if let Some(lru) = lru {
+                state.entries.remove(&lru);
+            }
+        }
+        state.uses += 1;
+        let last_used = state.uses;
+        state.entries.insert(
+            key,
+            CacheEntry {
+                inserted_at: now,
+                last_used,
+                body,
+            },
+        );
+    }
+
+    /// Remove the responses cached for the given database, along with those for any of its
+    /// retention policies
+    pub(crate) fn invalidate_database(&self, database: &str) {
+        let base = base_database_name(database);
+        let mut state = self.state.lock();
+        state
+            .entries
+            .retain(|key, _| base_database_name(&key.database) != base);
+        *state.invalidations.entry(base.to_string()).or_default() += 1;
+    }
+
+    /// Remove all cached responses
+    pub(crate) fn clear(&self) {
+        let mut state = self.state.lock();
+        state.entries.clear();
+        state.clears += 1;
+    }
+
+    fn is_expired(&self, entry: &CacheEntry, now: Time) -> bool {
+        now.checked_duration_since(entry.inserted_at)
+            .map_or(false, |elapsed| elapsed >= self.ttl)
+    }
+}
+
+/// The name of the database without any retention policy
+fn base_database_name(database: &str) -> &str {
+    database
+        .split(V1_NAMESPACE_RP_SEPARATOR)
+        .next()
+        .unwrap_or_default()
+}
+
+/// Trim the query and collapse each run of whitespace to a single space, other than within
+/// quoted strings and identifiers, where whitespace is significant
+fn normalize_query(query: &str) -> String {
+    let mut normalized = String::with_capacity(query.len());
+    let mut quote = None;
+    let mut escaped = false;
+    let mut pending_space = false;
+    for c in query.trim().chars() {
+        match quote {
+            Some(q) => {
+                if escaped {
+                    escaped = false;
+                } else if c == '\\' {
+                    escaped = true;
+                } else if c == q {
+                    quote = None;
+                }
+                normalized.push(c);
+            }
+            None if c.is_whitespace() => pending_space = true,
+            None => {
+                if pending_space {
+                    normalized.push(' ');
+                    pending_space = false;
+                }
+                if matches!(c, '\'' | '"') {
+                    quote = Some(c);
+                }
+                normalized.push(c);
+            }
+        }
+    }
+    normalized
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use bytes::Bytes;
+    use iox_time::Time;
+    use metric::{Attributes, Metric, Registry, U64Counter};
+
+    use super::{normalize_query, QueryCache, QueryCacheKey};
+
+    fn key(database: &str, query: &str) -> QueryCacheKey {
+        QueryCacheKey::new(database, "sql", query, "application/json", String::new())
+    }
+
+    fn insert(cache: &QueryCache, key: QueryCacheKey, body: &'static str, now: Time) {
+        let generation = cache.generation(&key);
+        cache.insert(key, Bytes::from(body), now, generation);
+    }
+
+    #[test]
+    fn normalize() {
+        assert_eq!(
+            normalize_query("  SELECT *\n  FROM\tcpu  "),
+            "SELECT * FROM cpu"
+        );
+        assert_eq!(
+            normalize_query("SELECT  \"a  b\" FROM cpu WHERE host =  'x  \\'  y'"),
+            "SELECT \"a  b\" FROM cpu WHERE host = 'x  \\'  y'"
+        );
+    }
+
+    #[test]
+    fn get_and_insert() {
+        let registry = Registry::new();
+        let cache = QueryCache::new(Duration::from_secs(60), 2, &registry);
+        let start = Time::from_timestamp_nanos(0);
+
+        assert!(cache.get(&key("foo", "SELECT 1"), start).is_none());
+        insert(&cache, key("foo", "SELECT 1"), "one", start);
+        assert_eq!(
+            cache.get(&key("foo", "SELECT   1"), start),
+            Some(Bytes::from("one"))
+        );
+        // the database is part of the key:
+        assert!(cache.get(&key("bar", "SELECT 1"), start).is_none());
+
+        // the least recently used response is evicted once the cache is full:
+        insert(&cache, key("foo", "SELECT 2"), "two", start);
+        cache.get(&key("foo", "SELECT 1"), start);
+        insert(&cache, key("foo", "SELECT 3"), "three", start);
+        assert!(cache.get(&key("foo", "SELECT 1"), start).is_some());
+        assert!(cache.get(&key("foo", "SELECT 2"), start).is_none());
+        assert!(cache.get(&key("foo", "SELECT 3"), start).is_some());
+
+        // responses expire once the TTL has elapsed:
+        let later = start + Duration::from_secs(60);
+        assert!(cache.get(&key("foo", "SELECT 1"), later).is_none());
+
+        let requests = registry
+            .get_instrument::<Metric<U64Counter>>("influxdb3_query_cache_requests")
+            .unwrap();
+        let count = |result: &'static str| {
+            requests
+                .get_observer(&Attributes::from(&[("result", result)]))
+                .unwrap()
+                .fetch()
+        };
+        assert_eq!(count("hit"), 4);
+        assert_eq!(count("miss"), 4);
+    }
+
+    #[test]
+    fn invalidate_database() {
+        let cache = QueryCache::new(Duration::from_secs(60), 10, &Registry::new());
+        let now = Time::from_timestamp_nanos(0);
+        for db in ["foo", "foo/bar", "baz"] {
+            insert(&cache, key(db, "SELECT 1"), db, now);
+        }
+
+        // writing to a retention policy invalidates the whole database:
+        cache.invalidate_database("foo/bar");
+        assert!(cache.get(&key("foo", "SELECT 1"), now).is_none());
+        assert!(cache.get(&key("foo/bar", "SELECT 1"), now).is_none());
+        assert!(cache.get(&key("baz", "SELECT 1"), now).is_some());
+
+        cache.clear();
+        assert!(cache.get(&key("baz", "SELECT 1"), now).is_none());
+    }
+
+    #[test]
+    fn not_cached_when_invalidated_while_running() {
+        let cache = QueryCache::new(Duration::from_secs(60), 10, &Registry::new());
+        let now = Time::from_timestamp_nanos(0);
+
+        // a write to the database while the query runs means the response may be stale:
+        let generation = cache.generation(&key("foo", "SELECT 1"));
+        cache.invalidate_database("foo/autogen");
+        cache.insert(key("foo", "SELECT 1"), Bytes::from("one"), now, generation);
+        assert!(cache.get(&key("foo", "SELECT 1"), now).is_none());
+
+        // as does clearing the cache:
+        let generation = cache.generation(&key("foo", "SELECT 1"));
+        cache.clear();
+        cache.insert(key("foo", "SELECT 1"), Bytes::from("one"), now, generation);
+        assert!(cache.get(&key("foo", "SELECT 1"), now).is_none());
+
+        // but a write to another database does not:
+        let generation = cache.generation(&key("foo", "SELECT 1"));
+        cache.invalidate_database("bar");
+        cache.insert(key("foo", "SELECT 1"), Bytes::from("one"), now, generation);
+        assert!(cache.get(&key("foo", "SELECT 1"), now).is_some());
+    }
+}
@@ -0,0 +1,184 @@
+//! Limiting the number of queries that run at once, queuing any excess queries up to a limit
+
+use std::pin::Pin;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::task::{Context, Poll};
+
+use arrow::datatypes::SchemaRef;
+use arrow::record_batch::RecordBatch;
+use datafusion::error::DataFusionError;
+use datafusion::execution::{RecordBatchStream, SendableRecordBatchStream};
+use futures::Stream;
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+/// Limits the number of queries that run at once
+///
+/// Queries over the limit wait for a running query to finish, unless `max_queued` queries are
+/// already waiting, in which case they are rejected.
+#[derive(Debug)]
+pub(crate) struct QueryLimit {
+    permits: Arc<Semaphore>,
+    max_running: usize,
+    max_queued: usize,
+    queued: AtomicUsize,
+}
+
+/// A query has been rejected as the queue of queries waiting to run is full
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct QueueFull;
+
+/// Permission for a single query to run, which is given back when dropped
+#[derive(Debug)]
+pub(crate) struct QueryPermit(OwnedSemaphorePermit);
+
+impl QueryLimit {
+    pub(crate) fn new(max_running: usize, max_queued: usize) -> Self {
+        Self {
+            permits: Arc::new(Semaphore::new(max_running)),
+            max_running,
+            max_queued,
+            queued: AtomicUsize::new(0),
+        }
+    }
+
+    /// Wait for permission to run a query, or fail straight away if the queue is full
+    pub(crate) async fn acquire(&self) -> Result<QueryPermit, QueueFull> {
+        if let Ok(permit) = Arc::clone(&self.permits).try_acquire_owned() {
+            return Ok(QueryPermit(permit));
+        }
+
+        // the count is decremented when the guard is dropped, which covers the request being
+        // cancelled while it waits:
+        self.queued
+            .fetch_update(Ordering::AcqRel, Ordering::Acquire, |queued| {
+                (queued < self.max_queued).then_some(queued + 1)
+            })
+            .map_err(|_| QueueFull)?;
+        let _queued = QueuedGuard(&self.queued);
+
+        let permit = Arc::clone(&self.permits)
+            .acquire_owned()
+            .await
+            .expect("query limit semaphore is never closed");
+        Ok(QueryPermit(permit))
+    }
+
+    /// The number of queries that are currently running
+    pub(crate) fn running(&self) -> usize {
+        self.max_running - self.permits.available_permits()
+    }
+
+    /// The number of queries that are currently waiting to run
+    pub(crate) fn queued(&self) -> usize {
+        self.queued.load(Ordering::Acquire)
+    }
+}
+
+impl QueryPermit {
+    /// Keep hold of the permit until the results of the query have been streamed, or the
+    /// stream is dropped
+    pub(crate) fn hold_for(self, stream: SendableRecordBatchStream) -> SendableRecordBatchStream {
+        Box::pin(PermitStream {
+            inner: stream,
+            _permit: self,
+        })
+    }
+}
+
+/// Decrements the number of queued queries when dropped
+struct QueuedGuard<'a>(&'a AtomicUsize);
+
+impl Drop for QueuedGuard<'_> {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::AcqRel);
+    }
+}
+
+/// A stream of the results of a query that holds on to the permit for the query to run
+struct PermitStream {
+    inner: SendableRecordBatchStream,
+    _permit: QueryPermit,
+}
+
+impl Stream for PermitStream {
+    type Item = Result<RecordBatch, DataFusionError>;
+
+    fn poll_next(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Option<Self::Item>> {
+        self.inner.as_mut().poll_next(cx)
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        self.inner.size_hint()
+    }
+}
+
+impl RecordBatchStream for PermitStream {
+    fn schema(&self) -> SchemaRef {
+        self.inner.schema()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    use arrow::datatypes::Schema;
+    use datafusion_util::MemoryStream;
+    use futures::FutureExt;
+
+    use super::{QueryLimit, QueueFull};
+
+    #[tokio::test]
+    async fn queue_up_to_limit() {
+        let limit = Arc::new(QueryLimit::new(1, 1));
+
+        let running = limit.acquire().await.unwrap();
+        assert_eq!((limit.running(), limit.queued()), (1, 0));
+
+        let waiting = tokio::spawn({
+            let limit = Arc::clone(&limit);
+            async move { limit.acquire().await.map(drop) }
+        });
+        while limit.queued() == 0 {
+            tokio::time::sleep(Duration::from_millis(1)).await;
+        }
+        assert_eq!((limit.running(), limit.queued()), (1, 1));
+
+        // the queue is full:
+        assert_eq!(limit.acquire().await.unwrap_err(), QueueFull);
+
+        drop(running);
+        waiting.await.unwrap().unwrap();
+        assert_eq!((limit.running(), limit.queued()), (0, 0));
+    }
+
+    #[tokio::test]
+    async fn cancelled_while_queued() {
+        let limit = QueryLimit::new(1, 1);
+        let running = limit.acquire().await.unwrap();
+
+        // polling once queues the query, which is then dropped:
+        assert!(limit.acquire().now_or_never().is_none());
+        assert_eq!(limit.queued(), 0);
+
+        drop(running);
+        assert_eq!(limit.running(), 0);
+    }
+
+    #[tokio::test]
+    async fn held_until_stream_dropped() {
+        let limit = QueryLimit::new(1, 0);
+        let permit = limit.acquire().await.unwrap();
+        let stream = permit.hold_for(Box::pin(MemoryStream::new_with_schema(
+            vec![],
+            Arc::new(Schema::empty()),
+        )));
+        assert_eq!(limit.running(), 1);
+        assert_eq!(limit.acquire().await.unwrap_err(), QueueFull);
+
+        drop(stream);
+        assert_eq!(limit.running(), 0);
+    }
+}
@@ -0,0 +1,118 @@
+//! Logging of each request handled by the HTTP API, identified by a generated request ID
+
+use std::time::{Duration, Instant};
+
+use hyper::http::HeaderValue;
+use hyper::{Body, Method, Request, Response};
+use observability_deps::tracing::info;
+use serde::Deserialize;
+
+/// The response header that gives the ID generated for the request
+pub(crate) const REQUEST_ID_HEADER: &str = "X-Request-Id";
+
+/// The details of a request that are logged once its response has been produced
+#[derive(Debug)]
+pub(crate) struct RequestLog {
+    request_id: String,
+    method: Method,
+    path: String,
+    db: Option<String>,
+    start: Instant,
+}
+
+/// The query parameters that name the database that a request is for, `bucket` being used by
+/// the v2 write API
+#[derive(Debug, Deserialize)]
+struct DatabaseParams {
+    db: Option<String>,
+    bucket: Option<String>,
+}
+
+impl RequestLog {
+    /// Start timing the given request, and generate an ID for it
+    pub(crate) fn new<B>(req: &Request<B>) -> Self {
+        let db = req
+            .uri()
+            .query()
+            .and_then(|q| serde_urlencoded::from_str::<DatabaseParams>(q).ok())
+            .and_then(|p| p.db.or(p.bucket));
+        Self {
+            request_id: uuid::Uuid::new_v4().to_string(),
+            method: req.method().clone(),
+            path: req.uri().path().to_string(),
+            db,
+            start: Instant::now(),
+        }
+    }
+
+    #[cfg(test)]
+    pub(crate) fn request_id(&self) -> &str {
+        &self.request_id
+    }
+
+    pub(crate) fn path(&self) -> &str {
+        &self.path
+    }
+
+    /// The time elapsed since the request started being handled
+    pub(crate) fn elapsed(&self) -> Duration {
+        self.start.elapsed()
+    }
+
+    /// Log the request along with the status of its response, and set the request ID header
+    /// on the response
+    pub(crate) fn finish(self, response: &mut Response<Body>) {
+        let duration = self.elapsed();
+        info!(
+            request_id = %self.request_id,
+            method = %self.method,
+            path = %self.path,
+            db = self.db.as_deref().unwrap_or_default(),
+            status = response.status().as_u16(),
+            ?duration,
+            "handled http request"
+        );
+        // a UUID is always a valid header value:
+        response.headers_mut().insert(
+            REQUEST_ID_HEADER,
+            HeaderValue::from_str(&self.request_id).unwrap(),
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use hyper::{Body, Request, Response, StatusCode};
+    use test_helpers::assert_contains;
+    use test_helpers::tracing::TracingCapture;
+
+    use super::{RequestLog, REQUEST_ID_HEADER};
+
+    #[test]
+    fn log_request_with_id() {
+        let capture = TracingCapture::new();
+
+        let req = Request::get("/query?db=foo&q=SELECT%201")
+            .body(Body::empty())
+            .unwrap();
+        let log = RequestLog::new(&req);
+        let request_id = log.request_id().to_string();
+        let mut response = Response::builder()
+            .status(StatusCode::NOT_FOUND)
+            .body(Body::empty())
+            .unwrap();
+        log.finish(&mut response);
+
+        assert_eq!(response.headers()[REQUEST_ID_HEADER], request_id.as_str());
+        let logs = capture.to_string();
+        assert_contains!(&logs, "handled http request");
+        assert_contains!(&logs, request_id.as_str());
+        assert_contains!(&logs, "GET");
+        assert_contains!(&logs, "/query");
+        assert_contains!(&logs, "foo");
+        assert_contains!(&logs, "404");
+
+        // each request gets its own ID:
+        assert_ne!(RequestLog::new(&req).request_id(), request_id);
+    }
+}
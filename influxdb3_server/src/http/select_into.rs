@@ -0,0 +1,473 @@
+//! Support for the `INTO` clause of InfluxQL `SELECT` statements
+//!
+//! The InfluxQL parser used for query planning does not support the `INTO` clause, so it is
+//! removed from the query string before the `SELECT` is planned and run, and the results of the
+//! query are then converted to line protocol and written to the target measurement.
+
+use std::fmt::Write;
+
+use arrow::array::{Array, AsArray};
+use arrow::compute::cast;
+use arrow::datatypes::{
+    DataType, Float64Type, Int64Type, TimeUnit, TimestampNanosecondType, UInt64Type,
+};
+use arrow::error::ArrowError;
+use arrow::record_batch::RecordBatch;
+use schema::{INFLUXQL_MEASUREMENT_COLUMN_NAME, TIME_COLUMN_NAME};
+
+/// A `SELECT` statement with an `INTO` clause
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct SelectInto {
+    /// Where the results of the query are written to
+    pub(crate) target: IntoTarget,
+    /// The `SELECT` statement, with the `INTO` clause removed
+    pub(crate) select: String,
+}
+
+/// The target of an `INTO` clause, `[[<database>.]<retention_policy>.]<measurement>`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct IntoTarget {
+    pub(crate) database: Option<String>,
+    /// The retention policy, `None` meaning the default retention policy
+    pub(crate) retention_policy: Option<String>,
+    pub(crate) measurement: String,
+}
+
+#[derive(Debug, thiserror::Error)]
+pub enum SelectIntoError {
+    #[error("expected measurement after INTO")]
+    ExpectedMeasurement,
+    #[error("expected FROM after INTO clause")]
+    ExpectedFrom,
+    #[error("unterminated quoted identifier in INTO clause")]
+    UnterminatedIdentifier,
+    #[error("INTO target has too many segments, expected [[<database>.]<retention_policy>.]<measurement>")]
+    TooManySegments,
+    #[error("the :MEASUREMENT back-reference in INTO clauses is not supported")]
+    BackReference,
+    #[error("column '{column}' has type {data_type}, which cannot be written as a field")]
+    UnsupportedFieldType { column: String, data_type: DataType },
+    #[error("query results do not have a nanosecond '{TIME_COLUMN_NAME}' column")]
+    MissingTimeColumn,
+    #[error("error converting tag column: {0}")]
+    Arrow(#[from] ArrowError),
+}
+
+impl SelectInto {
+    /// Attempt to parse a [`SelectInto`] from the given query string
+    ///
+    /// Returns `Ok(None)` if the query string is not a `SELECT` statement with an `INTO` clause,
+    /// so that it can be handled by the regular InfluxQL parser.
+    pub(crate) fn parse(query_str: &str) -> Result<Option<Self>, SelectIntoError> {
+        let mut scanner = Scanner::new(query_str);
+        match scanner.next_word() {
+            Some(w) if w.eq_ignore_ascii_case("SELECT") => (),
+            _ => return Ok(None),
+        }
+
+        // find the INTO clause, which comes between the selected fields and the FROM clause:
+        let into_start = loop {
+            let Some(start) = scanner.skip_to_word() else {
+                return Ok(None);
+            };
+            match scanner.next_word() {
+                Some(w) if w.eq_ignore_ascii_case("INTO") => break start,
+                Some(w) if w.eq_ignore_ascii_case("FROM") => return Ok(None),
+                _ => (),
+            }
+        };
+
+        let target = scanner.into_target()?;
+        let select = format!(
+            "{}{}",
+            &query_str[..into_start],
+            &query_str[scanner.position..]
+        );
+        Ok(Some(Self { target, select }))
+    }
+}
+
+/// Scans over the part of a `SELECT` statement that precedes its `FROM` clause, skipping over
+/// quoted strings and identifiers, and anything nested in parentheses
+struct Scanner<'a> {
+    input: &'a str,
+    position: usize,
+}
+
+impl<'a> Scanner<'a> {
+    fn new(input: &'a str) -> Self {
+        Self { input, position: 0 }
+    }
+
+    fn peek(&self) -> Option<char> {
+        self.input[self.position..].chars().next()
+    }
+
+    fn bump(&mut self) -> Option<char> {
+        let c = self.peek()?;
+        self.position += c.len_utf8();
+        Some(c)
+    }
+
+    fn skip_whitespace(&mut self) {
+        while self.peek().is_some_and(char::is_whitespace) {
+            self.bump();
+        }
+    }
+
+    /// Consume a bare word, made up of alphanumeric characters and underscores, if there is
+    /// one at the current position
+    fn next_word(&mut self) -> Option<&'a str> {
+        self.skip_whitespace();
+        let start = self.position;
+        while self
+            .peek()
+            .is_some_and(|c| c.is_ascii_alphanumeric() || c == '_')
+        {
+            self.bump();
+        }
+        (self.position > start).then(|| &self.input[start..self.position])
+    }
+
+    /// Skip to the start of the next bare word that is not nested in parentheses or quotes,
+    /// returning its position, or `None` if the end of the input is reached
+    fn skip_to_word(&mut self) -> Option<usize> {
+        let mut depth = 0_usize;
+        loop {
+            let c = self.peek()?;
+            match c {
+                '(' => depth += 1,
+                ')' => depth = depth.saturating_sub(1),
+                '\'' | '"' => {
+                    self.bump();
+                    self.quoted(c).ok()?;
+                    continue;
+                }
+                c if depth == 0 && (c.is_ascii_alphanumeric() || c == '_') => {
+                    return Some(self.position)
+                }
+                _ => (),
+            }
+            self.bump();
+        }
+    }
+
+    /// Consume the remainder of a string quoted with `quote`, whose opening quote has already
+    /// been consumed, returning its unescaped contents
+    fn quoted(&mut self, quote: char) -> Result<String, SelectIntoError> {
+        let mut s = String::new();
+        loop {
+            match self.bump() {
+                None => return Err(SelectIntoError::UnterminatedIdentifier),
+                Some(c) if c == quote => return Ok(s),
+                Some('\\') => match self.bump() {
+                    Some(c) if c == quote || c == '\\' => s.push(c),
+                    Some(c) => {
+                        s.push('\\');
+                        s.push(c);
+                    }
+                    None => return Err(SelectIntoError::UnterminatedIdentifier),
+                },
+                Some(c) => s.push(c),
+            }
+        }
+    }
+
+    /// Consume an identifier, which may be empty, e.g., for the retention policy in `db..m`
+    fn identifier(&mut self) -> Result<String, SelectIntoError> {
+        match self.peek() {
+            Some('"') => {
+                self.bump();
+                self.quoted('"')
+            }
+            Some(':') => Err(SelectIntoError::BackReference),
+            _ => match self.next_word() {
+                Some(w) if w.eq_ignore_ascii_case("FROM") => {
+                    Err(SelectIntoError::ExpectedMeasurement)
+                }
+                w => Ok(w.map(ToString::to_string).unwrap_or_default()),
+            },
+        }
+    }
+
+    /// Consume the target of an `INTO` clause
+    fn into_target(&mut self) -> Result<IntoTarget, SelectIntoError> {
+        self.skip_whitespace();
+        let mut segments = vec![self.identifier()?];
+        while self.peek() == Some('.') {
+            self.bump();
+            segments.push(self.identifier()?);
+        }
+        let non_empty = |s: String| (!s.is_empty()).then_some(s);
+        let (database, retention_policy, measurement) = match segments.len() {
+            1 => (None, None, segments.pop()),
+            2 => {
+                let measurement = segments.pop();
+                (None, segments.pop().and_then(non_empty), measurement)
+            }
+            3 => {
+                let measurement = segments.pop();
+                let retention_policy = segments.pop().and_then(non_empty);
+                (
+                    segments.pop().and_then(non_empty),
+                    retention_policy,
+                    measurement,
+                )
+            }
+            _ => return Err(SelectIntoError::TooManySegments),
+        };
+        let measurement = measurement
+            .and_then(non_empty)
+            .ok_or(SelectIntoError::ExpectedMeasurement)?;
+
+        // the target must be followed by the FROM clause:
+        let end = self.position;
+        match self.next_word() {
+            Some(w) if w.eq_ignore_ascii_case("FROM") => self.position = end,
+            _ => return Err(SelectIntoError::ExpectedFrom),
+        }
+
+        Ok(IntoTarget {
+            database,
+            retention_policy,
+            measurement,
+        })
+    }
+}
+
+/// Convert the results of an InfluxQL query into line protocol for the given measurement,
+/// returning the line protocol and the number of lines in it
+///
+/// Columns with string dictionary types, which is how the InfluxQL planner produces the tag
+/// columns of `GROUP BY` clauses, are written as tags. All other columns, aside from the
+/// measurement and time columns, are written as fields. Rows with no non-null fields are
+/// skipped.
+pub(crate) fn record_batches_to_lp(
+    measurement: &str,
+    batches: &[RecordBatch],
+) -> Result<(String, usize), SelectIntoError> {
+    let mut lp = String::new();
+    let mut line_count = 0;
+    for batch in batches {
+        let schema = batch.schema();
+        let time = batch
+            .column_by_name(TIME_COLUMN_NAME)
+            .and_then(|c| c.as_primitive_opt::<TimestampNanosecondType>())
+            .ok_or(SelectIntoError::MissingTimeColumn)?;
+
+        let mut tags = vec![];
+        let mut fields = vec![];
+        for (field, column) in schema.fields().iter().zip(batch.columns()) {
+            let name = field.name().as_str();
+            if name == INFLUXQL_MEASUREMENT_COLUMN_NAME || name == TIME_COLUMN_NAME {
+                continue;
+            }
+            match column.data_type() {
+                DataType::Dictionary(_, value) if value.as_ref() == &DataType::Utf8 => {
+                    tags.push((name, cast(column, &DataType::Utf8)?));
+                }
+                DataType::Float64
+                | DataType::Int64
+                | DataType::UInt64
+                | DataType::Boolean
+                | DataType::Utf8 => fields.push((name, column)),
+                DataType::Timestamp(TimeUnit::Nanosecond, _) => fields.push((name, column)),
+                data_type => {
+                    return Err(SelectIntoError::UnsupportedFieldType {
+                        column: name.to_string(),
+                        data_type: data_type.clone(),
+                    })
+                }
+            }
+        }
+
+        for row in 0..batch.num_rows() {
+            if fields.iter().all(|(_, c)| c.is_null(row)) || time.is_null(row) {
+                continue;
+            }
+            lp.push_str(&escape(measurement, &[',', ' ']));
+            for (key, column) in &tags {
+                let column = column.as_string::<i32>();
+                if column.is_null(row) || column.value(row).is_empty() {
+                    continue;
+                }
+                write!(
+                    lp,
+                    ",{}={}",
+                    escape(key, &[',', '=', ' ']),
+                    escape(column.value(row), &[',', '=', ' '])
+                )
+                .unwrap();
+            }
+            let mut separator = ' ';
+            for (key, column) in &fields {
+                if column.is_null(row) {
+                    continue;
+                }
+                write!(lp, "{separator}{}=", escape(key, &[',', '=', ' '])).unwrap();
+                separator = ',';
+                match column.data_type() {
+                    DataType::Float64 => {
+                        write!(lp, "{}", column.as_primitive::<Float64Type>().value(row))
+                    }
+                    DataType::Int64 => {
+                        write!(lp, "{}i", column.as_primitive::<Int64Type>().value(row))
+                    }
+                    DataType::UInt64 => {
+                        write!(lp, "{}u", column.as_primitive::<UInt64Type>().value(row))
+                    }
+                    DataType::Boolean => write!(lp, "{}", column.as_boolean().value(row)),
+                    DataType::Utf8 => write!(
+                        lp,
+                        "\"{}\"",
+                        escape(column.as_string::<i32>().value(row), &['"'])
+                    ),
+                    // timestamps, e.g., from selector functions, are written as integers:
+                    _ => write!(
+                        lp,
+                        "{}i",
+                        column.as_primitive::<TimestampNanosecondType>().value(row)
+                    ),
+                }
+                .unwrap();
+            }
+            writeln!(lp, " {}", time.value(row)).unwrap();
+            line_count += 1;
+        }
+    }
+    Ok((lp, line_count))
+}
+
+/// Escape backslashes and the given special characters with a backslash
+fn escape(s: &str, special: &[char]) -> String {
+    let mut escaped = String::with_capacity(s.len());
+    for c in s.chars() {
+        if c == '\\' || special.contains(&c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use arrow::array::{
+        ArrayRef, DictionaryArray, Float64Array, Int64Array, StringArray, TimestampNanosecondArray,
+    };
+    use arrow::datatypes::Int32Type;
+    use arrow::record_batch::RecordBatch;
+    use pretty_assertions::assert_eq;
+
+    use super::{record_batches_to_lp, IntoTarget, SelectInto, SelectIntoError};
+
+    #[test]
+    fn parse_select_into() {
+        let target = |db: Option<&str>, rp: Option<&str>, m: &str| IntoTarget {
+            database: db.map(Into::into),
+            retention_policy: rp.map(Into::into),
+            measurement: m.into(),
+        };
+        let test_cases = [
+            (
+                "SELECT mean(usage) INTO cpu_1h FROM cpu GROUP BY time(1h)",
+                Some((
+                    target(None, None, "cpu_1h"),
+                    "SELECT mean(usage)  FROM cpu GROUP BY time(1h)",
+                )),
+            ),
+            (
+                "select max(\"into\") into foo.\"one week\".\"cpu max\" from cpu",
+                Some((
+                    target(Some("foo"), Some("one week"), "cpu max"),
+                    "select max(\"into\")  from cpu",
+                )),
+            ),
+            (
+                "SELECT * INTO foo..cpu_copy FROM cpu",
+                Some((target(Some("foo"), None, "cpu_copy"), "SELECT *  FROM cpu")),
+            ),
+            (
+                "SELECT usage INTO autogen.cpu_copy FROM cpu",
+                Some((
+                    target(None, Some("autogen"), "cpu_copy"),
+                    "SELECT usage  FROM cpu",
+                )),
+            ),
+            // INTO nested in a function call, a string, or after FROM, is not an INTO clause:
+            ("SELECT mean(\"into\") FROM cpu", None),
+            ("SELECT usage FROM cpu WHERE host = 'INTO x'", None),
+            ("SELECT usage FROM (SELECT usage INTO x FROM cpu)", None),
+            ("SHOW MEASUREMENTS", None),
+        ];
+
+        for (input, expected) in test_cases {
+            let actual = SelectInto::parse(input).unwrap();
+            let expected = expected.map(|(target, select)| SelectInto {
+                target,
+                select: select.into(),
+            });
+            assert_eq!(actual, expected, "input: {input}");
+        }
+
+        assert!(matches!(
+            SelectInto::parse("SELECT usage INTO FROM cpu"),
+            Err(SelectIntoError::ExpectedMeasurement)
+        ));
+        assert!(matches!(
+            SelectInto::parse("SELECT usage INTO cpu_copy"),
+            Err(SelectIntoError::ExpectedFrom)
+        ));
+        assert!(matches!(
+            SelectInto::parse("SELECT usage INTO a.b.c.d FROM cpu"),
+            Err(SelectIntoError::TooManySegments)
+        ));
+        assert!(matches!(
+            SelectInto::parse("SELECT usage INTO foo..:MEASUREMENT FROM cpu"),
+            Err(SelectIntoError::BackReference)
+        ));
+        assert!(matches!(
+            SelectInto::parse("SELECT usage INTO \"cpu FROM cpu"),
+            Err(SelectIntoError::UnterminatedIdentifier)
+        ));
+    }
+
+    #[test]
+    fn convert_to_line_protocol() {
+        let measurement: DictionaryArray<Int32Type> =
+            vec!["cpu", "cpu", "cpu"].into_iter().collect();
+        let host: DictionaryArray<Int32Type> =
+            vec![Some("a"), Some("b c"), None].into_iter().collect();
+        let batch = RecordBatch::try_from_iter([
+            ("iox::measurement", Arc::new(measurement) as ArrayRef),
+            (
+                "time",
+                Arc::new(TimestampNanosecondArray::from(vec![10, 20, 30])) as ArrayRef,
+            ),
+            ("host", Arc::new(host) as ArrayRef),
+            (
+                "mean",
+                Arc::new(Float64Array::from(vec![Some(0.5), None, Some(1.0)])) as ArrayRef,
+            ),
+            (
+                "count",
+                Arc::new(Int64Array::from(vec![Some(2), None, Some(1)])) as ArrayRef,
+            ),
+            (
+                "last",
+                Arc::new(StringArray::from(vec![Some("x \"y\""), None, None])) as ArrayRef,
+            ),
+        ])
+        .unwrap();
+
+        let (lp, line_count) = record_batches_to_lp("cpu 1h", &[batch]).unwrap();
+        assert_eq!(line_count, 2);
+        assert_eq!(
+            lp,
+            "cpu\\ 1h,host=a mean=0.5,count=2i,last=\"x \\\"y\\\"\" 10\n\
+            cpu\\ 1h mean=1,count=1i 30\n"
+        );
+    }
+}
@@ -1,5 +1,5 @@
 use std::{
-    collections::{HashMap, VecDeque},
+    collections::{BTreeMap, HashMap, VecDeque},
     pin::Pin,
     sync::Arc,
     task::{Context, Poll},
@@ -18,17 +18,23 @@ use arrow_schema::DataType;
 use bytes::Bytes;
 use datafusion::physical_plan::SendableRecordBatchStream;
 use futures::{ready, stream::Fuse, Stream, StreamExt};
-use hyper::{Body, Request, Response};
+use hyper::{header::CONTENT_TYPE, Body, Method, Request, Response};
 use influxdb3_write::WriteBuffer;
+use iox_query_params::StatementParams;
 use iox_time::TimeProvider;
 use observability_deps::tracing::info;
-use schema::{INFLUXQL_MEASUREMENT_COLUMN_NAME, TIME_COLUMN_NAME};
+use schema::{
+    InfluxQlMetadata, INFLUXQL_MEASUREMENT_COLUMN_NAME, INFLUXQL_METADATA_KEY, TIME_COLUMN_NAME,
+};
 use serde::{Deserialize, Serialize};
 use serde_json::Value;
 
 use crate::QueryExecutor;
 
-use super::{Error, HttpApi, Result};
+use super::{
+    check_influxql_drop_method, query_string, Error, HttpApi, RequestToken, Result,
+    PARTIAL_RESULTS_HEADER,
+};
 
 const DEFAULT_CHUNK_SIZE: usize = 10_000;
 
@@ -41,13 +47,18 @@ where
 {
     /// Implements the v1 query API for InfluxDB
     ///
-    /// Accepts the URL parameters, defined by [`QueryParams`]), and returns a stream
-    /// of [`QueryResponse`]s. If the `chunked` parameter is set to `true`, then the
-    /// response stream will be chunked into chunks of size `chunk_size`, if provided,
-    /// or 10,000. For InfluxQL queries that select from multiple measurements, chunks
-    /// will be split on the `chunk_size`, or series, whichever comes first.
+    /// Accepts the parameters, defined by [`QueryParams`], in the URL, or in the form encoded
+    /// body of a `POST` request, and returns a stream of [`QueryResponse`]s. If the `chunked`
+    /// parameter is set to `true`, then the response stream will be chunked into chunks of size
+    /// `chunk_size`, if provided, or 10,000. For InfluxQL queries that select from multiple
+    /// measurements, chunks will be split on the `chunk_size`, or series, whichever comes first.
+    ///
+    /// If there is a limit on the number of rows that a query returns, the results are truncated
+    /// to it, and marked as partial with a header, or the query fails, before any are sent.
     pub(super) async fn v1_query(&self, req: Request<Body>) -> Result<Response<Body>> {
-        let params = QueryParams::from_request(&req)?;
+        let token = RequestToken::get(&req);
+        let method = req.method().clone();
+        let params = self.v1_query_params(req).await?;
         info!(?params, "handle v1 query API");
         let QueryParams {
             chunk_size,
@@ -60,15 +71,136 @@ where
 
         let chunk_size = chunked.then(|| chunk_size.unwrap_or(DEFAULT_CHUNK_SIZE));
 
+        check_influxql_drop_method(&method, &query)?;
+        self.authorize_influxql(token, database.as_deref(), &query)
+            .await?;
+
         // TODO - Currently not supporting parameterized queries, see
         //        https://github.com/influxdata/influxdb/issues/24805
         let stream = self.query_influxql_inner(database, &query, None).await?;
+        let (stream, partial) = self.limit_query_rows(stream).await?;
         let stream =
             QueryResponseStream::new(0, stream, chunk_size, pretty, epoch).map_err(QueryError)?;
         let body = Body::wrap_stream(stream);
 
-        Ok(Response::builder().status(200).body(body).unwrap())
+        let mut builder = Response::builder().status(200);
+        if partial {
+            builder = builder.header(PARTIAL_RESULTS_HEADER, "true");
+        }
+        Ok(builder.body(body).unwrap())
+    }
+
+    /// Implements `POST` requests to the v1 query API
+    ///
+    /// As with InfluxDB 1.x, a form encoded body holds the same parameters as the URL of a `GET`
+    /// request, for queries that are too long to fit in the URL. Any other body is a bulk query,
+    /// see [`Self::v1_query_bulk`].
+    pub(super) async fn v1_query_post(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let form = req
+            .headers()
+            .get(CONTENT_TYPE)
+            .and_then(|v| v.to_str().ok())
+            .is_some_and(|v| v.starts_with("application/x-www-form-urlencoded"));
+        if form {
+            self.v1_query(req).await
+        } else {
+            self.v1_query_bulk(req).await
+        }
+    }
+
+    /// Extract the [`QueryParams`] from the URL of a `GET` request, or from both the URL and the
+    /// form encoded body of a `POST` request
+    async fn v1_query_params(&self, req: Request<Body>) -> Result<QueryParams> {
+        if req.method() != Method::POST {
+            return serde_urlencoded::from_str(query_string(&req)?).map_err(Into::into);
+        }
+        let url_params = req.uri().query().unwrap_or_default().to_string();
+        let body = self.read_body(req).await?;
+        let body = std::str::from_utf8(&body).map_err(Error::NonUtf8Body)?;
+        let params = match (url_params.is_empty(), body.is_empty()) {
+            (true, _) => body.to_string(),
+            (false, true) => url_params,
+            (false, false) => format!("{url_params}&{body}"),
+        };
+        serde_urlencoded::from_str(&params).map_err(Into::into)
+    }
+
+    /// Implements a bulk variant of the v1 query API
+    ///
+    /// Accepts a JSON body, defined by [`BulkQueryRequest`], that contains a list of InfluxQL
+    /// queries, each with their own database and parameters. The queries are run in order, and
+    /// a single [`QueryResponse`] is returned with a result for each query, aligned to the input
+    /// order by `statement_id`. A query that fails will have the `error` set on its result, but
+    /// does not prevent the remaining queries from being run. A query whose results were
+    /// truncated to the limit on the number of rows that a query returns has `partial` set on its
+    /// result.
+    ///
+    /// The `epoch` and `pretty` URL parameters are supported, and apply to all queries.
+    pub(super) async fn v1_query_bulk(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let params = req
+            .uri()
+            .query()
+            .map(serde_urlencoded::from_str::<BulkQueryParams>)
+            .transpose()?
+            .unwrap_or_default();
+        let token = RequestToken::get(&req);
+        let body = self.read_body(req).await?;
+        let BulkQueryRequest { queries } = serde_json::from_slice(&body)?;
+        info!(
+            ?params,
+            n_queries = queries.len(),
+            "handle v1 bulk query API"
+        );
+
+        let mut results = Vec::with_capacity(queries.len());
+        for (statement_id, query) in queries.into_iter().enumerate() {
+            let stream = async {
+                self.authorize_influxql(token.clone(), query.database.as_deref(), &query.query)
+                    .await?;
+                let stream = self
+                    .query_influxql_inner(query.database, &query.query, query.params)
+                    .await?;
+                self.limit_query_rows(stream).await
+            };
+            let result = match stream.await {
+                Ok((stream, partial)) => {
+                    collect_statement_response(statement_id, stream, params.epoch)
+                        .await
+                        .map(|result| StatementResponse { partial, ..result })
+                        .map_err(|e| e.to_string())
+                }
+                Err(e) => Err(e.to_string()),
+            };
+            results.push(result.unwrap_or_else(|error| StatementResponse {
+                statement_id,
+                series: vec![],
+                partial: false,
+                error: Some(error),
+            }));
+        }
+
+        let body = Bytes::from(QueryResponse {
+            results,
+            pretty: params.pretty,
+        });
+
+        Ok(Response::builder().status(200).body(body.into()).unwrap())
+    }
+}
+
+/// Run the `input` stream to completion, collecting it into a single [`StatementResponse`]
+async fn collect_statement_response(
+    statement_id: usize,
+    input: SendableRecordBatchStream,
+    epoch: Option<Precision>,
+) -> Result<StatementResponse, anyhow::Error> {
+    let mut stream = QueryResponseStream::new(statement_id, input, None, false, epoch)?;
+    let mut results = vec![];
+    while let Some(response) = stream.next().await {
+        results.extend(response?.results);
     }
+    // the stream is not chunked, so will only ever produce one result:
+    results.pop().context("query did not produce a result")
 }
 
 /// Query parameters for the v1/query API
@@ -98,12 +230,35 @@ struct QueryParams {
     query: String,
 }
 
-impl QueryParams {
-    /// Extract [`QueryParams`] from an HTTP [`Request`]
-    fn from_request(req: &Request<Body>) -> Result<Self> {
-        let query = req.uri().query().ok_or(Error::MissingQueryParams)?;
-        serde_urlencoded::from_str(query).map_err(Into::into)
-    }
+/// Request body for the bulk variant of the v1 query API
+#[derive(Debug, Deserialize)]
+struct BulkQueryRequest {
+    queries: Vec<BulkQuery>,
+}
+
+/// An individual query in a [`BulkQueryRequest`]
+#[derive(Debug, Deserialize)]
+struct BulkQuery {
+    /// The InfluxQL query string
+    #[serde(rename = "q")]
+    query: String,
+    /// Database to perform the query against
+    ///
+    /// This is optional because the query string may specify the database
+    #[serde(rename = "db")]
+    database: Option<String>,
+    /// Parameters bound to the query
+    params: Option<StatementParams>,
+}
+
+/// URL parameters for the bulk variant of the v1 query API
+#[derive(Debug, Default, Deserialize)]
+struct BulkQueryParams {
+    /// Map timestamps to UNIX epoch time, with the given precision
+    epoch: Option<Precision>,
+    /// Format the JSON outputted in pretty format
+    #[serde(default)]
+    pretty: bool,
 }
 
 /// UNIX epoch precision
@@ -164,17 +319,37 @@ impl From<QueryResponse> for Bytes {
 #[derive(Debug, Serialize)]
 struct StatementResponse {
     statement_id: usize,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
     series: Vec<Series>,
+    /// Whether the results were truncated to the limit on the number of rows a query returns
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    partial: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
 }
 
 /// The records produced for a single time series (measurement)
+///
+/// For queries with a `GROUP BY` on tags, there is a series for each distinct set of values of
+/// the tags, which are given by `tags`.
 #[derive(Debug, Serialize)]
 struct Series {
     name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    tags: Option<BTreeMap<String, String>>,
     columns: Vec<String>,
     values: Vec<Row>,
 }
 
+/// Identifies the [`Series`] that a [`Row`] belongs to
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct SeriesKey {
+    /// The measurement name
+    name: String,
+    /// The values of the tags in the `GROUP BY` clause, if the query had one
+    tags: Option<BTreeMap<String, String>>,
+}
+
 /// A single row, or record in a time series
 #[derive(Debug, Serialize)]
 struct Row(Vec<Value>);
@@ -186,7 +361,7 @@ struct Row(Vec<Value>);
 /// be emitted.
 struct ChunkBuffer {
     size: Option<usize>,
-    series: VecDeque<(String, Vec<Row>)>,
+    series: VecDeque<(SeriesKey, Vec<Row>)>,
 }
 
 impl ChunkBuffer {
@@ -197,29 +372,29 @@ impl ChunkBuffer {
         }
     }
 
-    /// Get the name of the current measurement [`Series`] being streamed
-    fn current_measurement_name(&self) -> Option<&str> {
-        self.series.front().map(|(n, _)| n.as_str())
+    /// Get the key of the current [`Series`] being streamed
+    fn current_series(&self) -> Option<&SeriesKey> {
+        self.series.front().map(|(k, _)| k)
     }
 
     /// For queries that produce multiple [`Series`], this will be called when
     /// the current series is completed streaming
-    fn push_next_measurement<S: Into<String>>(&mut self, name: S) {
-        self.series.push_front((name.into(), vec![]));
+    fn push_next_series(&mut self, key: SeriesKey) {
+        self.series.push_front((key, vec![]));
     }
 
-    /// Push a new [`Row`] into the current measurement [`Series`]
+    /// Push a new [`Row`] into the current [`Series`]
     fn push_row(&mut self, row: Row) -> Result<(), anyhow::Error> {
         self.series
             .front_mut()
-            .context("tried to push row with no measurements buffered")?
+            .context("tried to push row with no series buffered")?
             .1
             .push(row);
         Ok(())
     }
 
     /// Flush a single chunk from the [`ChunkBuffer`], if possible
-    fn flush_one(&mut self) -> Option<(String, Vec<Row>)> {
+    fn flush_one(&mut self) -> Option<(SeriesKey, Vec<Row>)> {
         if !self.can_flush() {
             return None;
         }
@@ -237,7 +412,7 @@ impl ChunkBuffer {
             // only drain a chunk's worth from the back series:
             self.series
                 .back_mut()
-                .map(|(name, rows)| (name.to_owned(), rows.drain(..size).collect()))
+                .map(|(key, rows)| (key.clone(), rows.drain(..size).collect()))
         }
     }
 
@@ -269,15 +444,23 @@ impl ChunkBuffer {
 /// Providing an `epoch` [`Precision`] will have the `time` column values emitted
 /// as UNIX epoch times with the given precision.
 ///
+/// For queries that `GROUP BY` tags, the rows are split into a [`Series`] for each set of
+/// tag values, and the tags are given with the series rather than as columns, unless they
+/// were also selected.
+///
 /// The input stream is wrapped in [`Fuse`], because of the [`Stream`] implementation
 /// below, it is possible that the input stream is polled after completion.
 struct QueryResponseStream {
     buffer: ChunkBuffer,
     input: Fuse<SendableRecordBatchStream>,
     column_map: HashMap<String, usize>,
+    /// The names of the tag columns in the `GROUP BY` clause of the query
+    group_by_tags: Vec<String>,
     statement_id: usize,
     pretty: bool,
     epoch: Option<Precision>,
+    /// Whether a [`QueryResponse`] has been emitted by the stream
+    emitted: bool,
 }
 
 impl QueryResponseStream {
@@ -293,26 +476,48 @@ impl QueryResponseStream {
     ) -> Result<Self, anyhow::Error> {
         let buffer = ChunkBuffer::new(chunk_size);
         let schema = input.schema();
+        let metadata = schema
+            .metadata()
+            .get(INFLUXQL_METADATA_KEY)
+            .map(|m| serde_json::from_str::<InfluxQlMetadata>(m))
+            .transpose()
+            .context("failed to parse InfluxQL metadata from the query schema")?;
+        // tags that are grouped by, but were not selected, are given with each series rather
+        // than as columns:
+        let mut group_by_tags = vec![];
+        let mut hidden_columns = vec![];
+        for tag in metadata.iter().flat_map(|m| &m.tag_key_columns) {
+            let name = schema
+                .fields
+                .get(tag.column_index as usize)
+                .context("InfluxQL metadata refers to a column that is not in the schema")?
+                .name()
+                .to_owned();
+            if !tag.projected {
+                hidden_columns.push(name.clone());
+            }
+            group_by_tags.push(name);
+        }
         let column_map = schema
             .fields
             .iter()
             .map(|f| f.name().to_owned())
             .enumerate()
-            .flat_map(|(i, n)| {
-                if n != INFLUXQL_MEASUREMENT_COLUMN_NAME && i > 0 {
-                    Some((n, i - 1))
-                } else {
-                    None
-                }
+            .filter(|(i, n)| {
+                *i > 0 && n != INFLUXQL_MEASUREMENT_COLUMN_NAME && !hidden_columns.contains(n)
             })
+            .enumerate()
+            .map(|(j, (_, n))| (n, j))
             .collect();
         Ok(Self {
             buffer,
             column_map,
+            group_by_tags,
             input: input.fuse(),
             pretty,
             statement_id,
             epoch,
+            emitted: false,
         })
     }
 
@@ -343,35 +548,55 @@ impl QueryResponseStream {
             .context("failed to convert RecordBatch to JSON rows")?;
         for json_row in json_rows {
             let mut row = vec![Value::Null; self.column_map.len()];
+            let mut name = None;
+            // null values are not included in the JSON rows, so tags default to empty, which
+            // is how series without a value for a tag are grouped:
+            let mut tags = (!self.group_by_tags.is_empty()).then(|| {
+                self.group_by_tags
+                    .iter()
+                    .map(|t| (t.clone(), String::new()))
+                    .collect::<BTreeMap<_, _>>()
+            });
             for (k, v) in json_row {
-                if k == INFLUXQL_MEASUREMENT_COLUMN_NAME
-                    && (self.buffer.current_measurement_name().is_none()
-                        || self
-                            .buffer
-                            .current_measurement_name()
-                            .is_some_and(|n| *n != v))
-                {
+                if k == INFLUXQL_MEASUREMENT_COLUMN_NAME {
                     // we are on the "iox::measurement" column, which gives the name of the time series
-                    // if we are on the first row, or if the measurement changes, we push into the
-                    // buffer queue
-                    self.buffer
-                        .push_next_measurement(v.as_str().with_context(|| {
-                            format!("{INFLUXQL_MEASUREMENT_COLUMN_NAME} value was not a string")
-                        })?);
-                } else if k == INFLUXQL_MEASUREMENT_COLUMN_NAME {
-                    // we are still working on the current measurement in the buffer, so ignore
+                    name = Some(
+                        v.as_str()
+                            .with_context(|| {
+                                format!("{INFLUXQL_MEASUREMENT_COLUMN_NAME} value was not a string")
+                            })?
+                            .to_owned(),
+                    );
                     continue;
-                } else {
-                    // this is a column value that is part of the time series, add it to the row
-                    let j = self.column_map.get(&k).unwrap();
-                    row[*j] = if let (Some(precision), TIME_COLUMN_NAME) = (self.epoch, k.as_str())
-                    {
-                        // specially handle the time column if `epoch` parameter provided
-                        convert_ns_epoch(v, precision)?
-                    } else {
-                        v
-                    };
                 }
+                if let Some(tag) = tags.as_mut().and_then(|tags| tags.get_mut(&k)) {
+                    // the column is a tag that is grouped by, so gives part of the series key
+                    v.as_str()
+                        .with_context(|| format!("GROUP BY tag {k} value was not a string"))?
+                        .clone_into(tag);
+                }
+                let Some(j) = self.column_map.get(&k) else {
+                    // a tag that was grouped by but not selected
+                    continue;
+                };
+                // this is a column value that is part of the time series, add it to the row
+                row[*j] = if let (Some(precision), TIME_COLUMN_NAME) = (self.epoch, k.as_str()) {
+                    // specially handle the time column if `epoch` parameter provided
+                    convert_ns_epoch(v, precision)?
+                } else {
+                    v
+                };
+            }
+            let key = SeriesKey {
+                name: name.with_context(|| {
+                    format!("row did not have a {INFLUXQL_MEASUREMENT_COLUMN_NAME} value")
+                })?,
+                tags,
+            };
+            // if we are on the first row, or if the series changes, we push into the
+            // buffer queue
+            if self.buffer.current_series() != Some(&key) {
+                self.buffer.push_next_series(key);
             }
             self.buffer.push_row(Row(row))?;
         }
@@ -391,9 +616,11 @@ impl QueryResponseStream {
         let columns = self.columns();
         // this unwrap is okay because we only ever call flush_one
         // after calling can_flush on the buffer:
-        let (name, values) = self.buffer.flush_one().unwrap();
+        let (SeriesKey { name, tags }, values) = self.buffer.flush_one().unwrap();
+        self.emitted = true;
         let series = vec![Series {
             name,
+            tags,
             columns,
             values,
         }];
@@ -401,6 +628,8 @@ impl QueryResponseStream {
             results: vec![StatementResponse {
                 statement_id: self.statement_id,
                 series,
+                partial: false,
+                error: None,
             }],
             pretty: self.pretty,
         }
@@ -413,16 +642,20 @@ impl QueryResponseStream {
             .buffer
             .series
             .drain(..)
-            .map(|(name, values)| Series {
+            .map(|(SeriesKey { name, tags }, values)| Series {
                 name,
+                tags,
                 columns: columns.clone(),
                 values,
             })
             .collect();
+        self.emitted = true;
         Ok(QueryResponse {
             results: vec![StatementResponse {
                 statement_id: self.statement_id,
                 series,
+                partial: false,
+                error: None,
             }],
             pretty: self.pretty,
         })
@@ -474,13 +707,16 @@ impl Stream for QueryResponseStream {
             }
             Some(Err(e)) => Poll::Ready(Some(Err(e.into()))),
             None => {
-                if !self.buffer.is_empty() {
+                if !self.buffer.is_empty() || !self.emitted {
                     // we only get here if we are not operating in chunked mode and
                     // we need to flush the entire buffer at once, OR if we are in chunked
                     // mode, and there is less than a chunk's worth of records left
                     //
                     // this is why the input stream is fused, because we will end up
                     // polling the input stream again if we end up here.
+                    //
+                    // statements that produce no records, e.g., DROP DATABASE, still
+                    // emit a single, empty, result.
                     Poll::Ready(Some(self.flush_all()))
                 } else {
                     Poll::Ready(None)
@@ -17,6 +17,7 @@ mod grpc;
 mod http;
 pub mod query_executor;
 mod service;
+pub mod tls;
 
 use crate::grpc::make_flight_server;
 use crate::http::route_request;
@@ -36,6 +37,8 @@ use std::fmt::Debug;
 use std::net::SocketAddr;
 use std::sync::Arc;
 use thiserror::Error;
+use tokio::net::TcpListener;
+use tokio_rustls::rustls::ServerConfig;
 use tokio_util::sync::CancellationToken;
 use tower::Layer;
 use trace::ctx::SpanContext;
@@ -67,6 +70,13 @@ pub enum Error {
 
     #[error("from hex error: {0}")]
     FromHex(#[from] hex::FromHexError),
+
+    #[error("failed to bind to {addr}: {source}")]
+    Bind {
+        addr: SocketAddr,
+        #[source]
+        source: std::io::Error,
+    },
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -120,6 +130,8 @@ pub struct Server<W, Q, P, T> {
     http: Arc<HttpApi<W, Q, T>>,
     persister: Arc<P>,
     authorizer: Arc<dyn Authorizer>,
+    /// Serve over TLS, rather than plaintext, if set
+    tls_config: Option<Arc<ServerConfig>>,
 }
 
 #[async_trait]
@@ -193,10 +205,22 @@ where
 
     let hybrid_make_service = hybrid(rest_service, grpc_service);
 
-    hyper::Server::bind(&server.common_state.http_addr)
-        .serve(hybrid_make_service)
-        .with_graceful_shutdown(shutdown.cancelled())
-        .await?;
+    let addr = server.common_state.http_addr;
+    if let Some(tls_config) = &server.tls_config {
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|source| Error::Bind { addr, source })?;
+        let incoming = tls::accept_tls(listener, Arc::clone(tls_config), shutdown.clone());
+        hyper::Server::builder(hyper::server::accept::from_stream(incoming))
+            .serve(hybrid_make_service)
+            .with_graceful_shutdown(shutdown.cancelled())
+            .await?;
+    } else {
+        hyper::Server::bind(&addr)
+            .serve(hybrid_make_service)
+            .with_graceful_shutdown(shutdown.cancelled())
+            .await?;
+    }
 
     Ok(())
 }
@@ -291,6 +315,7 @@ mod tests {
             Arc::new(HashMap::new()),
             10,
             10,
+            None,
         ));
 
         let server = ServerBuilder::new(common_state)
@@ -451,6 +476,7 @@ mod tests {
             Arc::new(HashMap::new()),
             10,
             10,
+            None,
         );
 
         let server = ServerBuilder::new(common_state)
@@ -658,6 +684,7 @@ mod tests {
             Arc::new(HashMap::new()),
             10,
             10,
+            None,
         );
 
         let server = ServerBuilder::new(common_state)
@@ -1,8 +1,9 @@
 //! module for query executor
+use crate::query_executor::slow_query_log::{SlowQueryLog, SlowQueryStream};
 use crate::{QueryExecutor, QueryKind};
 use arrow::array::{
-    ArrayRef, BooleanArray, DurationNanosecondArray, Int64Array, Int64Builder, StringBuilder,
-    StructArray, TimestampNanosecondArray,
+    ArrayRef, BooleanArray, BooleanBuilder, DurationNanosecondArray, Int64Array, Int64Builder,
+    StringBuilder, StructArray, TimestampNanosecondArray,
 };
 use arrow::datatypes::SchemaRef;
 use arrow::record_batch::RecordBatch;
@@ -13,17 +14,22 @@ use datafusion::catalog::schema::SchemaProvider;
 use datafusion::catalog::CatalogProvider;
 use datafusion::common::arrow::array::StringArray;
 use datafusion::common::arrow::datatypes::{DataType, Field, Schema as DatafusionSchema};
+use datafusion::common::DFSchema;
 use datafusion::datasource::{TableProvider, TableType};
 use datafusion::error::DataFusionError;
 use datafusion::execution::context::SessionState;
 use datafusion::execution::SendableRecordBatchStream;
-use datafusion::logical_expr::TableProviderFilterPushDown;
+use datafusion::logical_expr::{ident, lit, lit_timestamp_nano, TableProviderFilterPushDown};
+use datafusion::physical_expr::PhysicalExpr;
+use datafusion::physical_plan::expressions::Column as PhysicalColumn;
+use datafusion::physical_plan::filter::FilterExec;
+use datafusion::physical_plan::projection::ProjectionExec;
 use datafusion::physical_plan::ExecutionPlan;
 use datafusion::prelude::Expr;
 use datafusion_util::config::DEFAULT_SCHEMA;
 use datafusion_util::MemoryStream;
 use influxdb3_write::{
-    catalog::{Catalog, DatabaseSchema},
+    catalog::{Catalog, DatabaseSchema, DeletePredicate},
     WriteBuffer,
 };
 use iox_query::exec::{Executor, IOxSessionContext, QueryConfig};
@@ -38,13 +44,15 @@ use iox_query::{QueryChunk, QueryNamespace};
 use iox_query_influxql::frontend::planner::InfluxQLQueryPlanner;
 use iox_query_params::StatementParams;
 use iox_system_tables::{IoxSystemTable, SystemTableProvider};
+use iox_time::{SystemProvider, TimeProvider};
 use metric::Registry;
 use observability_deps::tracing::{debug, info, trace};
-use schema::Schema;
+use schema::{Schema, TIME_COLUMN_NAME};
 use std::any::Any;
 use std::collections::HashMap;
 use std::fmt::Debug;
 use std::sync::Arc;
+use std::time::Duration;
 use trace::ctx::SpanContext;
 use trace::span::{Span, SpanExt, SpanRecorder};
 use trace_http::ctx::RequestLogContext;
@@ -52,6 +60,8 @@ use tracker::{
     AsyncSemaphoreMetrics, InstrumentedAsyncOwnedSemaphorePermit, InstrumentedAsyncSemaphore,
 };
 
+mod slow_query_log;
+
 #[derive(Debug)]
 pub struct QueryExecutorImpl<W> {
     catalog: Arc<Catalog>,
@@ -60,9 +70,13 @@ pub struct QueryExecutorImpl<W> {
     datafusion_config: Arc<HashMap<String, String>>,
     query_execution_semaphore: Arc<InstrumentedAsyncSemaphore>,
     query_log: Arc<QueryLog>,
+    time_provider: Arc<dyn TimeProvider>,
+    /// Queries that take at least this long are logged, if set
+    slow_query_threshold: Option<Duration>,
 }
 
 impl<W: WriteBuffer> QueryExecutorImpl<W> {
+    #[allow(clippy::too_many_arguments)]
     pub fn new(
         catalog: Arc<Catalog>,
         write_buffer: Arc<W>,
@@ -71,6 +85,7 @@ impl<W: WriteBuffer> QueryExecutorImpl<W> {
         datafusion_config: Arc<HashMap<String, String>>,
         concurrent_query_limit: usize,
         query_log_size: usize,
+        slow_query_threshold: Option<Duration>,
     ) -> Self {
         let semaphore_metrics = Arc::new(AsyncSemaphoreMetrics::new(
             &metrics,
@@ -78,10 +93,8 @@ impl<W: WriteBuffer> QueryExecutorImpl<W> {
         ));
         let query_execution_semaphore =
             Arc::new(semaphore_metrics.new_semaphore(concurrent_query_limit));
-        let query_log = Arc::new(QueryLog::new(
-            query_log_size,
-            Arc::new(iox_time::SystemProvider::new()),
-        ));
+        let time_provider: Arc<dyn TimeProvider> = Arc::new(SystemProvider::new());
+        let query_log = Arc::new(QueryLog::new(query_log_size, Arc::clone(&time_provider)));
         Self {
             catalog,
             write_buffer,
@@ -89,6 +102,8 @@ impl<W: WriteBuffer> QueryExecutorImpl<W> {
             datafusion_config,
             query_execution_semaphore,
             query_log,
+            time_provider,
+            slow_query_threshold,
         }
     }
 }
@@ -107,6 +122,9 @@ impl<W: WriteBuffer> QueryExecutor for QueryExecutorImpl<W> {
         external_span_ctx: Option<RequestLogContext>,
     ) -> Result<SendableRecordBatchStream, Self::Error> {
         info!("query in executor {}", database);
+        let slow_query_log = self
+            .slow_query_threshold
+            .map(|threshold| SlowQueryLog::new(threshold, database, &kind, q));
         let db = self
             .namespace(database, span_ctx.child_span("get database"), false)
             .await
@@ -156,7 +174,10 @@ impl<W: WriteBuffer> QueryExecutor for QueryExecutorImpl<W> {
         match ctx.execute_stream(Arc::clone(&plan)).await {
             Ok(query_results) => {
                 token.success();
-                Ok(query_results)
+                Ok(match slow_query_log {
+                    Some(log) => Box::pin(SlowQueryStream::new(query_results, log)),
+                    None => query_results,
+                })
             }
             Err(err) => {
                 token.fail();
@@ -180,31 +201,35 @@ impl<W: WriteBuffer> QueryExecutor for QueryExecutorImpl<W> {
     async fn show_retention_policies(
         &self,
         database: Option<&str>,
-        span_ctx: Option<SpanContext>,
+        _span_ctx: Option<SpanContext>,
     ) -> Result<SendableRecordBatchStream, Self::Error> {
-        let mut databases = if let Some(db) = database {
-            vec![db.to_owned()]
-        } else {
-            self.catalog.list_databases()
-        };
+        let mut databases = self.catalog.list_databases();
+        // only list the retention policies of the given database:
+        if let Some(db) = database {
+            let (db_name, _) = split_database_name(db);
+            databases.retain(|database| split_database_name(database).0 == db_name);
+            if databases.is_empty() {
+                return Err(Error::DatabaseNotFound {
+                    db_name: db.to_string(),
+                });
+            }
+        }
         // sort them to ensure consistent order:
         databases.sort_unstable();
 
         let mut rows = Vec::with_capacity(databases.len());
         for database in databases {
-            let db = self
-                .namespace(&database, span_ctx.child_span("get database"), false)
-                .await
-                .map_err(|_| Error::DatabaseNotFound {
-                    db_name: database.to_string(),
-                })?
-                .ok_or_else(|| Error::DatabaseNotFound {
-                    db_name: database.to_string(),
-                })?;
-            let duration = db.retention_time_ns();
+            let db_schema =
+                self.catalog
+                    .db_schema(&database)
+                    .ok_or_else(|| Error::DatabaseNotFound {
+                        db_name: database.to_string(),
+                    })?;
+            let duration = db_schema.retention_period_ns;
             let (db_name, rp_name) = split_database_name(&database);
             rows.push(RetentionPolicyRow {
                 database: db_name,
+                default: rp_name == AUTOGEN_RETENTION_POLICY,
                 name: rp_name,
                 duration,
             });
@@ -220,13 +245,21 @@ struct RetentionPolicyRow {
     database: String,
     name: String,
     duration: Option<i64>,
+    /// Whether this is the retention policy that is written to and queried when none is given,
+    /// which is always the `autogen` retention policy
+    default: bool,
 }
 
+/// Data is not replicated, so there is always a single copy of it
+const RETENTION_POLICY_REPLICA_N: i64 = 1;
+
 #[derive(Debug, Default)]
 struct RetentionPolicyRowBuilder {
     database: StringBuilder,
     name: StringBuilder,
     duration: Int64Builder,
+    replica_n: Int64Builder,
+    default: BooleanBuilder,
 }
 
 impl RetentionPolicyRowBuilder {
@@ -234,6 +267,8 @@ impl RetentionPolicyRowBuilder {
         self.database.append_value(row.database.as_str());
         self.name.append_value(row.name.as_str());
         self.duration.append_option(row.duration);
+        self.replica_n.append_value(RETENTION_POLICY_REPLICA_N);
+        self.default.append_value(row.default);
     }
 
     // Note: may be able to use something simpler than StructArray here, this is just based
@@ -252,6 +287,14 @@ impl RetentionPolicyRowBuilder {
                 Arc::new(Field::new("duration", DataType::Int64, true)),
                 Arc::new(self.duration.finish()) as ArrayRef,
             ),
+            (
+                Arc::new(Field::new("replicaN", DataType::Int64, false)),
+                Arc::new(self.replica_n.finish()) as ArrayRef,
+            ),
+            (
+                Arc::new(Field::new("default", DataType::Boolean, false)),
+                Arc::new(self.default.finish()) as ArrayRef,
+            ),
         ])
     }
 }
@@ -268,7 +311,7 @@ fn retention_policy_rows_to_batch(rows: &[RetentionPolicyRow]) -> RecordBatch {
     RecordBatch::from(&builder.finish())
 }
 
-const AUTOGEN_RETENTION_POLICY: &str = "autogen";
+pub(crate) const AUTOGEN_RETENTION_POLICY: &str = "autogen";
 
 fn split_database_name(db_name: &str) -> (String, String) {
     let mut split = db_name.split('/');
@@ -316,6 +359,7 @@ impl<W: WriteBuffer> QueryDatabase for QueryExecutorImpl<W> {
             Arc::clone(&self.exec),
             Arc::clone(&self.datafusion_config),
             Arc::clone(&self.query_log),
+            Arc::clone(&self.time_provider),
         ))))
     }
 
@@ -339,6 +383,7 @@ pub struct Database<B> {
     datafusion_config: Arc<HashMap<String, String>>,
     query_log: Arc<QueryLog>,
     system_schema_provider: Arc<SystemSchemaProvider>,
+    time_provider: Arc<dyn TimeProvider>,
 }
 
 impl<B: WriteBuffer> Database<B> {
@@ -348,6 +393,7 @@ impl<B: WriteBuffer> Database<B> {
         exec: Arc<Executor>,
         datafusion_config: Arc<HashMap<String, String>>,
         query_log: Arc<QueryLog>,
+        time_provider: Arc<dyn TimeProvider>,
     ) -> Self {
         let system_schema_provider = Arc::new(SystemSchemaProvider::new(
             write_buffer.catalog(),
@@ -360,6 +406,7 @@ impl<B: WriteBuffer> Database<B> {
             datafusion_config,
             query_log,
             system_schema_provider,
+            time_provider,
         }
     }
 
@@ -371,6 +418,7 @@ impl<B: WriteBuffer> Database<B> {
             datafusion_config: Arc::clone(&db.datafusion_config),
             query_log: Arc::clone(&db.query_log),
             system_schema_provider: Arc::clone(&db.system_schema_provider),
+            time_provider: Arc::clone(&db.time_provider),
         }
     }
 
@@ -381,6 +429,7 @@ impl<B: WriteBuffer> Database<B> {
                 name: table_name.into(),
                 schema: schema.clone(),
                 write_buffer: Arc::clone(&self.write_buffer),
+                retention_time_ns: self.retention_time_ns(),
             })
         })
     }
@@ -407,7 +456,14 @@ impl<B: WriteBuffer> QueryNamespace for Database<B> {
     }
 
     fn retention_time_ns(&self) -> Option<i64> {
-        None
+        self.db_schema
+            .retention_period_ns
+            .map(|retention_period_ns| {
+                self.time_provider
+                    .now()
+                    .timestamp_nanos()
+                    .saturating_sub(retention_period_ns)
+            })
     }
 
     fn record_query(
@@ -493,6 +549,9 @@ pub struct QueryTable<B> {
     name: Arc<str>,
     schema: Schema,
     write_buffer: Arc<B>,
+    /// Rows older than this time are outside of the database's retention period, and are not
+    /// returned even if they have not been removed yet
+    retention_time_ns: Option<i64>,
 }
 
 impl<B: WriteBuffer> QueryTable<B> {
@@ -546,9 +605,29 @@ impl<B: WriteBuffer> TableProvider for QueryTable<B> {
             "TableProvider scan {:?} {:?} {:?}",
             projection, filters, limit
         );
+        let expired = self
+            .retention_time_ns
+            .map(|time| ident(TIME_COLUMN_NAME).lt(lit_timestamp_nano(time)));
+        let deleted = [
+            deleted_rows_expr(
+                &self.schema,
+                self.db_schema.table_deletes(self.name.as_ref()),
+            ),
+            expired,
+        ]
+        .into_iter()
+        .flatten()
+        .reduce(Expr::or);
+        // deleted and expired rows are filtered out before the projection and limit are
+        // applied, as the columns in the delete predicates may not be in the projection:
+        let (scan_projection, scan_limit) = match deleted {
+            Some(_) => (None, None),
+            None => (projection, limit),
+        };
+
         let mut builder = ProviderBuilder::new(Arc::clone(&self.name), self.schema.clone());
 
-        let chunks = self.chunks(ctx, projection, &filters, limit)?;
+        let chunks = self.chunks(ctx, scan_projection, &filters, scan_limit)?;
         for chunk in chunks {
             builder = builder.add_chunk(chunk);
         }
@@ -558,10 +637,61 @@ impl<B: WriteBuffer> TableProvider for QueryTable<B> {
             Err(e) => panic!("unexpected error: {e:?}"),
         };
 
-        provider.scan(ctx, projection, &filters, limit).await
+        let plan = provider
+            .scan(ctx, scan_projection, &filters, scan_limit)
+            .await?;
+        let Some(deleted) = deleted else {
+            return Ok(plan);
+        };
+
+        let df_schema = DFSchema::try_from(plan.schema().as_ref().clone())?;
+        let predicate = ctx.create_physical_expr(deleted.is_not_true(), &df_schema)?;
+        let plan: Arc<dyn ExecutionPlan> = Arc::new(FilterExec::try_new(predicate, plan)?);
+        match projection {
+            Some(projection) => {
+                let schema = plan.schema();
+                let exprs = projection
+                    .iter()
+                    .map(|i| {
+                        let name = schema.field(*i).name();
+                        (
+                            Arc::new(PhysicalColumn::new(name, *i)) as Arc<dyn PhysicalExpr>,
+                            name.to_string(),
+                        )
+                    })
+                    .collect();
+                Ok(Arc::new(ProjectionExec::try_new(exprs, plan)?))
+            }
+            None => Ok(plan),
+        }
     }
 }
 
+/// Build an expression that matches the persisted rows of a table that have been deleted, and
+/// not yet removed by compaction, if any of the given delete predicates can match rows of the
+/// table
+fn deleted_rows_expr(schema: &Schema, deletes: &[DeletePredicate]) -> Option<Expr> {
+    deletes
+        .iter()
+        // a predicate on a tag that the table does not have can not match any rows:
+        .filter(|delete| {
+            delete
+                .tags
+                .keys()
+                .all(|tag| schema.find_index_of(tag).is_some())
+        })
+        .map(|delete| {
+            let time = ident(TIME_COLUMN_NAME);
+            delete.tags.iter().fold(
+                time.clone()
+                    .gt_eq(lit_timestamp_nano(delete.min_time))
+                    .and(time.lt_eq(lit_timestamp_nano(delete.max_time))),
+                |expr, (tag, value)| expr.and(ident(tag).eq(lit(value.as_str()))),
+            )
+        })
+        .reduce(Expr::or)
+}
+
 pub const SYSTEM_SCHEMA: &str = "system";
 
 const QUERIES_TABLE: &str = "queries";
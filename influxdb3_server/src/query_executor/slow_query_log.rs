@@ -0,0 +1,182 @@
+//! Logging of queries that take longer than a configured threshold to run
+
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use std::time::{Duration, Instant};
+
+use arrow::datatypes::SchemaRef;
+use arrow::record_batch::RecordBatch;
+use datafusion::error::DataFusionError;
+use datafusion::execution::{RecordBatchStream, SendableRecordBatchStream};
+use futures::Stream;
+use observability_deps::tracing::warn;
+
+use crate::QueryKind;
+
+/// The details of a query that are logged if it is slow
+#[derive(Debug)]
+pub(crate) struct SlowQueryLog {
+    threshold: Duration,
+    database: String,
+    kind: &'static str,
+    query: String,
+    start: Instant,
+}
+
+impl SlowQueryLog {
+    /// Start timing a query, which will be logged if it takes at least `threshold` to run
+    pub(crate) fn new(threshold: Duration, database: &str, kind: &QueryKind, query: &str) -> Self {
+        Self {
+            threshold,
+            database: database.to_string(),
+            kind: match kind {
+                QueryKind::Sql => "sql",
+                QueryKind::InfluxQl => "influxql",
+            },
+            query: query.to_string(),
+            start: Instant::now(),
+        }
+    }
+
+    /// Log the query if it took at least the threshold to run, having returned `rows` rows
+    fn finish(self, rows: usize, completed: bool) {
+        let duration = self.start.elapsed();
+        if duration < self.threshold {
+            return;
+        }
+        warn!(
+            db = %self.database,
+            kind = self.kind,
+            query = %self.query,
+            ?duration,
+            rows,
+            completed,
+            "slow query"
+        );
+    }
+}
+
+/// A stream of the results of a query that logs the query once the stream is finished, if it
+/// was slow
+///
+/// The time taken includes both planning and executing the query, up until the last batch of
+/// results is produced. Queries whose results are dropped before they are finished are logged
+/// when dropped, as not being completed.
+pub(crate) struct SlowQueryStream {
+    inner: SendableRecordBatchStream,
+    /// `None` once the query has been logged
+    log: Option<SlowQueryLog>,
+    rows: usize,
+}
+
+impl SlowQueryStream {
+    pub(crate) fn new(inner: SendableRecordBatchStream, log: SlowQueryLog) -> Self {
+        Self {
+            inner,
+            log: Some(log),
+            rows: 0,
+        }
+    }
+
+    fn finish(&mut self, completed: bool) {
+        if let Some(log) = self.log.take() {
+            log.finish(self.rows, completed);
+        }
+    }
+}
+
+impl Stream for SlowQueryStream {
+    type Item = Result<RecordBatch, DataFusionError>;
+
+    fn poll_next(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Option<Self::Item>> {
+        let poll = self.inner.as_mut().poll_next(cx);
+        match &poll {
+            Poll::Ready(Some(Ok(batch))) => self.rows += batch.num_rows(),
+            Poll::Ready(Some(Err(_))) => self.finish(false),
+            Poll::Ready(None) => self.finish(true),
+            Poll::Pending => {}
+        }
+        poll
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        self.inner.size_hint()
+    }
+}
+
+impl RecordBatchStream for SlowQueryStream {
+    fn schema(&self) -> SchemaRef {
+        self.inner.schema()
+    }
+}
+
+impl Drop for SlowQueryStream {
+    fn drop(&mut self) {
+        self.finish(false);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    use arrow::array::Int64Array;
+    use arrow::datatypes::{DataType, Field, Schema};
+    use arrow::record_batch::RecordBatch;
+    use datafusion_util::MemoryStream;
+    use futures::TryStreamExt;
+    use test_helpers::assert_contains;
+    use test_helpers::tracing::TracingCapture;
+
+    use crate::QueryKind;
+
+    use super::{SlowQueryLog, SlowQueryStream};
+
+    fn batch(rows: i64) -> RecordBatch {
+        let schema = Arc::new(Schema::new(vec![Field::new("v", DataType::Int64, false)]));
+        RecordBatch::try_new(
+            schema,
+            vec![Arc::new(Int64Array::from_iter_values(0..rows))],
+        )
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn log_slow_query() {
+        let capture = TracingCapture::new();
+
+        let stream = SlowQueryStream::new(
+            Box::pin(MemoryStream::new(vec![batch(2), batch(3)])),
+            SlowQueryLog::new(Duration::ZERO, "foo", &QueryKind::Sql, "SELECT v FROM bar"),
+        );
+        let batches: Vec<RecordBatch> = stream.try_collect().await.unwrap();
+        assert_eq!(batches.len(), 2);
+
+        let logs = capture.to_string();
+        assert_contains!(&logs, "slow query");
+        assert_contains!(&logs, "foo");
+        assert_contains!(&logs, "sql");
+        assert_contains!(&logs, "SELECT v FROM bar");
+        assert_contains!(&logs, "rows");
+        assert_contains!(&logs, "5");
+    }
+
+    #[tokio::test]
+    async fn fast_query_not_logged() {
+        let capture = TracingCapture::new();
+
+        let stream = SlowQueryStream::new(
+            Box::pin(MemoryStream::new(vec![batch(1)])),
+            SlowQueryLog::new(
+                Duration::from_secs(3600),
+                "foo",
+                &QueryKind::InfluxQl,
+                "SELECT v FROM fast",
+            ),
+        );
+        let _: Vec<RecordBatch> = stream.try_collect().await.unwrap();
+
+        assert!(!capture.to_string().contains("SELECT v FROM fast"));
+    }
+}
@@ -0,0 +1,177 @@
+//! Serving the HTTP and gRPC APIs over TLS
+//!
+//! Connections made over TLS negotiate HTTP/2 with ALPN where the client supports it, falling
+//! back to HTTP/1.1 otherwise.
+
+use std::convert::Infallible;
+use std::fs::File;
+use std::io::BufReader;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+
+use futures::Stream;
+use observability_deps::tracing::{debug, warn};
+use thiserror::Error;
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::{mpsc, Semaphore};
+use tokio_rustls::rustls::ServerConfig;
+use tokio_rustls::server::TlsStream;
+use tokio_rustls::TlsAcceptor;
+use tokio_util::sync::CancellationToken;
+
+/// The maximum number of connections that have completed the TLS handshake but are yet to be
+/// picked up by the server
+const ACCEPTED_CONNECTION_BUFFER: usize = 128;
+
+/// How long to wait before accepting further connections after failing to accept one
+const ACCEPT_ERROR_BACKOFF: Duration = Duration::from_millis(100);
+
+/// How long a client has to complete the TLS handshake before its connection is dropped
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// The maximum number of TLS handshakes that are in progress at once, beyond which further
+/// connections are dropped until some of the handshakes complete or time out
+const MAX_PENDING_HANDSHAKES: usize = 1024;
+
+#[derive(Debug, Error)]
+pub enum TlsError {
+    #[error("failed to read {path:?}: {source}")]
+    Read {
+        path: PathBuf,
+        #[source]
+        source: std::io::Error,
+    },
+
+    #[error("no certificates found in {path:?}")]
+    NoCertificates { path: PathBuf },
+
+    #[error("no private key found in {path:?}")]
+    NoPrivateKey { path: PathBuf },
+
+    #[error("invalid certificate or private key: {0}")]
+    Rustls(#[from] tokio_rustls::rustls::Error),
+}
+
+/// Load the TLS configuration for the server from a PEM encoded certificate chain and private
+/// key
+///
+/// The configuration advertises both HTTP/2 and HTTP/1.1 with ALPN, preferring HTTP/2.
+pub fn load_server_config(
+    cert_path: &Path,
+    key_path: &Path,
+) -> Result<Arc<ServerConfig>, TlsError> {
+    let read_err = |path: &Path| {
+        let path = path.to_path_buf();
+        move |source| TlsError::Read { path, source }
+    };
+
+    let mut cert_reader = BufReader::new(File::open(cert_path).map_err(read_err(cert_path))?);
+    let certs = rustls_pemfile::certs(&mut cert_reader)
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(read_err(cert_path))?;
+    if certs.is_empty() {
+        return Err(TlsError::NoCertificates {
+            path: cert_path.to_path_buf(),
+        });
+    }
+
+    let mut key_reader = BufReader::new(File::open(key_path).map_err(read_err(key_path))?);
+    let key = rustls_pemfile::private_key(&mut key_reader)
+        .map_err(read_err(key_path))?
+        .ok_or_else(|| TlsError::NoPrivateKey {
+            path: key_path.to_path_buf(),
+        })?;
+
+    let mut config = ServerConfig::builder()
+        .with_no_client_auth()
+        .with_single_cert(certs, key)?;
+    config.alpn_protocols = vec![b"h2".to_vec(), b"http/1.1".to_vec()];
+    Ok(Arc::new(config))
+}
+
+/// Accept connections from the listener, completing the TLS handshake for each one
+///
+/// Handshakes are done in their own tasks, so that a slow client does not hold up others, and
+/// connections whose handshake fails or times out are dropped rather than ending the stream.
+/// Connections stop being accepted once `shutdown` is cancelled or the returned stream is
+/// dropped.
+pub(crate) fn accept_tls(
+    listener: TcpListener,
+    config: Arc<ServerConfig>,
+    shutdown: CancellationToken,
+) -> impl Stream<Item = Result<TlsStream<TcpStream>, Infallible>> {
+    let acceptor = TlsAcceptor::from(config);
+    let (tx, mut rx) = mpsc::channel(ACCEPTED_CONNECTION_BUFFER);
+    let handshakes = Arc::new(Semaphore::new(MAX_PENDING_HANDSHAKES));
+
+    tokio::spawn(async move {
+        loop {
+            let (stream, remote_addr) = tokio::select! {
+                _ = shutdown.cancelled() => return,
+                _ = tx.closed() => return,
+                accepted = listener.accept() => match accepted {
+                    Ok(accepted) => accepted,
+                    Err(e) => {
+                        // errors such as running out of file descriptors are likely to persist
+                        // for a while, so back off rather than spinning:
+                        warn!(%e, "failed to accept connection");
+                        tokio::time::sleep(ACCEPT_ERROR_BACKOFF).await;
+                        continue;
+                    }
+                },
+            };
+
+            let Ok(permit) = Arc::clone(&handshakes).try_acquire_owned() else {
+                warn!(%remote_addr, "too many pending TLS handshakes, dropping connection");
+                continue;
+            };
+            let acceptor = acceptor.clone();
+            let tx = tx.clone();
+            tokio::spawn(async move {
+                let accepted =
+                    tokio::time::timeout(HANDSHAKE_TIMEOUT, acceptor.accept(stream)).await;
+                drop(permit);
+                match accepted {
+                    Ok(Ok(stream)) => {
+                        // the server has stopped if the receiver was dropped:
+                        let _ = tx.send(Ok(stream)).await;
+                    }
+                    Ok(Err(e)) => debug!(%e, %remote_addr, "TLS handshake failed"),
+                    Err(_) => debug!(%remote_addr, "TLS handshake timed out"),
+                }
+            });
+        }
+    });
+
+    futures::stream::poll_fn(move |cx| rx.poll_recv(cx))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use super::{load_server_config, TlsError};
+
+    #[test]
+    fn missing_files() {
+        let err = load_server_config(
+            Path::new("/does/not/exist/cert.pem"),
+            Path::new("/does/not/exist/key.pem"),
+        )
+        .unwrap_err();
+        assert!(matches!(err, TlsError::Read { path, .. } if path.ends_with("cert.pem")));
+    }
+
+    #[test]
+    fn no_certificates() {
+        let path = std::env::temp_dir().join(format!(
+            "influxdb3-tls-empty-{pid}.pem",
+            pid = std::process::id()
+        ));
+        std::fs::write(&path, "not a certificate").unwrap();
+        let err = load_server_config(&path, &path).unwrap_err();
+        std::fs::remove_file(&path).unwrap();
+        assert!(matches!(err, TlsError::NoCertificates { .. }));
+    }
+}
@@ -1,14 +1,20 @@
 //! Implementation of the Catalog that sits entirely in memory.
 
-use crate::SequenceNumber;
+use crate::{ConfigureDatabaseOp, SequenceNumber};
+use arrow::array::{Array, AsArray, BooleanArray};
+use arrow::compute::cast;
+use arrow::datatypes::{DataType, TimestampNanosecondType};
+use arrow::error::ArrowError;
+use arrow::record_batch::RecordBatch;
 use data_types::ColumnType;
 use observability_deps::tracing::info;
 use parking_lot::RwLock;
 use schema::{InfluxColumnType, InfluxFieldType, Schema, SchemaBuilder};
 use serde::de::Visitor;
 use serde::{Deserialize, Deserializer, Serialize};
-use std::collections::{BTreeMap, HashMap};
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fmt;
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::Arc;
 use thiserror::Error;
 
@@ -34,6 +40,15 @@ pub enum Error {
         Catalog::NUM_DBS_LIMIT
     )]
     TooManyDbs,
+
+    #[error("database not found: {db_name}")]
+    DatabaseNotFound { db_name: String },
+
+    #[error("table not found: {table_name} in database {db_name}")]
+    TableNotFound { db_name: String, table_name: String },
+
+    #[error("table already exists: {table_name} in database {db_name}")]
+    TableAlreadyExists { db_name: String, table_name: String },
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -43,6 +58,13 @@ pub const TIME_COLUMN_NAME: &str = "time";
 #[derive(Debug)]
 pub struct Catalog {
     inner: RwLock<InnerCatalog>,
+    /// The keys of the series that have been written to each database, used to enforce the
+    /// series limit of each database. These are persisted along with the rest of the catalog,
+    /// and the ones written since it was last persisted are added back as the WAL is replayed.
+    series: RwLock<HashMap<String, HashSet<u64>>>,
+    /// Whether series have been added since the catalog was last persisted, as adding them does
+    /// not update the sequence number
+    unpersisted_series: AtomicBool,
 }
 
 impl Default for Catalog {
@@ -62,12 +84,17 @@ impl Catalog {
     pub fn new() -> Self {
         Self {
             inner: RwLock::new(InnerCatalog::new()),
+            series: RwLock::default(),
+            unpersisted_series: AtomicBool::new(false),
         }
     }
 
-    pub fn from_inner(inner: InnerCatalog) -> Self {
+    pub fn from_inner(mut inner: InnerCatalog) -> Self {
+        let series = std::mem::take(&mut inner.series);
         Self {
             inner: RwLock::new(inner),
+            series: RwLock::new(series),
+            unpersisted_series: AtomicBool::new(false),
         }
     }
 
@@ -82,25 +109,7 @@ impl Catalog {
             return Err(Error::CatalogUpdatedElsewhere);
         }
 
-        // Check we have not gone over the table limit with this updated DB
-        let mut num_tables = inner
-            .databases
-            .iter()
-            .filter(|(k, _)| *k != &db.name)
-            .map(|(_, v)| v)
-            .fold(0, |acc, db| acc + db.tables.len());
-
-        num_tables += db.tables.len();
-
-        if num_tables > Self::NUM_TABLES_LIMIT {
-            return Err(Error::TooManyTables);
-        }
-
-        for table in db.tables.values() {
-            if table.columns.len() > Self::NUM_COLUMNS_PER_TABLE_LIMIT {
-                return Err(Error::TooManyColumns);
-            }
-        }
+        inner.check_table_and_column_limits(&db)?;
 
         info!("inserted/updated database in catalog: {}", db.name);
         inner.sequence = inner.sequence.next();
@@ -108,6 +117,17 @@ impl Catalog {
         Ok(())
     }
 
+    /// Check that the given database could be inserted into, or replace its existing version
+    /// in, the catalog without going over any of the catalog limits, without updating the
+    /// catalog
+    pub(crate) fn check_limits(&self, db: &DatabaseSchema) -> Result<()> {
+        let inner = self.inner.read();
+        if !inner.databases.contains_key(&db.name) && inner.databases.len() >= Self::NUM_DBS_LIMIT {
+            return Err(Error::TooManyDbs);
+        }
+        inner.check_table_and_column_limits(db)
+    }
+
     pub(crate) fn db_or_create(
         &self,
         db_name: &str,
@@ -139,13 +159,357 @@ impl Catalog {
         Ok((sequence, db))
     }
 
+    /// Remove the database with the given name from the catalog, returning its schema
+    pub(crate) fn drop_database(&self, db_name: &str) -> Result<Arc<DatabaseSchema>> {
+        let mut inner = self.inner.write();
+        let db = inner
+            .databases
+            .remove(db_name)
+            .ok_or_else(|| Error::DatabaseNotFound {
+                db_name: db_name.to_string(),
+            })?;
+
+        info!("dropped database from catalog: {}", db_name);
+        inner.sequence = inner.sequence.next();
+        self.series.write().remove(db_name);
+        Ok(db)
+    }
+
+    /// Set the retention period of the database with the given name, `None` meaning the data
+    /// in the database is retained indefinitely
+    pub fn set_retention_period(
+        &self,
+        db_name: &str,
+        retention_period_ns: Option<i64>,
+    ) -> Result<()> {
+        let mut inner = self.inner.write();
+        let db = inner
+            .databases
+            .get_mut(db_name)
+            .ok_or_else(|| Error::DatabaseNotFound {
+                db_name: db_name.to_string(),
+            })?;
+
+        if db.retention_period_ns != retention_period_ns {
+            Arc::make_mut(db).retention_period_ns = retention_period_ns;
+            info!(
+                "updated retention period of database {} to {:?}",
+                db_name, retention_period_ns
+            );
+            inner.sequence = inner.sequence.next();
+        }
+
+        Ok(())
+    }
+
+    /// Set whether writes to the database with the given name must keep each field at the type
+    /// it was first written with, creating the database if it does not exist so that this can
+    /// be set before anything is written to it
+    pub fn set_enforce_field_types(&self, db_name: &str, enforce_field_types: bool) -> Result<()> {
+        let mut inner = self.inner.write();
+        if !inner.databases.contains_key(db_name) && inner.databases.len() >= Self::NUM_DBS_LIMIT {
+            return Err(Error::TooManyDbs);
+        }
+        let mut updated = false;
+        let db = inner
+            .databases
+            .entry(db_name.to_string())
+            .or_insert_with(|| {
+                updated = true;
+                Arc::new(DatabaseSchema::new(db_name))
+            });
+
+        if db.enforce_field_types != enforce_field_types {
+            Arc::make_mut(db).enforce_field_types = enforce_field_types;
+            info!(
+                "updated field type enforcement of database {} to {}",
+                db_name, enforce_field_types
+            );
+            updated = true;
+        }
+        if updated {
+            inner.sequence = inner.sequence.next();
+        }
+
+        Ok(())
+    }
+
+    /// Set the most series that can be written to the database with the given name, `0`
+    /// meaning there is no limit, creating the database if it does not exist so that this can
+    /// be set before anything is written to it
+    pub fn set_max_series(&self, db_name: &str, max_series: usize) -> Result<()> {
+        let mut inner = self.inner.write();
+        if !inner.databases.contains_key(db_name) && inner.databases.len() >= Self::NUM_DBS_LIMIT {
+            return Err(Error::TooManyDbs);
+        }
+        let mut updated = false;
+        let db = inner
+            .databases
+            .entry(db_name.to_string())
+            .or_insert_with(|| {
+                updated = true;
+                Arc::new(DatabaseSchema::new(db_name))
+            });
+
+        if db.max_series != max_series {
+            Arc::make_mut(db).max_series = max_series;
+            info!(
+                "updated series limit of database {} to {}",
+                db_name, max_series
+            );
+            updated = true;
+        }
+        if updated {
+            inner.sequence = inner.sequence.next();
+        }
+
+        Ok(())
+    }
+
+    /// The settings of the database with the given name, as they are written to the WAL when
+    /// any of them are changed
+    pub(crate) fn database_settings(&self, db_name: &str) -> Option<ConfigureDatabaseOp> {
+        let db = self.db_schema(db_name)?;
+        Some(ConfigureDatabaseOp {
+            db_name: db_name.to_string(),
+            retention_period_ns: db.retention_period_ns,
+            enforce_field_types: db.enforce_field_types,
+            max_series: db.max_series,
+        })
+    }
+
+    /// Apply a change to the settings of a database replayed from the WAL, creating the database
+    /// if it does not exist
+    pub(crate) fn replay_configure_database(&self, settings: &ConfigureDatabaseOp) {
+        let mut inner = self.inner.write();
+        let db = inner
+            .databases
+            .entry(settings.db_name.clone())
+            .or_insert_with(|| Arc::new(DatabaseSchema::new(&settings.db_name)));
+
+        let db = Arc::make_mut(db);
+        db.retention_period_ns = settings.retention_period_ns;
+        db.enforce_field_types = settings.enforce_field_types;
+        db.max_series = settings.max_series;
+        info!("replayed settings of database {}", settings.db_name);
+        inner.sequence = inner.sequence.next();
+    }
+
+    /// Call `f` with the keys of the series that have been written to the database with the
+    /// given name
+    pub(crate) fn with_series<R>(&self, db_name: &str, f: impl FnOnce(&HashSet<u64>) -> R) -> R {
+        let series = self.series.read();
+        match series.get(db_name) {
+            Some(keys) => f(keys),
+            None => f(&HashSet::new()),
+        }
+    }
+
+    /// Record that the series with the given keys have been written to the database with the
+    /// given name
+    pub(crate) fn add_series(&self, db_name: &str, keys: HashSet<u64>) {
+        if keys.is_empty() {
+            return;
+        }
+        let mut series = self.series.write();
+        let db_series = series.entry(db_name.to_string()).or_default();
+        let count = db_series.len();
+        db_series.extend(keys);
+        if db_series.len() > count {
+            self.unpersisted_series.store(true, Ordering::Release);
+        }
+    }
+
+    /// Returns true if series have been added since this was last called, or since the catalog
+    /// was loaded, in which case the catalog needs to be persisted to keep them
+    pub(crate) fn take_unpersisted_series(&self) -> bool {
+        self.unpersisted_series.swap(false, Ordering::AcqRel)
+    }
+
+    /// Record that series have been added that are not persisted, after persisting the catalog
+    /// with them has failed
+    pub(crate) fn set_unpersisted_series(&self) {
+        self.unpersisted_series.store(true, Ordering::Release);
+    }
+
+    /// The number of series that have been written to the database with the given name
+    pub fn series_count(&self, db_name: &str) -> usize {
+        self.with_series(db_name, HashSet::len)
+    }
+
+    /// Rename the table with the given name in the database, along with the deletes from it.
+    /// Returns an error if there is already a table with the new name.
+    pub(crate) fn rename_table(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        new_name: &str,
+    ) -> Result<()> {
+        let mut inner = self.inner.write();
+        let db = inner
+            .databases
+            .get_mut(db_name)
+            .ok_or_else(|| Error::DatabaseNotFound {
+                db_name: db_name.to_string(),
+            })?;
+        if !db.table_exists(table_name) {
+            return Err(Error::TableNotFound {
+                db_name: db_name.to_string(),
+                table_name: table_name.to_string(),
+            });
+        }
+        if db.table_exists(new_name) {
+            return Err(Error::TableAlreadyExists {
+                db_name: db_name.to_string(),
+                table_name: new_name.to_string(),
+            });
+        }
+
+        Arc::make_mut(db).rename_table(table_name, new_name);
+        info!(
+            "renamed table {} to {} in database {}",
+            table_name, new_name, db_name
+        );
+        inner.sequence = inner.sequence.next();
+
+        Ok(())
+    }
+
+    /// Apply a rename of a table replayed from the WAL, which has no effect if the table does not
+    /// exist under its old name.
+    ///
+    /// If there is already a table with the new name, the catalog was persisted after the rename,
+    /// and the table under the old name was added back by writes to it replayed from before the
+    /// rename. Its columns and deletes are merged into the renamed table, and it is removed if
+    /// `remove` is set, which it should not be if the table was written to again since the rename.
+    pub(crate) fn replay_rename_table(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        new_name: &str,
+        remove: bool,
+    ) {
+        let mut inner = self.inner.write();
+        let Some(db) = inner.databases.get_mut(db_name) else {
+            return;
+        };
+        let Some(table) = db.tables.get(table_name) else {
+            return;
+        };
+
+        match db.tables.get(new_name) {
+            None => Arc::make_mut(db).rename_table(table_name, new_name),
+            Some(renamed) => {
+                let columns = table
+                    .columns
+                    .iter()
+                    .filter(|(name, _)| !renamed.column_exists(name))
+                    .map(|(name, column_type)| (name.clone(), *column_type))
+                    .collect::<Vec<_>>();
+                let db = Arc::make_mut(db);
+                db.tables
+                    .get_mut(new_name)
+                    .expect("table exists")
+                    .add_columns(columns);
+                if remove {
+                    db.tables.remove(table_name);
+                    if let Some(deletes) = db.deletes.remove(table_name) {
+                        db.deletes
+                            .entry(new_name.to_string())
+                            .or_default()
+                            .extend(deletes);
+                    }
+                }
+            }
+        }
+        info!(
+            "replayed rename of table {} to {} in database {}",
+            table_name, new_name, db_name
+        );
+        inner.sequence = inner.sequence.next();
+    }
+
+    /// Record that the persisted rows of the given table matching the given predicate have been
+    /// deleted. A predicate that is already recorded for the table is not recorded again.
+    pub fn add_delete(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        predicate: DeletePredicate,
+    ) -> Result<()> {
+        let mut inner = self.inner.write();
+        let db = inner
+            .databases
+            .get_mut(db_name)
+            .ok_or_else(|| Error::DatabaseNotFound {
+                db_name: db_name.to_string(),
+            })?;
+        if db.table_deletes(table_name).contains(&predicate) {
+            return Ok(());
+        }
+
+        info!(
+            "recorded delete from table {} in database {}: {:?}",
+            table_name, db_name, predicate
+        );
+        Arc::make_mut(db)
+            .deletes
+            .entry(table_name.to_string())
+            .or_default()
+            .push(predicate);
+        inner.sequence = inner.sequence.next();
+
+        Ok(())
+    }
+
+    /// Remove the given predicates of deleted rows from the table, once the rows that they match
+    /// have been removed from the persisted data. Returns the number of predicates removed.
+    pub(crate) fn remove_deletes(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        predicates: &[DeletePredicate],
+    ) -> usize {
+        let mut inner = self.inner.write();
+        let Some(db) = inner.databases.get_mut(db_name) else {
+            return 0;
+        };
+        if !db
+            .table_deletes(table_name)
+            .iter()
+            .any(|delete| predicates.contains(delete))
+        {
+            return 0;
+        }
+
+        let deletes = Arc::make_mut(db)
+            .deletes
+            .get_mut(table_name)
+            .expect("table has deletes");
+        let count = deletes.len();
+        deletes.retain(|delete| !predicates.contains(delete));
+        let removed = count - deletes.len();
+        if deletes.is_empty() {
+            Arc::make_mut(db).deletes.remove(table_name);
+        }
+        info!(
+            "removed {} applied deletes from table {} in database {}",
+            removed, table_name, db_name
+        );
+        inner.sequence = inner.sequence.next();
+
+        removed
+    }
+
     pub fn db_schema(&self, name: &str) -> Option<Arc<DatabaseSchema>> {
         info!("db_schema {}", name);
         self.inner.read().databases.get(name).cloned()
     }
 
     pub fn into_inner(self) -> InnerCatalog {
-        self.inner.into_inner()
+        let mut inner = self.inner.into_inner();
+        inner.series = self.series.into_inner();
+        inner
     }
 
     pub fn sequence_number(&self) -> SequenceNumber {
@@ -153,7 +517,9 @@ impl Catalog {
     }
 
     pub fn clone_inner(&self) -> InnerCatalog {
-        self.inner.read().clone()
+        let mut inner = self.inner.read().clone();
+        inner.series = self.series.read().clone();
+        inner
     }
 
     pub fn list_databases(&self) -> Vec<String> {
@@ -166,6 +532,10 @@ pub struct InnerCatalog {
     /// The catalog is a map of databases with their table schemas
     databases: HashMap<String, Arc<DatabaseSchema>>,
     sequence: SequenceNumber,
+    /// The keys of the series written to each database, which are held separately by the
+    /// [`Catalog`], so are only set here when it is persisted or loaded
+    #[serde(default)]
+    series: HashMap<String, HashSet<u64>>,
 }
 
 impl InnerCatalog {
@@ -173,6 +543,7 @@ impl InnerCatalog {
         Self {
             databases: HashMap::new(),
             sequence: SequenceNumber::new(0),
+            series: HashMap::new(),
         }
     }
 
@@ -180,6 +551,30 @@ impl InnerCatalog {
         self.sequence
     }
 
+    /// Check we have not gone over the table or column limits with the given updated DB
+    fn check_table_and_column_limits(&self, db: &DatabaseSchema) -> Result<()> {
+        let mut num_tables = self
+            .databases
+            .iter()
+            .filter(|(k, _)| *k != &db.name)
+            .map(|(_, v)| v)
+            .fold(0, |acc, db| acc + db.tables.len());
+
+        num_tables += db.tables.len();
+
+        if num_tables > Catalog::NUM_TABLES_LIMIT {
+            return Err(Error::TooManyTables);
+        }
+
+        for table in db.tables.values() {
+            if table.columns.len() > Catalog::NUM_COLUMNS_PER_TABLE_LIMIT {
+                return Err(Error::TooManyColumns);
+            }
+        }
+
+        Ok(())
+    }
+
     #[cfg(test)]
     pub fn db_exists(&self, db_name: &str) -> bool {
         self.databases.contains_key(db_name)
@@ -191,6 +586,19 @@ pub struct DatabaseSchema {
     pub name: String,
     /// The database is a map of tables
     pub(crate) tables: BTreeMap<String, TableDefinition>,
+    /// How long data is retained in the database, in nanoseconds, `None` means forever
+    #[serde(default)]
+    pub retention_period_ns: Option<i64>,
+    /// Whether writes that give a field a different type to the one it was first written with
+    /// are rejected
+    #[serde(default)]
+    pub enforce_field_types: bool,
+    /// The most series that can be written to the database, `0` meaning there is no limit
+    #[serde(default)]
+    pub max_series: usize,
+    /// The predicates of the rows that have been deleted from each table, keyed on table name
+    #[serde(default)]
+    pub deletes: BTreeMap<String, Vec<DeletePredicate>>,
 }
 
 impl DatabaseSchema {
@@ -198,6 +606,10 @@ impl DatabaseSchema {
         Self {
             name: name.into(),
             tables: BTreeMap::new(),
+            retention_period_ns: None,
+            enforce_field_types: false,
+            max_series: 0,
+            deletes: BTreeMap::new(),
         }
     }
 
@@ -216,6 +628,72 @@ impl DatabaseSchema {
     pub fn table_exists(&self, table_name: &str) -> bool {
         self.tables.contains_key(table_name)
     }
+
+    /// Move the table, along with the deletes from it, to be under the new name
+    fn rename_table(&mut self, table_name: &str, new_name: &str) {
+        let mut table = self.tables.remove(table_name).expect("table exists");
+        table.name = new_name.to_string();
+        self.tables.insert(new_name.to_string(), table);
+        if let Some(deletes) = self.deletes.remove(table_name) {
+            self.deletes.insert(new_name.to_string(), deletes);
+        }
+    }
+
+    /// The predicates of the rows that have been deleted from the given table
+    pub fn table_deletes(&self, table_name: &str) -> &[DeletePredicate] {
+        self.deletes
+            .get(table_name)
+            .map(Vec::as_slice)
+            .unwrap_or_default()
+    }
+}
+
+/// A predicate matching rows of a table that have been deleted
+///
+/// Buffered rows matching a delete are removed from the buffer when it is made. The predicates
+/// recorded in the catalog only cover the time ranges of the data that had been persisted, or
+/// was being persisted, at the time of the delete, and the rows matching them are excluded from
+/// queries of the table until compaction removes them from the persisted files.
+#[derive(Debug, Serialize, Deserialize, Eq, PartialEq, Clone)]
+pub struct DeletePredicate {
+    /// The earliest time of the deleted rows, in nanoseconds, inclusive
+    pub min_time: i64,
+    /// The latest time of the deleted rows, in nanoseconds, inclusive
+    pub max_time: i64,
+    /// The values that the tags of the deleted rows all have, keyed on the tag name
+    pub tags: BTreeMap<String, String>,
+}
+
+impl DeletePredicate {
+    /// Returns whether each of the rows in the batch matches the predicate. A batch without the
+    /// time column, or one of the tags, has no matching rows.
+    pub(crate) fn matching_rows(&self, batch: &RecordBatch) -> Result<BooleanArray, ArrowError> {
+        let none_match = || BooleanArray::from(vec![false; batch.num_rows()]);
+        let Some(time) = batch.column_by_name(TIME_COLUMN_NAME) else {
+            return Ok(none_match());
+        };
+        let time = time.as_primitive::<TimestampNanosecondType>();
+        let mut tags = Vec::with_capacity(self.tags.len());
+        for (tag, value) in &self.tags {
+            let Some(column) = batch.column_by_name(tag) else {
+                return Ok(none_match());
+            };
+            tags.push((cast(column, &DataType::Utf8)?, value));
+        }
+
+        Ok((0..batch.num_rows())
+            .map(|row| {
+                let time_matches = time.is_valid(row)
+                    && self.min_time <= time.value(row)
+                    && time.value(row) <= self.max_time;
+                let tags_match = tags.iter().all(|(column, value)| {
+                    let column = column.as_string::<i32>();
+                    column.is_valid(row) && column.value(row) == value.as_str()
+                });
+                Some(time_matches && tags_match)
+            })
+            .collect())
+    }
 }
 
 #[derive(Debug, Serialize, Eq, PartialEq, Clone)]
@@ -298,6 +776,13 @@ impl TableDefinition {
         self.columns.contains_key(column)
     }
 
+    /// The type of the given column, if it exists
+    pub(crate) fn column_type(&self, column: &str) -> Option<ColumnType> {
+        self.columns
+            .get(column)
+            .map(|column_type| ColumnType::try_from(*column_type).unwrap())
+    }
+
     pub(crate) fn add_columns(&mut self, columns: Vec<(String, i16)>) {
         for (name, column_type) in columns.into_iter() {
             self.columns.insert(name, column_type);
@@ -354,6 +839,7 @@ fn column_type_to_influx_column_type(column_type: &ColumnType) -> InfluxColumnTy
 #[cfg(test)]
 mod tests {
     use super::*;
+    use arrow::array::{ArrayRef, StringArray, TimestampNanosecondArray};
 
     #[test]
     fn catalog_serialization() {
@@ -361,6 +847,10 @@ mod tests {
         let mut database = DatabaseSchema {
             name: "test".to_string(),
             tables: BTreeMap::new(),
+            retention_period_ns: None,
+            enforce_field_types: false,
+            max_series: 0,
+            deletes: BTreeMap::new(),
         };
         database.tables.insert(
             "test".into(),
@@ -386,6 +876,10 @@ mod tests {
         let mut database = DatabaseSchema {
             name: "test".to_string(),
             tables: BTreeMap::new(),
+            retention_period_ns: None,
+            enforce_field_types: false,
+            max_series: 0,
+            deletes: BTreeMap::new(),
         };
         database.tables.insert(
             "test".into(),
@@ -404,4 +898,296 @@ mod tests {
         );
         assert_eq!(schema.field(1).0, InfluxColumnType::Tag);
     }
+
+    #[test]
+    fn drop_database() {
+        let catalog = Catalog::new();
+        catalog.db_or_create("foo").unwrap();
+        catalog.db_or_create("foo/bar").unwrap();
+        let sequence = catalog.sequence_number();
+
+        catalog.drop_database("foo").unwrap();
+        assert!(catalog.db_schema("foo").is_none());
+        assert!(catalog.db_schema("foo/bar").is_some());
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        assert!(matches!(
+            catalog.drop_database("foo"),
+            Err(Error::DatabaseNotFound { db_name }) if db_name == "foo"
+        ));
+    }
+
+    #[test]
+    fn set_retention_period() {
+        let catalog = Catalog::new();
+        catalog.db_or_create("foo").unwrap();
+        let sequence = catalog.sequence_number();
+
+        catalog.set_retention_period("foo", Some(3_600)).unwrap();
+        assert_eq!(
+            catalog.db_schema("foo").unwrap().retention_period_ns,
+            Some(3_600)
+        );
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        // setting the same retention period does not update the catalog:
+        catalog.set_retention_period("foo", Some(3_600)).unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        catalog.set_retention_period("foo", None).unwrap();
+        assert_eq!(catalog.db_schema("foo").unwrap().retention_period_ns, None);
+
+        assert!(matches!(
+            catalog.set_retention_period("bar", None),
+            Err(Error::DatabaseNotFound { db_name }) if db_name == "bar"
+        ));
+    }
+
+    #[test]
+    fn set_enforce_field_types() {
+        let catalog = Catalog::new();
+        let sequence = catalog.sequence_number();
+
+        // the database is created if it does not exist:
+        catalog.set_enforce_field_types("foo", true).unwrap();
+        assert!(catalog.db_schema("foo").unwrap().enforce_field_types);
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        catalog.set_enforce_field_types("foo", true).unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        catalog.set_enforce_field_types("foo", false).unwrap();
+        assert!(!catalog.db_schema("foo").unwrap().enforce_field_types);
+    }
+
+    #[test]
+    fn set_max_series() {
+        let catalog = Catalog::new();
+        let sequence = catalog.sequence_number();
+
+        // the database is created if it does not exist:
+        catalog.set_max_series("foo", 10).unwrap();
+        assert_eq!(catalog.db_schema("foo").unwrap().max_series, 10);
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        catalog.set_max_series("foo", 10).unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        catalog.set_max_series("foo", 0).unwrap();
+        assert_eq!(catalog.db_schema("foo").unwrap().max_series, 0);
+    }
+
+    #[test]
+    fn series_are_dropped_with_database() {
+        let catalog = Catalog::new();
+        catalog.db_or_create("foo").unwrap();
+        catalog.add_series("foo", HashSet::from([1, 2]));
+        catalog.add_series("foo", HashSet::from([2, 3]));
+        assert_eq!(catalog.series_count("foo"), 3);
+        assert_eq!(catalog.series_count("bar"), 0);
+
+        catalog.drop_database("foo").unwrap();
+        assert_eq!(catalog.series_count("foo"), 0);
+    }
+
+    #[test]
+    fn series_are_persisted() {
+        let catalog = Catalog::new();
+        catalog.db_or_create("foo").unwrap();
+        assert!(!catalog.take_unpersisted_series());
+        catalog.add_series("foo", HashSet::from([1, 2]));
+        assert!(catalog.take_unpersisted_series());
+        assert!(!catalog.take_unpersisted_series());
+
+        // adding series that are already there does not need the catalog to be persisted again:
+        catalog.add_series("foo", HashSet::from([2]));
+        assert!(!catalog.take_unpersisted_series());
+
+        let json = serde_json::to_vec(&catalog.clone_inner()).unwrap();
+        let catalog = Catalog::from_inner(serde_json::from_slice(&json).unwrap());
+        assert_eq!(catalog.series_count("foo"), 2);
+        assert!(!catalog.take_unpersisted_series());
+    }
+
+    #[test]
+    fn add_delete() {
+        let catalog = Catalog::new();
+        catalog.db_or_create("foo").unwrap();
+        let sequence = catalog.sequence_number();
+
+        let predicate = DeletePredicate {
+            min_time: i64::MIN,
+            max_time: 100,
+            tags: BTreeMap::from([("host".to_string(), "a".to_string())]),
+        };
+        catalog.add_delete("foo", "cpu", predicate.clone()).unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        let db = catalog.db_schema("foo").unwrap();
+        assert_eq!(db.table_deletes("cpu"), &[predicate]);
+        assert!(db.table_deletes("mem").is_empty());
+
+        // deletes are kept when the catalog is serialized:
+        let inner = catalog.clone_inner();
+        let serialized = serde_json::to_string(&inner).unwrap();
+        let deserialized: InnerCatalog = serde_json::from_str(&serialized).unwrap();
+        assert_eq!(inner, deserialized);
+
+        assert!(matches!(
+            catalog.add_delete("bar", "cpu", db.table_deletes("cpu")[0].clone()),
+            Err(Error::DatabaseNotFound { db_name }) if db_name == "bar"
+        ));
+
+        // repeating a delete does not record it twice:
+        catalog.add_delete("foo", "cpu", predicate.clone()).unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+
+        // removing the delete once it is applied leaves any others in place:
+        let other = DeletePredicate {
+            min_time: 200,
+            max_time: 300,
+            tags: BTreeMap::new(),
+        };
+        catalog.add_delete("foo", "cpu", other.clone()).unwrap();
+        assert_eq!(
+            catalog.remove_deletes("foo", "cpu", &[predicate.clone()]),
+            1
+        );
+        assert_eq!(catalog.remove_deletes("foo", "cpu", &[predicate]), 0);
+        let db = catalog.db_schema("foo").unwrap();
+        assert_eq!(db.table_deletes("cpu"), &[other.clone()]);
+        assert_eq!(catalog.remove_deletes("foo", "cpu", &[other]), 1);
+        assert!(!catalog
+            .db_schema("foo")
+            .unwrap()
+            .deletes
+            .contains_key("cpu"));
+    }
+
+    #[test]
+    fn delete_predicate_matching_rows() {
+        let batch = RecordBatch::try_from_iter([
+            (
+                "host",
+                Arc::new(StringArray::from(vec![
+                    Some("a"),
+                    Some("b"),
+                    None,
+                    Some("a"),
+                ])) as ArrayRef,
+            ),
+            (
+                TIME_COLUMN_NAME,
+                Arc::new(TimestampNanosecondArray::from(vec![10, 10, 10, 30])) as ArrayRef,
+            ),
+        ])
+        .unwrap();
+        let predicate = |max_time, tags: &[(&str, &str)]| DeletePredicate {
+            min_time: 0,
+            max_time,
+            tags: tags
+                .iter()
+                .map(|(tag, value)| (tag.to_string(), value.to_string()))
+                .collect(),
+        };
+
+        let matching = |predicate: DeletePredicate| {
+            predicate
+                .matching_rows(&batch)
+                .unwrap()
+                .iter()
+                .map(Option::unwrap)
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(matching(predicate(20, &[])), [true, true, true, false]);
+        assert_eq!(
+            matching(predicate(i64::MAX, &[("host", "a")])),
+            [true, false, false, true]
+        );
+        assert_eq!(
+            matching(predicate(20, &[("host", "a")])),
+            [true, false, false, false]
+        );
+        // a tag that the batch does not have matches nothing:
+        assert_eq!(
+            matching(predicate(i64::MAX, &[("region", "a")])),
+            [false, false, false, false]
+        );
+    }
+
+    #[test]
+    fn rename_table_moves_deletes() {
+        let catalog = Catalog::new();
+        let mut database = DatabaseSchema::new("foo");
+        database.tables.insert(
+            "cpu".into(),
+            TableDefinition::new(
+                "cpu",
+                BTreeMap::from([("usage".to_string(), ColumnType::F64 as i16)]),
+            ),
+        );
+        catalog
+            .replace_database(SequenceNumber::new(0), Arc::new(database))
+            .unwrap();
+        let predicate = DeletePredicate {
+            min_time: i64::MIN,
+            max_time: 100,
+            tags: BTreeMap::new(),
+        };
+        catalog.add_delete("foo", "cpu", predicate.clone()).unwrap();
+        let sequence = catalog.sequence_number();
+
+        catalog.rename_table("foo", "cpu", "cpu_old").unwrap();
+        assert_eq!(catalog.sequence_number(), sequence.next());
+        let db = catalog.db_schema("foo").unwrap();
+        assert!(!db.table_exists("cpu"));
+        assert_eq!(db.get_table("cpu_old").unwrap().name, "cpu_old");
+        assert_eq!(db.table_deletes("cpu_old"), &[predicate]);
+        assert!(db.table_deletes("cpu").is_empty());
+
+        assert!(matches!(
+            catalog.rename_table("bar", "cpu", "cpu_old"),
+            Err(Error::DatabaseNotFound { .. })
+        ));
+    }
+
+    #[test]
+    fn replay_rename_table() {
+        let catalog = Catalog::new();
+        let mut database = DatabaseSchema::new("foo");
+        for (table_name, column) in [("cpu", "usage"), ("cpu_old", "user")] {
+            database.tables.insert(
+                table_name.into(),
+                TableDefinition::new(
+                    table_name,
+                    BTreeMap::from([(column.to_string(), ColumnType::F64 as i16)]),
+                ),
+            );
+        }
+        catalog
+            .replace_database(SequenceNumber::new(0), Arc::new(database))
+            .unwrap();
+
+        // the table was added back by writes from before the rename, so is merged into the
+        // renamed table, but left in place if it was written to again since:
+        catalog.replay_rename_table("foo", "cpu", "cpu_old", false);
+        let db = catalog.db_schema("foo").unwrap();
+        assert_eq!(db.table_names(), ["cpu", "cpu_old"]);
+        assert!(db.get_table("cpu_old").unwrap().column_exists("usage"));
+
+        catalog.replay_rename_table("foo", "cpu", "cpu_old", true);
+        let db = catalog.db_schema("foo").unwrap();
+        assert_eq!(db.table_names(), ["cpu_old"]);
+
+        // the catalog has not had the table renamed yet:
+        catalog.replay_rename_table("foo", "cpu_old", "cpu_new", true);
+        let db = catalog.db_schema("foo").unwrap();
+        assert_eq!(db.table_names(), ["cpu_new"]);
+        assert_eq!(db.get_table("cpu_new").unwrap().name, "cpu_new");
+
+        // the table was already renamed in the catalog:
+        let sequence = catalog.sequence_number();
+        catalog.replay_rename_table("foo", "cpu_old", "cpu_new", true);
+        assert_eq!(catalog.sequence_number(), sequence);
+    }
 }
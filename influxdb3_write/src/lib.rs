@@ -72,7 +72,8 @@ pub trait WriteBuffer: Bufferer + ChunkContainer {}
 #[async_trait]
 pub trait Bufferer: Debug + Send + Sync + 'static {
     /// Validates the line protocol, writes it into the WAL if configured, writes it into the in memory buffer
-    /// and returns the result with any lines that had errors and summary statistics. This writes into the currently
+    /// and returns the result with any lines that had errors and summary statistics. The write is durable and
+    /// queryable once this returns. This writes into the currently
     /// open segment or it will open one. The open segment id and the memory usage of the currently open segment are
     /// returned.
     async fn write_lp(
@@ -84,6 +85,81 @@ pub trait Bufferer: Debug + Send + Sync + 'static {
         precision: Precision,
     ) -> write_buffer::Result<BufferedWriteRequest>;
 
+    /// Validates the line protocol and updates the catalog in the same way as [`Bufferer::write_lp`], but returns as
+    /// soon as the write is queued to be written into the WAL and buffer, rather than once it has been. So the write
+    /// is neither durable nor queryable when this returns. It is lost if the server stops before it is written to
+    /// the WAL, and an error in writing it is never returned to the caller, only logged.
+    async fn write_lp_no_sync(
+        &self,
+        database: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> write_buffer::Result<BufferedWriteRequest>;
+
+    /// Validates the line protocol against the catalog in the same way as [`Bufferer::write_lp`], but without
+    /// updating the catalog or writing anything into the WAL or buffer. Returns the result that the write would have
+    /// had.
+    fn validate_lp(
+        &self,
+        database: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> write_buffer::Result<BufferedWriteRequest>;
+
+    /// Removes the database from the catalog and drops any of its data held by the buffer. Returns
+    /// an error if the database does not exist.
+    fn drop_database(&self, database: &str) -> write_buffer::Result<()>;
+
+    /// Renames a table in the database, moving any of its data held by the buffer, or already
+    /// persisted, to be under the new name. Returns an error if the table does not exist, or if
+    /// there is already a table with the new name.
+    fn rename_table(
+        &self,
+        database: &str,
+        table_name: &str,
+        new_name: &str,
+    ) -> write_buffer::Result<()>;
+
+    /// Sets the retention period of the database, `None` meaning its data is retained
+    /// indefinitely. Returns an error if the database does not exist.
+    fn set_retention_period(
+        &self,
+        database: &str,
+        retention_period_ns: Option<i64>,
+    ) -> write_buffer::Result<()>;
+
+    /// Sets whether writes to the database must keep each field at the type it was first
+    /// written with, creating the database if it does not exist.
+    fn set_enforce_field_types(
+        &self,
+        database: &str,
+        enforce_field_types: bool,
+    ) -> write_buffer::Result<()>;
+
+    /// Sets the most series that can be written to the database, `0` meaning there is no
+    /// limit, creating the database if it does not exist.
+    fn set_max_series(&self, database: &str, max_series: usize) -> write_buffer::Result<()>;
+
+    /// Deletes the rows of a table in the database that match the predicate, returning the
+    /// number of buffered rows that were removed. Persisted rows that match are no longer
+    /// returned for queries, and are removed by the next compaction. Rows written after the
+    /// delete are not deleted by it. Returns an error if the database does not exist.
+    fn delete_rows(
+        &self,
+        database: &str,
+        table_name: &str,
+        predicate: catalog::DeletePredicate,
+    ) -> write_buffer::Result<usize>;
+
+    /// Reclaims the object storage used by persisted data that has been dropped, deleted, or has
+    /// expired, returning once it has been removed. This is safe to run while queries are in
+    /// progress, as the data it removes is no longer returned for queries.
+    async fn compact(&self) -> write_buffer::Result<CompactionSummary>;
+
     /// Returns the configured WAL, if there is one.
     fn wal(&self) -> Option<Arc<impl Wal>>;
 
@@ -424,6 +500,11 @@ pub struct WalOpBatch {
 #[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
 pub enum WalOp {
     LpWrite(LpWriteOp),
+    Delete(DeleteOp),
+    DropDatabase(DropDatabaseOp),
+    RenameTable(RenameTableOp),
+    ConfigureDatabase(ConfigureDatabaseOp),
+    ExpireData(ExpireDataOp),
 }
 
 /// A write of 1 or more lines of line protocol to a single database. The default time is set by the server at the
@@ -436,9 +517,62 @@ pub struct LpWriteOp {
     pub precision: Precision,
 }
 
+/// A delete of the rows of a table that match a predicate. The rows buffered in the segment before the delete are
+/// removed from it when the op is replayed. As the catalog is only persisted along with a segment, the op also holds
+/// the predicates for the rows that had already been persisted, which are recorded in the catalog.
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
+pub struct DeleteOp {
+    pub db_name: String,
+    pub table_name: String,
+    pub predicate: catalog::DeletePredicate,
+    pub persisted_predicates: Vec<catalog::DeletePredicate>,
+}
+
+/// A drop of a database. The data buffered in the segment before the drop is removed from it when the op is replayed,
+/// and the database is removed from the catalog, unless the catalog was persisted after the drop, as given by the
+/// catalog sequence number after it. The op also holds the ids of the segments that were being persisted, or had been
+/// persisted, with data for the database, which is removed from them on replay.
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
+pub struct DropDatabaseOp {
+    pub db_name: String,
+    pub catalog_sequence_number: SequenceNumber,
+    pub segment_ids: Vec<SegmentId>,
+}
+
+/// A rename of a table in a database. The data buffered in the segment for the table before the rename is moved to
+/// be under the new name when the op is replayed, as is the table in the catalog, unless the catalog was persisted
+/// after the rename. The op also holds the ids of the segments that were being persisted, or had been persisted, with
+/// data for the table, which is moved to be under the new name in them on replay.
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
+pub struct RenameTableOp {
+    pub db_name: String,
+    pub table_name: String,
+    pub new_name: String,
+    pub segment_ids: Vec<SegmentId>,
+}
+
+/// A change to the settings of a database, holding all of its settings after the change. The database is given these
+/// settings in the catalog when the op is replayed, being created if it does not exist, so that the change is kept
+/// until the catalog is persisted.
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
+pub struct ConfigureDatabaseOp {
+    pub db_name: String,
+    pub retention_period_ns: Option<i64>,
+    pub enforce_field_types: bool,
+    pub max_series: usize,
+}
+
+/// A removal of the data of a database from a segment whose range is entirely older than the database's retention
+/// period. The data buffered in the segment for the database before the op is removed from it when the op is replayed.
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq)]
+pub struct ExpireDataOp {
+    pub db_name: String,
+    pub cutoff_time_ns: i64,
+}
+
 /// A single write request can have many lines in it. A writer can request to accept all lines that are valid, while
 /// returning an error for any invalid lines. This is the error information for a single invalid line.
-#[derive(Debug, Serialize)]
+#[derive(Debug, Clone, Serialize)]
 pub struct WriteLineError {
     pub original_line: String,
     pub line_number: usize,
@@ -447,7 +581,7 @@ pub struct WriteLineError {
 
 /// A write that has been validated against the catalog schema, written to the WAL (if configured), and buffered in
 /// memory. This is the summary information for the write along with any errors that were encountered.
-#[derive(Debug)]
+#[derive(Debug, Clone)]
 pub struct BufferedWriteRequest {
     pub db_name: NamespaceName<'static>,
     pub invalid_lines: Vec<WriteLineError>,
@@ -456,6 +590,24 @@ pub struct BufferedWriteRequest {
     pub tag_count: usize,
 }
 
+/// The summary of a compaction of the persisted data, see [`Bufferer::compact`].
+#[derive(Debug, Clone, Copy, Default, Serialize, Eq, PartialEq)]
+pub struct CompactionSummary {
+    /// The number of persisted segments whose info files were rewritten
+    pub segments_rewritten: usize,
+    /// The number of parquet files rewritten without the rows that were deleted from them
+    pub files_rewritten: usize,
+    /// The number of delete predicates that were removed from the catalog, as the rows that they
+    /// match were removed from the persisted data
+    pub deletes_applied: usize,
+    /// The number of parquet files removed from object storage
+    pub files_removed: usize,
+    /// The number of rows in the removed parquet files
+    pub rows_removed: u64,
+    /// The size of the removed parquet files in bytes
+    pub bytes_removed: u64,
+}
+
 /// A persisted Catalog that contains the database, table, and column schemas.
 #[derive(Debug, Serialize, Deserialize, Default)]
 pub struct PersistedCatalog {
@@ -602,6 +754,7 @@ mod test_helpers {
             lp,
             &db,
             db_name.clone(),
+            None,
             Time::from_timestamp_nanos(0),
             SegmentDuration::new_5m(),
             false,
@@ -632,6 +785,7 @@ mod test_helpers {
             lp,
             &db,
             db_name,
+            None,
             Time::from_timestamp_nanos(default_time),
             SegmentDuration::new_5m(),
             false,
@@ -1,6 +1,6 @@
 use crate::SegmentId;
 use chrono::prelude::*;
-use object_store::path::Path as ObjPath;
+use object_store::path::{Path as ObjPath, PathPart};
 use std::fmt;
 use std::ops::Deref;
 use std::path::Path;
@@ -82,6 +82,27 @@ impl ParquetFilePath {
         ));
         Self(path)
     }
+
+    /// The path of a parquet file that replaces the one at `path`, such as when compaction
+    /// removes the deleted rows from it, made unique by the time that it was rewritten at
+    pub fn rewrite_of(path: &str, rewrite_time_ns: i64) -> Self {
+        let path = ObjPath::parse(path).unwrap_or_else(|_| ObjPath::from(path));
+        let mut parts = path.parts().collect::<Vec<_>>();
+        let file_number = parts
+            .pop()
+            .and_then(|file_name| {
+                file_name
+                    .as_ref()
+                    .split(['-', '.'])
+                    .next()
+                    .map(String::from)
+            })
+            .unwrap_or_default();
+        parts.push(PathPart::from(format!(
+            "{file_number}-{rewrite_time_ns}.{PARQUET_FILE_EXTENSION}"
+        )));
+        Self(ObjPath::from_iter(parts))
+    }
 }
 
 impl Deref for ParquetFilePath {
@@ -198,6 +219,27 @@ fn parquet_file_percent_encoded() {
     );
 }
 
+#[test]
+fn parquet_file_path_rewrite_of() {
+    let path = ParquetFilePath::new(
+        "..",
+        "my_table",
+        Utc.with_ymd_and_hms(2038, 1, 19, 3, 14, 7).unwrap(),
+        0,
+    )
+    .to_string();
+    let rewritten = ParquetFilePath::rewrite_of(&path, 5).to_string();
+    assert_eq!(
+        rewritten,
+        "dbs/%2E%2E/my_table/2038-01-19/4294967295-5.parquet"
+    );
+    // rewriting it again replaces the rewrite time:
+    assert_eq!(
+        ParquetFilePath::rewrite_of(&rewritten, 7).to_string(),
+        "dbs/%2E%2E/my_table/2038-01-19/4294967295-7.parquet"
+    );
+}
+
 #[test]
 fn segment_info_file_path_new() {
     assert_eq!(
@@ -824,6 +824,7 @@ mod tests {
         // Load the data into a buffer.
         let buffer = crate::write_buffer::buffer_segment::load_buffer_from_segment(
             &catalog,
+            catalog.sequence_number(),
             wal.open_segment_reader(segment).unwrap(),
         )
         .unwrap()
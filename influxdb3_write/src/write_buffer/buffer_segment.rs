@@ -2,7 +2,7 @@
 //! single WAL segment. Only one segment should be open for writes in the write buffer at any
 //! given time.
 
-use crate::catalog::Catalog;
+use crate::catalog::{Catalog, DeletePredicate};
 use crate::chunk::BufferChunk;
 use crate::paths::ParquetFilePath;
 use crate::write_buffer::flusher::BufferedWriteResult;
@@ -12,9 +12,10 @@ use crate::write_buffer::{
     parse_validate_and_update_catalog, Error, TableBatch, ValidSegmentedData,
 };
 use crate::{
-    wal, write_buffer, write_buffer::Result, DatabaseTables, ParquetFile, PersistedSegment,
-    Persister, SegmentDuration, SegmentId, SegmentRange, SequenceNumber, TableParquetFiles, WalOp,
-    WalSegmentReader, WalSegmentWriter,
+    wal, write_buffer, write_buffer::Result, DatabaseTables, DeleteOp, DropDatabaseOp,
+    ExpireDataOp, ParquetFile, PersistedSegment, Persister, RenameTableOp, SegmentDuration,
+    SegmentId, SegmentRange, SequenceNumber, TableParquetFiles, WalOp, WalSegmentReader,
+    WalSegmentWriter,
 };
 use arrow::datatypes::SchemaRef;
 use arrow::record_batch::RecordBatch;
@@ -22,7 +23,7 @@ use data_types::ChunkId;
 use data_types::ChunkOrder;
 use data_types::TableId;
 use data_types::TransitionPartitionId;
-use data_types::{NamespaceName, PartitionKey};
+use data_types::{NamespaceName, PartitionKey, TimestampMinMax};
 use datafusion::logical_expr::Expr;
 use datafusion_util::stream_from_batches;
 use iox_query::chunk_statistics::create_chunk_statistics;
@@ -30,7 +31,7 @@ use iox_query::frontend::reorg::ReorgPlanner;
 use iox_query::QueryChunk;
 use iox_time::Time;
 use schema::sort::SortKey;
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use std::sync::Arc;
 use std::time::{Duration, Instant};
 use tokio::sync::oneshot;
@@ -145,6 +146,56 @@ impl OpenBufferSegment {
             .table_record_batches(db_name, table_name, schema, filter)
     }
 
+    /// Removes all data buffered for the given database from the segment, returning the number
+    /// of rows removed
+    pub(crate) fn drop_database(&mut self, db_name: &str) -> usize {
+        let rows = self.buffered_data.drop_database(db_name);
+        self.segment_size -= rows;
+        rows
+    }
+
+    /// Removes all data buffered for the database from the segment, then writes the drop into
+    /// the segment's WAL, returning the number of rows removed
+    pub(crate) fn write_drop_database(&mut self, drop: DropDatabaseOp) -> Result<usize> {
+        let rows = self.drop_database(&drop.db_name);
+        self.write_wal_ops(vec![WalOp::DropDatabase(drop)])?;
+        Ok(rows)
+    }
+
+    /// Removes all data buffered for the database from the segment, as it has expired, then
+    /// writes the removal into the segment's WAL, returning the number of rows removed
+    pub(crate) fn write_expire_data(&mut self, expire: ExpireDataOp) -> Result<usize> {
+        let rows = self.drop_database(&expire.db_name);
+        self.write_wal_ops(vec![WalOp::ExpireData(expire)])?;
+        Ok(rows)
+    }
+
+    /// Returns true if there is data buffered for the database
+    pub(crate) fn contains_database(&self, db_name: &str) -> bool {
+        self.buffered_data.contains_database(db_name)
+    }
+
+    /// Writes the delete into the segment's WAL, then removes the rows buffered for the table
+    /// that match its predicate, returning the number of rows removed
+    pub(crate) fn delete_rows(&mut self, delete: DeleteOp) -> Result<usize> {
+        let rows = self.buffered_data.delete_rows(
+            &delete.db_name,
+            &delete.table_name,
+            &delete.predicate,
+        )?;
+        self.write_wal_ops(vec![WalOp::Delete(delete)])?;
+        Ok(rows)
+    }
+
+    /// Moves the data buffered for the table to be under its new name, then writes the rename
+    /// into the segment's WAL
+    pub(crate) fn write_rename_table(&mut self, rename: RenameTableOp) -> Result<()> {
+        self.buffered_data
+            .rename_table(&rename.db_name, &rename.table_name, &rename.new_name);
+        self.write_wal_ops(vec![WalOp::RenameTable(rename)])?;
+        Ok(())
+    }
+
     /// Returns true if the segment should be persisted. A segment should be persisted if both of
     /// the following are true:
     /// 1. The segment has been open longer than half its duration
@@ -178,12 +229,20 @@ impl OpenBufferSegment {
     }
 }
 
+/// Replays the ops in the WAL segment, returning the data buffered by them and its size, along
+/// with the drops of databases and renames of tables, which may also need to be applied to other
+/// segments. The sequence number of the catalog as it was persisted, before any of the WAL was
+/// replayed into it, is used to tell which drops it already has.
 pub(crate) fn load_buffer_from_segment(
     catalog: &Arc<Catalog>,
+    persisted_sequence: SequenceNumber,
     mut segment_reader: Box<dyn WalSegmentReader>,
-) -> Result<(BufferedData, usize)> {
+) -> Result<(BufferedData, usize, Vec<WalOp>)> {
     let mut segment_size = 0;
     let mut buffered_data = BufferedData::default();
+    let mut segment_ops = vec![];
+    // the tables that writes replayed from the segment have added to the catalog:
+    let mut created_tables = HashSet::new();
     let segment_key = PartitionKey::from(segment_reader.header().range.key());
     let segment_duration = SegmentDuration::from_range(segment_reader.header().range);
 
@@ -191,6 +250,7 @@ pub(crate) fn load_buffer_from_segment(
         for wal_op in batch.ops {
             match wal_op {
                 WalOp::LpWrite(write) => {
+                    let db_schema = catalog.db_schema(&write.db_name);
                     let mut validated_write = parse_validate_and_update_catalog(
                         NamespaceName::new(write.db_name.clone())?,
                         &write.lp,
@@ -199,6 +259,7 @@ pub(crate) fn load_buffer_from_segment(
                         segment_duration,
                         false,
                         write.precision,
+                        false,
                     )?;
 
                     let db_name = &write.db_name;
@@ -225,6 +286,13 @@ pub(crate) fn load_buffer_from_segment(
                         .db_schema(db_name)
                         .expect("database exists in schema");
                     for (table_name, table_batch) in segment_data.table_batches {
+                        if !db_schema
+                            .as_ref()
+                            .is_some_and(|db| db.table_exists(&table_name))
+                        {
+                            created_tables.insert((db_name.clone(), table_name.clone()));
+                        }
+
                         // TODO: for now we'll just have the number of rows represent the segment size. The entire
                         //       buffer is going to get refactored to use different structures, so this will change.
                         segment_size += table_batch.rows.len();
@@ -237,11 +305,65 @@ pub(crate) fn load_buffer_from_segment(
                         );
                     }
                 }
+                WalOp::Delete(delete) => {
+                    // the database may have been dropped since, in which case there is nothing
+                    // left to delete:
+                    if catalog.db_schema(&delete.db_name).is_none() {
+                        continue;
+                    }
+                    for predicate in delete.persisted_predicates {
+                        catalog.add_delete(&delete.db_name, &delete.table_name, predicate)?;
+                    }
+                    buffered_data.delete_rows(
+                        &delete.db_name,
+                        &delete.table_name,
+                        &delete.predicate,
+                    )?;
+                }
+                WalOp::DropDatabase(drop) => {
+                    // a catalog persisted after the drop already has the database removed, and
+                    // any database with the name in it was created again since. The sequence
+                    // number of the catalog being replayed into can not be used, as replaying
+                    // the ops before the drop may take it past the drop's:
+                    if persisted_sequence < drop.catalog_sequence_number
+                        && catalog.db_schema(&drop.db_name).is_some()
+                    {
+                        catalog.drop_database(&drop.db_name)?;
+                    }
+                    segment_size -= buffered_data.drop_database(&drop.db_name);
+                    created_tables.retain(|(db_name, _)| db_name != &drop.db_name);
+                    segment_ops.push(WalOp::DropDatabase(drop));
+                }
+                WalOp::RenameTable(rename) => {
+                    // the table is only removed from the catalog if it was added back by the
+                    // writes replayed above, as it may have been written to again since the
+                    // rename if it was already there:
+                    let created =
+                        created_tables.remove(&(rename.db_name.clone(), rename.table_name.clone()));
+                    catalog.replay_rename_table(
+                        &rename.db_name,
+                        &rename.table_name,
+                        &rename.new_name,
+                        created,
+                    );
+                    buffered_data.rename_table(
+                        &rename.db_name,
+                        &rename.table_name,
+                        &rename.new_name,
+                    );
+                    segment_ops.push(WalOp::RenameTable(rename));
+                }
+                WalOp::ConfigureDatabase(settings) => {
+                    catalog.replay_configure_database(&settings);
+                }
+                WalOp::ExpireData(expire) => {
+                    segment_size -= buffered_data.drop_database(&expire.db_name);
+                }
             }
         }
     }
 
-    Ok((buffered_data, segment_size))
+    Ok((buffered_data, segment_size, segment_ops))
 }
 
 #[derive(Debug, Default)]
@@ -299,6 +421,82 @@ impl BufferedData {
             .map(|table_buffer| table_buffer.record_batch(schema, filter))
     }
 
+    /// Marks the buffered rows of the table that match the predicate as deleted, returning the
+    /// number of rows deleted
+    pub(crate) fn delete_rows(
+        &mut self,
+        db_name: &str,
+        table_name: &str,
+        predicate: &DeletePredicate,
+    ) -> TableBufferResult<usize> {
+        match self
+            .database_buffers
+            .get_mut(db_name)
+            .and_then(|db_buffer| db_buffer.table_buffers.get_mut(table_name))
+        {
+            Some(table_buffer) => table_buffer.delete_rows(predicate),
+            None => Ok(0),
+        }
+    }
+
+    /// Returns true if there is data buffered for the database
+    pub(crate) fn contains_database(&self, db_name: &str) -> bool {
+        self.database_buffers.contains_key(db_name)
+    }
+
+    /// Returns true if there is data buffered for the table
+    pub(crate) fn contains_table(&self, db_name: &str, table_name: &str) -> bool {
+        self.database_buffers
+            .get(db_name)
+            .is_some_and(|db_buffer| db_buffer.table_buffers.contains_key(table_name))
+    }
+
+    /// Moves the data buffered for the table to be under the new name
+    pub(crate) fn rename_table(&mut self, db_name: &str, table_name: &str, new_name: &str) {
+        let Some(db_buffer) = self.database_buffers.get_mut(db_name) else {
+            return;
+        };
+        if let Some(table_buffer) = db_buffer.table_buffers.remove(table_name) {
+            db_buffer
+                .table_buffers
+                .insert(new_name.to_string(), table_buffer);
+        }
+    }
+
+    /// The number of rows buffered for the database
+    pub(crate) fn database_row_count(&self, db_name: &str) -> usize {
+        self.database_buffers
+            .get(db_name)
+            .map(|db_buffer| {
+                db_buffer
+                    .table_buffers
+                    .values()
+                    .map(|table_buffer| table_buffer.row_count())
+                    .sum()
+            })
+            .unwrap_or_default()
+    }
+
+    /// Removes all data buffered for the database, returning the number of rows removed
+    pub(crate) fn drop_database(&mut self, db_name: &str) -> usize {
+        let rows = self.database_row_count(db_name);
+        self.database_buffers.remove(db_name);
+        rows
+    }
+
+    /// The min and max times of the rows buffered for the table, if there are any
+    pub(crate) fn table_timestamp_min_max(
+        &self,
+        db_name: &str,
+        table_name: &str,
+    ) -> Option<TimestampMinMax> {
+        self.database_buffers
+            .get(db_name)
+            .and_then(|db_buffer| db_buffer.table_buffers.get(table_name))
+            .filter(|table_buffer| table_buffer.row_count() > 0)
+            .map(TableBuffer::timestamp_min_max)
+    }
+
     /// Verifies that the passed in buffer has the same data as this buffer
     #[cfg(test)]
     pub(crate) fn verify_matches(&self, other: &BufferedData, catalog: &Catalog) {
@@ -368,6 +566,9 @@ pub struct ClosedBufferSegment {
     pub buffered_data: BufferedData,
     pub segment_wal_bytes: u64,
     catalog: Arc<Catalog>,
+    // The schemas of the databases with buffered data as of when the segment was closed, which
+    // are used to persist the data, as its tables may be renamed in the catalog in the meantime.
+    db_schemas: HashMap<String, Arc<DatabaseSchema>>,
 }
 
 impl ClosedBufferSegment {
@@ -383,6 +584,12 @@ impl ClosedBufferSegment {
         segment_wal_bytes: u64,
         catalog: Arc<Catalog>,
     ) -> Self {
+        let db_schemas = buffered_data
+            .database_buffers
+            .keys()
+            .filter_map(|db_name| Some((db_name.clone(), catalog.db_schema(db_name)?)))
+            .collect();
+
         Self {
             segment_id,
             segment_range,
@@ -392,6 +599,7 @@ impl ClosedBufferSegment {
             buffered_data,
             segment_wal_bytes,
             catalog,
+            db_schemas,
         }
     }
 
@@ -405,12 +613,23 @@ impl ClosedBufferSegment {
         P: Persister,
         write_buffer::Error: From<<P as Persister>::Error>,
     {
-        if self.catalog_start_sequence_number != self.catalog_end_sequence_number {
+        // adding series does not update the catalog sequence number, so the catalog is also
+        // persisted if any have been added since it last was:
+        let unpersisted_series = self.catalog.take_unpersisted_series();
+        if unpersisted_series
+            || self.catalog_start_sequence_number != self.catalog_end_sequence_number
+        {
             let inner_catalog = self.catalog.clone_inner();
 
-            persister
+            if let Err(e) = persister
                 .persist_catalog(self.segment_id, Catalog::from_inner(inner_catalog))
-                .await?;
+                .await
+            {
+                if unpersisted_series {
+                    self.catalog.set_unpersisted_series();
+                }
+                return Err(e.into());
+            }
         }
 
         let mut persisted_database_files = HashMap::new();
@@ -423,7 +642,7 @@ impl ClosedBufferSegment {
         for (db_name, db_buffer) in &self.buffered_data.database_buffers {
             let mut database_tables = DatabaseTables::default();
 
-            if let Some(db_schema) = self.catalog.db_schema(db_name) {
+            if let Some(db_schema) = self.db_schemas.get(db_name) {
                 for (table_name, table_buffer) in &db_buffer.table_buffers {
                     if let Some(table) = db_schema.get_table(table_name) {
                         let mut table_parquet_files = TableParquetFiles {
@@ -892,6 +1111,55 @@ pub(crate) mod tests {
         assert!(segment.last_write_time < Instant::now());
     }
 
+    #[test]
+    fn replays_drop_made_after_catalog_persisted() {
+        use crate::wal::WalImpl;
+        use crate::Wal;
+
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = WalImpl::new(dir).unwrap();
+
+        // the catalog was persisted after the write and the change to the settings, but before
+        // the drop:
+        let catalog = Arc::new(Catalog::new());
+        lp_to_write_batch(&catalog, "foo", "cpu bar=1 10");
+        catalog.set_max_series("foo", 10).unwrap();
+        let persisted_sequence = catalog.sequence_number();
+
+        let mut writer = wal
+            .new_segment_writer(SegmentId::new(1), SegmentRange::test_range())
+            .unwrap();
+        writer
+            .write_batch(vec![
+                WalOp::LpWrite(LpWriteOp {
+                    db_name: "foo".to_string(),
+                    lp: "cpu bar=1 10".to_string(),
+                    default_time: 0,
+                    precision: crate::Precision::Nanosecond,
+                }),
+                WalOp::ConfigureDatabase(catalog.database_settings("foo").unwrap()),
+                WalOp::DropDatabase(DropDatabaseOp {
+                    db_name: "foo".to_string(),
+                    catalog_sequence_number: persisted_sequence.next(),
+                    segment_ids: vec![],
+                }),
+            ])
+            .unwrap();
+
+        // replaying the settings takes the catalog to the drop's sequence number, but the drop
+        // is still applied:
+        let (buffered_data, segment_size, segment_ops) = load_buffer_from_segment(
+            &catalog,
+            persisted_sequence,
+            wal.open_segment_reader(SegmentId::new(1)).unwrap(),
+        )
+        .unwrap();
+        assert!(catalog.db_schema("foo").is_none());
+        assert!(!buffered_data.contains_database("foo"));
+        assert_eq!(segment_size, 0);
+        assert_eq!(segment_ops.len(), 1);
+    }
+
     #[derive(Debug, Default)]
     pub(crate) struct TestPersister {
         pub(crate) state: Mutex<PersistedState>,
@@ -5,7 +5,7 @@ use crate::write_buffer::{Error, SegmentState, ValidSegmentedData};
 use crate::{wal, SequenceNumber, Wal, WalOp};
 use crossbeam_channel::{bounded, Receiver as CrossbeamReceiver, Sender as CrossbeamSender};
 use iox_time::{Time, TimeProvider};
-use observability_deps::tracing::debug;
+use observability_deps::tracing::{debug, error};
 use parking_lot::{Mutex, RwLock};
 use std::collections::HashMap;
 use std::sync::Arc;
@@ -102,6 +102,30 @@ impl WriteBufferFlusher {
             BufferedWriteResult::Error(e) => Err(Error::BufferSegmentError(e)),
         }
     }
+
+    /// Queue the data to be written to the open segment, returning without waiting for it to
+    /// be written to the WAL or buffered.
+    ///
+    /// The data is lost if the server stops before the next flush to the WAL, and if writing it
+    /// to the WAL or buffering it fails, the error is only logged, as there is no one left to
+    /// return it to. The caller has already been told that the write succeeded.
+    pub async fn queue_write_to_open_segment(&self, segmented_data: Vec<ValidSegmentedData>) {
+        let (response_tx, response_rx) = oneshot::channel();
+
+        self.buffer_tx
+            .send(BufferedWrite {
+                segmented_data,
+                response_tx,
+            })
+            .await
+            .expect("wal op buffer thread is dead");
+
+        tokio::spawn(async move {
+            if let Ok(BufferedWriteResult::Error(e)) = response_rx.await {
+                error!(%e, "failed to write queued write to the open segment");
+            }
+        });
+    }
 }
 
 async fn run_wal_op_buffer<T: TimeProvider, W: Wal>(
@@ -267,6 +291,7 @@ mod tests {
             SegmentDuration::new_5m(),
             false,
             Precision::Nanosecond,
+            true,
         )
         .unwrap();
 
@@ -283,6 +308,7 @@ mod tests {
             SegmentDuration::new_5m(),
             false,
             Precision::Nanosecond,
+            true,
         )
         .unwrap();
         flusher
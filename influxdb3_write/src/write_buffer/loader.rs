@@ -7,7 +7,9 @@ use crate::write_buffer::{
     buffer_segment::{load_buffer_from_segment, ClosedBufferSegment, OpenBufferSegment},
     Result,
 };
-use crate::{persister, write_buffer, PersistedCatalog, PersistedSegment, Persister, SegmentId};
+use crate::{
+    persister, write_buffer, PersistedCatalog, PersistedSegment, Persister, SegmentId, WalOp,
+};
 use crate::{SegmentDuration, SegmentRange, Wal};
 use iox_time::Time;
 use std::sync::Arc;
@@ -22,6 +24,9 @@ pub struct LoadedState {
     pub persisting_buffer_segments: Vec<ClosedBufferSegment>,
     pub persisted_segments: Vec<PersistedSegment>,
     pub last_segment_id: SegmentId,
+    /// The drops of databases and renames of tables replayed from the WAL, in the order they were
+    /// replayed, which also apply to the persisting and persisted segments
+    pub segment_ops: Vec<WalOp>,
 }
 
 pub async fn load_starting_state<P, W>(
@@ -38,6 +43,7 @@ where
 {
     let PersistedCatalog { catalog, .. } = persister.load_catalog().await?.unwrap_or_default();
     let catalog = Arc::new(Catalog::from_inner(catalog));
+    let persisted_sequence = catalog.sequence_number();
 
     let persisted_segments = persister.load_segments(SEGMENTS_TO_LOAD).await?;
 
@@ -52,6 +58,7 @@ where
     let next_segment_range = current_segment_range.next();
 
     let mut open_segments = Vec::new();
+    let mut segment_ops = Vec::new();
     let mut max_segment_id = last_persisted_segment_id;
 
     if let Some(wal) = wal {
@@ -72,7 +79,9 @@ where
             let starting_sequence_number = catalog.sequence_number();
             let segment_reader = wal.open_segment_reader(segment_file.segment_id)?;
             let segment_header = *segment_reader.header();
-            let buffer = load_buffer_from_segment(&catalog, segment_reader)?;
+            let (buffered_data, segment_size, replayed_segment_ops) =
+                load_buffer_from_segment(&catalog, persisted_sequence, segment_reader)?;
+            segment_ops.extend(replayed_segment_ops);
 
             let segment = OpenBufferSegment::new(
                 Arc::clone(&catalog),
@@ -81,7 +90,7 @@ where
                 server_load_time,
                 starting_sequence_number,
                 wal.open_segment_writer(segment_file.segment_id)?,
-                Some(buffer),
+                Some((buffered_data, segment_size)),
             );
 
             // if it's the current or next segment, we want to keep it open rather than move it to
@@ -136,6 +145,7 @@ where
         open_segments,
         persisting_buffer_segments,
         persisted_segments,
+        segment_ops,
     })
 }
 
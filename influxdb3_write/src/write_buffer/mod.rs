@@ -7,16 +7,25 @@ mod segment_state;
 mod table_buffer;
 
 use crate::cache::ParquetCache;
-use crate::catalog::{Catalog, DatabaseSchema, TableDefinition, TIME_COLUMN_NAME};
+use crate::catalog::{Catalog, DatabaseSchema, DeletePredicate, TableDefinition, TIME_COLUMN_NAME};
 use crate::chunk::ParquetChunk;
+use crate::paths::ParquetFilePath;
 use crate::persister::PersisterImpl;
 use crate::write_buffer::flusher::WriteBufferFlusher;
 use crate::write_buffer::loader::load_starting_state;
-use crate::write_buffer::segment_state::{run_buffer_segment_persist_and_cleanup, SegmentState};
+use crate::write_buffer::segment_state::{
+    run_buffer_segment_persist_and_cleanup, SegmentState, UnreferencedFiles,
+};
 use crate::{
-    BufferedWriteRequest, Bufferer, ChunkContainer, LpWriteOp, Persister, Precision,
-    SegmentDuration, SequenceNumber, Wal, WalOp, WriteBuffer, WriteLineError,
+    persister, BufferedWriteRequest, Bufferer, ChunkContainer, CompactionSummary, LpWriteOp,
+    ParquetFile, Persister, Precision, SegmentDuration, SequenceNumber, Wal, WalOp, WriteBuffer,
+    WriteLineError,
 };
+use arrow::array::{AsArray, BooleanArray};
+use arrow::compute::kernels::boolean::{not, or};
+use arrow::compute::{filter_record_batch, max, min};
+use arrow::datatypes::TimestampNanosecondType;
+use arrow::record_batch::RecordBatch;
 use async_trait::async_trait;
 use data_types::{
     column_type_from_field, ChunkId, ChunkOrder, ColumnType, NamespaceName, NamespaceNameError,
@@ -25,23 +34,27 @@ use datafusion::common::DataFusionError;
 use datafusion::execution::context::SessionState;
 use datafusion::logical_expr::Expr;
 use datafusion::physical_plan::SendableRecordBatchStream;
+use datafusion_util::stream_from_batches;
 use influxdb_line_protocol::{parse_lines, FieldValue, ParsedLine};
 use iox_query::chunk_statistics::create_chunk_statistics;
 use iox_query::QueryChunk;
 use iox_time::{Time, TimeProvider};
 use object_store::path::Path as ObjPath;
-use object_store::ObjectMeta;
-use observability_deps::tracing::{debug, error};
+use object_store::{ObjectMeta, ObjectStore};
+use observability_deps::tracing::{debug, error, info};
 use parking_lot::{Mutex, RwLock};
+use parquet::arrow::arrow_reader::ParquetRecordBatchReaderBuilder;
 use parquet_file::storage::ParquetExecInput;
 use sha2::Digest;
 use sha2::Sha256;
 use std::borrow::Cow;
-use std::collections::{BTreeMap, HashMap};
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::i64;
 use std::sync::{Arc, OnceLock};
+use std::time::Duration;
 use thiserror::Error;
 use tokio::sync::watch;
+use tokio::time::MissedTickBehavior;
 
 #[derive(Debug, Error)]
 pub enum Error {
@@ -78,6 +91,9 @@ pub enum Error {
 
     #[error("error from table buffer: {0}")]
     TableBufferError(#[from] table_buffer::Error),
+
+    #[error("error from arrow: {0}")]
+    ArrowError(#[from] arrow::error::ArrowError),
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -98,12 +114,14 @@ pub struct WriteBufferImpl<W, T> {
     wal: Option<Arc<W>>,
     write_buffer_flusher: WriteBufferFlusher,
     segment_duration: SegmentDuration,
-    #[allow(dead_code)]
     time_provider: Arc<T>,
     #[allow(dead_code)]
     segment_persist_handle: Mutex<tokio::task::JoinHandle<()>>,
     #[allow(dead_code)]
     shutdown_segment_persist_tx: watch::Sender<()>,
+    // Held while cleaning up the persisted data, so that the info files of the persisted
+    // segments are not rewritten concurrently, where an older version could be written last.
+    compaction_lock: tokio::sync::Mutex<()>,
 }
 
 impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
@@ -118,7 +136,7 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
         let loaded_state =
             load_starting_state(Arc::clone(&persister), wal.clone(), now, segment_duration).await?;
 
-        let segment_state = Arc::new(RwLock::new(SegmentState::new(
+        let mut segment_state = SegmentState::new(
             segment_duration,
             loaded_state.last_segment_id,
             Arc::clone(&loaded_state.catalog),
@@ -127,7 +145,18 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
             loaded_state.persisting_buffer_segments,
             loaded_state.persisted_segments,
             wal.clone(),
-        )));
+        );
+        for op in &loaded_state.segment_ops {
+            match op {
+                WalOp::DropDatabase(drop) => segment_state.replay_drop_database(drop),
+                WalOp::RenameTable(rename) => segment_state.replay_rename_table(rename),
+                WalOp::LpWrite(_)
+                | WalOp::Delete(_)
+                | WalOp::ConfigureDatabase(_)
+                | WalOp::ExpireData(_) => {}
+            }
+        }
+        let segment_state = Arc::new(RwLock::new(segment_state));
 
         let write_buffer_flusher = WriteBufferFlusher::new(Arc::clone(&segment_state));
 
@@ -160,6 +189,7 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
             segment_duration,
             segment_persist_handle: Mutex::new(segment_persist_handle),
             shutdown_segment_persist_tx,
+            compaction_lock: tokio::sync::Mutex::new(()),
         })
     }
 
@@ -167,6 +197,283 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
         Arc::clone(&self.catalog)
     }
 
+    /// Removes the data of each database with a retention period that is older than that
+    /// period, returning the number of rows removed.
+    ///
+    /// Only data that is entirely older than the retention period can be removed, so recently
+    /// expired rows may remain until a later run, and should be filtered out when queried. The
+    /// expired parquet files are removed from object storage by [`Self::remove_unreferenced`].
+    pub fn enforce_retention(&self) -> Result<u64> {
+        let now = self.time_provider.now().timestamp_nanos();
+        let mut rows_removed = 0;
+        for db_name in self.catalog.list_databases() {
+            let Some(retention_period_ns) = self
+                .catalog
+                .db_schema(&db_name)
+                .and_then(|db| db.retention_period_ns)
+            else {
+                continue;
+            };
+            let cutoff_time_ns = now.saturating_sub(retention_period_ns);
+            let rows = self
+                .segment_state
+                .write()
+                .expire_database_data(&db_name, cutoff_time_ns)?;
+            if rows > 0 {
+                info!(%db_name, rows, cutoff_time_ns, "removed data outside of retention period");
+            }
+            rows_removed += rows;
+        }
+        Ok(rows_removed)
+    }
+
+    /// Spawns a task that runs [`Self::enforce_retention`], followed by
+    /// [`Self::remove_unreferenced`], every `interval` until the write buffer is dropped.
+    pub fn spawn_retention_enforcement(
+        self: &Arc<Self>,
+        interval: Duration,
+    ) -> tokio::task::JoinHandle<()> {
+        let write_buffer = Arc::downgrade(self);
+        tokio::task::spawn(async move {
+            let mut ticker = tokio::time::interval(interval);
+            ticker.set_missed_tick_behavior(MissedTickBehavior::Delay);
+            loop {
+                ticker.tick().await;
+                let Some(write_buffer) = write_buffer.upgrade() else {
+                    break;
+                };
+                if let Err(e) = write_buffer.enforce_retention() {
+                    error!(%e, "error removing data outside of retention period");
+                }
+                if let Err(e) = write_buffer.remove_unreferenced().await {
+                    error!(%e, "error removing unreferenced persisted data");
+                }
+            }
+        })
+    }
+
+    /// Removes the parquet files that are no longer referenced by any persisted segment, as their
+    /// data has been dropped or has expired, from object storage. Unlike [`Self::compact`], the
+    /// deleted rows are not removed from the files.
+    pub async fn remove_unreferenced(&self) -> Result<CompactionSummary> {
+        let _compaction = self.compaction_lock.lock().await;
+        let mut summary = CompactionSummary::default();
+        self.remove_unreferenced_files(&mut summary).await?;
+        if summary != CompactionSummary::default() {
+            info!(?summary, "removed unreferenced persisted data");
+        }
+        Ok(summary)
+    }
+
+    /// Removes the deleted rows from the persisted parquet files, then removes the files that are
+    /// no longer referenced from object storage, along with rewriting the info files of the
+    /// persisted segments that referenced them, so that they are not loaded again on restart.
+    ///
+    /// Anything that could not be cleaned up is retried by the next compaction.
+    pub async fn compact(&self) -> Result<CompactionSummary> {
+        let _compaction = self.compaction_lock.lock().await;
+        let mut summary = CompactionSummary::default();
+        let mut applied_deletes = vec![];
+        for db_name in self.catalog.list_databases() {
+            let Some(db) = self.catalog.db_schema(&db_name) else {
+                continue;
+            };
+            for (table_name, deletes) in &db.deletes {
+                let applied = self
+                    .apply_deletes(&db_name, table_name, deletes, &mut summary)
+                    .await?;
+                applied_deletes.push((
+                    db_name.clone(),
+                    table_name.clone(),
+                    deletes.clone(),
+                    applied,
+                ));
+            }
+        }
+        self.remove_unreferenced_files(&mut summary).await?;
+
+        // the deletes are only removed from the catalog once the info files of the segments with
+        // rewritten files have been persisted, so that the deleted rows do not come back after a
+        // restart. The segment state lock is held so that no segments are closed, and no deletes
+        // are made, while they are removed.
+        {
+            let segment_state = self.segment_state.read();
+            for (db_name, table_name, deletes, applied) in applied_deletes {
+                if segment_state.deletes_applied(&db_name, &table_name, &deletes, &applied) {
+                    summary.deletes_applied +=
+                        self.catalog.remove_deletes(&db_name, &table_name, &deletes);
+                }
+            }
+        }
+
+        info!(?summary, "compacted persisted data");
+        Ok(summary)
+    }
+
+    /// Rewrites the info files of the persisted segments that have had parquet files removed, so
+    /// that the files are not loaded again on restart, then removes the files that are no longer
+    /// referenced from object storage. Anything that could not be cleaned up is retried the next
+    /// time this runs. The compaction lock must be held while this runs.
+    async fn remove_unreferenced_files(&self, summary: &mut CompactionSummary) -> Result<()> {
+        let unreferenced = self.segment_state.write().take_unreferenced_files();
+
+        for segment in unreferenced.segments.values() {
+            if let Err(e) = self.persister.persist_segment(segment).await {
+                error!(%e, segment_id = ?segment.segment_id, "error rewriting segment info file");
+                self.segment_state
+                    .write()
+                    .return_unreferenced_files(unreferenced);
+                return Err(e.into());
+            }
+            summary.segments_rewritten += 1;
+        }
+
+        let object_store = self.persister.object_store();
+        let mut failed = vec![];
+        let mut error = None;
+        for file in unreferenced.files {
+            match object_store
+                .delete(&ObjPath::from(file.path.as_str()))
+                .await
+            {
+                Ok(()) | Err(object_store::Error::NotFound { .. }) => {
+                    summary.files_removed += 1;
+                    summary.rows_removed += file.row_count;
+                    summary.bytes_removed += file.size_bytes;
+                }
+                Err(e) => {
+                    error!(%e, path = %file.path, "error removing parquet file");
+                    failed.push(file);
+                    error = Some(e);
+                }
+            }
+        }
+        if let Some(e) = error {
+            self.segment_state
+                .write()
+                .return_unreferenced_files(UnreferencedFiles {
+                    segments: BTreeMap::new(),
+                    files: failed,
+                });
+            return Err(crate::persister::Error::from(e).into());
+        }
+
+        Ok(())
+    }
+
+    /// Removes the rows matching the delete predicates from the persisted parquet files of the
+    /// table, returning the paths of the files that are known to have no rows matching them.
+    /// Files that only have deleted rows are removed, and the others that have deleted rows are
+    /// rewritten without them.
+    async fn apply_deletes(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        deletes: &[DeletePredicate],
+        summary: &mut CompactionSummary,
+    ) -> Result<HashSet<String>> {
+        let files = {
+            let mut segment_state = self.segment_state.write();
+            segment_state.remove_deleted_files(db_name, table_name, deletes);
+            segment_state.files_overlapping_deletes(db_name, table_name, deletes)
+        };
+
+        let mut applied = HashSet::new();
+        for file in files {
+            let Some(batches) = self.remove_deleted_rows(&file, deletes).await? else {
+                applied.insert(file.path);
+                continue;
+            };
+            let rewrite = match batches.iter().map(RecordBatch::num_rows).sum::<usize>() {
+                0 => None,
+                row_count => Some(self.persist_rewrite(&file, batches, row_count).await?),
+            };
+            let rewrite_path = rewrite.as_ref().map(|rewrite| rewrite.path.clone());
+            let replaced = self
+                .segment_state
+                .write()
+                .replace_persisted_file(db_name, table_name, &file.path, rewrite);
+            if replaced {
+                summary.files_rewritten += rewrite_path.is_some() as usize;
+                applied.extend(rewrite_path);
+            }
+        }
+
+        Ok(applied)
+    }
+
+    /// Reads the persisted parquet file, returning the rows of it that do not match any of the
+    /// delete predicates, or `None` if none of its rows match
+    async fn remove_deleted_rows(
+        &self,
+        file: &ParquetFile,
+        deletes: &[DeletePredicate],
+    ) -> Result<Option<Vec<RecordBatch>>> {
+        let bytes = self
+            .persister
+            .object_store()
+            .get(&ObjPath::from(file.path.as_str()))
+            .await
+            .map_err(persister::Error::from)?
+            .bytes()
+            .await
+            .map_err(persister::Error::from)?;
+        let reader = ParquetRecordBatchReaderBuilder::try_new(bytes)
+            .and_then(|builder| builder.build())
+            .map_err(persister::Error::from)?;
+
+        let mut any_deleted = false;
+        let mut batches = vec![];
+        for batch in reader {
+            let batch = batch?;
+            let mut deleted = BooleanArray::from(vec![false; batch.num_rows()]);
+            for delete in deletes {
+                deleted = or(&deleted, &delete.matching_rows(&batch)?)?;
+            }
+            if deleted.true_count() == 0 {
+                batches.push(batch);
+                continue;
+            }
+            any_deleted = true;
+            batches.push(filter_record_batch(&batch, &not(&deleted)?)?);
+        }
+
+        Ok(any_deleted.then_some(batches))
+    }
+
+    /// Persists the rows kept from a persisted parquet file into a new file to replace it
+    async fn persist_rewrite(
+        &self,
+        file: &ParquetFile,
+        batches: Vec<RecordBatch>,
+        row_count: usize,
+    ) -> Result<ParquetFile> {
+        let times = batches
+            .iter()
+            .filter_map(|batch| batch.column_by_name(TIME_COLUMN_NAME))
+            .map(|time| time.as_primitive::<TimestampNanosecondType>())
+            .collect::<Vec<_>>();
+        let min_time = times.iter().filter_map(|time| min(*time)).min();
+        let max_time = times.iter().filter_map(|time| max(*time)).max();
+
+        let path =
+            ParquetFilePath::rewrite_of(&file.path, self.time_provider.now().timestamp_nanos());
+        let rewrite_path = path.to_string();
+        let schema = batches[0].schema();
+        let (size_bytes, _) = self
+            .persister
+            .persist_parquet_file(path, stream_from_batches(schema, batches))
+            .await?;
+
+        Ok(ParquetFile {
+            path: rewrite_path,
+            size_bytes,
+            row_count: row_count as u64,
+            min_time: min_time.unwrap_or(file.min_time),
+            max_time: max_time.unwrap_or(file.max_time),
+        })
+    }
+
     async fn write_lp(
         &self,
         db_name: NamespaceName<'static>,
@@ -176,7 +483,34 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
         precision: Precision,
     ) -> Result<BufferedWriteRequest> {
         debug!("write_lp to {} in writebuffer", db_name);
+        self.buffer_lp(db_name, lp, ingest_time, accept_partial, precision, true)
+            .await
+    }
+
+    async fn write_lp_no_sync(
+        &self,
+        db_name: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> Result<BufferedWriteRequest> {
+        debug!("write_lp_no_sync to {} in writebuffer", db_name);
+        self.buffer_lp(db_name, lp, ingest_time, accept_partial, precision, false)
+            .await
+    }
 
+    /// Validate the line protocol and update the catalog, then write it into the WAL and
+    /// buffer, waiting for that to complete only if `sync` is set
+    async fn buffer_lp(
+        &self,
+        db_name: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+        sync: bool,
+    ) -> Result<BufferedWriteRequest> {
         let result = parse_validate_and_update_catalog(
             db_name.clone(),
             lp,
@@ -185,11 +519,57 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
             self.segment_duration,
             accept_partial,
             precision,
+            true,
         )?;
 
-        self.write_buffer_flusher
-            .write_to_open_segment(result.valid_segmented_data)
-            .await?;
+        if sync {
+            self.write_buffer_flusher
+                .write_to_open_segment(result.valid_segmented_data)
+                .await?;
+        } else {
+            self.write_buffer_flusher
+                .queue_write_to_open_segment(result.valid_segmented_data)
+                .await;
+        }
+
+        Ok(BufferedWriteRequest {
+            db_name,
+            invalid_lines: result.errors,
+            line_count: result.line_count,
+            field_count: result.field_count,
+            tag_count: result.tag_count,
+        })
+    }
+
+    fn validate_lp(
+        &self,
+        db_name: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> Result<BufferedWriteRequest> {
+        debug!("validate_lp for {} in writebuffer", db_name);
+
+        let db = self
+            .catalog
+            .db_schema(db_name.as_str())
+            .unwrap_or_else(|| Arc::new(DatabaseSchema::new(db_name.as_str())));
+        let result = self.catalog.with_series(db_name.as_str(), |series| {
+            parse_validate_and_update_schema(
+                lp,
+                &db,
+                db_name.clone(),
+                Some(series),
+                ingest_time,
+                self.segment_duration,
+                accept_partial,
+                precision,
+                self.catalog.sequence_number(),
+            )
+        })?;
+        self.catalog
+            .check_limits(result.schema.as_ref().unwrap_or(&db))?;
 
         Ok(BufferedWriteRequest {
             db_name,
@@ -200,6 +580,41 @@ impl<W: Wal, T: TimeProvider> WriteBufferImpl<W, T> {
         })
     }
 
+    fn drop_database(&self, db_name: &str) -> Result<()> {
+        debug!("drop database {} in writebuffer", db_name);
+
+        // hold the segment state lock while updating the catalog so that no writes are buffered
+        // for the database in between the two:
+        self.segment_state.write().drop_database(db_name)
+    }
+
+    fn delete_rows(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        predicate: DeletePredicate,
+    ) -> Result<usize> {
+        debug!(
+            "delete rows from table {} in database {} in writebuffer: {:?}",
+            table_name, db_name, predicate
+        );
+
+        self.segment_state
+            .write()
+            .delete_rows(db_name, table_name, predicate)
+    }
+
+    fn rename_table(&self, db_name: &str, table_name: &str, new_name: &str) -> Result<()> {
+        debug!(
+            "rename table {} to {} in database {} in writebuffer",
+            table_name, new_name, db_name
+        );
+
+        self.segment_state
+            .write()
+            .rename_table(db_name, table_name, new_name)
+    }
+
     fn get_table_chunks(
         &self,
         database_name: &str,
@@ -394,6 +809,74 @@ impl<W: Wal, T: TimeProvider> Bufferer for WriteBufferImpl<W, T> {
             .await
     }
 
+    async fn write_lp_no_sync(
+        &self,
+        database: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> Result<BufferedWriteRequest> {
+        self.write_lp_no_sync(database, lp, ingest_time, accept_partial, precision)
+            .await
+    }
+
+    fn validate_lp(
+        &self,
+        database: NamespaceName<'static>,
+        lp: &str,
+        ingest_time: Time,
+        accept_partial: bool,
+        precision: Precision,
+    ) -> Result<BufferedWriteRequest> {
+        self.validate_lp(database, lp, ingest_time, accept_partial, precision)
+    }
+
+    fn drop_database(&self, database: &str) -> Result<()> {
+        self.drop_database(database)
+    }
+
+    fn rename_table(&self, database: &str, table_name: &str, new_name: &str) -> Result<()> {
+        self.rename_table(database, table_name, new_name)
+    }
+
+    fn set_retention_period(&self, database: &str, retention_period_ns: Option<i64>) -> Result<()> {
+        self.segment_state
+            .write()
+            .configure_database(database, |catalog| {
+                catalog.set_retention_period(database, retention_period_ns)
+            })
+    }
+
+    fn set_enforce_field_types(&self, database: &str, enforce_field_types: bool) -> Result<()> {
+        self.segment_state
+            .write()
+            .configure_database(database, |catalog| {
+                catalog.set_enforce_field_types(database, enforce_field_types)
+            })
+    }
+
+    fn set_max_series(&self, database: &str, max_series: usize) -> Result<()> {
+        self.segment_state
+            .write()
+            .configure_database(database, |catalog| {
+                catalog.set_max_series(database, max_series)
+            })
+    }
+
+    fn delete_rows(
+        &self,
+        database: &str,
+        table_name: &str,
+        predicate: DeletePredicate,
+    ) -> Result<usize> {
+        self.delete_rows(database, table_name, predicate)
+    }
+
+    async fn compact(&self) -> Result<CompactionSummary> {
+        self.compact().await
+    }
+
     fn wal(&self) -> Option<Arc<impl Wal>> {
         self.wal.clone()
     }
@@ -420,6 +903,11 @@ impl<W: Wal, T: TimeProvider> WriteBuffer for WriteBufferImpl<W, T> {}
 
 /// Returns a validated result and the sequence number of the catalog before any updates were
 /// applied.
+///
+/// The series written are recorded in the catalog, and if `enforce_series_limit` is set then
+/// lines that would take the database over its series limit are rejected. The limit is not
+/// enforced when replaying the WAL, as everything in it has already been accepted.
+#[allow(clippy::too_many_arguments)]
 pub(crate) fn parse_validate_and_update_catalog(
     db_name: NamespaceName<'static>,
     lp: &str,
@@ -428,35 +916,44 @@ pub(crate) fn parse_validate_and_update_catalog(
     segment_duration: SegmentDuration,
     accept_partial: bool,
     precision: Precision,
+    enforce_series_limit: bool,
 ) -> Result<ValidationResult> {
     let (sequence, db) = catalog.db_or_create(db_name.as_str())?;
-    let mut result = parse_validate_and_update_schema(
-        lp,
-        &db,
-        db_name,
-        ingest_time,
-        segment_duration,
-        accept_partial,
-        precision,
-        sequence,
-    )?;
+    let mut result = catalog.with_series(db_name.as_str(), |series| {
+        parse_validate_and_update_schema(
+            lp,
+            &db,
+            db_name.clone(),
+            enforce_series_limit.then_some(series),
+            ingest_time,
+            segment_duration,
+            accept_partial,
+            precision,
+            sequence,
+        )
+    })?;
 
     if let Some(schema) = result.schema.take() {
         debug!("replacing schema for {:?}", schema);
 
         catalog.replace_database(sequence, Arc::new(schema))?;
     }
+    catalog.add_series(db_name.as_str(), std::mem::take(&mut result.new_series));
 
     Ok(result)
 }
 
 /// Takes &str of line protocol, parses lines, validates the schema, and inserts new columns
 /// if present. Assigns the default time to any lines that do not include a time
+///
+/// If the keys of the series already written to the database are given, lines for new series
+/// that would take the database over its series limit are rejected.
 #[allow(clippy::too_many_arguments)]
 pub(crate) fn parse_validate_and_update_schema(
     lp: &str,
     schema: &DatabaseSchema,
     db_name: NamespaceName<'static>,
+    existing_series: Option<&HashSet<u64>>,
     ingest_time: Time,
     segment_duration: SegmentDuration,
     accept_partial: bool,
@@ -466,7 +963,8 @@ pub(crate) fn parse_validate_and_update_schema(
     let mut errors = vec![];
     let mut lp_lines = lp.lines();
 
-    let mut valid_parsed_and_raw_lines: Vec<(ParsedLine, &str)> = vec![];
+    let mut valid_parsed_and_raw_lines: Vec<(ParsedLine, &str, usize)> = vec![];
+    let mut new_series = HashSet::new();
 
     for (line_idx, maybe_line) in parse_lines(lp).enumerate() {
         let line = match maybe_line {
@@ -494,7 +992,34 @@ pub(crate) fn parse_validate_and_update_schema(
         };
         // This unwrap is fine because we're moving line by line
         // alongside the output from parse_lines
-        valid_parsed_and_raw_lines.push((line, lp_lines.next().unwrap()));
+        let raw_line = lp_lines.next().unwrap();
+
+        let key = series_key(&line);
+        if !new_series.contains(&key) && !existing_series.is_some_and(|s| s.contains(&key)) {
+            let series_count = existing_series.map_or(0, HashSet::len) + new_series.len();
+            if existing_series.is_some()
+                && schema.max_series > 0
+                && series_count >= schema.max_series
+            {
+                let error = WriteLineError {
+                    original_line: raw_line.to_string(),
+                    line_number: line_idx + 1,
+                    error_message: format!(
+                        "write would create a new series, exceeding the limit of {} series in \
+                        database {}",
+                        schema.max_series, db_name
+                    ),
+                };
+                if !accept_partial {
+                    return Err(Error::ParseError(error));
+                }
+                errors.push(error);
+                continue;
+            }
+            new_series.insert(key);
+        }
+
+        valid_parsed_and_raw_lines.push((line, raw_line, line_idx + 1));
     }
 
     validate_or_insert_schema_and_partitions(
@@ -503,25 +1028,58 @@ pub(crate) fn parse_validate_and_update_schema(
         db_name,
         ingest_time,
         segment_duration,
+        accept_partial,
         precision,
         starting_catalog_sequence_number,
     )
     .map(move |mut result| {
+        errors.append(&mut result.errors);
+        errors.sort_by_key(|e| e.line_number);
         result.errors = errors;
+        result.new_series = new_series;
         result
     })
 }
 
-/// Takes parsed lines, validates their schema. If new tables or columns are defined, they
-/// are passed back as a new DatabaseSchema as part of the ValidationResult. Lines are split
-/// into partitions and the validation result contains the data that can then be serialized
-/// into the WAL.
+/// The key that identifies the series of a line, made from its measurement and tag set, which
+/// does not depend on the order the tags are given in. The keys are persisted with the catalog,
+/// so they are hashed with a stable hash, each string being prefixed by its length.
+fn series_key(line: &ParsedLine<'_>) -> u64 {
+    let mut tags: Vec<(&str, &str)> = line
+        .series
+        .tag_set
+        .iter()
+        .flatten()
+        .map(|(k, v)| (k.as_str(), v.as_str()))
+        .collect();
+    tags.sort_unstable();
+
+    let mut hasher = Sha256::new();
+    let measurement = line.series.measurement.as_str();
+    for s in std::iter::once(measurement).chain(tags.into_iter().flat_map(|(k, v)| [k, v])) {
+        hasher.update((s.len() as u64).to_le_bytes());
+        hasher.update(s);
+    }
+    // the unwrap is safe here because the Sha256 digest will always be 32 bytes:
+    u64::from_le_bytes(hasher.finalize()[..8].try_into().unwrap())
+}
+
+/// Takes parsed lines, along with their line numbers, validates their schema. If new tables or
+/// columns are defined, they are passed back as a new DatabaseSchema as part of the
+/// ValidationResult. Lines are split into partitions and the validation result contains the data
+/// that can then be serialized into the WAL.
+///
+/// Lines with a column of a different type than it already has are invalid. If the database
+/// enforces field types, and partial writes are not accepted, they are rejected as a conflict
+/// with the existing type.
+#[allow(clippy::too_many_arguments)]
 pub(crate) fn validate_or_insert_schema_and_partitions(
-    lines: Vec<(ParsedLine<'_>, &str)>,
+    lines: Vec<(ParsedLine<'_>, &str, usize)>,
     schema: &DatabaseSchema,
     db_name: NamespaceName<'static>,
     ingest_time: Time,
     segment_duration: SegmentDuration,
+    accept_partial: bool,
     precision: Precision,
     starting_catalog_sequence_number: SequenceNumber,
 ) -> Result<ValidationResult> {
@@ -531,15 +1089,16 @@ pub(crate) fn validate_or_insert_schema_and_partitions(
     // The parsed and validated table_batches
     let mut segment_table_batches: HashMap<Time, TableBatchMap> = HashMap::new();
 
-    let line_count = lines.len();
+    let mut errors = vec![];
+    let mut line_count = 0;
     let mut field_count = 0;
     let mut tag_count = 0;
 
-    for (line, raw_line) in lines.into_iter() {
-        field_count += line.field_set.len();
-        tag_count += line.series.tag_set.as_ref().map(|t| t.len()).unwrap_or(0);
+    for (line, raw_line, line_number) in lines.into_iter() {
+        let line_field_count = line.field_set.len();
+        let line_tag_count = line.series.tag_set.as_ref().map(|t| t.len()).unwrap_or(0);
 
-        validate_and_convert_parsed_line(
+        match validate_and_convert_parsed_line(
             line,
             raw_line,
             &mut segment_table_batches,
@@ -547,7 +1106,29 @@ pub(crate) fn validate_or_insert_schema_and_partitions(
             ingest_time,
             segment_duration,
             precision,
-        )?;
+        ) {
+            Ok(()) => (),
+            Err(e @ Error::ColumnTypeMismatch { .. }) => {
+                if !accept_partial && schema.enforce_field_types {
+                    return Err(e);
+                }
+                let error = WriteLineError {
+                    original_line: raw_line.to_string(),
+                    line_number,
+                    error_message: e.to_string(),
+                };
+                if !accept_partial {
+                    return Err(Error::ParseError(error));
+                }
+                errors.push(error);
+                continue;
+            }
+            Err(e) => return Err(e),
+        }
+
+        line_count += 1;
+        field_count += line_field_count;
+        tag_count += line_tag_count;
     }
 
     let schema = match schema {
@@ -576,15 +1157,22 @@ pub(crate) fn validate_or_insert_schema_and_partitions(
         line_count,
         field_count,
         tag_count,
-        errors: vec![],
+        errors,
         valid_segmented_data,
+        new_series: HashSet::new(),
     })
 }
 
 /// Check if the table exists in the schema and update the schema if it does not
+///
+/// Lines with tags or fields that already exist in the table with a different type are
+/// rejected, without updating the schema.
 // Because the entry API requires &mut it is not used to avoid a premature
 // clone of the Cow.
-fn validate_and_update_schema(line: &ParsedLine<'_>, schema: &mut Cow<'_, DatabaseSchema>) {
+fn validate_and_update_schema(
+    line: &ParsedLine<'_>,
+    schema: &mut Cow<'_, DatabaseSchema>,
+) -> Result<()> {
     let table_name = line.series.measurement.as_str();
     match schema.tables.get(table_name) {
         Some(t) => {
@@ -592,14 +1180,31 @@ fn validate_and_update_schema(line: &ParsedLine<'_>, schema: &mut Cow<'_, Databa
             let mut new_cols = Vec::with_capacity(line.column_count() + 1);
             if let Some(tagset) = &line.series.tag_set {
                 for (tag_key, _) in tagset {
-                    if !t.column_exists(tag_key.as_str()) {
-                        new_cols.push((tag_key.to_string(), ColumnType::Tag as i16));
+                    match t.column_type(tag_key.as_str()) {
+                        None => new_cols.push((tag_key.to_string(), ColumnType::Tag as i16)),
+                        Some(ColumnType::Tag) => (),
+                        Some(existing) => {
+                            return Err(Error::ColumnTypeMismatch {
+                                name: tag_key.to_string(),
+                                existing,
+                                new: ColumnType::Tag,
+                            });
+                        }
                     }
                 }
             }
             for (field_name, value) in &line.field_set {
-                if !t.column_exists(field_name.as_str()) {
-                    new_cols.push((field_name.to_string(), column_type_from_field(value) as i16));
+                let new = column_type_from_field(value);
+                match t.column_type(field_name.as_str()) {
+                    None => new_cols.push((field_name.to_string(), new as i16)),
+                    Some(existing) if existing != new => {
+                        return Err(Error::ColumnTypeMismatch {
+                            name: field_name.to_string(),
+                            existing,
+                            new,
+                        });
+                    }
+                    Some(_) => (),
                 }
             }
 
@@ -630,6 +1235,8 @@ fn validate_and_update_schema(line: &ParsedLine<'_>, schema: &mut Cow<'_, Databa
                 .is_none());
         }
     };
+
+    Ok(())
 }
 
 fn validate_and_convert_parsed_line<'a>(
@@ -641,7 +1248,7 @@ fn validate_and_convert_parsed_line<'a>(
     segment_duration: SegmentDuration,
     precision: Precision,
 ) -> Result<()> {
-    validate_and_update_schema(&line, schema);
+    validate_and_update_schema(&line, schema)?;
 
     // now that we've ensured all columns exist in the schema, construct the actual row and values
     // while validating the column types match.
@@ -786,6 +1393,9 @@ pub(crate) struct ValidationResult {
     /// Only valid lines from what was passed in to validate, segmented based on the
     /// timestamps of the data.
     pub(crate) valid_segmented_data: Vec<ValidSegmentedData>,
+    /// The keys of the series written by the valid lines that were not already known to have
+    /// been written to the database
+    pub(crate) new_series: HashSet<u64>,
 }
 
 #[derive(Debug)]
@@ -833,8 +1443,9 @@ mod tests {
     use crate::wal::WalImpl;
     use crate::{SegmentId, SequenceNumber, WalOpBatch};
     use arrow::record_batch::RecordBatch;
-    use arrow_util::assert_batches_eq;
+    use arrow_util::{assert_batches_eq, assert_batches_sorted_eq};
     use datafusion_util::config::register_iox_object_store;
+    use futures_util::TryStreamExt;
     use iox_query::exec::IOxSessionContext;
     use iox_time::{MockProvider, Time};
     use object_store::memory::InMemory;
@@ -849,6 +1460,7 @@ mod tests {
             lp,
             &db,
             db_name,
+            None,
             Time::from_timestamp_nanos(0),
             SegmentDuration::new_5m(),
             false,
@@ -864,6 +1476,133 @@ mod tests {
         assert_eq!(db.tables.get("foo").unwrap().columns().len(), 2);
     }
 
+    #[test]
+    fn enforce_field_types() {
+        let catalog = Catalog::new();
+        let db_name = NamespaceName::new("foo").unwrap();
+        let write = |lp: &str, accept_partial: bool| {
+            parse_validate_and_update_catalog(
+                db_name.clone(),
+                lp,
+                &catalog,
+                Time::from_timestamp_nanos(0),
+                SegmentDuration::new_5m(),
+                accept_partial,
+                Precision::Nanosecond,
+                true,
+            )
+        };
+        let value_type = |table: &str| {
+            catalog
+                .db_schema("foo")
+                .unwrap()
+                .get_table(table)
+                .unwrap()
+                .column_type("value")
+        };
+
+        // lines with a field of a different type are always invalid, including when the type
+        // changes within the write:
+        write("cpu value=100i 1", false).unwrap();
+        let err = write("cpu value=\"foo\" 2", false).unwrap_err();
+        assert!(matches!(
+            err,
+            Error::ParseError(WriteLineError { line_number: 1, error_message, .. })
+                if error_message.contains("column value")
+        ));
+        let result = write(
+            "cpu,host=a value=200i 2\n\
+            mem value=1 1\n\
+            mem value=\"foo\" 2\n\
+            cpu value=true 3\n\
+            cpu,value=b usage=1 4",
+            true,
+        )
+        .unwrap();
+        assert_eq!(result.line_count, 2);
+        assert_eq!(
+            result
+                .errors
+                .iter()
+                .map(|e| e.line_number)
+                .collect::<Vec<_>>(),
+            vec![3, 4, 5]
+        );
+        assert_eq!(value_type("cpu"), Some(ColumnType::I64));
+        assert_eq!(value_type("mem"), Some(ColumnType::F64));
+
+        // enforcing field types rejects a write that is not partial as a conflict:
+        catalog.set_enforce_field_types("foo", true).unwrap();
+        write("cpu value=300i 5", false).unwrap();
+        let err = write("cpu value=\"foo\" 6", false).unwrap_err();
+        assert!(matches!(
+            err,
+            Error::ColumnTypeMismatch {
+                name,
+                existing: ColumnType::I64,
+                new: ColumnType::String,
+            } if name == "value"
+        ));
+        let result = write("cpu value=\"foo\" 6\ncpu value=400i 7", true).unwrap();
+        assert_eq!(result.line_count, 1);
+        assert_eq!(result.errors.len(), 1);
+        assert_eq!(value_type("cpu"), Some(ColumnType::I64));
+    }
+
+    #[test]
+    fn enforce_series_limit() {
+        let catalog = Catalog::new();
+        let db_name = NamespaceName::new("foo").unwrap();
+        let write = |lp: &str, accept_partial: bool| {
+            parse_validate_and_update_catalog(
+                db_name.clone(),
+                lp,
+                &catalog,
+                Time::from_timestamp_nanos(0),
+                SegmentDuration::new_5m(),
+                accept_partial,
+                Precision::Nanosecond,
+                true,
+            )
+        };
+
+        catalog.set_max_series("foo", 2).unwrap();
+        // the order of the tags does not make a different series:
+        write(
+            "cpu,host=a,region=west usage=1 1\n\
+            cpu,region=west,host=a usage=2 2\n\
+            mem,host=a used=1 1",
+            false,
+        )
+        .unwrap();
+        assert_eq!(catalog.series_count("foo"), 2);
+
+        let err = write("cpu,host=b,region=west usage=1 3", false).unwrap_err();
+        assert!(matches!(
+            err,
+            Error::ParseError(WriteLineError { line_number: 1, error_message, .. })
+                if error_message.contains("limit of 2 series")
+        ));
+
+        // existing series can still be written to, and only the new series is rejected when
+        // accepting partial writes:
+        let result = write(
+            "cpu,host=a,region=west usage=3 4\n\
+            cpu,host=c usage=1 4",
+            true,
+        )
+        .unwrap();
+        assert_eq!(result.line_count, 1);
+        assert_eq!(result.errors.len(), 1);
+        assert_eq!(result.errors[0].line_number, 2);
+        assert_eq!(catalog.series_count("foo"), 2);
+
+        // removing the limit allows new series again:
+        catalog.set_max_series("foo", 0).unwrap();
+        write("cpu,host=b,region=west usage=1 3", false).unwrap();
+        assert_eq!(catalog.series_count("foo"), 3);
+    }
+
     #[tokio::test]
     async fn buffers_and_persists_to_wal() {
         let dir = test_helpers::tmp_dir().unwrap().into_path();
@@ -936,51 +1675,508 @@ mod tests {
         assert_batches_eq!(&expected, &actual);
     }
 
-    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
-    async fn returns_chunks_across_buffered_persisted_and_persisting_data() {
+    #[tokio::test]
+    async fn drop_database_removes_buffered_data() {
         let dir = test_helpers::tmp_dir().unwrap().into_path();
         let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
         let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
         let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
         let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
-        let segment_duration = SegmentDuration::new_5m();
         let write_buffer = WriteBufferImpl::new(
             Arc::clone(&persister),
             wal.clone(),
             Arc::clone(&time_provider),
-            segment_duration,
+            SegmentDuration::new_5m(),
             crate::test_help::make_exec(),
         )
         .await
         .unwrap();
-        let session_context = IOxSessionContext::with_testing();
-        let runtime_env = session_context.inner().runtime_env();
-        register_iox_object_store(runtime_env, "influxdb3", Arc::clone(&object_store));
 
-        let _ = write_buffer
+        for db_name in ["foo", "bar"] {
+            write_buffer
+                .write_lp(
+                    NamespaceName::new(db_name).unwrap(),
+                    "cpu bar=1 10",
+                    Time::from_timestamp_nanos(123),
+                    false,
+                    Precision::Nanosecond,
+                )
+                .await
+                .unwrap();
+        }
+
+        write_buffer.drop_database("bar").unwrap();
+        write_buffer.drop_database("foo").unwrap();
+        assert!(write_buffer.catalog().db_schema("foo").is_none());
+        assert!(matches!(
+            write_buffer.drop_database("foo"),
+            Err(Error::CatalogUpdateError(
+                crate::catalog::Error::DatabaseNotFound { .. }
+            ))
+        ));
+
+        // re-creating the database should not bring back the dropped data:
+        write_buffer
             .write_lp(
                 NamespaceName::new("foo").unwrap(),
-                "cpu bar=1 10",
+                "cpu bar=2 20",
                 Time::from_timestamp_nanos(123),
                 false,
                 Precision::Nanosecond,
             )
             .await
             .unwrap();
-
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
         let expected = [
             "+-----+--------------------------------+",
             "| bar | time                           |",
             "+-----+--------------------------------+",
-            "| 1.0 | 1970-01-01T00:00:00.000000010Z |",
+            "| 2.0 | 1970-01-01T00:00:00.000000020Z |",
             "+-----+--------------------------------+",
         ];
-        let actual = get_table_batches(&write_buffer, "foo", "cpu", &session_context).await;
         assert_batches_eq!(&expected, &actual);
 
-        // advance the time and wait for it to persist
-        time_provider.set(Time::from_timestamp(800, 0).unwrap());
-        loop {
+        // the drops are replayed from the WAL after a restart, so the dropped data does not come
+        // back:
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            wal,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        assert_eq!(write_buffer.catalog().list_databases(), ["foo"]);
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        assert_batches_eq!(&expected, &actual);
+    }
+
+    #[tokio::test]
+    async fn delete_rows_removes_earlier_buffered_rows() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+
+        let write = |lp: &'static str| {
+            write_buffer.write_lp(
+                NamespaceName::new("foo").unwrap(),
+                lp,
+                Time::from_timestamp_nanos(123),
+                false,
+                Precision::Nanosecond,
+            )
+        };
+        write("cpu,host=a bar=1 10\ncpu,host=b bar=2 10")
+            .await
+            .unwrap();
+
+        let predicate = DeletePredicate {
+            min_time: i64::MIN,
+            max_time: i64::MAX,
+            tags: BTreeMap::from([("host".to_string(), "a".to_string())]),
+        };
+        assert_eq!(
+            write_buffer
+                .delete_rows("foo", "cpu", predicate.clone())
+                .unwrap(),
+            1
+        );
+        assert!(matches!(
+            write_buffer.delete_rows("bar", "cpu", predicate),
+            Err(Error::CatalogUpdateError(
+                crate::catalog::Error::DatabaseNotFound { .. }
+            ))
+        ));
+        // nothing has been persisted, so there is nothing for queries to filter out:
+        assert!(write_buffer
+            .catalog()
+            .db_schema("foo")
+            .unwrap()
+            .deletes
+            .is_empty());
+
+        // rows written after the delete are not deleted by it:
+        write("cpu,host=a bar=3 20").await.unwrap();
+        let expected = [
+            "+-----+------+--------------------------------+",
+            "| bar | host | time                           |",
+            "+-----+------+--------------------------------+",
+            "| 2.0 | b    | 1970-01-01T00:00:00.000000010Z |",
+            "| 3.0 | a    | 1970-01-01T00:00:00.000000020Z |",
+            "+-----+------+--------------------------------+",
+        ];
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        assert_batches_sorted_eq!(&expected, &actual);
+
+        // the delete is replayed from the WAL in the same order after a restart:
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            wal,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        assert_batches_sorted_eq!(&expected, &actual);
+    }
+
+    #[tokio::test]
+    async fn database_settings_are_replayed_after_restart() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+
+        write_buffer.set_enforce_field_types("foo", true).unwrap();
+        write_buffer.set_max_series("foo", 10).unwrap();
+        write_buffer
+            .set_retention_period("foo", Some(3_600_000_000_000))
+            .unwrap();
+        assert!(matches!(
+            write_buffer.set_retention_period("bar", None),
+            Err(Error::CatalogUpdateError(
+                crate::catalog::Error::DatabaseNotFound { .. }
+            ))
+        ));
+
+        // the catalog has not been persisted, so the settings are replayed from the WAL:
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            wal,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let db = write_buffer.catalog().db_schema("foo").unwrap();
+        assert!(db.enforce_field_types);
+        assert_eq!(db.max_series, 10);
+        assert_eq!(db.retention_period_ns, Some(3_600_000_000_000));
+        assert!(write_buffer.catalog().db_schema("bar").is_none());
+    }
+
+    #[tokio::test]
+    async fn rename_table_moves_buffered_data() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+
+        let write = |lp: &'static str| {
+            write_buffer.write_lp(
+                NamespaceName::new("foo").unwrap(),
+                lp,
+                Time::from_timestamp_nanos(123),
+                false,
+                Precision::Nanosecond,
+            )
+        };
+        write("cpu bar=1 10\nmem bar=1 10").await.unwrap();
+
+        write_buffer.rename_table("foo", "cpu", "cpu_old").unwrap();
+        let db = write_buffer.catalog().db_schema("foo").unwrap();
+        assert_eq!(db.table_names(), ["cpu_old", "mem"]);
+        assert_eq!(db.get_table("cpu_old").unwrap().name, "cpu_old");
+        let actual = write_buffer.get_table_record_batches("foo", "cpu_old");
+        let expected = [
+            "+-----+--------------------------------+",
+            "| bar | time                           |",
+            "+-----+--------------------------------+",
+            "| 1.0 | 1970-01-01T00:00:00.000000010Z |",
+            "+-----+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected, &actual);
+
+        // neither a missing table, nor an existing new name, can be renamed:
+        assert!(matches!(
+            write_buffer.rename_table("foo", "cpu", "cpu_new"),
+            Err(Error::CatalogUpdateError(
+                crate::catalog::Error::TableNotFound { .. }
+            ))
+        ));
+        assert!(matches!(
+            write_buffer.rename_table("foo", "cpu_old", "mem"),
+            Err(Error::CatalogUpdateError(
+                crate::catalog::Error::TableAlreadyExists { .. }
+            ))
+        ));
+
+        // writing to the old name creates a new table, without the renamed data:
+        write("cpu bar=2 20").await.unwrap();
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        let expected_cpu = [
+            "+-----+--------------------------------+",
+            "| bar | time                           |",
+            "+-----+--------------------------------+",
+            "| 2.0 | 1970-01-01T00:00:00.000000020Z |",
+            "+-----+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected_cpu, &actual);
+
+        // the rename is replayed from the WAL after a restart, so the data stays under the new
+        // name:
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            wal,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let db = write_buffer.catalog().db_schema("foo").unwrap();
+        assert_eq!(db.table_names(), ["cpu", "cpu_old", "mem"]);
+        let actual = write_buffer.get_table_record_batches("foo", "cpu_old");
+        assert_batches_eq!(&expected, &actual);
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        assert_batches_eq!(&expected_cpu, &actual);
+    }
+
+    #[tokio::test]
+    async fn enforce_retention_removes_expired_data() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let session_context = IOxSessionContext::with_testing();
+        let runtime_env = session_context.inner().runtime_env();
+        register_iox_object_store(runtime_env, "influxdb3", Arc::clone(&object_store));
+
+        // one row in the segment starting at 0, and one in the segment starting at 10m:
+        for db in ["foo", "bar"] {
+            write_buffer
+                .write_lp(
+                    NamespaceName::new(db).unwrap(),
+                    "cpu bar=1 10\ncpu bar=2 600000000000",
+                    Time::from_timestamp_nanos(0),
+                    false,
+                    Precision::Nanosecond,
+                )
+                .await
+                .unwrap();
+        }
+        write_buffer
+            .set_retention_period("foo", Some(60_000_000_000))
+            .unwrap();
+        // nothing is older than the retention period of 1m yet:
+        assert_eq!(write_buffer.enforce_retention().unwrap(), 0);
+
+        // advance the time and wait for the first segment to persist
+        time_provider.set(Time::from_timestamp(500, 0).unwrap());
+        loop {
+            let segment_state = write_buffer.segment_state.read();
+            if !segment_state.persisted_segments().is_empty() {
+                break;
+            }
+        }
+        assert_eq!(parquet_file_count(&object_store).await, 2);
+
+        // both the persisted segment, and the segment starting at 10m that is still open, are
+        // entirely older than the retention period:
+        time_provider.set(Time::from_timestamp(1000, 0).unwrap());
+        assert_eq!(write_buffer.enforce_retention().unwrap(), 2);
+        assert!(
+            get_table_batches(&write_buffer, "foo", "cpu", &session_context)
+                .await
+                .is_empty()
+        );
+
+        // the expired parquet file is removed from object storage:
+        let summary = write_buffer.remove_unreferenced().await.unwrap();
+        assert_eq!(summary.segments_rewritten, 1);
+        assert_eq!(summary.files_removed, 1);
+        assert_eq!(summary.rows_removed, 1);
+        assert_eq!(parquet_file_count(&object_store).await, 1);
+
+        // a database without a retention period keeps all of its data:
+        let expected = [
+            "+-----+--------------------------------+",
+            "| bar | time                           |",
+            "+-----+--------------------------------+",
+            "| 1.0 | 1970-01-01T00:00:00.000000010Z |",
+            "| 2.0 | 1970-01-01T00:10:00Z           |",
+            "+-----+--------------------------------+",
+        ];
+        let actual = get_table_batches(&write_buffer, "bar", "cpu", &session_context).await;
+        assert_batches_sorted_eq!(&expected, &actual);
+
+        // the expired data does not come back from the WAL, or the persisted segment, after a
+        // restart:
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            wal,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        assert!(
+            get_table_batches(&write_buffer, "foo", "cpu", &session_context)
+                .await
+                .is_empty()
+        );
+        let actual = get_table_batches(&write_buffer, "bar", "cpu", &session_context).await;
+        assert_batches_sorted_eq!(&expected, &actual);
+    }
+
+    #[tokio::test]
+    async fn validate_lp_does_not_write() {
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let write_buffer = WriteBufferImpl::new(
+            persister,
+            None::<Arc<WalImpl>>,
+            time_provider,
+            SegmentDuration::new_5m(),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let sequence = write_buffer.catalog().sequence_number();
+
+        let result = write_buffer
+            .validate_lp(
+                NamespaceName::new("foo").unwrap(),
+                "cpu,host=a bar=1 10\ncpu,host=a bar=\nmem used=1i 10",
+                Time::from_timestamp_nanos(123),
+                true,
+                Precision::Nanosecond,
+            )
+            .unwrap();
+        assert_eq!(result.line_count, 2);
+        assert_eq!(result.field_count, 2);
+        assert_eq!(result.tag_count, 1);
+        assert_eq!(result.invalid_lines.len(), 1);
+        assert_eq!(result.invalid_lines[0].line_number, 2);
+
+        // nothing was added to the catalog or buffered:
+        assert_eq!(write_buffer.catalog().sequence_number(), sequence);
+        assert!(write_buffer.catalog().db_schema("foo").is_none());
+        write_buffer
+            .write_lp(
+                NamespaceName::new("foo").unwrap(),
+                "cpu,host=a bar=2 20",
+                Time::from_timestamp_nanos(123),
+                false,
+                Precision::Nanosecond,
+            )
+            .await
+            .unwrap();
+        let actual = write_buffer.get_table_record_batches("foo", "cpu");
+        let expected = [
+            "+-----+------+--------------------------------+",
+            "| bar | host | time                           |",
+            "+-----+------+--------------------------------+",
+            "| 2.0 | a    | 1970-01-01T00:00:00.000000020Z |",
+            "+-----+------+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected, &actual);
+
+        // lines are rejected without partial writes being accepted:
+        assert!(matches!(
+            write_buffer.validate_lp(
+                NamespaceName::new("foo").unwrap(),
+                "cpu,host=a bar=",
+                Time::from_timestamp_nanos(123),
+                false,
+                Precision::Nanosecond,
+            ),
+            Err(Error::ParseError(_))
+        ));
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn returns_chunks_across_buffered_persisted_and_persisting_data() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let segment_duration = SegmentDuration::new_5m();
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            segment_duration,
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let session_context = IOxSessionContext::with_testing();
+        let runtime_env = session_context.inner().runtime_env();
+        register_iox_object_store(runtime_env, "influxdb3", Arc::clone(&object_store));
+
+        let _ = write_buffer
+            .write_lp(
+                NamespaceName::new("foo").unwrap(),
+                "cpu bar=1 10",
+                Time::from_timestamp_nanos(123),
+                false,
+                Precision::Nanosecond,
+            )
+            .await
+            .unwrap();
+
+        let expected = [
+            "+-----+--------------------------------+",
+            "| bar | time                           |",
+            "+-----+--------------------------------+",
+            "| 1.0 | 1970-01-01T00:00:00.000000010Z |",
+            "+-----+--------------------------------+",
+        ];
+        let actual = get_table_batches(&write_buffer, "foo", "cpu", &session_context).await;
+        assert_batches_eq!(&expected, &actual);
+
+        // advance the time and wait for it to persist
+        time_provider.set(Time::from_timestamp(800, 0).unwrap());
+        loop {
             let segment_state = write_buffer.segment_state.read();
             if !segment_state.persisted_segments().is_empty() {
                 break;
@@ -1057,6 +2253,140 @@ mod tests {
         assert_batches_eq!(&expected, &actual);
     }
 
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn compact_removes_deleted_persisted_data() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = Some(Arc::new(WalImpl::new(dir.clone()).unwrap()));
+        let object_store: Arc<dyn ObjectStore> = Arc::new(InMemory::new());
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let segment_duration = SegmentDuration::new_5m();
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal.clone(),
+            Arc::clone(&time_provider),
+            segment_duration,
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        let session_context = IOxSessionContext::with_testing();
+        let runtime_env = session_context.inner().runtime_env();
+        register_iox_object_store(runtime_env, "influxdb3", Arc::clone(&object_store));
+
+        for db in ["foo", "bar"] {
+            write_buffer
+                .write_lp(
+                    NamespaceName::new(db).unwrap(),
+                    "cpu bar=1 10\ncpu bar=2 20",
+                    Time::from_timestamp_nanos(123),
+                    false,
+                    Precision::Nanosecond,
+                )
+                .await
+                .unwrap();
+        }
+
+        // advance the time and wait for it to persist
+        time_provider.set(Time::from_timestamp(800, 0).unwrap());
+        loop {
+            let segment_state = write_buffer.segment_state.read();
+            if !segment_state.persisted_segments().is_empty() {
+                break;
+            }
+        }
+        assert_eq!(parquet_file_count(&object_store).await, 2);
+
+        // nothing has been deleted or dropped yet:
+        assert_eq!(
+            write_buffer.compact().await.unwrap(),
+            CompactionSummary::default()
+        );
+
+        // a delete that only covers part of the file has it rewritten without the deleted rows,
+        // after which the delete is no longer needed:
+        let delete = |min_time, max_time| DeletePredicate {
+            min_time,
+            max_time,
+            tags: Default::default(),
+        };
+        assert_eq!(
+            write_buffer
+                .delete_rows("foo", "cpu", delete(0, 15))
+                .unwrap(),
+            0
+        );
+        assert_eq!(
+            write_buffer
+                .catalog()
+                .db_schema("foo")
+                .unwrap()
+                .table_deletes("cpu"),
+            &[delete(10, 15)]
+        );
+        let summary = write_buffer.compact().await.unwrap();
+        assert_eq!(summary.segments_rewritten, 1);
+        assert_eq!(summary.files_rewritten, 1);
+        assert_eq!(summary.deletes_applied, 1);
+        assert_eq!(summary.files_removed, 1);
+        assert_eq!(summary.rows_removed, 2);
+        assert_eq!(parquet_file_count(&object_store).await, 2);
+        assert!(write_buffer
+            .catalog()
+            .db_schema("foo")
+            .unwrap()
+            .deletes
+            .is_empty());
+        let actual = get_table_batches(&write_buffer, "foo", "cpu", &session_context).await;
+        let expected = [
+            "+-----+--------------------------------+",
+            "| bar | time                           |",
+            "+-----+--------------------------------+",
+            "| 2.0 | 1970-01-01T00:00:00.000000020Z |",
+            "+-----+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected, &actual);
+
+        // a delete that covers all of the file has it removed:
+        write_buffer
+            .delete_rows("foo", "cpu", delete(0, 100))
+            .unwrap();
+        let summary = write_buffer.compact().await.unwrap();
+        assert_eq!(summary.segments_rewritten, 1);
+        assert_eq!(summary.files_rewritten, 0);
+        assert_eq!(summary.deletes_applied, 1);
+        assert_eq!(summary.files_removed, 1);
+        assert_eq!(summary.rows_removed, 1);
+        assert!(summary.bytes_removed > 0);
+        assert_eq!(parquet_file_count(&object_store).await, 1);
+        assert!(
+            get_table_batches(&write_buffer, "foo", "cpu", &session_context)
+                .await
+                .is_empty()
+        );
+
+        write_buffer.drop_database("bar").unwrap();
+        let summary = write_buffer.compact().await.unwrap();
+        assert_eq!(summary.files_removed, 1);
+        assert_eq!(parquet_file_count(&object_store).await, 0);
+
+        // the removed files are not loaded again after a restart:
+        let write_buffer = WriteBufferImpl::new(
+            Arc::clone(&persister),
+            wal,
+            Arc::clone(&time_provider),
+            segment_duration,
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+        assert!(
+            get_table_batches(&write_buffer, "foo", "cpu", &session_context)
+                .await
+                .is_empty()
+        );
+    }
+
     #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
     async fn sets_starting_catalog_number_on_new_segment() {
         let dir = test_helpers::tmp_dir().unwrap().into_path();
@@ -1113,6 +2443,15 @@ mod tests {
         );
     }
 
+    async fn parquet_file_count(object_store: &Arc<dyn ObjectStore>) -> usize {
+        object_store
+            .list(Some(&ObjPath::from("dbs")))
+            .try_collect::<Vec<_>>()
+            .await
+            .unwrap()
+            .len()
+    }
+
     async fn get_table_batches(
         write_buffer: &WriteBufferImpl<WalImpl, MockProvider>,
         database_name: &str,
@@ -1,12 +1,13 @@
 //! State for the write buffer segments.
 
-use crate::catalog::{Catalog, DatabaseSchema};
+use crate::catalog::{Catalog, DatabaseSchema, DeletePredicate};
 use crate::chunk::BufferChunk;
 use crate::wal::WalSegmentWriterNoopImpl;
 use crate::write_buffer::buffer_segment::{ClosedBufferSegment, OpenBufferSegment, WriteBatch};
 use crate::{
-    persister, wal, write_buffer, ParquetFile, PersistedSegment, Persister, SegmentDuration,
-    SegmentId, SegmentRange, SequenceNumber, Wal, WalOp,
+    catalog, persister, wal, write_buffer, DeleteOp, DropDatabaseOp, ExpireDataOp, ParquetFile,
+    PersistedSegment, Persister, RenameTableOp, SegmentDuration, SegmentId, SegmentRange,
+    SequenceNumber, Wal, WalOp,
 };
 use arrow::datatypes::SchemaRef;
 #[cfg(test)]
@@ -22,7 +23,7 @@ use observability_deps::tracing::error;
 use parking_lot::RwLock;
 #[cfg(test)]
 use schema::Schema;
-use std::collections::BTreeMap;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
 use std::sync::Arc;
 use std::time::Duration;
 use tokio::sync::watch;
@@ -42,7 +43,28 @@ pub(crate) struct SegmentState<T, W> {
     // start time that time.now falls into.
     segments: BTreeMap<Time, OpenBufferSegment>,
     persisting_segments: BTreeMap<Time, Arc<ClosedBufferSegment>>,
+    // The databases that have been dropped since the persisting segment with the id was closed,
+    // which are not returned for queries, and are removed from the segment once it is persisted.
+    dropped_persisting_databases: HashMap<SegmentId, HashSet<String>>,
+    // The tables that have been renamed since the persisting segment with the id was closed, in
+    // the order they were renamed, which are returned for queries under their new names, and are
+    // moved to be under them once the segment is persisted.
+    renamed_persisting_tables: HashMap<SegmentId, Vec<RenameTableOp>>,
     persisted_segments: BTreeMap<Time, Arc<PersistedSegment>>,
+    // Start times of the persisted segments that have had parquet files removed since their info
+    // file was last persisted, and the removed files, which are cleaned up by compaction.
+    compaction_segments: BTreeSet<Time>,
+    unreferenced_files: Vec<ParquetFile>,
+}
+
+/// Persisted data that has been removed from the segment state, but not yet from object storage
+#[derive(Debug, Default)]
+pub(crate) struct UnreferencedFiles {
+    /// The persisted segments that have had parquet files removed, keyed on their start time, as
+    /// they should now be persisted
+    pub(crate) segments: BTreeMap<Time, Arc<PersistedSegment>>,
+    /// The parquet files that are no longer referenced by any persisted segment
+    pub(crate) files: Vec<ParquetFile>,
 }
 
 impl<T: TimeProvider, W: Wal> SegmentState<T, W> {
@@ -83,7 +105,11 @@ impl<T: TimeProvider, W: Wal> SegmentState<T, W> {
             wal,
             segments,
             persisting_segments: persisting_segments_map,
+            dropped_persisting_databases: HashMap::new(),
+            renamed_persisting_tables: HashMap::new(),
             persisted_segments: persisted_segments_map,
+            compaction_segments: BTreeSet::new(),
+            unreferenced_files: vec![],
         }
     }
 
@@ -172,9 +198,23 @@ impl<T: TimeProvider, W: Wal> SegmentState<T, W> {
         }
 
         for persisting_segment in self.persisting_segments.values() {
-            if let Some(batch) = persisting_segment.buffered_data.table_record_batches(
+            if self
+                .dropped_persisting_databases
+                .get(&persisting_segment.segment_id)
+                .is_some_and(|db_names| db_names.contains(&db_schema.name))
+            {
+                continue;
+            }
+            let Some(segment_table_name) = self.persisting_table_name(
+                persisting_segment.segment_id,
                 &db_schema.name,
                 table_name,
+            ) else {
+                continue;
+            };
+            if let Some(batch) = persisting_segment.buffered_data.table_record_batches(
+                &db_schema.name,
+                segment_table_name,
                 Arc::clone(&arrow_schema),
                 filters,
             ) {
@@ -213,6 +253,644 @@ impl<T: TimeProvider, W: Wal> SegmentState<T, W> {
         Ok(chunks)
     }
 
+    /// Drops the database from the catalog, and removes all of its data from the segments.
+    ///
+    /// The drop is written to the WAL of each open segment, and the data that they buffer is
+    /// removed. Persisting segments can not be changed, so their data for the database is no
+    /// longer returned for queries, and is removed once they are persisted. The references to
+    /// the persisted parquet files are dropped, and the files are removed from object storage by
+    /// the next compaction.
+    pub(crate) fn drop_database(&mut self, db_name: &str) -> write_buffer::Result<()> {
+        // the segment for the current time is opened before the catalog is updated, so that the
+        // catalog is persisted along with it, and it holds the drop in its WAL until then:
+        let current_segment = self
+            .segment_duration
+            .start_time(self.time_provider.now().timestamp());
+        self.get_or_create_segment_for_time(current_segment, self.catalog.sequence_number())?;
+        self.catalog.drop_database(db_name)?;
+
+        let mut segment_ids = vec![];
+        for segment in self.persisting_segments.values() {
+            if segment.buffered_data.contains_database(db_name) {
+                self.dropped_persisting_databases
+                    .entry(segment.segment_id)
+                    .or_default()
+                    .insert(db_name.to_string());
+                segment_ids.push(segment.segment_id);
+            }
+        }
+        segment_ids.extend(
+            self.persisted_segments
+                .values()
+                .filter(|segment| segment.databases.contains_key(db_name))
+                .map(|segment| segment.segment_id),
+        );
+        self.remove_persisted_files(db_name, None, |_| true);
+
+        let drop = DropDatabaseOp {
+            db_name: db_name.to_string(),
+            catalog_sequence_number: self.catalog.sequence_number(),
+            segment_ids,
+        };
+        for segment in self.segments.values_mut() {
+            segment.write_drop_database(drop.clone())?;
+        }
+
+        Ok(())
+    }
+
+    /// Applies a drop of a database replayed from the WAL to the persisting and persisted
+    /// segments that had data for the database when it was dropped, as they do not have the drop
+    /// in their own WAL
+    pub(crate) fn replay_drop_database(&mut self, drop: &DropDatabaseOp) {
+        for segment in self.persisting_segments.values() {
+            if drop.segment_ids.contains(&segment.segment_id) {
+                self.dropped_persisting_databases
+                    .entry(segment.segment_id)
+                    .or_default()
+                    .insert(drop.db_name.clone());
+            }
+        }
+
+        let start_times = self
+            .persisted_segments
+            .iter()
+            .filter(|(_, segment)| drop.segment_ids.contains(&segment.segment_id))
+            .map(|(start_time, _)| *start_time)
+            .collect::<Vec<_>>();
+        for start_time in start_times {
+            self.remove_persisted_database(start_time, &drop.db_name);
+        }
+    }
+
+    /// Removes the persisted parquet files of the database from the persisted segment with the
+    /// given start time. The files are removed from object storage by the next compaction.
+    fn remove_persisted_database(&mut self, start_time: Time, db_name: &str) {
+        let Some(segment) = self.persisted_segments.get_mut(&start_time) else {
+            return;
+        };
+        if !segment.databases.contains_key(db_name) {
+            return;
+        }
+        let segment = Arc::make_mut(segment);
+        let db = segment
+            .databases
+            .remove(db_name)
+            .expect("database persisted");
+        for file in db
+            .tables
+            .into_values()
+            .flat_map(|table| table.parquet_files)
+        {
+            segment.segment_row_count -= file.row_count;
+            segment.segment_parquet_size_bytes -= file.size_bytes;
+            self.unreferenced_files.push(file);
+        }
+        self.compaction_segments.insert(start_time);
+    }
+
+    /// Renames the table in the catalog, and moves its data in the segments to be under the new
+    /// name.
+    ///
+    /// The rename is written to the WAL of each open segment, and the data that they buffer for
+    /// the table is moved. Persisting segments can not be changed, so their data for the table is
+    /// returned for queries under the new name, and is moved once they are persisted. The
+    /// persisted segments are rewritten with the new name by the next compaction.
+    pub(crate) fn rename_table(
+        &mut self,
+        db_name: &str,
+        table_name: &str,
+        new_name: &str,
+    ) -> write_buffer::Result<()> {
+        // as with dropping a database, the segment for the current time is opened before the
+        // catalog is updated, so that it holds the rename in its WAL until the catalog is
+        // persisted:
+        let current_segment = self
+            .segment_duration
+            .start_time(self.time_provider.now().timestamp());
+        self.get_or_create_segment_for_time(current_segment, self.catalog.sequence_number())?;
+        self.catalog.rename_table(db_name, table_name, new_name)?;
+
+        let mut persisting_segment_ids = vec![];
+        for segment in self.persisting_segments.values() {
+            if self
+                .persisting_table_name(segment.segment_id, db_name, table_name)
+                .is_some_and(|name| segment.buffered_data.contains_table(db_name, name))
+            {
+                persisting_segment_ids.push(segment.segment_id);
+            }
+        }
+        let persisted_segments = self
+            .persisted_segments
+            .iter()
+            .filter(|(_, segment)| {
+                segment
+                    .databases
+                    .get(db_name)
+                    .is_some_and(|db| db.tables.contains_key(table_name))
+            })
+            .map(|(start_time, segment)| (*start_time, segment.segment_id))
+            .collect::<Vec<_>>();
+
+        let rename = RenameTableOp {
+            db_name: db_name.to_string(),
+            table_name: table_name.to_string(),
+            new_name: new_name.to_string(),
+            segment_ids: persisting_segment_ids
+                .iter()
+                .copied()
+                .chain(persisted_segments.iter().map(|(_, segment_id)| *segment_id))
+                .collect(),
+        };
+        for segment_id in persisting_segment_ids {
+            self.renamed_persisting_tables
+                .entry(segment_id)
+                .or_default()
+                .push(rename.clone());
+        }
+        for (start_time, _) in persisted_segments {
+            self.rename_persisted_table(start_time, &rename);
+        }
+        for segment in self.segments.values_mut() {
+            segment.write_rename_table(rename.clone())?;
+        }
+
+        Ok(())
+    }
+
+    /// Changes the settings of the database in the catalog with `configure`, then writes all of
+    /// its settings into the WAL of each open segment, so that the change is replayed if the
+    /// server restarts before the catalog is persisted.
+    pub(crate) fn configure_database(
+        &mut self,
+        db_name: &str,
+        configure: impl FnOnce(&Catalog) -> catalog::Result<()>,
+    ) -> write_buffer::Result<()> {
+        // as with dropping a database, the segment for the current time is opened before the
+        // catalog is updated, so that it holds the change in its WAL until the catalog is
+        // persisted:
+        let current_segment = self
+            .segment_duration
+            .start_time(self.time_provider.now().timestamp());
+        self.get_or_create_segment_for_time(current_segment, self.catalog.sequence_number())?;
+        configure(&self.catalog)?;
+
+        let settings = self
+            .catalog
+            .database_settings(db_name)
+            .expect("configured database exists");
+        for segment in self.segments.values_mut() {
+            segment.write_wal_ops(vec![WalOp::ConfigureDatabase(settings.clone())])?;
+        }
+
+        Ok(())
+    }
+
+    /// Applies a rename of a table replayed from the WAL to the persisting and persisted segments
+    /// that had data for the table when it was renamed, as they do not have the rename in their
+    /// own WAL. The same rename is replayed from the WAL of each segment that was open at the
+    /// time, but is only applied once.
+    pub(crate) fn replay_rename_table(&mut self, rename: &RenameTableOp) {
+        for segment in self.persisting_segments.values() {
+            if !rename.segment_ids.contains(&segment.segment_id) {
+                continue;
+            }
+            let renames = self
+                .renamed_persisting_tables
+                .entry(segment.segment_id)
+                .or_default();
+            if !renames.contains(rename) {
+                renames.push(rename.clone());
+            }
+        }
+
+        let start_times = self
+            .persisted_segments
+            .iter()
+            .filter(|(_, segment)| rename.segment_ids.contains(&segment.segment_id))
+            .map(|(start_time, _)| *start_time)
+            .collect::<Vec<_>>();
+        for start_time in start_times {
+            self.rename_persisted_table(start_time, rename);
+        }
+    }
+
+    /// The name of the given table in the data of the persisting segment with the given id, which
+    /// is different if the table was renamed since the segment was closed, or `None` if the
+    /// table was renamed away from the name since then, so none of its data is in the segment
+    fn persisting_table_name<'a>(
+        &'a self,
+        segment_id: SegmentId,
+        db_name: &str,
+        table_name: &'a str,
+    ) -> Option<&'a str> {
+        let mut name = table_name;
+        let renames = self.renamed_persisting_tables.get(&segment_id);
+        for rename in renames.into_iter().flatten().rev() {
+            if rename.db_name != db_name {
+                continue;
+            }
+            if rename.new_name == name {
+                name = &rename.table_name;
+            } else if rename.table_name == name {
+                return None;
+            }
+        }
+        Some(name)
+    }
+
+    /// Moves the persisted parquet files of the renamed table in the persisted segment with the
+    /// given start time to be under its new name. The segment is rewritten with the new name by
+    /// the next compaction.
+    fn rename_persisted_table(&mut self, start_time: Time, rename: &RenameTableOp) {
+        let Some(segment) = self.persisted_segments.get_mut(&start_time) else {
+            return;
+        };
+        if !segment
+            .databases
+            .get(&rename.db_name)
+            .is_some_and(|db| db.tables.contains_key(&rename.table_name))
+        {
+            return;
+        }
+        let db = Arc::make_mut(segment)
+            .databases
+            .get_mut(&rename.db_name)
+            .expect("database persisted");
+        let mut table = db
+            .tables
+            .remove(&rename.table_name)
+            .expect("table persisted");
+        table.table_name = rename.new_name.clone();
+        db.tables.insert(rename.new_name.clone(), table);
+        self.compaction_segments.insert(start_time);
+    }
+
+    /// Removes the data for the given database that is entirely older than `cutoff_time_ns`.
+    /// Returns the number of rows removed.
+    ///
+    /// Open segments have the database's data dropped once the whole segment range is older than
+    /// the cutoff, which is written to their WAL so that it is not replayed. Persisting segments
+    /// in the same range have it dropped once they are persisted, as with dropping a database, and
+    /// persisted parquet files are dropped once their max time is older than the cutoff, to be
+    /// removed from object storage along with the other unreferenced files.
+    ///
+    /// Rows older than the cutoff that share a segment or file with newer rows are left in place,
+    /// and must be filtered out at query time.
+    pub(crate) fn expire_database_data(
+        &mut self,
+        db_name: &str,
+        cutoff_time_ns: i64,
+    ) -> write_buffer::Result<u64> {
+        let expired = |range: &SegmentRange| {
+            !range.contains_data_outside_range && range.end_time.timestamp_nanos() <= cutoff_time_ns
+        };
+        let mut rows_removed = 0;
+
+        for segment in self.segments.values_mut() {
+            if expired(segment.segment_range()) && segment.contains_database(db_name) {
+                rows_removed += segment.write_expire_data(ExpireDataOp {
+                    db_name: db_name.to_string(),
+                    cutoff_time_ns,
+                })? as u64;
+            }
+        }
+
+        for segment in self.persisting_segments.values() {
+            if expired(&segment.segment_range)
+                && segment.buffered_data.contains_database(db_name)
+                && self
+                    .dropped_persisting_databases
+                    .entry(segment.segment_id)
+                    .or_default()
+                    .insert(db_name.to_string())
+            {
+                rows_removed += segment.buffered_data.database_row_count(db_name) as u64;
+            }
+        }
+
+        rows_removed +=
+            self.remove_persisted_files(db_name, None, |file| file.max_time < cutoff_time_ns);
+
+        Ok(rows_removed)
+    }
+
+    /// Deletes the rows of a table in the database that match the predicate, returning the
+    /// number of buffered rows removed.
+    ///
+    /// The delete is written to the WAL of each open segment, and the rows that they buffer are
+    /// removed. The rows that are being persisted, or have been persisted, can not be removed
+    /// straight away, so the predicate is recorded in the catalog for the time ranges of that
+    /// data, and those rows are filtered out of queries until compaction removes them. Rows
+    /// written after the delete outside of those time ranges are unaffected by it.
+    pub(crate) fn delete_rows(
+        &mut self,
+        db_name: &str,
+        table_name: &str,
+        predicate: DeletePredicate,
+    ) -> write_buffer::Result<usize> {
+        if self.catalog.db_schema(db_name).is_none() {
+            return Err(catalog::Error::DatabaseNotFound {
+                db_name: db_name.to_string(),
+            }
+            .into());
+        }
+
+        // the segment for the current time is opened before the catalog is updated, so that the
+        // recorded predicates are persisted along with it, and it holds the delete in its WAL
+        // until then:
+        let current_segment = self
+            .segment_duration
+            .start_time(self.time_provider.now().timestamp());
+        self.get_or_create_segment_for_time(current_segment, self.catalog.sequence_number())?;
+
+        let persisted_predicates = self
+            .persisted_time_ranges(db_name, table_name)
+            .into_iter()
+            .filter_map(|(min_time, max_time)| {
+                let min_time = min_time.max(predicate.min_time);
+                let max_time = max_time.min(predicate.max_time);
+                (min_time <= max_time).then(|| DeletePredicate {
+                    min_time,
+                    max_time,
+                    tags: predicate.tags.clone(),
+                })
+            })
+            .collect::<Vec<_>>();
+        for persisted_predicate in &persisted_predicates {
+            self.catalog
+                .add_delete(db_name, table_name, persisted_predicate.clone())?;
+        }
+
+        let delete = DeleteOp {
+            db_name: db_name.to_string(),
+            table_name: table_name.to_string(),
+            predicate,
+            persisted_predicates,
+        };
+        let mut rows_deleted = 0;
+        for segment in self.segments.values_mut() {
+            rows_deleted += segment.delete_rows(delete.clone())?;
+        }
+
+        Ok(rows_deleted)
+    }
+
+    /// The time ranges of the rows of the table that are being persisted or have been persisted,
+    /// with overlapping ranges merged
+    fn persisted_time_ranges(&self, db_name: &str, table_name: &str) -> Vec<(i64, i64)> {
+        let mut ranges = self
+            .persisting_segments
+            .values()
+            .filter_map(|segment| {
+                let table_name =
+                    self.persisting_table_name(segment.segment_id, db_name, table_name)?;
+                segment
+                    .buffered_data
+                    .table_timestamp_min_max(db_name, table_name)
+            })
+            .map(|min_max| (min_max.min, min_max.max))
+            .chain(
+                self.persisted_files(db_name, table_name)
+                    .map(|file| (file.min_time, file.max_time)),
+            )
+            .collect::<Vec<_>>();
+        ranges.sort_unstable();
+
+        let mut merged: Vec<(i64, i64)> = Vec::with_capacity(ranges.len());
+        for (min_time, max_time) in ranges {
+            match merged.last_mut() {
+                Some((_, last_max_time)) if min_time <= last_max_time.saturating_add(1) => {
+                    *last_max_time = max_time.max(*last_max_time);
+                }
+                _ => merged.push((min_time, max_time)),
+            }
+        }
+        merged
+    }
+
+    fn persisted_files<'a>(
+        &'a self,
+        db_name: &'a str,
+        table_name: &'a str,
+    ) -> impl Iterator<Item = &'a ParquetFile> + 'a {
+        self.persisted_segments
+            .values()
+            .filter_map(move |segment| segment.databases.get(db_name)?.tables.get(table_name))
+            .flat_map(|table| &table.parquet_files)
+    }
+
+    /// Returns the persisted parquet files of the given table that could have rows matching one
+    /// of the given predicates
+    pub(crate) fn files_overlapping_deletes(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        deletes: &[DeletePredicate],
+    ) -> Vec<ParquetFile> {
+        self.persisted_files(db_name, table_name)
+            .filter(|file| overlaps_deletes(deletes, file.min_time, file.max_time))
+            .cloned()
+            .collect()
+    }
+
+    /// Returns true if the only persisting or persisted data of the given table that could have
+    /// rows matching one of the given predicates is in the files at the `applied` paths, which
+    /// have had those rows removed, so that the predicates are no longer needed
+    pub(crate) fn deletes_applied(
+        &self,
+        db_name: &str,
+        table_name: &str,
+        deletes: &[DeletePredicate],
+        applied: &HashSet<String>,
+    ) -> bool {
+        let persisting = self.persisting_segments.values().any(|segment| {
+            self.persisting_table_name(segment.segment_id, db_name, table_name)
+                .and_then(|table_name| {
+                    segment
+                        .buffered_data
+                        .table_timestamp_min_max(db_name, table_name)
+                })
+                .is_some_and(|min_max| overlaps_deletes(deletes, min_max.min, min_max.max))
+        });
+        !persisting
+            && self
+                .files_overlapping_deletes(db_name, table_name, deletes)
+                .iter()
+                .all(|file| applied.contains(&file.path))
+    }
+
+    /// Replaces the persisted parquet file of the given table at `path` with a rewrite of it, or
+    /// removes it if the rewrite has no rows, returning false if the file is no longer persisted.
+    /// The replaced file is removed from object storage by the next compaction, as is the
+    /// rewrite if it could not replace the file.
+    pub(crate) fn replace_persisted_file(
+        &mut self,
+        db_name: &str,
+        table_name: &str,
+        path: &str,
+        rewrite: Option<ParquetFile>,
+    ) -> bool {
+        let start_time = self
+            .persisted_segments
+            .iter()
+            .find_map(|(start_time, segment)| {
+                segment
+                    .databases
+                    .get(db_name)?
+                    .tables
+                    .get(table_name)?
+                    .parquet_files
+                    .iter()
+                    .any(|file| file.path == path)
+                    .then_some(*start_time)
+            });
+        let Some(start_time) = start_time else {
+            self.unreferenced_files.extend(rewrite);
+            return false;
+        };
+
+        let segment = Arc::make_mut(
+            self.persisted_segments
+                .get_mut(&start_time)
+                .expect("segment is persisted"),
+        );
+        let db = segment
+            .databases
+            .get_mut(db_name)
+            .expect("database persisted");
+        let table = db.tables.get_mut(table_name).expect("table persisted");
+        let index = table
+            .parquet_files
+            .iter()
+            .position(|file| file.path == path)
+            .expect("file persisted");
+        let replaced = match rewrite {
+            Some(rewrite) => {
+                segment.segment_row_count += rewrite.row_count;
+                segment.segment_parquet_size_bytes += rewrite.size_bytes;
+                std::mem::replace(&mut table.parquet_files[index], rewrite)
+            }
+            None => table.parquet_files.remove(index),
+        };
+        if table.parquet_files.is_empty() {
+            db.tables.remove(table_name);
+        }
+        if db.tables.is_empty() {
+            segment.databases.remove(db_name);
+        }
+        segment.segment_row_count -= replaced.row_count;
+        segment.segment_parquet_size_bytes -= replaced.size_bytes;
+        self.unreferenced_files.push(replaced);
+        self.compaction_segments.insert(start_time);
+
+        true
+    }
+
+    /// Removes the persisted parquet files of the given table that only contain rows deleted by
+    /// one of the given predicates, returning the number of rows removed. Only predicates without
+    /// tags can be known to match every row of a file.
+    pub(crate) fn remove_deleted_files(
+        &mut self,
+        db_name: &str,
+        table_name: &str,
+        deletes: &[DeletePredicate],
+    ) -> u64 {
+        let deletes = deletes
+            .iter()
+            .filter(|delete| delete.tags.is_empty())
+            .collect::<Vec<_>>();
+        if deletes.is_empty() {
+            return 0;
+        }
+
+        self.remove_persisted_files(db_name, Some(table_name), |file| {
+            deletes
+                .iter()
+                .any(|delete| delete.min_time <= file.min_time && file.max_time <= delete.max_time)
+        })
+    }
+
+    /// Removes the persisted parquet files of the database, or only of the given table, for which
+    /// `remove` returns true, returning the number of rows removed. The files are removed from
+    /// object storage by the next compaction.
+    fn remove_persisted_files(
+        &mut self,
+        db_name: &str,
+        table_name: Option<&str>,
+        remove: impl Fn(&ParquetFile) -> bool,
+    ) -> u64 {
+        let mut rows_removed = 0;
+
+        for (start_time, segment) in self.persisted_segments.iter_mut() {
+            let matches = segment.databases.get(db_name).is_some_and(|db| {
+                db.tables
+                    .iter()
+                    .filter(|(name, _)| table_name.map_or(true, |t| t == name.as_str()))
+                    .any(|(_, table)| table.parquet_files.iter().any(&remove))
+            });
+            if !matches {
+                continue;
+            }
+
+            let segment = Arc::make_mut(segment);
+            let Some(db) = segment.databases.get_mut(db_name) else {
+                continue;
+            };
+            let mut segment_rows_removed = 0;
+            let mut segment_bytes_removed = 0;
+            for (name, table) in db.tables.iter_mut() {
+                if table_name.is_some_and(|t| t != name.as_str()) {
+                    continue;
+                }
+                let (removed, kept) = std::mem::take(&mut table.parquet_files)
+                    .into_iter()
+                    .partition::<Vec<_>, _>(&remove);
+                table.parquet_files = kept;
+                for file in removed {
+                    segment_rows_removed += file.row_count;
+                    segment_bytes_removed += file.size_bytes;
+                    self.unreferenced_files.push(file);
+                }
+            }
+            db.tables.retain(|_, table| !table.parquet_files.is_empty());
+            if db.tables.is_empty() {
+                segment.databases.remove(db_name);
+            }
+            segment.segment_row_count -= segment_rows_removed;
+            segment.segment_parquet_size_bytes -= segment_bytes_removed;
+            self.compaction_segments.insert(*start_time);
+            rows_removed += segment_rows_removed;
+        }
+
+        rows_removed
+    }
+
+    /// Takes the persisted segments and parquet files that need to be cleaned up since the last
+    /// compaction. If the clean up fails, they should be handed back with
+    /// [`Self::return_unreferenced_files`] so that it can be retried.
+    pub(crate) fn take_unreferenced_files(&mut self) -> UnreferencedFiles {
+        let segments = std::mem::take(&mut self.compaction_segments)
+            .into_iter()
+            .filter_map(|start_time| {
+                let segment = self.persisted_segments.get(&start_time)?;
+                Some((start_time, Arc::clone(segment)))
+            })
+            .collect();
+        UnreferencedFiles {
+            segments,
+            files: std::mem::take(&mut self.unreferenced_files),
+        }
+    }
+
+    /// Hands back persisted segments and parquet files that could not be cleaned up, so that the
+    /// next compaction retries them
+    pub(crate) fn return_unreferenced_files(&mut self, unreferenced: UnreferencedFiles) {
+        self.compaction_segments
+            .extend(unreferenced.segments.into_keys());
+        self.unreferenced_files.extend(unreferenced.files);
+    }
+
     pub(crate) fn get_parquet_files(
         &self,
         database_name: &str,
@@ -329,6 +1007,13 @@ impl<T: TimeProvider, W: Wal> SegmentState<T, W> {
     }
 }
 
+/// Returns true if the time range from `min_time` to `max_time` overlaps one of the predicates
+fn overlaps_deletes(deletes: &[DeletePredicate], min_time: i64, max_time: i64) -> bool {
+    deletes
+        .iter()
+        .any(|delete| delete.min_time <= max_time && min_time <= delete.max_time)
+}
+
 #[cfg(test)]
 const PERSISTER_CHECK_INTERVAL: Duration = Duration::from_millis(10);
 
@@ -432,8 +1117,12 @@ where
 
 // Performs the following:
 // 1. persist the segment to the object store
-// 2. remove the segment from the persisting_segments map and add it to the persisted_segments map
-// 3. remove the wal segment file
+// 2. remove the segment from the persisting_segments map and add it to the persisted_segments map,
+//    with any tables renamed while it was persisting under their new names, and without the data
+//    of any database dropped while it was persisting
+// 3. persist the persisted segments that have had data removed, so that the removal does not
+//    depend on a drop in the wal
+// 4. remove the wal segment file
 async fn persist_closed_segment_and_cleanup<P, T, W>(
     closed_segment: Arc<ClosedBufferSegment>,
     persister: Arc<P>,
@@ -450,9 +1139,11 @@ where
 {
     let closed_segment_start_time = closed_segment.segment_range.start_time;
     let closed_segment_id = closed_segment.segment_id;
-    let persisted_segment = closed_segment.persist(persister, executor, None).await?;
+    let persisted_segment = closed_segment
+        .persist(Arc::clone(&persister), executor, None)
+        .await?;
 
-    {
+    let changed_segments = {
         let mut segment_state = segment_state.write();
         segment_state
             .persisting_segments
@@ -460,6 +1151,34 @@ where
         segment_state
             .persisted_segments
             .insert(closed_segment_start_time, Arc::new(persisted_segment));
+        if let Some(renames) = segment_state
+            .renamed_persisting_tables
+            .remove(&closed_segment_id)
+        {
+            for rename in renames {
+                segment_state.rename_persisted_table(closed_segment_start_time, &rename);
+            }
+        }
+        if let Some(db_names) = segment_state
+            .dropped_persisting_databases
+            .remove(&closed_segment_id)
+        {
+            for db_name in db_names {
+                segment_state.remove_persisted_database(closed_segment_start_time, &db_name);
+            }
+        }
+        segment_state
+            .compaction_segments
+            .iter()
+            .filter_map(|start_time| segment_state.persisted_segments.get(start_time).cloned())
+            .collect::<Vec<_>>()
+    };
+
+    for segment in changed_segments {
+        persister
+            .persist_segment(&segment)
+            .await
+            .map_err(write_buffer::Error::from)?;
     }
 
     if let Some(wal) = wal {
@@ -656,6 +1375,206 @@ mod tests {
         assert_eq!(deleted_segments, vec![SegmentId::new(1), SegmentId::new(2)]);
     }
 
+    #[tokio::test]
+    async fn drop_database_removes_persisting_data_once_persisted() {
+        let catalog = Arc::new(Catalog::new());
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp(300, 0).unwrap()));
+        let segment_duration = SegmentDuration::new_5m();
+
+        let mut closed_segment = OpenBufferSegment::new(
+            Arc::clone(&catalog),
+            SegmentId::new(1),
+            SegmentRange::from_time_and_duration(
+                Time::from_timestamp_nanos(0),
+                segment_duration,
+                false,
+            ),
+            time_provider.now(),
+            catalog.sequence_number(),
+            Box::new(WalSegmentWriterNoopImpl::new(SegmentId::new(1))),
+            None,
+        );
+        for db_name in ["foo", "bar"] {
+            closed_segment
+                .buffer_writes(lp_to_write_batch(&catalog, db_name, "cpu bar=1 10"))
+                .unwrap();
+        }
+        let closed_segment = closed_segment.into_closed_segment(Arc::clone(&catalog));
+
+        let open_segment = OpenBufferSegment::new(
+            Arc::clone(&catalog),
+            SegmentId::new(2),
+            SegmentRange::from_time_and_duration(
+                Time::from_timestamp(300, 0).unwrap(),
+                segment_duration,
+                false,
+            ),
+            time_provider.now(),
+            catalog.sequence_number(),
+            Box::new(WalSegmentWriterNoopImpl::new(SegmentId::new(2))),
+            None,
+        );
+
+        let wal = Arc::new(TestWal::default());
+        let mut segment_state: SegmentState<MockProvider, TestWal> = SegmentState::new(
+            segment_duration,
+            SegmentId::new(2),
+            Arc::clone(&catalog),
+            Arc::clone(&time_provider),
+            vec![open_segment],
+            vec![closed_segment],
+            vec![],
+            Some(Arc::clone(&wal)),
+        );
+
+        segment_state.drop_database("foo").unwrap();
+        assert!(catalog.db_schema("foo").is_none());
+        assert_eq!(
+            segment_state.dropped_persisting_databases,
+            HashMap::from([(SegmentId::new(1), HashSet::from(["foo".to_string()]))])
+        );
+
+        // the database is created again, so the dropped data would be persisted along with it:
+        segment_state
+            .write_batch_to_segment(
+                Time::from_timestamp(300, 0).unwrap(),
+                lp_to_write_batch(&catalog, "foo", "cpu bar=2 300000000000"),
+                catalog.sequence_number(),
+            )
+            .unwrap();
+
+        let segment_state = Arc::new(RwLock::new(segment_state));
+        let persister = Arc::new(TestPersister::default());
+        persist_and_cleanup_ready_segments(
+            Arc::clone(&persister),
+            Arc::clone(&segment_state),
+            Arc::clone(&time_provider),
+            Some(Arc::clone(&wal)),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+
+        // the persisted segment no longer references the dropped database's data, which is
+        // persisted before the WAL segment is deleted:
+        let segment_state = segment_state.read();
+        assert!(segment_state.dropped_persisting_databases.is_empty());
+        let persisted_segments = segment_state.persisted_segments();
+        assert_eq!(persisted_segments.len(), 1);
+        assert_eq!(
+            persisted_segments[0].databases.keys().collect::<Vec<_>>(),
+            ["bar"]
+        );
+        assert_eq!(segment_state.unreferenced_files.len(), 1);
+        assert_eq!(
+            persister.state.lock().segments.last(),
+            Some(persisted_segments[0].as_ref())
+        );
+        let deleted_segments = wal.deleted_wal_segments.lock().clone();
+        assert_eq!(deleted_segments, vec![SegmentId::new(1)]);
+    }
+
+    #[tokio::test]
+    async fn rename_table_moves_persisting_data_once_persisted() {
+        let catalog = Arc::new(Catalog::new());
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp(300, 0).unwrap()));
+        let segment_duration = SegmentDuration::new_5m();
+
+        let mut closed_segment = OpenBufferSegment::new(
+            Arc::clone(&catalog),
+            SegmentId::new(1),
+            SegmentRange::from_time_and_duration(
+                Time::from_timestamp_nanos(0),
+                segment_duration,
+                false,
+            ),
+            time_provider.now(),
+            catalog.sequence_number(),
+            Box::new(WalSegmentWriterNoopImpl::new(SegmentId::new(1))),
+            None,
+        );
+        closed_segment
+            .buffer_writes(lp_to_write_batch(&catalog, "foo", "cpu bar=1 10"))
+            .unwrap();
+        let closed_segment = closed_segment.into_closed_segment(Arc::clone(&catalog));
+
+        let open_segment = OpenBufferSegment::new(
+            Arc::clone(&catalog),
+            SegmentId::new(2),
+            SegmentRange::from_time_and_duration(
+                Time::from_timestamp(300, 0).unwrap(),
+                segment_duration,
+                false,
+            ),
+            time_provider.now(),
+            catalog.sequence_number(),
+            Box::new(WalSegmentWriterNoopImpl::new(SegmentId::new(2))),
+            None,
+        );
+
+        let wal = Arc::new(TestWal::default());
+        let mut segment_state: SegmentState<MockProvider, TestWal> = SegmentState::new(
+            segment_duration,
+            SegmentId::new(2),
+            Arc::clone(&catalog),
+            Arc::clone(&time_provider),
+            vec![open_segment],
+            vec![closed_segment],
+            vec![],
+            Some(Arc::clone(&wal)),
+        );
+
+        segment_state.rename_table("foo", "cpu", "cpu_new").unwrap();
+        assert_eq!(catalog.db_schema("foo").unwrap().table_names(), ["cpu_new"]);
+        assert_eq!(
+            segment_state.renamed_persisting_tables[&SegmentId::new(1)],
+            [RenameTableOp {
+                db_name: "foo".to_string(),
+                table_name: "cpu".to_string(),
+                new_name: "cpu_new".to_string(),
+                segment_ids: vec![SegmentId::new(1)],
+            }]
+        );
+        // the persisting data is found under the new name, but not the old one:
+        assert_eq!(
+            segment_state.persisted_time_ranges("foo", "cpu_new"),
+            [(10, 10)]
+        );
+        assert!(segment_state.persisted_time_ranges("foo", "cpu").is_empty());
+
+        let segment_state = Arc::new(RwLock::new(segment_state));
+        let persister = Arc::new(TestPersister::default());
+        persist_and_cleanup_ready_segments(
+            Arc::clone(&persister),
+            Arc::clone(&segment_state),
+            Arc::clone(&time_provider),
+            Some(Arc::clone(&wal)),
+            crate::test_help::make_exec(),
+        )
+        .await
+        .unwrap();
+
+        // the persisted segment has the data under the new name, which is persisted before the
+        // WAL segment is deleted:
+        let segment_state = segment_state.read();
+        assert!(segment_state.renamed_persisting_tables.is_empty());
+        let persisted_segments = segment_state.persisted_segments();
+        assert_eq!(persisted_segments.len(), 1);
+        assert_eq!(
+            persisted_segments[0].databases["foo"]
+                .tables
+                .keys()
+                .collect::<Vec<_>>(),
+            ["cpu_new"]
+        );
+        assert_eq!(
+            persister.state.lock().segments.last(),
+            Some(persisted_segments[0].as_ref())
+        );
+        let deleted_segments = wal.deleted_wal_segments.lock().clone();
+        assert_eq!(deleted_segments, vec![SegmentId::new(1)]);
+    }
+
     #[derive(Debug, Default)]
     struct TestWal {
         deleted_wal_segments: Mutex<Vec<SegmentId>>,
@@ -1,11 +1,13 @@
 //! The in memory buffer of a table that can be quickly added to and queried
 
+use crate::catalog::{DeletePredicate, TIME_COLUMN_NAME};
 use crate::write_buffer::{FieldData, Row};
 use arrow::array::{
-    Array, ArrayBuilder, ArrayRef, BooleanBuilder, Float64Builder, GenericByteDictionaryBuilder,
-    Int64Builder, StringArray, StringBuilder, StringDictionaryBuilder, TimestampNanosecondBuilder,
-    UInt64Builder,
+    Array, ArrayBuilder, ArrayRef, BooleanArray, BooleanBuilder, Float64Builder,
+    GenericByteDictionaryBuilder, Int64Builder, StringArray, StringBuilder,
+    StringDictionaryBuilder, TimestampNanosecondBuilder, UInt64Builder,
 };
+use arrow::compute::filter_record_batch;
 use arrow::datatypes::{GenericStringType, Int32Type, SchemaRef};
 use arrow::record_batch::RecordBatch;
 use data_types::{PartitionKey, TimestampMinMax};
@@ -34,6 +36,8 @@ pub struct TableBuffer {
     pub(crate) data: BTreeMap<String, Builder>,
     row_count: usize,
     index: BufferIndex,
+    // the rows that have been deleted, which are left in the builders but are not returned
+    deleted_rows: HashSet<usize>,
 }
 
 impl TableBuffer {
@@ -45,6 +49,7 @@ impl TableBuffer {
             data: Default::default(),
             row_count: 0,
             index: BufferIndex::new(index_columns),
+            deleted_rows: HashSet::new(),
         }
     }
 
@@ -204,6 +209,38 @@ impl TableBuffer {
         }
     }
 
+    pub fn row_count(&self) -> usize {
+        self.row_count
+    }
+
+    /// Marks the buffered rows that match the predicate as deleted, so that they are no longer
+    /// returned, returning the number of rows that were deleted
+    pub fn delete_rows(&mut self, predicate: &DeletePredicate) -> Result<usize> {
+        if predicate.max_time < self.timestamp_min || self.timestamp_max < predicate.min_time {
+            return Ok(0);
+        }
+
+        let mut columns = Vec::with_capacity(predicate.tags.len() + 1);
+        for name in
+            std::iter::once(TIME_COLUMN_NAME).chain(predicate.tags.keys().map(String::as_str))
+        {
+            // a tag that has never been written can not match any rows:
+            let Some(builder) = self.data.get(name) else {
+                return Ok(0);
+            };
+            columns.push((name, builder.as_arrow()));
+        }
+        let matching = predicate.matching_rows(&RecordBatch::try_from_iter(columns)?)?;
+
+        let mut deleted = 0;
+        for (row, matches) in matching.iter().enumerate() {
+            if matches == Some(true) && self.deleted_rows.insert(row) {
+                deleted += 1;
+            }
+        }
+        Ok(deleted)
+    }
+
     pub fn record_batch(&self, schema: SchemaRef, filter: &[Expr]) -> Result<RecordBatch> {
         let row_ids = self.index.get_rows_from_index_for_filter(filter);
 
@@ -230,7 +267,16 @@ impl TableBuffer {
             }
         }
 
-        Ok(RecordBatch::try_new(schema, cols)?)
+        let batch = RecordBatch::try_new(schema, cols)?;
+        if self.deleted_rows.is_empty() {
+            return Ok(batch);
+        }
+        let kept = |row: &usize| Some(!self.deleted_rows.contains(row));
+        let kept: BooleanArray = match row_ids {
+            Some(row_ids) => row_ids.iter().map(kept).collect(),
+            None => (0..self.row_count).map(|row| kept(&row)).collect(),
+        };
+        Ok(filter_record_batch(&batch, &kept)?)
     }
 
     /// Returns an estimate of the size of this table buffer based on the data and index sizes.
@@ -565,6 +611,108 @@ mod tests {
         assert_batches_eq!(&expected_b, &[b]);
     }
 
+    #[test]
+    fn deleted_rows_not_returned() {
+        let mut table_buffer = TableBuffer::new(PartitionKey::from("table"), &["tag".to_string()]);
+        let schema = SchemaBuilder::with_capacity(3)
+            .tag("tag")
+            .influx_field("value", InfluxFieldType::Integer)
+            .timestamp()
+            .build()
+            .unwrap();
+        let row = |tag: &str, time| Row {
+            time,
+            fields: vec![
+                Field {
+                    name: "tag".to_string(),
+                    value: FieldData::Tag(tag.to_string()),
+                },
+                Field {
+                    name: "value".to_string(),
+                    value: FieldData::Integer(time),
+                },
+                Field {
+                    name: "time".to_string(),
+                    value: FieldData::Timestamp(time),
+                },
+            ],
+        };
+        table_buffer.add_rows(vec![row("a", 1), row("b", 2), row("a", 3)]);
+
+        let delete = |max_time, tag: Option<&str>| DeletePredicate {
+            min_time: 0,
+            max_time,
+            tags: tag
+                .map(|tag| BTreeMap::from([("tag".to_string(), tag.to_string())]))
+                .unwrap_or_default(),
+        };
+        assert_eq!(table_buffer.delete_rows(&delete(2, Some("a"))).unwrap(), 1);
+        // rows that are already deleted are not counted again:
+        assert_eq!(table_buffer.delete_rows(&delete(2, Some("a"))).unwrap(), 0);
+        assert_eq!(
+            table_buffer
+                .delete_rows(&DeletePredicate {
+                    min_time: 0,
+                    max_time: 3,
+                    tags: BTreeMap::from([("region".to_string(), "a".to_string())]),
+                })
+                .unwrap(),
+            0
+        );
+
+        let batch = table_buffer.record_batch(schema.as_arrow(), &[]).unwrap();
+        let expected = vec![
+            "+-----+-------+--------------------------------+",
+            "| tag | value | time                           |",
+            "+-----+-------+--------------------------------+",
+            "| b   | 2     | 1970-01-01T00:00:00.000000002Z |",
+            "| a   | 3     | 1970-01-01T00:00:00.000000003Z |",
+            "+-----+-------+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected, &[batch]);
+
+        // as are the rows selected by the index:
+        let filter = &[Expr::BinaryExpr(BinaryExpr {
+            left: Box::new(Expr::Column(Column {
+                relation: None,
+                name: "tag".to_string(),
+            })),
+            op: datafusion::logical_expr::Operator::Eq,
+            right: Box::new(Expr::Literal(datafusion::scalar::ScalarValue::Utf8(Some(
+                "a".to_string(),
+            )))),
+        })];
+        let a = table_buffer
+            .record_batch(schema.as_arrow(), filter)
+            .unwrap();
+        let expected_a = vec![
+            "+-----+-------+--------------------------------+",
+            "| tag | value | time                           |",
+            "+-----+-------+--------------------------------+",
+            "| a   | 3     | 1970-01-01T00:00:00.000000003Z |",
+            "+-----+-------+--------------------------------+",
+        ];
+        assert_batches_eq!(&expected_a, &[a]);
+
+        // rows written after the delete are not deleted by it:
+        table_buffer.add_rows(vec![row("a", 1)]);
+        assert_eq!(
+            table_buffer
+                .record_batch(schema.as_arrow(), &[])
+                .unwrap()
+                .num_rows(),
+            3
+        );
+        assert_eq!(table_buffer.delete_rows(&delete(3, None)).unwrap(), 3);
+        assert_eq!(
+            table_buffer
+                .record_batch(schema.as_arrow(), &[])
+                .unwrap()
+                .num_rows(),
+            0
+        );
+    }
+
     #[test]
     fn computed_size_of_buffer() {
         let mut table_buffer = TableBuffer::new(PartitionKey::from("table"), &["tag".to_string()]);
@@ -626,6 +774,6 @@ mod tests {
         table_buffer.add_rows(rows);
 
         let size = table_buffer._computed_size();
-        assert_eq!(size, 18126);
+        assert_eq!(size, 18174);
     }
 }
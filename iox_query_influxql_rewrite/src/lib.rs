@@ -10,6 +10,8 @@ use influxdb_influxql_parser::{
     statement::Statement,
 };
 
+pub use influxdb_influxql_parser::statement::Statement as InfluxQlStatement;
+
 #[derive(Debug)]
 pub struct Rewritten<S> {
     database: Option<Identifier>,